@@ -0,0 +1,15 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/raindrop/nl2sql/pkg/handlers"
+)
+
+// api is shared across warm invocations; it routes by path like nl2sql serve
+var api = handlers.NewAPI(handlers.DefaultDeps())
+
+// Handler is the Vercel serverless function entry point for the service mode switch
+func Handler(w http.ResponseWriter, r *http.Request) {
+	api.ServeHTTP(w, r)
+}
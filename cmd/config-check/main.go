@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+
+	"github.com/raindrop/nl2sql/internal/cli"
+)
+
+// This CLI validates deploy configuration. It is equivalent to `nl2sql config check`.
+// Usage: go run ./cmd/config-check [-config file] [-skip-openai] [-skip-tinybird]
+func main() {
+	os.Exit(cli.ConfigCheck(os.Args[1:]))
+}
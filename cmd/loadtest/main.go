@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+
+	"github.com/raindrop/nl2sql/internal/cli"
+)
+
+// This CLI load-tests a running instance. It is equivalent to `nl2sql loadtest`.
+// Usage: go run ./cmd/loadtest -url http://localhost:8080 -rate 5 -duration 1m
+func main() {
+	os.Exit(cli.LoadTest(os.Args[1:]))
+}
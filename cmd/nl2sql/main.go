@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/raindrop/nl2sql/internal/cli"
+)
+
+const usage = `Usage: nl2sql <command> [flags]
+
+Commands:
+  serve           Run the API and frontend as a long-running server
+  query "..."     Answer a question and print the SQL and results
+  repl            Ask questions interactively against a loaded schema
+  eval            Run the eval suite (eval diff a.json b.json compares runs)
+  experiment      Compare two prompt variants over the eval suite
+  schema dump     Print the warehouse schema as JSON
+  grammar dump    Print or -check the grammar and tool description sent to OpenAI
+  config check    Validate configuration and connectivity
+  loadtest        Replay questions against a running instance at a fixed rate
+
+Run "nl2sql <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "serve":
+		os.Exit(cli.Serve(args))
+	case "query":
+		os.Exit(cli.Query(args))
+	case "repl":
+		os.Exit(cli.Repl(args))
+	case "eval":
+		os.Exit(cli.Eval(args))
+	case "experiment":
+		os.Exit(cli.Experiment(args))
+	case "schema":
+		os.Exit(cli.Schema(args))
+	case "grammar":
+		os.Exit(cli.Grammar(args))
+	case "config":
+		if len(args) == 0 || args[0] != "check" {
+			fmt.Fprintln(os.Stderr, "usage: nl2sql config check [flags]")
+			os.Exit(2)
+		}
+		os.Exit(cli.ConfigCheck(args[1:]))
+	case "loadtest":
+		os.Exit(cli.LoadTest(args))
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// apiGenerator generates SQL by calling a deployed /api/query endpoint, so
+// the same eval cases and comparison logic can check a live deployment.
+type apiGenerator struct {
+	url    string
+	client *http.Client
+}
+
+func newAPIGenerator(baseURL string) *apiGenerator {
+	return &apiGenerator{
+		url:    strings.TrimSuffix(baseURL, "/") + "/api/query",
+		client: &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// Generate forwards currentTime's zone but not the instant: the API always
+// uses its own clock.
+func (g *apiGenerator) Generate(naturalLanguage string, currentTime time.Time) (*shared.Generation, error) {
+	request := map[string]string{"query": naturalLanguage}
+	if currentTime.Location() != time.UTC {
+		request["timezone"] = currentTime.Location().String()
+	}
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	resp, err := g.client.Post(g.url, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		SQL   string `json:"sql"`
+		Error string `json:"error"`
+		Hint  string `json:"hint"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response (%d): %s", resp.StatusCode, string(body))
+	}
+
+	gen := &shared.Generation{SQL: result.SQL}
+
+	// The API reports refusals as 400s with a hint about the available data
+	if result.Error != "" && result.SQL == "" && result.Hint != "" {
+		return gen, shared.ErrUnsupportedQuery{Reason: result.Error, AvailableData: result.Hint}
+	}
+	if result.SQL == "" {
+		return gen, fmt.Errorf("api error (%d): %s", resp.StatusCode, result.Error)
+	}
+	return gen, nil
+}
@@ -0,0 +1,102 @@
+// Package cli implements the nl2sql subcommands. Each command takes its
+// arguments (without the command name) and returns a process exit code.
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// clients bundles what most commands need after startup
+type clients struct {
+	cfg      *shared.Config
+	tinybird *shared.TinybirdClient
+	openai   *shared.OpenAIClient
+	schema   *shared.Schema
+}
+
+// connect loads config, configures logging, creates clients and loads the schema
+func connect(configFlags *shared.ConfigFlags) (*clients, error) {
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := shared.SetupLogging(cfg); err != nil {
+		return nil, fmt.Errorf("failed to configure logging: %w", err)
+	}
+
+	c := &clients{
+		cfg:      cfg,
+		tinybird: shared.NewTinybirdClient(cfg, shared.WithRetryPolicy(shared.DefaultRetryPolicy)),
+		openai:   shared.NewOpenAIClient(cfg, shared.WithRetryPolicy(shared.DefaultRetryPolicy)),
+	}
+
+	c.schema, err = c.tinybird.FetchSchema()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch schema: %w", err)
+	}
+	c.openai.SetSchema(c.schema)
+	slog.Debug("Schema loaded", "tables", len(c.schema.Datasources))
+	return c, nil
+}
+
+// printTable renders rows as an ASCII table. Columns follow the warehouse
+// metadata order when available, otherwise they are sorted by name.
+func printTable(w io.Writer, result *shared.TinybirdResponse) {
+	var columns []string
+	for _, m := range result.Meta {
+		columns = append(columns, m["name"])
+	}
+	if len(columns) == 0 && len(result.Data) > 0 {
+		for k := range result.Data[0] {
+			columns = append(columns, k)
+		}
+		sort.Strings(columns)
+	}
+	if len(columns) == 0 {
+		fmt.Fprintln(w, "(no rows)")
+		return
+	}
+
+	widths := make([]int, len(columns))
+	cells := make([][]string, len(result.Data))
+	for i, col := range columns {
+		widths[i] = len(col)
+	}
+	for r, row := range result.Data {
+		cells[r] = make([]string, len(columns))
+		for i, col := range columns {
+			cells[r][i] = fmt.Sprint(row[col])
+			if n := len(cells[r][i]); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	sep := "+"
+	for _, width := range widths {
+		sep += strings.Repeat("-", width+2) + "+"
+	}
+	line := func(values []string) {
+		var sb strings.Builder
+		sb.WriteString("|")
+		for i, v := range values {
+			sb.WriteString(fmt.Sprintf(" %-*s |", widths[i], v))
+		}
+		fmt.Fprintln(w, sb.String())
+	}
+
+	fmt.Fprintln(w, sep)
+	line(columns)
+	fmt.Fprintln(w, sep)
+	for _, row := range cells {
+		line(row)
+	}
+	fmt.Fprintln(w, sep)
+	fmt.Fprintf(w, "%d row(s)\n", result.Rows)
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// ConfigCheck validates a deployment's configuration before it takes traffic:
+// it loads config, checks Tinybird connectivity and token scopes, checks the
+// OpenAI key and model, and prints the effective config with secrets masked.
+//
+//	config-check [-config file] [-skip-openai] [-skip-tinybird] [-generate]
+func ConfigCheck(args []string) int {
+	fs := flag.NewFlagSet("config-check", flag.ExitOnError)
+	skipOpenAI := fs.Bool("skip-openai", false, "don't call OpenAI")
+	skipTinybird := fs.Bool("skip-tinybird", false, "don't call Tinybird")
+	generate := fs.Bool("generate", false, "also generate SQL for one trivial question (needs Tinybird)")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		return 1
+	}
+	if err := shared.SetupLogging(cfg); err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		return 1
+	}
+
+	fmt.Println("Effective configuration:")
+	for _, s := range cfg.Redacted() {
+		fmt.Printf("  %-20s %s\n", s.Key, s.Value)
+	}
+	fmt.Println()
+
+	failed := false
+	check := func(name string, fn func() error) {
+		start := time.Now()
+		if err := fn(); err != nil {
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			failed = true
+			return
+		}
+		fmt.Printf("OK    %s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+	}
+
+	// The -generate check reuses the schema listed here
+	var schema *shared.Schema
+	if !*skipTinybird {
+		tinybird := shared.NewTinybirdClient(cfg)
+		check("tinybird: list datasources (DATASOURCES:READ scope)", func() error {
+			var err error
+			schema, err = tinybird.FetchSchema()
+			if err != nil {
+				return err
+			}
+			if len(schema.Datasources) == 0 {
+				return fmt.Errorf("token can't see any datasources")
+			}
+			return nil
+		})
+		check("tinybird: run SELECT 1 (SQL read scope)", func() error {
+			_, err := tinybird.ExecuteQuery("SELECT 1")
+			return err
+		})
+	}
+
+	if !*skipOpenAI {
+		openai := shared.NewOpenAIClient(cfg)
+		check(fmt.Sprintf("openai: key valid and model %q available", openai.Model()), openai.CheckModel)
+		if *generate && schema != nil && len(schema.Datasources) > 0 {
+			check(fmt.Sprintf("openai: generate SQL for %q", shared.PreflightQuestion(schema)), func() error {
+				return shared.CheckGeneration(openai, schema)
+			})
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Diff compares two saved runs and prints flipped cases, SQL changes and
+// latency/cost deltas. Returns non-zero when the candidate run regressed.
+func Diff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	all := fs.Bool("all", false, "also show unchanged cases")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: diff [-all] runA.json runB.json")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	a, err := shared.LoadEvalRun(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err := shared.LoadEvalRun(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	diff := shared.DiffEvalRuns(a, b)
+
+	fmt.Printf("A: %s  model=%s  passed=%d/%d  duration=%dms  cost=$%.4f\n",
+		fs.Arg(0), diff.ModelA, diff.SummaryA.Passed, diff.SummaryA.Total, a.DurationMs, a.CostUSD)
+	fmt.Printf("B: %s  model=%s  passed=%d/%d  duration=%dms  cost=$%.4f\n",
+		fs.Arg(1), diff.ModelB, diff.SummaryB.Passed, diff.SummaryB.Total, b.DurationMs, b.CostUSD)
+	fmt.Printf("Δ pass rate %+.1f%%  Δ duration %+dms  Δ cost $%+.4f\n\n",
+		diff.SummaryB.PassRate-diff.SummaryA.PassRate, diff.DurationDeltaMs, diff.CostDeltaUSD)
+
+	for _, c := range diff.Cases {
+		if !*all && c.Status == shared.DiffPassing && !c.SQLChanged {
+			continue
+		}
+		fmt.Printf("[%s] %s  Δ %+dms  Δ $%+.4f\n", c.Status, c.Name, c.DurationDeltaMs, c.CostDeltaUSD)
+		if c.SQLChanged || c.Status == shared.DiffAdded || c.Status == shared.DiffRemoved {
+			if c.SQLA != "" {
+				fmt.Printf("  - %s\n", c.SQLA)
+			}
+			if c.SQLB != "" {
+				fmt.Printf("  + %s\n", c.SQLB)
+			}
+		}
+	}
+
+	if n := len(diff.Regressions()); n > 0 {
+		fmt.Printf("\n%d case(s) regressed\n", n)
+		return 1
+	}
+	return 0
+}
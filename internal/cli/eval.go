@@ -0,0 +1,300 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Eval runs the eval suite and returns a non-zero exit code if any eval
+// fails. It is the build-time gate.
+//
+//	eval [-run regexp] [-cases cases.json] [-format text|json] [-output run.json] [-snapshot check|update]
+//	eval -against-api https://your-app.vercel.app
+//	eval diff runA.json runB.json
+func Eval(args []string) int {
+	if len(args) > 0 && args[0] == "diff" {
+		return Diff(args[1:])
+	}
+
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+
+	metricsFile := fs.String("metrics-file", "", "write Prometheus metrics for the run to this file (textfile collector format)")
+	output := fs.String("output", "", "save the run as JSON to this file for later diffing")
+	budgetUSD := fs.Float64("budget-usd", 0, "stop launching cases once OpenAI spend reaches this many dollars (0 = unlimited)")
+	budgetTokens := fs.Int("budget-tokens", 0, "stop launching cases once this many tokens are used (0 = unlimited)")
+	budgetMode := fs.String("budget-mode", shared.BudgetAbort, "what to do when the budget runs out: abort (fail the run) or sample (run a random subset that fits)")
+	snapshot := fs.String("snapshot", "", "golden SQL snapshots: check (fail on changed SQL) or update (rewrite golden files)")
+	goldenDir := fs.String("golden-dir", "golden", "directory holding golden <case>.sql files")
+	diagnose := fs.Bool("diagnose", false, "ask the model to explain each failed case")
+	smoke := fs.Bool("smoke", false, "also run smoke evals generated from the schema")
+	verifyExpected := fs.Bool("verify-expected", false, "recompute aggregate cases' expected values another way and flag suspect golden answers")
+	concurrency := fs.Int("concurrency", 0, "max cases in flight (0 = all at once, or 4 when a budget is set)")
+	againstAPI := fs.String("against-api", "", "generate SQL by calling a deployed instance at this base URL instead of OpenAI directly")
+	run := fs.String("run", "", "only run cases whose name matches this regexp")
+	casesFile := fs.String("cases", "", "run the cases in this JSON file instead of the built-in suite")
+	var artifacts stringList
+	fs.Var(&artifacts, "artifact", "write one record per case to this .jsonl or .csv file (repeatable)")
+	format := fs.String("format", "text", "result format on stdout: text (logs only) or json (the full run)")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		slog.Error("Invalid -format", "format", *format)
+		return 2
+	}
+
+	if *againstAPI != "" && *diagnose {
+		slog.Error("-diagnose requires direct OpenAI access and cannot be combined with -against-api")
+		return 2
+	}
+
+	if *budgetMode != shared.BudgetAbort && *budgetMode != shared.BudgetSample {
+		slog.Error("Invalid -budget-mode", "mode", *budgetMode)
+		return 2
+	}
+
+	if *snapshot != "" && *snapshot != "check" && *snapshot != "update" {
+		slog.Error("Invalid -snapshot", "mode", *snapshot)
+		return 2
+	}
+
+	opts := shared.EvalOptions{
+		Concurrency: *concurrency,
+		BudgetMode:  *budgetMode,
+	}
+	if *run != "" {
+		filter, err := regexp.Compile(*run)
+		if err != nil {
+			slog.Error("Invalid -run", "error", err)
+			return 2
+		}
+		opts.Filter = filter
+	}
+	if *casesFile != "" {
+		cases, err := shared.LoadEvalCases(*casesFile)
+		if err != nil {
+			slog.Error("Failed to load eval cases", "error", err)
+			return 2
+		}
+		opts.Cases = cases
+	}
+	if *budgetUSD > 0 || *budgetTokens > 0 {
+		opts.Budget = &shared.Budget{MaxUSD: *budgetUSD, MaxTokens: *budgetTokens}
+		if opts.Concurrency == 0 {
+			// Bound in-flight calls so the budget check has something to stop
+			opts.Concurrency = 4
+		}
+	}
+
+	slog.Info("Running build-time evals...")
+
+	// Load config from flags, environment and config file. Against a
+	// deployed API only Tinybird is needed locally, to execute the expected SQL.
+	var cfg *shared.Config
+	var err error
+	if *againstAPI != "" {
+		cfg, err = configFlags.LoadTinybird()
+	} else {
+		cfg, err = configFlags.Load()
+	}
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		return 1
+	}
+	if err := shared.SetupLogging(cfg); err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		return 1
+	}
+	opts.Stagger = cfg.EvalStagger
+
+	// Initialize clients. OPENAI_MAX_CONCURRENCY, if set, bounds the calls
+	// in flight on top of -concurrency.
+	tinybird := shared.NewTinybirdClient(cfg, shared.WithRetryPolicy(shared.DefaultRetryPolicy))
+	openai := shared.NewOpenAIClient(cfg, shared.WithRetryPolicy(shared.DefaultRetryPolicy))
+
+	var generator shared.Generator = openai
+	model := openai.Model()
+	if *againstAPI != "" {
+		generator = newAPIGenerator(*againstAPI)
+		model = "api:" + *againstAPI
+		slog.Info("Generating SQL via deployed API", "url", *againstAPI)
+	}
+
+	// Fetch schema
+	slog.Info("Fetching schema from Tinybird...")
+	schema, err := tinybird.FetchSchema()
+	if err != nil {
+		slog.Error("Failed to fetch schema", "error", err)
+		return 1
+	}
+	openai.SetSchema(schema)
+	opts.SchemaVersion = schema.Version()
+	slog.Info("Schema loaded", "tables", len(schema.Datasources), "version", opts.SchemaVersion)
+
+	if *verifyExpected {
+		opts.VerifyExpected = schema
+	}
+
+	if *smoke {
+		smokeCases := shared.SmokeEvalCases(schema)
+		if opts.Cases == nil {
+			opts.Cases = shared.DefaultEvalCases()
+		}
+		opts.Cases = append(opts.Cases, smokeCases...)
+		slog.Info("Smoke evals generated", "cases", len(smokeCases))
+	}
+
+	// Run evals
+	slog.Info("Running evals...")
+	evalStart := time.Now()
+	results, evalErr := shared.RunEvalsWithOptions(generator, tinybird, opts)
+	if *diagnose {
+		shared.DiagnoseFailures(openai, results, opts.Budget)
+	}
+	summary := shared.ComputeSummary(results)
+
+	// Log individual results
+	for _, r := range results {
+		if r.SuspectExpected {
+			slog.Warn("SUSPECT EXPECTED SQL", "name", r.Name, "expected", r.ExpectedSQL, "note", r.VerifyNote)
+		}
+		if r.Skipped {
+			slog.Warn("SKIP", "name", r.Name, "reason", r.Error)
+		} else if r.Passed {
+			slog.Info("PASS", "name", r.Name, "sql", r.GeneratedSQL)
+		} else {
+			slog.Error("FAIL", "name", r.Name, "error", r.Error, "expected", r.ExpectedSQL, "got", r.GeneratedSQL)
+			if r.Diagnosis != "" {
+				slog.Info("DIAGNOSIS", "name", r.Name, "diagnosis", r.Diagnosis)
+			}
+		}
+	}
+
+	slog.Info("Eval summary",
+		"passed", summary.Passed,
+		"failed", summary.Failed,
+		"total", summary.Total,
+		"pass_rate", summary.PassRate,
+		"suspect", summary.Suspect,
+	)
+	notifier := shared.NewNotifier()
+	defer notifier.Wait()
+	notifier.EvalCompleted(cfg, model, summary)
+	if opts.Budget != nil {
+		usd, tokens := opts.Budget.Spent()
+		slog.Info("Eval spend", "usd", usd, "tokens", tokens, "skipped", summary.Skipped)
+		if opts.Budget.Exceeded() {
+			notifier.Notify(cfg, shared.EventBudgetExceeded, map[string]interface{}{
+				"model":      model,
+				"spent_usd":  usd,
+				"tokens":     tokens,
+				"max_usd":    opts.Budget.MaxUSD,
+				"max_tokens": opts.Budget.MaxTokens,
+				"skipped":    summary.Skipped,
+			})
+		}
+	}
+
+	if *metricsFile != "" {
+		if err := writeMetrics(*metricsFile, results, time.Since(evalStart)); err != nil {
+			slog.Error("Failed to write metrics", "error", err)
+		} else {
+			slog.Info("Metrics written", "path", *metricsFile)
+		}
+	}
+
+	evalRun := shared.NewEvalRun(model, evalStart, results)
+	if *output != "" {
+		if err := shared.SaveEvalRun(*output, evalRun); err != nil {
+			slog.Error("Failed to save run", "error", err)
+		} else {
+			slog.Info("Run saved", "path", *output)
+		}
+	}
+	for _, path := range artifacts {
+		if err := shared.WriteEvalArtifact(path, evalRun); err != nil {
+			slog.Error("Failed to write artifact", "path", path, "error", err)
+		} else {
+			slog.Info("Artifact written", "path", path)
+		}
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(evalRun)
+	}
+
+	snapshotFailed := false
+	switch *snapshot {
+	case "update":
+		if err := shared.UpdateSnapshots(*goldenDir, results); err != nil {
+			slog.Error("Failed to update snapshots", "error", err)
+			return 1
+		}
+		slog.Info("Snapshots updated", "dir", *goldenDir)
+	case "check":
+		diffs, err := shared.CompareSnapshots(*goldenDir, results)
+		if err != nil {
+			slog.Error("Failed to compare snapshots", "error", err)
+			return 1
+		}
+		for _, d := range diffs {
+			fmt.Fprint(os.Stderr, d.String())
+		}
+		if len(diffs) > 0 {
+			slog.Error("Snapshot mismatch", "cases", len(diffs), "hint", "run with -snapshot update to accept")
+			snapshotFailed = true
+		}
+	}
+
+	if evalErr != nil {
+		slog.Error("BUILD FAILED: Evals did not pass", "error", evalErr)
+		return 1
+	}
+	if snapshotFailed {
+		slog.Error("BUILD FAILED: Generated SQL does not match golden snapshots")
+		return 1
+	}
+
+	slog.Info("BUILD OK: All evals passed")
+	return 0
+}
+
+// writeMetrics writes the run's metrics atomically so a textfile collector
+// never scrapes a partial file.
+func writeMetrics(path string, results []shared.EvalResult, duration time.Duration) error {
+	metrics := shared.NewEvalMetrics()
+	metrics.Record(results, duration)
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := metrics.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Experiment runs two prompt variants over the eval suite and prints a
+// statistical comparison. Returns non-zero when the candidate is
+// significantly worse than the baseline.
+//
+//	experiment -file exp.json [-repeats n] [-run regexp] [-corpus questions.txt] [-output report.json]
+func Experiment(args []string) int {
+	fs := flag.NewFlagSet("experiment", flag.ExitOnError)
+
+	file := fs.String("file", "", "experiment file with the baseline and candidate variants (required)")
+	repeats := fs.Int("repeats", 0, "run the suite this many times per variant (0 = the file's repeats, default 1)")
+	run := fs.String("run", "", "only run cases whose name matches this regexp")
+	corpus := fs.String("corpus", "", "also answer these questions (one per line) with both variants and compare the results")
+	concurrency := fs.Int("concurrency", 0, "max cases in flight per variant (0 = all at once)")
+	budgetUSD := fs.Float64("budget-usd", 0, "stop the experiment once OpenAI spend reaches this many dollars (0 = unlimited)")
+	output := fs.String("output", "", "save the report as JSON to this file")
+	format := fs.String("format", "text", "report format on stdout: text or json")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args)
+
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "usage: experiment -file exp.json [flags]")
+		fs.PrintDefaults()
+		return 2
+	}
+	if *format != "text" && *format != "json" {
+		slog.Error("Invalid -format", "format", *format)
+		return 2
+	}
+
+	exp, err := shared.LoadExperiment(*file)
+	if err != nil {
+		slog.Error("Failed to load experiment", "error", err)
+		return 2
+	}
+	if *repeats > 0 {
+		exp.Repeats = *repeats
+	}
+
+	opts := shared.ExperimentOptions{
+		Eval:          shared.EvalOptions{Concurrency: *concurrency, BudgetMode: shared.BudgetAbort},
+		ClientOptions: []shared.ClientOption{shared.WithRetryPolicy(shared.DefaultRetryPolicy)},
+	}
+	if *run != "" {
+		filter, err := regexp.Compile(*run)
+		if err != nil {
+			slog.Error("Invalid -run", "error", err)
+			return 2
+		}
+		opts.Eval.Filter = filter
+	}
+	if *budgetUSD > 0 {
+		opts.Eval.Budget = &shared.Budget{MaxUSD: *budgetUSD}
+		if opts.Eval.Concurrency == 0 {
+			opts.Eval.Concurrency = 4
+		}
+	}
+	if *corpus != "" {
+		if opts.Questions, err = loadCorpus(*corpus); err != nil {
+			slog.Error("Failed to load corpus", "error", err)
+			return 2
+		}
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		return 1
+	}
+	if err := shared.SetupLogging(cfg); err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		return 1
+	}
+	opts.Eval.Stagger = cfg.EvalStagger
+
+	tinybird := shared.NewTinybirdClient(cfg, shared.WithRetryPolicy(shared.DefaultRetryPolicy))
+	schema, err := tinybird.FetchSchema()
+	if err != nil {
+		slog.Error("Failed to fetch schema", "error", err)
+		return 1
+	}
+
+	slog.Info("Running experiment", "name", exp.Name, "baseline", exp.Baseline.Name, "candidate", exp.Candidate.Name, "repeats", max(exp.Repeats, 1))
+	report, err := shared.RunExperiment(cfg, schema, tinybird, exp, opts)
+	if err != nil {
+		slog.Error("Experiment failed", "error", err)
+		return 1
+	}
+
+	if *output != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*output, append(data, '\n'), 0o644); err != nil {
+			slog.Error("Failed to save report", "error", err)
+		} else {
+			slog.Info("Report saved", "path", *output)
+		}
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printExperiment(report)
+	}
+
+	if report.Verdict == shared.VerdictWorse {
+		return 1
+	}
+	return 0
+}
+
+// printExperiment writes the report in the layout of eval diff
+func printExperiment(r *shared.ExperimentReport) {
+	for _, v := range []shared.VariantReport{r.Baseline, r.Candidate} {
+		fmt.Printf("%s: model=%s  passed=%d/%d  pass rate %.1f%% (95%% CI %.1f–%.1f%%)  mean %.0fms  cost=$%.4f\n",
+			v.Name, v.Model, v.Passed, v.Trials, v.PassRate, v.PassRateLow, v.PassRateHigh, v.MeanDurationMs, v.CostUSD)
+	}
+	fmt.Printf("Δ pass rate %+.1f%%  Δ mean duration %+.0fms  Δ cost $%+.4f\n",
+		r.PassRateDelta, r.DurationDeltaMs, r.CostDeltaUSD)
+	fmt.Printf("Discordant pairs: %d baseline only, %d candidate only  p=%.4f  verdict: %s\n\n",
+		r.BaselineOnly, r.CandidateOnly, r.PValue, r.Verdict)
+
+	for _, c := range r.Cases {
+		if c.Status == shared.DiffPassing || c.Status == shared.DiffFailing {
+			continue
+		}
+		fmt.Printf("[%s] %s  baseline %d/%d  candidate %d/%d\n", c.Status, c.Name, c.BaselinePassed, c.Repeats, c.CandidatePassed, c.Repeats)
+	}
+
+	if s := r.Shadow; s != nil {
+		fmt.Printf("\nShadow: %d question(s), %d agreed (%.1f%%), errors baseline %d, candidate %d\n",
+			s.Questions, s.Agreed, s.AgreementRate, s.BaselineErrors, s.CandidateErrors)
+		for _, res := range s.Results {
+			if res.Agreed {
+				continue
+			}
+			fmt.Printf("[differs] %s\n", res.Question)
+			fmt.Printf("  - %s%s\n", res.BaselineSQL, res.BaselineError)
+			fmt.Printf("  + %s%s\n", res.CandidateSQL, res.CandidateError)
+		}
+	}
+}
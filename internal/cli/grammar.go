@@ -0,0 +1,188 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Grammar inspects the Lark grammar and tool description generated from a
+// schema, offline when given a schema file. With -golden it compares the
+// output to a file instead, so a change to the payload sent to OpenAI
+// fails CI until the file is updated. parse-response runs recorded
+// Responses API outputs through the parser generation uses.
+//
+//	grammar dump [-schema-file schema.json] [-format text|json|request] [-check] [-golden file [-update]]
+//	grammar parse-response response.json...
+func Grammar(args []string) int {
+	if len(args) > 0 && args[0] == "parse-response" {
+		return parseResponses(args[1:])
+	}
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: grammar dump [-schema-file file] [-format text|json|request] [-check] [-golden file [-update]]")
+		fmt.Fprintln(os.Stderr, "       grammar parse-response response.json...")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("grammar dump", flag.ExitOnError)
+	schemaFile := fs.String("schema-file", "", "build from this schema JSON (as written by schema dump) instead of fetching from Tinybird")
+	format := fs.String("format", "text", "text (grammar and tool description), json (the tools array exactly as sent to OpenAI) or request (the whole generation request)")
+	question := fs.String("question", "How many rows are there?", "question in the -format request prompt")
+	asOf := fs.String("as-of", "2024-01-01T00:00:00Z", "reference time in the -format request prompt (RFC 3339)")
+	check := fs.Bool("check", false, "validate the grammar instead of printing it; exits 1 on problems")
+	golden := fs.String("golden", "", "compare the output to this file instead of printing it; exits 1 if they differ")
+	update := fs.Bool("update", false, "with -golden, write the output to the file instead of comparing")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args[1:])
+
+	if *format != "text" && *format != "json" && *format != "request" {
+		slog.Error("Invalid -format", "format", *format)
+		return 2
+	}
+	now, err := time.Parse(time.RFC3339, *asOf)
+	if err != nil {
+		slog.Error("Invalid -as-of", "as_of", *asOf, "error", err)
+		return 2
+	}
+
+	var schema *shared.Schema
+	cfg := &shared.Config{}
+	if *schemaFile != "" {
+		data, err := os.ReadFile(*schemaFile)
+		if err != nil {
+			slog.Error("Failed to read schema file", "error", err)
+			return 1
+		}
+		schema = &shared.Schema{}
+		if err := json.Unmarshal(data, schema); err != nil {
+			slog.Error("Failed to parse schema file", "path", *schemaFile, "error", err)
+			return 1
+		}
+	} else {
+		var err error
+		if cfg, err = configFlags.LoadTinybird(); err != nil {
+			slog.Error("Failed to load config", "error", err)
+			return 1
+		}
+		if schema, err = shared.NewTinybirdClient(cfg).FetchSchema(); err != nil {
+			slog.Error("Failed to fetch schema", "error", err)
+			return 1
+		}
+	}
+
+	openai := shared.NewOpenAIClient(cfg)
+	openai.SetSchema(schema)
+	tools := openai.Tools()
+
+	if *check {
+		if err := shared.CheckGrammar(tools[0].Format.Definition, schema); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			slog.Error("Grammar check failed")
+			return 1
+		}
+		slog.Info("Grammar OK", "tables", len(schema.Datasources))
+		return 0
+	}
+
+	var out bytes.Buffer
+	switch *format {
+	case "json", "request":
+		var payload interface{} = tools
+		if *format == "request" {
+			payload = openai.GenerationRequest(*question, now)
+		}
+		enc := json.NewEncoder(&out)
+		enc.SetIndent("", "  ")
+		enc.Encode(payload)
+	default:
+		printGrammar(&out, tools)
+		fmt.Fprintf(&out, "### Estimated prompt size\n\nabout %d tokens before the question (limit %d)\n",
+			shared.EstimatePromptTokens(shared.ResponsesRequest{Tools: tools}), shared.PromptTokenLimit(openai.Model(), cfg.MaxPromptTokens))
+	}
+
+	if *golden == "" {
+		os.Stdout.Write(out.Bytes())
+		return 0
+	}
+	if *update {
+		if err := os.WriteFile(*golden, out.Bytes(), 0o644); err != nil {
+			slog.Error("Failed to write golden file", "error", err)
+			return 1
+		}
+		slog.Info("Golden file updated", "path", *golden)
+		return 0
+	}
+	want, err := os.ReadFile(*golden)
+	if err != nil {
+		slog.Error("Failed to read golden file", "error", err)
+		return 1
+	}
+	if line, ok := firstDiff(string(want), out.String()); !ok {
+		slog.Error("Output differs from golden file; rerun with -update if the change is intended", "path", *golden, "line", line)
+		return 1
+	}
+	slog.Info("Output matches golden file", "path", *golden)
+	return 0
+}
+
+// firstDiff returns the first line (1-based) where got differs from want,
+// and false, or 0 and true when they are equal
+func firstDiff(want, got string) (int, bool) {
+	if want == got {
+		return 0, true
+	}
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := range wantLines {
+		if i >= len(gotLines) || wantLines[i] != gotLines[i] {
+			return i + 1, false
+		}
+	}
+	return len(wantLines) + 1, false
+}
+
+// parseResponses prints what each recorded Responses API output parses to:
+// the SQL, or the error code and message. It exits 1 if a file can't be
+// read as a response.
+func parseResponses(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: grammar parse-response response.json...")
+		return 2
+	}
+	status := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Failed to read response", "path", path, "error", err)
+			status = 1
+			continue
+		}
+		var resp shared.ResponsesResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			slog.Error("Failed to parse response", "path", path, "error", err)
+			status = 1
+			continue
+		}
+		sql, err := shared.ParseGeneration(&resp, "")
+		if err != nil {
+			fmt.Printf("%s: %s: %v\n", path, nlerrors.CodeOf(err), err)
+			continue
+		}
+		fmt.Printf("%s: sql: %s\n", path, sql)
+	}
+	return status
+}
+
+func printGrammar(w io.Writer, tools []shared.Tool) {
+	sql := tools[0]
+	fmt.Fprintf(w, "### Lark grammar (%s)\n\n%s\n", sql.Name, sql.Format.Definition)
+	fmt.Fprintf(w, "### Tool description (%s)\n\n%s\n", sql.Name, sql.Description)
+}
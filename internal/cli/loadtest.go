@@ -0,0 +1,272 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// LoadTest replays a corpus of questions against a running instance at a
+// fixed rate and reports latency percentiles per phase and an error
+// breakdown.
+//
+//	loadtest -url http://localhost:8080 -rate 5 -duration 1m [-corpus questions.txt]
+func LoadTest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	baseURL := fs.String("url", "http://localhost:8080", "base URL of the instance under test")
+	corpusFile := fs.String("corpus", "", "file with one question per line (default: the eval case questions)")
+	rate := fs.Float64("rate", 1, "requests started per second")
+	duration := fs.Duration("duration", 30*time.Second, "how long to keep starting requests")
+	maxInFlight := fs.Int("max-in-flight", 50, "cap on concurrent requests; starts beyond it are counted as dropped")
+	apiKey := fs.String("api-key", "", "bearer API key, when the instance uses ACCESS_FILE")
+	timeout := fs.Duration("timeout", 2*time.Minute, "per-request timeout")
+	format := fs.String("format", "text", "report format: text or json")
+	fs.Parse(args)
+
+	if *rate <= 0 || *format != "text" && *format != "json" {
+		fs.Usage()
+		return 2
+	}
+
+	corpus, err := loadCorpus(*corpusFile)
+	if err != nil {
+		slog.Error("Failed to load corpus", "error", err)
+		return 1
+	}
+
+	target := strings.TrimSuffix(*baseURL, "/") + "/api/query"
+	client := &http.Client{Timeout: *timeout}
+
+	var (
+		mu      sync.Mutex
+		samples []loadSample
+		wg      sync.WaitGroup
+		dropped int
+	)
+	sem := make(chan struct{}, *maxInFlight)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	deadline := time.After(*duration)
+
+	slog.Info("Load test started", "url", target, "rate", *rate, "duration", *duration, "questions", len(corpus))
+	start := time.Now()
+	for i := 0; ; i++ {
+		select {
+		case <-deadline:
+			wg.Wait()
+			report := newLoadReport(samples, dropped, time.Since(start))
+			if *format == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(report)
+			} else {
+				report.print(os.Stdout)
+			}
+			return 0
+		case <-ticker.C:
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			dropped++
+			continue
+		}
+		wg.Add(1)
+		go func(question string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s := sendQuery(client, target, *apiKey, question)
+			mu.Lock()
+			samples = append(samples, s)
+			mu.Unlock()
+		}(corpus[i%len(corpus)])
+	}
+}
+
+// loadCorpus reads one question per line, skipping blanks and # comments
+func loadCorpus(path string) ([]string, error) {
+	if path == "" {
+		var questions []string
+		for _, tc := range shared.DefaultEvalCases() {
+			questions = append(questions, tc.Query)
+		}
+		return questions, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var questions []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			questions = append(questions, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(questions) == 0 {
+		return nil, fmt.Errorf("%s contains no questions", path)
+	}
+	return questions, nil
+}
+
+// loadSample is the outcome of one request
+type loadSample struct {
+	total  time.Duration
+	phases map[string]float64 // from Server-Timing, in ms
+	// outcome is "ok", the response's error code, "http_<status>" or "transport"
+	outcome string
+}
+
+func sendQuery(client *http.Client, target, apiKey, question string) loadSample {
+	body, _ := json.Marshal(map[string]string{"query": question})
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return loadSample{outcome: "transport"}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return loadSample{total: time.Since(start), outcome: "transport"}
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	s := loadSample{
+		total:   time.Since(start),
+		phases:  parseServerTiming(resp.Header.Get("Server-Timing")),
+		outcome: "ok",
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(respBody, &result)
+		s.outcome = result.Code
+		if s.outcome == "" {
+			s.outcome = fmt.Sprintf("http_%d", resp.StatusCode)
+		}
+	}
+	return s
+}
+
+// parseServerTiming parses "schema;dur=12.3, generate;dur=800" into phase -> ms
+func parseServerTiming(header string) map[string]float64 {
+	phases := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "dur="); ok {
+				if ms, err := strconv.ParseFloat(v, 64); err == nil && name != "" {
+					phases[name] = ms
+				}
+			}
+		}
+	}
+	return phases
+}
+
+// Percentiles are latency percentiles in milliseconds
+type Percentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func percentiles(values []float64) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sort.Float64s(values)
+	at := func(p float64) float64 {
+		return values[int(p*float64(len(values)-1))]
+	}
+	return Percentiles{Count: len(values), P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: values[len(values)-1]}
+}
+
+// LoadReport summarizes a load test run
+type LoadReport struct {
+	Requests   int                    `json:"requests"`
+	Dropped    int                    `json:"dropped"`
+	Throughput float64                `json:"throughput_rps"`
+	Total      Percentiles            `json:"total"`
+	Phases     map[string]Percentiles `json:"phases"`
+	Outcomes   map[string]int         `json:"outcomes"`
+}
+
+func newLoadReport(samples []loadSample, dropped int, elapsed time.Duration) LoadReport {
+	report := LoadReport{
+		Requests:   len(samples),
+		Dropped:    dropped,
+		Throughput: float64(len(samples)) / elapsed.Seconds(),
+		Phases:     make(map[string]Percentiles),
+		Outcomes:   make(map[string]int),
+	}
+
+	var totals []float64
+	phaseValues := make(map[string][]float64)
+	for _, s := range samples {
+		report.Outcomes[s.outcome]++
+		totals = append(totals, float64(s.total.Microseconds())/1000)
+		for phase, ms := range s.phases {
+			phaseValues[phase] = append(phaseValues[phase], ms)
+		}
+	}
+	report.Total = percentiles(totals)
+	for phase, values := range phaseValues {
+		report.Phases[phase] = percentiles(values)
+	}
+	return report
+}
+
+func (r LoadReport) print(w io.Writer) {
+	fmt.Fprintf(w, "requests: %d (dropped %d), throughput: %.2f req/s\n\n", r.Requests, r.Dropped, r.Throughput)
+
+	fmt.Fprintf(w, "%-10s %6s %9s %9s %9s %9s\n", "phase", "count", "p50", "p90", "p99", "max")
+	line := func(name string, p Percentiles) {
+		fmt.Fprintf(w, "%-10s %6d %7.0fms %7.0fms %7.0fms %7.0fms\n", name, p.Count, p.P50, p.P90, p.P99, p.Max)
+	}
+	for _, phase := range []string{shared.PhaseSchema, shared.PhaseGenerate, shared.PhaseExecute} {
+		if p, ok := r.Phases[phase]; ok {
+			line(phase, p)
+		}
+	}
+	line("total", r.Total)
+
+	outcomes := make([]string, 0, len(r.Outcomes))
+	for outcome := range r.Outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	fmt.Fprintln(w, "\noutcomes:")
+	for _, outcome := range outcomes {
+		fmt.Fprintf(w, "  %-22s %d\n", outcome, r.Outcomes[outcome])
+	}
+}
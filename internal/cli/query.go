@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Query answers one question from the command line.
+//
+//	query [-sql-only] [-explain] [-as-of 2018-06-01] [-format table|json] [-trace trace.json] "What is the total revenue?"
+func Query(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	sqlOnly := fs.Bool("sql-only", false, "print the generated SQL without executing it")
+	format := fs.String("format", "table", "output format: table or json")
+	explain := fs.Bool("explain", false, "describe the query plan in plain English before running it")
+	asOf := fs.String("as-of", "", "reference time for relative dates, e.g. 2018-06-01 (default now)")
+	traceFile := fs.String("trace", "", "write the prompt, grammar and every OpenAI and Tinybird call to this file as a JSON bundle, for bug reports")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args)
+
+	question := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if question == "" {
+		fmt.Fprintln(os.Stderr, `usage: query [flags] "question"`)
+		return 2
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -format %q\n", *format)
+		return 2
+	}
+
+	c, err := connect(configFlags)
+	if err != nil {
+		slog.Error("Startup failed", "error", err)
+		return 1
+	}
+
+	sql := ""
+	if *traceFile != "" {
+		trace := &shared.Trace{}
+		c.openai.TraceTo(trace)
+		c.tinybird.TraceTo(trace)
+		defer writeTrace(*traceFile, trace, question, *asOf, &sql, time.Now())
+	}
+
+	sql, limitApplied, err := c.generate(question, *asOf)
+	if err != nil {
+		if !printRefusal(os.Stderr, err) {
+			slog.Error("Generation failed", "error", err)
+		}
+		return 1
+	}
+
+	explanation := ""
+	if *explain {
+		explanation, err = c.explain(sql)
+		if err != nil {
+			slog.Warn("Plan explanation failed", "error", err)
+		}
+	}
+
+	if *sqlOnly {
+		fmt.Println(shared.FormatSQL(sql))
+		if explanation != "" {
+			fmt.Println()
+			fmt.Println(explanation)
+		}
+		return 0
+	}
+
+	c.tinybird.TagQuestion(question)
+	result, err := c.tinybird.ExecuteQuery(sql)
+	if err != nil {
+		slog.Error("Execution failed", "error", err, "sql", sql)
+		return 1
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{
+			"sql":           shared.FormatSQL(sql),
+			"data":          result.Data,
+			"rows":          result.Rows,
+			"limit_applied": limitApplied,
+			"explanation":   explanation,
+		})
+		return 0
+	}
+
+	fmt.Println(shared.FormatSQL(sql))
+	fmt.Println()
+	if explanation != "" {
+		fmt.Println(explanation)
+		fmt.Println()
+	}
+	printTable(os.Stdout, result)
+	if limitApplied > 0 && result.Rows >= limitApplied {
+		fmt.Printf("(capped at %d rows)\n", limitApplied)
+	}
+	return 0
+}
+
+// generate produces SQL for question, with relative dates in
+// DEFAULT_TIMEZONE as of asOf (now if empty), row selects bounded and the
+// default LIMIT applied. The returned limit is non-zero when a LIMIT was
+// added or lowered.
+func (c *clients) generate(question, asOf string) (string, int, error) {
+	loc, err := shared.LoadTimezone(c.cfg.DefaultTimezone)
+	if err != nil {
+		return "", 0, err
+	}
+	now := time.Now().In(loc)
+	if asOf != "" {
+		if now, err = shared.ParseReferenceTime(asOf, loc); err != nil {
+			return "", 0, err
+		}
+	}
+	gen, err := c.openai.Generate(question, now)
+	if err != nil {
+		return "", 0, err
+	}
+	sql, _, lowered := shared.BoundRowSelect(gen.SQL, c.schema, c.cfg.MaxDefaultLimit, nil)
+	if capped, ok := shared.ApplyDefaultLimit(sql, c.cfg.MaxDefaultLimit); ok || lowered {
+		return capped, c.cfg.MaxDefaultLimit, nil
+	}
+	return sql, 0, nil
+}
+
+// explain describes how sql will execute, from EXPLAIN and the row estimate
+func (c *clients) explain(sql string) (string, error) {
+	plan, err := c.tinybird.ExplainPlan(sql)
+	if err != nil {
+		return "", err
+	}
+	estimated, err := c.tinybird.EstimateRows(sql)
+	if err != nil {
+		estimated = -1
+	}
+	text, _, err := shared.DescribePlan(c.openai, sql, plan, estimated)
+	return text, err
+}
+
+// writeTrace saves what a query sent to OpenAI and Tinybird as a trace
+// bundle, in the format of /api/admin/traces
+func writeTrace(path string, trace *shared.Trace, question, asOf string, sql *string, start time.Time) {
+	request, _ := json.Marshal(map[string]string{"query": question, "as_of": asOf})
+	bundle := &shared.TraceBundle{
+		Time:       start.UTC(),
+		Path:       "nl2sql query",
+		Request:    request,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	bundle.Finish(trace.Calls())
+	if *sql != "" {
+		bundle.SQL = shared.FormatSQL(*sql)
+	}
+	data, _ := json.MarshalIndent(bundle, "", "  ")
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		slog.Error("Failed to write trace", "error", err)
+		return
+	}
+	slog.Info("Trace saved", "path", path)
+}
+
+// printRefusal reports err to w if the model declined the question
+func printRefusal(w io.Writer, err error) bool {
+	var unsupportedErr shared.ErrUnsupportedQuery
+	if !errors.As(err, &unsupportedErr) {
+		return false
+	}
+	fmt.Fprintf(w, "Can't answer: %s\n%s\n", unsupportedErr.Reason, unsupportedErr.AvailableData)
+	return true
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+const replHelp = `Type a question to generate SQL. Commands:
+  \tables   list tables and columns
+  \auto     toggle executing without confirmation
+  \help     show this help
+  \quit     exit (Ctrl-D also works)
+`
+
+// Repl loads the schema once and then answers questions interactively:
+// each question shows the generated SQL and, once confirmed, the results.
+//
+//	repl [-yes]
+func Repl(args []string) int {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	auto := fs.Bool("yes", false, "execute generated SQL without asking")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args)
+
+	c, err := connect(configFlags)
+	if err != nil {
+		slog.Error("Startup failed", "error", err)
+		return 1
+	}
+
+	fmt.Printf("Loaded %d tables. Type \\help for commands.\n", len(c.schema.Datasources))
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("nl2sql> ")
+		if !in.Scan() {
+			fmt.Println()
+			return 0
+		}
+		line := strings.TrimSpace(in.Text())
+
+		switch line {
+		case "":
+			continue
+		case `\q`, `\quit`, "exit", "quit":
+			return 0
+		case `\h`, `\help`:
+			fmt.Print(replHelp)
+			continue
+		case `\tables`:
+			printSchema(os.Stdout, c.schema)
+			continue
+		case `\auto`:
+			*auto = !*auto
+			fmt.Printf("auto-execute: %v\n", *auto)
+			continue
+		}
+
+		sql, limitApplied, err := c.generate(line, "")
+		if err != nil {
+			if !printRefusal(os.Stdout, err) {
+				fmt.Printf("error: %v\n", err)
+			}
+			continue
+		}
+		fmt.Printf("\n  %s\n\n", strings.ReplaceAll(shared.FormatSQL(sql), "\n", "\n  "))
+
+		if !*auto {
+			fmt.Print("Execute? [Y/n] ")
+			if !in.Scan() {
+				fmt.Println()
+				return 0
+			}
+			if answer := strings.ToLower(strings.TrimSpace(in.Text())); answer != "" && answer != "y" && answer != "yes" {
+				continue
+			}
+		}
+
+		result, err := c.tinybird.ExecuteQuery(sql)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			continue
+		}
+		printTable(os.Stdout, result)
+		if limitApplied > 0 && result.Rows >= limitApplied {
+			fmt.Printf("(capped at %d rows)\n", limitApplied)
+		}
+		fmt.Println()
+	}
+}
+
+// printSchema lists each table with its columns
+func printSchema(w io.Writer, schema *shared.Schema) {
+	for _, ds := range schema.Datasources {
+		cols := make([]string, len(ds.Columns))
+		for i, col := range ds.Columns {
+			cols[i] = col.Name + " " + col.Type
+		}
+		fmt.Fprintf(w, "%s(%s)\n", ds.Name, strings.Join(cols, ", "))
+	}
+}
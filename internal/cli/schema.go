@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Schema inspects the warehouse schema.
+//
+//	schema dump [-o schema.json]
+func Schema(args []string) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: schema dump [-o file]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("schema dump", flag.ExitOnError)
+	output := fs.String("o", "", "write to this file instead of stdout")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args[1:])
+
+	cfg, err := configFlags.LoadTinybird()
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		return 1
+	}
+	schema, err := shared.NewTinybirdClient(cfg).FetchSchema()
+	if err != nil {
+		slog.Error("Failed to fetch schema", "error", err)
+		return 1
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode schema", "error", err)
+		return 1
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		slog.Error("Failed to write schema", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,220 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/handlers"
+	"github.com/raindrop/nl2sql/pkg/reports"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Serve runs the API and the static frontend as a long-running server,
+// mirroring the Vercel deployment. SIGHUP or POST /api/admin/reload
+// reloads reloadable settings; SIGINT/SIGTERM shut down gracefully.
+//
+//	serve [-static public]
+func Serve(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	static := fs.String("static", "public", "directory of static frontend files (empty disables)")
+	configFlags := shared.BindConfigFlags(fs)
+	fs.Parse(args)
+
+	reloader, err := shared.NewConfigReloader(configFlags.Load)
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		return 1
+	}
+	cfg := reloader.Config()
+	if err := shared.SetupLogging(cfg); err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		return 1
+	}
+	if err := shared.Features.SetConfig(cfg.FeatureFlags); err != nil {
+		slog.Error("Invalid feature flags", "error", err)
+		return 1
+	}
+	reloader.OnReload(func(cfg *shared.Config) {
+		if err := shared.SetupLogging(cfg); err != nil {
+			slog.Error("Failed to reconfigure logging", "error", err)
+		}
+		if err := shared.Features.SetConfig(cfg.FeatureFlags); err != nil {
+			slog.Error("Invalid feature flags", "error", err)
+		}
+	})
+
+	// Same handlers as the Vercel functions, reading the live config
+	deps := handlers.DefaultDeps()
+	deps.LoadConfig = func() (*shared.Config, error) { return reloader.Config(), nil }
+	deps.Reloader = reloader
+	jobs, err := shared.NewJobQueue(cfg)
+	if err != nil {
+		slog.Error("Failed to load jobs", "error", err)
+		return 1
+	}
+	deps.Jobs = jobs
+	deps.Shadows = shared.NewShadowRunner(shared.DefaultShadowInFlight)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Before start-up, which may retry for a while: an unhandled SIGHUP
+	// would kill the process
+	reloader.ReloadOnSIGHUP(ctx)
+
+	// Fail fast on bad credentials rather than on the first request, or
+	// wait out a Tinybird outage as STARTUP_MODE says
+	if !startup(ctx, deps, cfg) {
+		return 1
+	}
+
+	router := handlers.NewAPI(deps)
+	if *static != "" {
+		router.Handle("/", http.FileServer(http.Dir(*static)))
+	}
+
+	ln, err := shared.Listen(cfg)
+	if err != nil {
+		slog.Error("Failed to listen", "error", err)
+		return 1
+	}
+	srv := shared.NewHTTPServer(cfg, router)
+
+	// Scheduled reports re-read REPORTS_FILE every minute, so edits made
+	// through /api/admin/reports apply without a restart
+	scheduler := &reports.Scheduler{
+		Runner: reports.NewRunner(deps.LoadConfig),
+		Load: func() ([]reports.Report, error) {
+			if path := reloader.Config().ReportsFile; path != "" {
+				return reports.Load(path)
+			}
+			return nil, nil
+		},
+	}
+	go scheduler.Run(ctx)
+
+	// Async query jobs, including ones a previous run didn't finish
+	go jobs.Run(ctx, handlers.NewQuery(deps).RunJob)
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "addr", ln.Addr().String())
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		slog.Error("Server failed", "error", err)
+		return 1
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Shutdown failed", "error", err)
+		return 1
+	}
+	// Shadow comparisons in flight finish their logging
+	deps.Shadows.Wait()
+	return 0
+}
+
+// degradedReason marks the generate_only override of STARTUP_MODE=degraded,
+// so it is only lifted if nobody has switched modes since
+const degradedReason = "Tinybird unavailable since start-up"
+
+// startup checks Tinybird per STARTUP_MODE and runs PREFLIGHT. It reports
+// whether to start serving.
+func startup(ctx context.Context, deps handlers.Deps, cfg *shared.Config) bool {
+	switch cfg.StartupMode {
+	case shared.StartupRetry:
+		if err := warmSchema(ctx, deps, cfg, cfg.StartupTimeout); err != nil {
+			slog.Error("Tinybird unavailable at start-up", "error", err)
+			return false
+		}
+
+	case shared.StartupDegraded:
+		schema, err := deps.NewWarehouse(cfg).FetchSchema()
+		if err == nil {
+			cacheSchema(deps, cfg, schema)
+			break
+		}
+		if cfg.SchemaFallbackFile != "" {
+			fallback, err := shared.LoadSchemaFile(cfg.SchemaFallbackFile)
+			if err != nil {
+				slog.Error("Failed to load fallback schema", "error", err)
+				return false
+			}
+			if deps.Schemas != nil {
+				deps.Schemas.Pin(shared.SchemaCacheKey(cfg), fallback)
+			}
+		}
+		// An operator's maintenance switch stays as it is
+		if shared.ServiceMode.State(cfg).Mode == shared.ModeNormal {
+			shared.ServiceMode.Override(shared.ModeGenerateOnly, degradedReason)
+		}
+		slog.Warn("Starting degraded", "mode", shared.ServiceMode.State(cfg).Mode, "fallback_schema", cfg.SchemaFallbackFile, "error", err)
+
+		// The server is already up, so from here on failures are logged
+		go func() {
+			if err := warmSchema(ctx, deps, cfg, 0); err != nil {
+				return
+			}
+			if state := shared.ServiceMode.State(cfg); state.Source == "override" && state.Reason == degradedReason {
+				shared.ServiceMode.ClearOverride()
+			}
+			slog.Info("Tinybird available, leaving degraded mode", "mode", shared.ServiceMode.State(cfg).Mode)
+			if cfg.Preflight && !preflight(deps, cfg) {
+				slog.Error("Preflight failed after degraded start-up, still serving")
+			}
+		}()
+		return true
+	}
+	return !cfg.Preflight || preflight(deps, cfg)
+}
+
+// warmSchema fetches the schema with backoff, for up to timeout (0 = until
+// ctx is done), and caches it for the first requests
+func warmSchema(ctx context.Context, deps handlers.Deps, cfg *shared.Config, timeout time.Duration) error {
+	schema, err := shared.FetchSchemaWithBackoff(ctx, deps.NewWarehouse(cfg), timeout, slog.Default())
+	if err != nil {
+		return err
+	}
+	cacheSchema(deps, cfg, schema)
+	return nil
+}
+
+// cacheSchema caches a schema fetched at start-up, replacing a pinned
+// fallback, and records it as the first schema version
+func cacheSchema(deps handlers.Deps, cfg *shared.Config, schema *shared.Schema) {
+	if deps.Schemas == nil {
+		return
+	}
+	key := shared.SchemaCacheKey(cfg)
+	deps.Schemas.Record(key, schema)
+	deps.Schemas.Set(key, schema)
+	slog.Info("Schema loaded", "tables", len(schema.Datasources), "version", schema.Version())
+}
+
+// preflight runs shared.Preflight with the server's clients and logs each
+// check. It reports whether every check passed.
+func preflight(deps handlers.Deps, cfg *shared.Config) bool {
+	checks := shared.Preflight(deps.NewGenerator(cfg), deps.NewWarehouse(cfg))
+	for _, c := range checks {
+		if c.Err != nil {
+			slog.Error("Preflight check failed", "check", c.Name, "error", c.Err, shared.DurationMs(c.Duration))
+		} else {
+			slog.Info("Preflight check passed", "check", c.Name, shared.DurationMs(c.Duration))
+		}
+	}
+	return shared.PreflightError(checks) == nil
+}
@@ -0,0 +1,276 @@
+// Package client is a typed Go client for the nl2sql HTTP API, for services
+// that want answers from Go code without hand-rolling requests.
+//
+//	c := client.New("https://your-app.vercel.app", client.WithAPIKey(key))
+//	resp, err := c.Query(ctx, "total revenue last month")
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/handlers"
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Client calls a deployed nl2sql API. Safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retry      shared.RetryPolicy
+}
+
+// Option customizes New
+type Option func(*Client)
+
+// WithAPIKey sends key as a bearer token, for deployments with ACCESS_FILE.
+// A JWT from the JWT_ISSUER of the deployment works the same way.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient sets the HTTP client used for API calls
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetryPolicy sets how network errors, 429s and 5xx responses are
+// retried. The default is shared.DefaultRetryPolicy.
+func WithRetryPolicy(p shared.RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// New creates a client for the API at baseURL, e.g. "https://your-app.vercel.app"
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 2 * time.Minute},
+		retry:      shared.DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// APIError is a non-2xx response from the API
+type APIError struct {
+	Status  int
+	Code    nlerrors.Code
+	Message string
+	// Hint describes the available data when the question was unsupported
+	Hint string
+	// SQL is the generated SQL, when the failure happened after generation
+	SQL string
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("nl2sql api error (%d, %s): %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("nl2sql api error (%d): %s", e.Status, e.Message)
+}
+
+// Retryable reports whether the same request may succeed later
+func (e *APIError) Retryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey makes calls with ctx send key as the Idempotency-Key
+// header. Without it each call generates its own key, which is reused
+// across that call's retries.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+// Query asks question and returns the generated SQL and rows
+func (c *Client) Query(ctx context.Context, question string) (*handlers.QueryResponse, error) {
+	var resp handlers.QueryResponse
+	err := c.do(ctx, http.MethodPost, "/api/query", handlers.QueryRequest{Query: question}, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// QueryStream asks question and calls fn for each row as it is decoded,
+// without holding the result in memory. It works whether or not the server
+// streams (STREAM_RESULTS); streaming servers just deliver rows sooner.
+// The returned response has everything except Data. An error reported
+// after rows were sent is returned as an *APIError alongside it.
+func (c *Client) QueryStream(ctx context.Context, question string, fn func(row map[string]interface{}) error) (*handlers.QueryResponse, error) {
+	var resp handlers.QueryResponse
+	err := c.do(ctx, http.MethodPost, "/api/query", handlers.QueryRequest{Query: question}, func(body io.Reader) error {
+		return decodeQueryStream(body, &resp, fn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, &APIError{Status: http.StatusOK, Code: nlerrors.Code(resp.Code), Message: resp.Error, SQL: resp.SQL}
+	}
+	return &resp, nil
+}
+
+// EvalOptions selects optional eval behaviour; see GET /api/eval
+type EvalOptions struct {
+	Smoke    bool
+	Diagnose bool
+}
+
+// EvalResponse is the outcome of an eval run
+type EvalResponse struct {
+	Passed  bool                `json:"passed"`
+	Summary shared.EvalSummary  `json:"summary"`
+	Results []shared.EvalResult `json:"results"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// Eval runs the deployment's eval suite. A run with failing cases is not an
+// error; check Passed.
+func (c *Client) Eval(ctx context.Context, opts EvalOptions) (*EvalResponse, error) {
+	q := url.Values{}
+	if opts.Smoke {
+		q.Set("smoke", "true")
+	}
+	if opts.Diagnose {
+		q.Set("diagnose", "true")
+	}
+	path := "/api/eval"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	var resp EvalResponse
+	err := c.do(ctx, http.MethodGet, path, nil, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Schema returns the datasources and columns visible to the client's key
+func (c *Client) Schema(ctx context.Context) (*shared.Schema, error) {
+	var schema shared.Schema
+	err := c.do(ctx, http.MethodGet, "/api/schema", nil, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&schema)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// do sends the request, retrying transient failures per the retry policy,
+// and hands a 2xx body to decode. Retries stop once decode is called.
+func (c *Client) do(ctx context.Context, method, path string, in interface{}, decode func(io.Reader) error) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	idempotencyKey, _ := ctx.Value(idempotencyKeyCtx{}).(string)
+	if idempotencyKey == "" && method == http.MethodPost {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	attempts := c.retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := c.retry.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			err = fmt.Errorf("failed to execute request: %w", err)
+		} else if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if err := decode(resp.Body); err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+			return nil
+		} else {
+			err = readAPIError(resp)
+			if apiErr := err.(*APIError); !apiErr.Retryable() {
+				return err
+			}
+		}
+
+		if attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if c.retry.MaxBackoff > 0 && backoff > c.retry.MaxBackoff {
+			backoff = c.retry.MaxBackoff
+		}
+	}
+}
+
+// readAPIError consumes and closes a non-2xx response
+func readAPIError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var payload struct {
+		SQL   string `json:"sql"`
+		Error string `json:"error"`
+		Code  string `json:"code"`
+		Hint  string `json:"hint"`
+	}
+	apiErr := &APIError{Status: resp.StatusCode}
+	if json.Unmarshal(body, &payload) == nil && payload.Error != "" {
+		apiErr.Code = nlerrors.Code(payload.Code)
+		apiErr.Message = payload.Error
+		apiErr.Hint = payload.Hint
+		apiErr.SQL = payload.SQL
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
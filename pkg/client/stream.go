@@ -0,0 +1,65 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/raindrop/nl2sql/pkg/handlers"
+)
+
+// decodeQueryStream decodes a QueryResponse body into resp, calling fn for
+// each element of "data" instead of collecting it
+func decodeQueryStream(r io.Reader, resp *handlers.QueryResponse, fn func(row map[string]interface{}) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		switch key {
+		case "data":
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			for dec.More() {
+				var row map[string]interface{}
+				if err := dec.Decode(&row); err != nil {
+					return fmt.Errorf("failed to parse row: %w", err)
+				}
+				if err := fn(row); err != nil {
+					return err
+				}
+			}
+			err = expectDelim(dec, ']')
+		default:
+			// Decode each remaining field through a one-key object so the
+			// field tags on QueryResponse stay the single source of truth
+			var raw json.RawMessage
+			if err = dec.Decode(&raw); err == nil {
+				field, _ := json.Marshal(map[string]json.RawMessage{key: raw})
+				err = json.Unmarshal(field, resp)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q, got %v", want, tok)
+	}
+	return nil
+}
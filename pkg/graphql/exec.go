@@ -0,0 +1,221 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Resolver resolves a root field. Its result is converted to JSON values
+// and narrowed to the requested selection: object keys are matched by field
+// name or its snake_case form, so resolvers can return the API's existing
+// JSON types. A field selected without sub-fields returns its whole value,
+// which is how result rows with dynamic columns are fetched.
+type Resolver func(ctx context.Context, args map[string]interface{}) (interface{}, error)
+
+// Request is a GraphQL request as POSTed by clients
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Error is a GraphQL error entry
+type Error struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Response is a GraphQL response
+type Response struct {
+	Data   *Object `json:"data"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+// Object is a JSON object that keeps its keys in selection order, as the
+// GraphQL spec asks of responses
+type Object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newObject(size int) *Object {
+	return &Object{values: make(map[string]interface{}, size)}
+}
+
+// Set adds or replaces key, keeping its first position
+func (o *Object) Set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// Get returns the value of key
+func (o *Object) Get(key string) interface{} {
+	return o.values[key]
+}
+
+func (o *Object) MarshalJSON() ([]byte, error) {
+	if o == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// CodedError is a resolver error reported with extensions.code
+type CodedError struct {
+	Code string
+	Err  error
+}
+
+func (e CodedError) Error() string { return e.Err.Error() }
+
+func (e CodedError) Unwrap() error { return e.Err }
+
+// Execute runs the selected operation of req against resolvers. A failing
+// root field is null in data with an entry in errors; other fields still
+// resolve. Parse and validation errors return no data.
+func Execute(ctx context.Context, req Request, resolvers map[string]Resolver) *Response {
+	ops, err := Parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	var op *Operation
+	switch {
+	case req.OperationName != "":
+		for _, o := range ops {
+			if o.Name == req.OperationName {
+				op = o
+			}
+		}
+		if op == nil {
+			return &Response{Errors: []Error{{Message: fmt.Sprintf("unknown operation %q", req.OperationName)}}}
+		}
+	case len(ops) == 1:
+		op = ops[0]
+	default:
+		return &Response{Errors: []Error{{Message: "operationName is required for documents with several operations"}}}
+	}
+
+	for _, f := range op.Selection {
+		if _, ok := resolvers[f.Name]; !ok {
+			return &Response{Errors: []Error{{Message: fmt.Sprintf("unknown field %q on Query", f.Name), Path: []interface{}{f.Key()}}}}
+		}
+	}
+
+	resp := &Response{Data: newObject(len(op.Selection))}
+	for _, f := range op.Selection {
+		args := make(map[string]interface{}, len(f.Arguments))
+		for name, v := range f.Arguments {
+			if v.Variable != "" {
+				args[name] = req.Variables[v.Variable]
+			} else {
+				args[name] = v.Literal
+			}
+		}
+
+		result, err := resolvers[f.Name](ctx, args)
+		if err == nil {
+			result, err = project(result, f.Selection)
+		}
+		if err != nil {
+			resp.Data.Set(f.Key(), nil)
+			e := Error{Message: err.Error(), Path: []interface{}{f.Key()}}
+			var coded CodedError
+			if errors.As(err, &coded) {
+				e.Extensions = map[string]interface{}{"code": coded.Code}
+			}
+			resp.Errors = append(resp.Errors, e)
+			continue
+		}
+		resp.Data.Set(f.Key(), result)
+	}
+	return resp
+}
+
+// project converts v to JSON values and keeps only the selected fields
+func project(v interface{}, selection []*Field) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return selectFields(generic, selection)
+}
+
+func selectFields(v interface{}, selection []*Field) (interface{}, error) {
+	if len(selection) == 0 {
+		return v, nil
+	}
+	switch t := v.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, item := range t {
+			projected, err := selectFields(item, selection)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = projected
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := newObject(len(selection))
+		for _, f := range selection {
+			value, ok := t[f.Name]
+			if !ok {
+				value = t[snakeCase(f.Name)]
+			}
+			projected, err := selectFields(value, f.Selection)
+			if err != nil {
+				return nil, err
+			}
+			out.Set(f.Key(), projected)
+		}
+		return out, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot select fields of scalar value %v", v)
+}
+
+// snakeCase maps a GraphQL field name to the API's JSON key, e.g.
+// limitApplied to limit_applied
+func snakeCase(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,360 @@
+// Package graphql executes a small subset of GraphQL against root
+// resolvers: query operations with fields, aliases, arguments, variables
+// and nested selections. Fragments, directives, mutations, subscriptions
+// and introspection are not supported and are rejected at parse time.
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field is one selected field
+type Field struct {
+	Alias     string
+	Name      string
+	Arguments map[string]Value
+	Selection []*Field
+}
+
+// Key is the field's name in the response
+func (f *Field) Key() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// Value is an argument value: a literal or a $variable reference
+type Value struct {
+	Literal  interface{}
+	Variable string
+}
+
+// Operation is a parsed query operation
+type Operation struct {
+	Name      string
+	Selection []*Field
+}
+
+// Parse parses a document of one or more query operations
+func Parse(src string) ([]*Operation, error) {
+	p := &parser{lex: lexer{src: src}}
+	p.next()
+
+	var ops []*Operation
+	for p.tok.kind != tokEOF {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("document has no operations")
+	}
+	return ops, nil
+}
+
+type parser struct {
+	lex lexer
+	tok token
+	err error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+	if p.err != nil {
+		p.tok = token{kind: tokEOF}
+	}
+}
+
+func (p *parser) fail(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("syntax error at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if p.tok.kind != kind || (text != "" && p.tok.text != text) {
+		want := text
+		if want == "" {
+			want = kind.String()
+		}
+		return p.fail("expected %s, got %q", want, p.tok.text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) operation() (*Operation, error) {
+	op := &Operation{}
+	if p.tok.kind == tokName {
+		switch p.tok.text {
+		case "query":
+			p.next()
+		case "mutation", "subscription":
+			return nil, p.fail("%s operations are not supported", p.tok.text)
+		case "fragment":
+			return nil, p.fail("fragments are not supported")
+		default:
+			return nil, p.fail("unexpected %q", p.tok.text)
+		}
+		if p.tok.kind == tokName {
+			op.Name = p.tok.text
+			p.next()
+		}
+		if p.tok.kind == tokPunct && p.tok.text == "(" {
+			if err := p.skipVariableDefinitions(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.Selection = sel
+	return op, nil
+}
+
+// skipVariableDefinitions consumes ($name: Type = default, ...). Variable
+// types are not checked; values are taken as sent.
+func (p *parser) skipVariableDefinitions() error {
+	depth := 0
+	for {
+		if p.tok.kind == tokEOF {
+			return p.fail("unterminated variable definitions")
+		}
+		if p.tok.kind == tokPunct {
+			switch p.tok.text {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+		}
+		p.next()
+		if depth == 0 {
+			return p.err
+		}
+	}
+}
+
+func (p *parser) selectionSet() ([]*Field, error) {
+	if err := p.expect(tokPunct, "{"); err != nil {
+		return nil, err
+	}
+	var fields []*Field
+	for !(p.tok.kind == tokPunct && p.tok.text == "}") {
+		if p.tok.kind == tokPunct && p.tok.text == "..." {
+			return nil, p.fail("fragments are not supported")
+		}
+		if p.tok.kind == tokPunct && p.tok.text == "@" {
+			return nil, p.fail("directives are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, p.fail("empty selection set")
+	}
+	p.next()
+	return fields, p.err
+}
+
+func (p *parser) field() (*Field, error) {
+	if p.tok.kind != tokName {
+		return nil, p.fail("expected field name, got %q", p.tok.text)
+	}
+	f := &Field{Name: p.tok.text}
+	p.next()
+	if p.tok.kind == tokPunct && p.tok.text == ":" {
+		p.next()
+		if p.tok.kind != tokName {
+			return nil, p.fail("expected field name after alias %q", f.Name)
+		}
+		f.Alias, f.Name = f.Name, p.tok.text
+		p.next()
+	}
+	if strings.HasPrefix(f.Name, "__") {
+		return nil, p.fail("introspection is not supported")
+	}
+
+	if p.tok.kind == tokPunct && p.tok.text == "(" {
+		p.next()
+		f.Arguments = make(map[string]Value)
+		for !(p.tok.kind == tokPunct && p.tok.text == ")") {
+			if p.tok.kind != tokName {
+				return nil, p.fail("expected argument name, got %q", p.tok.text)
+			}
+			name := p.tok.text
+			p.next()
+			if err := p.expect(tokPunct, ":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			f.Arguments[name] = v
+		}
+		p.next()
+	}
+
+	if p.tok.kind == tokPunct && p.tok.text == "{" {
+		sel, err := p.selectionSet()
+		if err != nil {
+			return nil, err
+		}
+		f.Selection = sel
+	}
+	return f, p.err
+}
+
+// value parses scalars and variables. Lists and input objects are not
+// needed by any resolver and are rejected.
+func (p *parser) value() (Value, error) {
+	tok := p.tok
+	p.next()
+	switch tok.kind {
+	case tokVariable:
+		return Value{Variable: tok.text}, p.err
+	case tokString:
+		return Value{Literal: tok.text}, p.err
+	case tokNumber:
+		if n, err := strconv.Atoi(tok.text); err == nil {
+			return Value{Literal: n}, p.err
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid number %q", tok.text)
+		}
+		return Value{Literal: f}, p.err
+	case tokName:
+		switch tok.text {
+		case "true":
+			return Value{Literal: true}, p.err
+		case "false":
+			return Value{Literal: false}, p.err
+		case "null":
+			return Value{}, p.err
+		}
+		return Value{Literal: tok.text}, p.err // enum value
+	}
+	return Value{}, fmt.Errorf("syntax error at offset %d: unsupported argument value %q", tok.pos, tok.text)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokVariable
+	tokString
+	tokNumber
+	tokPunct
+)
+
+func (k tokenKind) String() string {
+	return [...]string{"end of document", "name", "variable", "string", "number", "punctuation"}[k]
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || !first && c >= '0' && c <= '9'
+}
+
+func (l *lexer) next() (token, error) {
+	// Whitespace, commas and comments are insignificant
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.pos++
+		} else if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case isNameByte(c, true):
+		for l.pos < len(l.src) && isNameByte(l.src[l.pos], false) {
+			l.pos++
+		}
+		return token{kind: tokName, text: l.src[start:l.pos], pos: start}, nil
+	case c == '$':
+		l.pos++
+		for l.pos < len(l.src) && isNameByte(l.src[l.pos], l.pos == start+1) {
+			l.pos++
+		}
+		if l.pos == start+1 {
+			return token{}, fmt.Errorf("syntax error at offset %d: expected variable name", start)
+		}
+		return token{kind: tokVariable, text: l.src[start+1 : l.pos], pos: start}, nil
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			end := strings.Index(l.src[l.pos+3:], `"""`)
+			if end < 0 {
+				return token{}, fmt.Errorf("syntax error at offset %d: unterminated block string", start)
+			}
+			l.pos += 3 + end + 3
+			return token{kind: tokString, text: l.src[start+3 : l.pos-3], pos: start}, nil
+		}
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' && l.src[l.pos] != '\n' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) || l.src[l.pos] != '"' {
+			return token{}, fmt.Errorf("syntax error at offset %d: unterminated string", start)
+		}
+		l.pos++
+		s, err := strconv.Unquote(l.src[start:l.pos])
+		if err != nil {
+			return token{}, fmt.Errorf("syntax error at offset %d: invalid string: %w", start, err)
+		}
+		return token{kind: tokString, text: s, pos: start}, nil
+	case c == '-' || c >= '0' && c <= '9':
+		l.pos++
+		for l.pos < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: tokPunct, text: "...", pos: start}, nil
+	case strings.IndexByte("{}():!=@[]|&", c) >= 0:
+		l.pos++
+		return token{kind: tokPunct, text: string(c), pos: start}, nil
+	}
+	return token{}, fmt.Errorf("syntax error at offset %d: unexpected character %q", start, c)
+}
@@ -0,0 +1,423 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// FlagUpdate sets or clears a runtime override. A null Enabled clears it.
+type FlagUpdate struct {
+	Flag    string `json:"flag"`
+	Tenant  string `json:"tenant,omitempty"`
+	Enabled *bool  `json:"enabled"`
+}
+
+// AdminFlags serves /api/admin/flags. GET lists flags; POST applies a FlagUpdate.
+// Mount it behind AdminOnly.
+type AdminFlags struct {
+	Deps
+}
+
+// NewAdminFlags creates the feature flag admin handler
+func NewAdminFlags(deps Deps) *AdminFlags {
+	return &AdminFlags{Deps: deps}
+}
+
+func (h *AdminFlags) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	if err := shared.Features.SetConfig(cfg.FeatureFlags); err != nil {
+		log.Error("Failed to load feature flags", "error", err)
+	}
+
+	if r.Method == http.MethodPost {
+		var update FlagUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil || update.Flag == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+			return
+		}
+
+		if update.Enabled == nil {
+			shared.Features.ClearOverride(update.Flag, update.Tenant)
+		} else if err := shared.Features.Override(update.Flag, update.Tenant, *update.Enabled); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		log.Info("Feature flag override", "audit", true, "flag", update.Flag, shared.LogTenant, update.Tenant, "enabled", update.Enabled)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flags": shared.Features.Snapshot(),
+	})
+}
+
+// ModeUpdate switches the service mode at runtime. An empty Mode clears
+// the override, so SERVICE_MODE applies again.
+type ModeUpdate struct {
+	Mode   string `json:"mode"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdminMode serves /api/admin/mode, the kill switch for query execution.
+// GET returns the mode in effect; POST applies a ModeUpdate. Mount it
+// behind AdminOnly.
+type AdminMode struct {
+	Deps
+}
+
+// NewAdminMode creates the service mode admin handler
+func NewAdminMode(deps Deps) *AdminMode {
+	return &AdminMode{Deps: deps}
+}
+
+func (h *AdminMode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var update ModeUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+			return
+		}
+
+		if update.Mode == "" {
+			shared.ServiceMode.ClearOverride()
+		} else if err := shared.ServiceMode.Override(update.Mode, update.Reason); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		log.Warn("Service mode override", "audit", true, "mode", update.Mode, "reason", update.Reason)
+	}
+
+	json.NewEncoder(w).Encode(shared.ServiceMode.State(cfg))
+}
+
+// AdminConfig serves GET /api/admin/config: every resolved setting with
+// secrets masked. Mount it behind AdminOnly.
+type AdminConfig struct {
+	Deps
+}
+
+// NewAdminConfig creates the effective-config admin handler
+func NewAdminConfig(deps Deps) *AdminConfig {
+	return &AdminConfig{Deps: deps}
+}
+
+func (h *AdminConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	log.Info("Effective config served", "audit", true)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"config": cfg.Redacted(),
+	})
+}
+
+// AdminReload serves POST /api/admin/reload: the same reload as SIGHUP,
+// responding with every setting that changed and whether it was applied.
+// Mount it behind AdminOnly.
+type AdminReload struct {
+	Deps
+}
+
+// NewAdminReload creates the config reload admin handler
+func NewAdminReload(deps Deps) *AdminReload {
+	return &AdminReload{Deps: deps}
+}
+
+func (h *AdminReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	if h.Reloader == nil {
+		log.Warn("Config reload without a live config")
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(map[string]string{"error": "config reload needs a long-running server (nl2sql serve)"})
+		return
+	}
+
+	log.Info("Config reload requested", "audit", true)
+	changes, err := h.Reloader.Reload()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "config reload rejected: " + err.Error()})
+		return
+	}
+	if changes == nil {
+		changes = []shared.ConfigChange{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changes": changes,
+	})
+}
+
+// AdminUsage serves GET /api/admin/usage?days=N: LLM tokens, estimated
+// cost and Tinybird bytes read, totalled and broken down by day, tenant and
+// model. Mount it behind AdminOnly.
+type AdminUsage struct {
+	Deps
+}
+
+// NewAdminUsage creates the usage admin handler
+func NewAdminUsage(deps Deps) *AdminUsage {
+	return &AdminUsage{Deps: deps}
+}
+
+func (h *AdminUsage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "days must be a positive integer"})
+			return
+		}
+		days = n
+	}
+
+	// Whole UTC days, counting today as the first
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	report, err := h.Usage.Report(today.AddDate(0, 0, 1-days), cfg.UsageFile)
+	if err != nil {
+		log.Error("Failed to build usage report", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to build usage report"})
+		return
+	}
+
+	log.Info("Usage report served", "audit", true, "days", days)
+	json.NewEncoder(w).Encode(report)
+}
+
+// AdminCanary serves GET /api/admin/canary?days=N: success rate, errors,
+// generation latency and cost of the stable and canary cohorts, to decide
+// whether CANARY_MODEL can replace OPENAI_MODEL. Mount it behind AdminOnly.
+type AdminCanary struct {
+	Deps
+}
+
+// NewAdminCanary creates the canary comparison admin handler
+func NewAdminCanary(deps Deps) *AdminCanary {
+	return &AdminCanary{Deps: deps}
+}
+
+func (h *AdminCanary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "days must be a positive integer"})
+			return
+		}
+		days = n
+	}
+
+	// Whole UTC days, counting today as the first
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	report, err := h.Usage.CanaryReport(today.AddDate(0, 0, 1-days), cfg.UsageFile)
+	if err != nil {
+		log.Error("Failed to build canary report", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to build canary report"})
+		return
+	}
+
+	log.Info("Canary report served", "audit", true, "days", days)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"model":          cfg.OpenAIModel,
+		"canary_model":   cfg.CanaryModel,
+		"canary_percent": cfg.CanaryPercent,
+		"since":          report.Since,
+		"cohorts":        report.Cohorts,
+	})
+}
+
+// AdminRefusals serves GET /api/admin/refusals?days=N&top=N: the
+// questions the model refused most often, with its reasons, and the words
+// they share, to guide which datasources or metrics to add. Mount it
+// behind AdminOnly.
+type AdminRefusals struct {
+	Deps
+}
+
+// NewAdminRefusals creates the refusal report admin handler
+func NewAdminRefusals(deps Deps) *AdminRefusals {
+	return &AdminRefusals{Deps: deps}
+}
+
+func (h *AdminRefusals) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	days, top := 30, 20
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"days", &days}, {"top", &top}} {
+		if v := r.URL.Query().Get(param.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": param.name + " must be a positive integer"})
+				return
+			}
+			*param.value = n
+		}
+	}
+
+	// Whole UTC days, counting today as the first
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	report, err := h.Refusals.Report(today.AddDate(0, 0, 1-days), top, cfg.RefusalsFile)
+	if err != nil {
+		log.Error("Failed to build refusal report", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to build refusal report"})
+		return
+	}
+
+	log.Info("Refusal report served", "audit", true, "days", days, "refusals", report.Total)
+	json.NewEncoder(w).Encode(report)
+}
+
+// AdminSchema serves GET /api/admin/schema: the current schema version and
+// the versions this instance has seen, each with what changed from the one
+// before. Mount it behind AdminOnly.
+type AdminSchema struct {
+	Deps
+}
+
+// NewAdminSchema creates the schema history admin handler
+func NewAdminSchema(deps Deps) *AdminSchema {
+	return &AdminSchema{Deps: deps}
+}
+
+func (h *AdminSchema) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	schema, _, err := h.schema(r, cfg, h.NewWarehouse(cfg))
+	if err != nil {
+		log.Error("Failed to fetch schema", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch schema"})
+		return
+	}
+	var versions []shared.SchemaVersion
+	if h.Schemas != nil {
+		versions = h.Schemas.Versions(shared.SchemaCacheKey(cfg))
+	}
+
+	log.Info("Schema versions served", "audit", true, "versions", len(versions))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":  schema.Version(),
+		"versions": versions,
+	})
+}
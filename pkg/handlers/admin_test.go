@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+	"github.com/raindrop/nl2sql/pkg/shared/fake"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	const token = "admin-secret"
+
+	tests := []struct {
+		name       string
+		adminToken string
+		method     string
+		path       string
+		auth       string
+		reloadable bool
+		wantStatus int
+	}{
+		{"admin disabled", "", http.MethodGet, "/api/admin/config", "Bearer " + token, false, http.StatusNotFound},
+		{"missing token", token, http.MethodGet, "/api/admin/config", "", false, http.StatusUnauthorized},
+		{"wrong token", token, http.MethodGet, "/api/admin/config", "Bearer nope", false, http.StatusUnauthorized},
+		{"config", token, http.MethodGet, "/api/admin/config", "Bearer " + token, false, http.StatusOK},
+		{"config by POST", token, http.MethodPost, "/api/admin/config", "Bearer " + token, false, http.StatusMethodNotAllowed},
+		{"mode", token, http.MethodGet, "/api/admin/mode", "Bearer " + token, false, http.StatusOK},
+		{"reload by GET", token, http.MethodGet, "/api/admin/reload", "Bearer " + token, true, http.StatusMethodNotAllowed},
+		{"reload without a live config", token, http.MethodPost, "/api/admin/reload", "Bearer " + token, false, http.StatusNotImplemented},
+		{"reload", token, http.MethodPost, "/api/admin/reload", "Bearer " + token, true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"ADMIN_TOKEN": tt.adminToken})
+			deps := testDeps(cfg, &fake.Generator{}, &fake.Warehouse{Schema: testSchema})
+			if tt.reloadable {
+				reloader, err := shared.NewConfigReloader(func() (*shared.Config, error) { return cfg, nil })
+				if err != nil {
+					t.Fatal(err)
+				}
+				deps.Reloader = reloader
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			NewAPI(deps).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAdminReloadReportsChanges(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"ADMIN_TOKEN": "admin-secret", "RATE_LIMIT": "60"})
+	next := *cfg
+	next.RateLimit = 120
+	loads := 0
+	reloader, err := shared.NewConfigReloader(func() (*shared.Config, error) {
+		loads++
+		if loads == 1 {
+			return cfg, nil
+		}
+		return &next, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := testDeps(cfg, &fake.Generator{}, &fake.Warehouse{Schema: testSchema})
+	deps.LoadConfig = func() (*shared.Config, error) { return reloader.Config(), nil }
+	deps.Reloader = reloader
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	NewAPI(deps).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Changes []shared.ConfigChange `json:"changes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := shared.ConfigChange{Key: "RATE_LIMIT", Old: "60", New: "120", Applied: true}
+	if len(resp.Changes) != 1 || resp.Changes[0] != want {
+		t.Errorf("changes = %+v, want [%+v]", resp.Changes, want)
+	}
+	if got := reloader.Config().RateLimit; got != 120 {
+		t.Errorf("live RATE_LIMIT = %d, want 120", got)
+	}
+}
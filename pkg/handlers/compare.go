@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// answerComparison runs sql over the current and previous windows of a
+// compare request, in parallel, and responds with the rows merged and their
+// deltas. base carries the response fields answer already knows.
+func (h *Query) answerComparison(w http.ResponseWriter, r *http.Request, cfg *shared.Config, warehouse shared.Warehouse, pipeline *shared.Pipeline, schema *shared.Schema, sql string, spec shared.CompareSpec, now time.Time, minGroup int, timing *serverTiming, slow *shared.SlowQuery, base QueryResponse) {
+	log := shared.Logger(r.Context())
+	fail := func(status int, err error, sql string) {
+		h.recordRequest(r, cfg, slow, err)
+		resp := base
+		resp.SQL, resp.Error, resp.Code, resp.Timings = shared.FormatSQL(sql), err.Error(), string(nlerrors.CodeOf(err)), timing.result()
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+
+	// Rows are matched across windows by group, so there must be groups
+	if shared.IsRowSelect(sql) {
+		log.Warn("Compare of a row select", shared.SQLFields(sql))
+		fail(http.StatusBadRequest, errors.New("compare needs a question that aggregates, e.g. a total or a breakdown"), sql)
+		return
+	}
+	column, err := shared.CompareColumn(sql, schema, spec.Column)
+	if err != nil {
+		log.Warn("No column to compare on", "error", err, shared.SQLFields(sql))
+		fail(http.StatusBadRequest, err, sql)
+		return
+	}
+	// Validated before generation
+	current, previous, _ := shared.ResolveWindows(spec, now)
+	current.SQL = shared.WindowSQL(sql, column, current)
+	previous.SQL = shared.WindowSQL(sql, column, previous)
+	slow.SQL = current.SQL
+	slow.Columns = shared.ReferencedColumns(current.SQL, schema)
+	base.ReferencedColumns = slow.Columns
+	log.Info("Comparing windows", "column", column, "current_from", current.From, "current_to", current.To, "previous_from", previous.From, "previous_to", previous.To)
+
+	for _, q := range []string{current.SQL, previous.SQL} {
+		if err := shared.CheckEstimatedCost(warehouse, q, cfg); err != nil {
+			if nlerrors.CodeOf(err) == nlerrors.CodeTooExpensive {
+				log.Warn("Query rejected by estimate", shared.Phase(shared.PhaseExecute), "error", err, shared.SQLFields(q))
+				fail(nlerrors.HTTPStatus(err), err, q)
+				return
+			}
+			log.Warn("Cost estimate failed, executing anyway", shared.Phase(shared.PhaseExecute), "error", err)
+		}
+	}
+
+	dbStart := time.Now()
+	var results [2]*shared.TinybirdResponse
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i, q := range []string{current.SQL, previous.SQL} {
+		wg.Add(1)
+		go func(i int, q string) {
+			defer wg.Done()
+			results[i], errs[i] = warehouse.ExecuteQuery(q)
+		}(i, q)
+	}
+	wg.Wait()
+	dbDuration := time.Since(dbStart)
+	timing.add(shared.PhaseExecute, dbDuration)
+	slow.ExecuteMs = dbDuration.Milliseconds()
+
+	for i, q := range []string{current.SQL, previous.SQL} {
+		if errs[i] != nil {
+			slow.SQL = q
+			h.notifyWarehouseError(cfg, slow, errs[i])
+			log.Error("Tinybird error", shared.Phase(shared.PhaseExecute), "error", errs[i], "code", nlerrors.CodeOf(errs[i]), shared.SQLFields(q), shared.DurationMs(dbDuration))
+			fail(nlerrors.HTTPStatus(errs[i]), errs[i], q)
+			return
+		}
+	}
+
+	// Each window is held to the budget on its own, like any query
+	for i, q := range []string{current.SQL, previous.SQL} {
+		stats := results[i].Stats()
+		slow.Rows += results[i].Rows
+		slow.RowsRead += stats.RowsRead
+		slow.BytesRead += stats.BytesRead
+		err := shared.CheckQueryCost(stats, cfg)
+		if err == nil && minGroup > 0 {
+			err = shared.CheckGroupSizes(results[i], minGroup, cfg.MinGroupPolicy)
+		}
+		if err != nil {
+			log.Warn("Query results withheld", shared.Phase(shared.PhaseExecute), "error", err, "code", nlerrors.CodeOf(err), shared.SQLFields(q))
+			fail(nlerrors.HTTPStatus(err), err, q)
+			return
+		}
+	}
+	log.Info("Query executed",
+		shared.Phase(shared.PhaseExecute),
+		"rows", results[0].Rows,
+		"previous_rows", results[1].Rows,
+		"rows_read", slow.RowsRead,
+		"bytes_read", slow.BytesRead,
+		shared.DurationMs(dbDuration),
+	)
+	current.Rows, previous.Rows = results[0].Rows, results[1].Rows
+
+	// Masking and presentation run on each window before the merge, so
+	// masked values never reach a delta
+	pipeline.Process(results[0])
+	pipeline.Process(results[1])
+	h.recordRequest(r, cfg, slow, nil)
+
+	data, keys, measures := shared.CompareResults(sql, results[0], results[1])
+	current.SQL, previous.SQL = shared.FormatSQL(current.SQL), shared.FormatSQL(previous.SQL)
+	resp := base
+	resp.SQL = current.SQL
+	resp.Data, resp.Rows = data, len(data)
+	resp.MaskedColumns = pipeline.MaskedColumns()
+	resp.Display = pipeline.Display(shared.ComparisonDisplay(base.Display, measures))
+	resp.Comparison = &shared.Comparison{Column: column, Current: current, Previous: previous, Keys: keys, Measures: measures}
+	resp.Timings = timing.result()
+	json.NewEncoder(w).Encode(resp)
+}
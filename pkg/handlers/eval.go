@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Eval serves GET/POST /api/eval: runs the eval suite. With ?stream=true or
+// Accept: text/event-stream, results are sent as server-sent events as each
+// case finishes. Runs are recorded for EvalMetrics.
+type Eval struct {
+	Deps
+
+	// metrics survives warm invocations so counters accumulate across runs
+	metrics *shared.EvalMetrics
+}
+
+// NewEval creates the eval handler
+func NewEval(deps Deps) *Eval {
+	return &Eval{Deps: deps, metrics: shared.NewEvalMetrics()}
+}
+
+func (h *Eval) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	start := time.Now()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	// A scraper polling for metrics would start a full run every scrape
+	if r.URL.Query().Get("format") == "prometheus" {
+		log.Warn("Eval metrics requested from the run endpoint")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "format=prometheus is served by GET /api/eval/metrics, which reports recorded runs without starting one"})
+		return
+	}
+
+	log.Info("Running evals")
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+	if err := shared.Features.SetConfig(cfg.FeatureFlags); err != nil {
+		log.Error("Failed to load feature flags", "error", err)
+	}
+	// Evals compare executed results, so they need execution on
+	if err := shared.ServiceMode.CheckExecute(cfg); err != nil {
+		log.Warn("Evals refused", "error", err)
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "code": string(nlerrors.CodeOf(err))})
+		return
+	}
+
+	// Initialize clients
+	tinybird := h.warehouse(r, cfg)
+	openai := h.NewGenerator(cfg)
+
+	// Fetch schema, reusing it across warm invocations for SCHEMA_CACHE_TTL
+	schemaStart := time.Now()
+	schema, cached, err := h.schema(r, cfg, tinybird)
+	if err != nil {
+		log.Error("Failed to fetch schema", "error", err, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch schema"})
+		return
+	}
+	openai.SetSchema(schema)
+	log.Debug("Schema loaded", "tables", len(schema.Datasources), "cached", cached, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+
+	// Run evals
+	evalStart := time.Now()
+	opts := shared.EvalOptions{SchemaVersion: schema.Version(), Stagger: cfg.EvalStagger}
+	if r.URL.Query().Get("smoke") == "true" && shared.Features.Enabled(shared.FlagSmokeEvals) {
+		opts.Cases = append(shared.DefaultEvalCases(), shared.SmokeEvalCases(schema)...)
+	}
+	if r.URL.Query().Get("verify") == "true" {
+		opts.VerifyExpected = schema
+	}
+	// Once streaming starts the status is sent, so everything from here on,
+	// failures included, is reported in events
+	var events *eventStream
+	wantsStream := r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if wantsStream {
+		if opts.Cases == nil {
+			opts.Cases = shared.DefaultEvalCases()
+		}
+		total, completed := len(opts.Cases), 0
+		events = newEventStream(w)
+		events.send("start", map[string]int{"total": total})
+		opts.OnResult = func(index int, result shared.EvalResult) {
+			completed++
+			events.send("result", evalProgress{Index: index, Completed: completed, Total: total, Result: result})
+		}
+	}
+	results, evalErr := shared.RunEvalsWithOptions(openai, tinybird, opts)
+	if r.URL.Query().Get("diagnose") == "true" && shared.Features.Enabled(shared.FlagEvalDiagnosis) {
+		shared.DiagnoseFailures(h.NewCompleter(cfg), results, nil)
+	}
+	summary := shared.ComputeSummary(results)
+	h.metrics.Record(results, time.Since(evalStart))
+	model := ""
+	if len(results) > 0 {
+		model = results[0].Model
+	}
+	h.Notifier.EvalCompleted(cfg, model, summary)
+
+	// Log individual results
+	for _, r := range results {
+		caseLog := log.With(shared.Phase(shared.PhaseEval), "name", r.Name, shared.LogModel, r.Model, shared.LogDurationMs, r.DurationMs)
+		if r.SuspectExpected {
+			caseLog.Warn("Suspect expected SQL", "expected", r.ExpectedSQL, "note", r.VerifyNote)
+		}
+		if r.Skipped {
+			caseLog.Warn("SKIP", "reason", r.Error)
+		} else if r.Passed {
+			caseLog.Info("PASS", shared.SQLFields(r.GeneratedSQL))
+		} else {
+			caseLog.Warn("FAIL", "error", r.Error, "expected", r.ExpectedSQL, "got", r.GeneratedSQL)
+		}
+	}
+
+	log.Info("Eval summary",
+		shared.Phase(shared.PhaseEval),
+		"passed", summary.Passed,
+		"failed", summary.Failed,
+		"total", summary.Total,
+		"pass_rate", summary.PassRate,
+		shared.DurationMs(time.Since(evalStart)),
+		"total_duration_ms", time.Since(start).Milliseconds(),
+	)
+
+	response := map[string]interface{}{
+		"results": results,
+		"summary": summary,
+		"passed":  evalErr == nil,
+	}
+	if evalErr != nil {
+		response["error"] = evalErr.Error()
+	}
+
+	if events != nil {
+		events.send("done", response)
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// EvalMetrics serves GET /api/eval/metrics: the eval runs recorded by an
+// Eval handler in the Prometheus text format. It never runs the suite, so
+// it is cheap enough to scrape.
+type EvalMetrics struct {
+	metrics *shared.EvalMetrics
+}
+
+// NewEvalMetrics creates the metrics handler for the runs eval records
+func NewEvalMetrics(eval *Eval) *EvalMetrics {
+	return &EvalMetrics{metrics: eval.metrics}
+}
+
+func (h *EvalMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		shared.Logger(r.Context()).Warn("Method not allowed", "method", r.Method)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	h.metrics.WriteTo(w)
+}
+
+// evalProgress is the data of a "result" event
+type evalProgress struct {
+	// Index is the case's position in the run; cases finish out of order
+	Index     int               `json:"index"`
+	Completed int               `json:"completed"`
+	Total     int               `json:"total"`
+	Result    shared.EvalResult `json:"result"`
+}
+
+// eventStream writes server-sent events, flushing each one so it reaches
+// the client (through gzip too) as soon as it is sent
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	s := &eventStream{w: w, flusher: flusher}
+	s.flush()
+	return s
+}
+
+// send writes one event with data as its JSON payload
+func (s *eventStream) send(event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		payload, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload)
+	s.flush()
+}
+
+func (s *eventStream) flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+	"github.com/raindrop/nl2sql/pkg/shared/fake"
+)
+
+// TestEvalMetrics checks that scraping reports the recorded run without
+// starting another one
+func TestEvalMetrics(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"ACCESS_FILE": "", "EVAL_STAGGER": "0"})
+	gen := &fake.Generator{}
+	api := NewAPI(testDeps(cfg, gen, &fake.Warehouse{Schema: testSchema, Results: map[string]*shared.TinybirdResponse{}}))
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	if rec := serve("/api/eval/metrics"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "nl2sql_eval_runs_total 0\n") {
+		t.Fatalf("metrics before any run: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := serve("/api/eval?format=prometheus"); rec.Code != http.StatusBadRequest {
+		t.Errorf("format=prometheus on the run endpoint: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if calls := len(gen.Calls()); calls != 0 {
+		t.Fatalf("%d generations before an explicit run", calls)
+	}
+
+	if rec := serve("/api/eval"); rec.Code != http.StatusOK {
+		t.Fatalf("eval run: status %d, body %s", rec.Code, rec.Body)
+	}
+	ran := len(gen.Calls())
+	for i := 0; i < 2; i++ {
+		rec := serve("/api/eval/metrics")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "nl2sql_eval_runs_total 1\n") {
+			t.Errorf("scrape %d: status %d, body %s", i+1, rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("scrape %d: content type %q", i+1, ct)
+		}
+	}
+	if calls := len(gen.Calls()); calls != ran {
+		t.Errorf("scraping ran %d more generations", calls-ran)
+	}
+}
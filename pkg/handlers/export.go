@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// SheetsExportRequest is the body of POST /api/export/sheets
+type SheetsExportRequest struct {
+	Query string `json:"query"`
+	// SpreadsheetID writes into an existing spreadsheet instead of creating one
+	SpreadsheetID string `json:"spreadsheet_id,omitempty"`
+	// Sheet names the tab to write; it is replaced if it exists
+	Sheet string `json:"sheet,omitempty"`
+}
+
+// SheetsExportResponse is the query's SQL plus where its rows were written
+type SheetsExportResponse struct {
+	SQL string `json:"sql"`
+	shared.SheetsExport
+	LimitApplied  int      `json:"limit_applied,omitempty"`
+	MaskedColumns []string `json:"masked_columns,omitempty"`
+}
+
+// ExportSheets serves POST /api/export/sheets: it answers a question
+// through the query handler, so access rules and masking apply, and writes
+// the rows to Google Sheets.
+type ExportSheets struct {
+	Deps
+	query http.Handler
+}
+
+// NewExportSheets creates the Sheets export handler
+func NewExportSheets(deps Deps) *ExportSheets {
+	return &ExportSheets{Deps: deps, query: NewQuery(deps)}
+}
+
+func (h *ExportSheets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+	sheets, err := shared.NewSheetsClient(cfg)
+	if errors.Is(err, shared.ErrSheetsNotConfigured) {
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error("Invalid Sheets configuration", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server configuration error"})
+		return
+	}
+
+	var req SheetsExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "query is required"})
+		return
+	}
+
+	body, _ := json.Marshal(QueryRequest{Query: req.Query})
+	var result QueryResponse
+	if err := serveInProcess(r, h.query, http.MethodPost, body, &result); err != nil {
+		var failed *handlerError
+		if errors.As(err, &failed) {
+			w.WriteHeader(failed.Status)
+			json.NewEncoder(w).Encode(map[string]string{"error": failed.Message, "code": failed.Code})
+			return
+		}
+		log.Error("Query failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "query failed"})
+		return
+	}
+	if result.Error != "" {
+		// A stream that failed part-way; don't export a partial result
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": result.Error, "code": result.Code})
+		return
+	}
+
+	exportStart := time.Now()
+	export, err := sheets.Export(req.Query, req.SpreadsheetID, req.Sheet, result.Data)
+	if err != nil {
+		log.Error("Sheets export failed", "error", err, "spreadsheet_id", req.SpreadsheetID, shared.DurationMs(time.Since(exportStart)))
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to write to Google Sheets"})
+		return
+	}
+	log.Info("Exported to Google Sheets", "spreadsheet_id", export.SpreadsheetID, "sheet", export.Sheet, "rows", export.Rows, shared.DurationMs(time.Since(exportStart)))
+
+	json.NewEncoder(w).Encode(SheetsExportResponse{
+		SQL:           result.SQL,
+		SheetsExport:  *export,
+		LimitApplied:  result.LimitApplied,
+		MaskedColumns: result.MaskedColumns,
+	})
+}
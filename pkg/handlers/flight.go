@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// flightGroup collapses concurrent calls with the same key into one: the
+// first caller runs the function and the others wait for its response.
+// Nothing is cached once the call returns.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	resp *bufferedResponse
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do returns fn's response, running fn only if no call for key is in
+// flight. joined reports whether the response came from another caller.
+func (g *flightGroup) do(key string, fn func() *bufferedResponse) (resp *bufferedResponse, joined bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.resp, true
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	// Release waiters even if fn panics; they get the 500 Recover sends
+	f.resp = &bufferedResponse{header: make(http.Header), status: http.StatusInternalServerError}
+	json.NewEncoder(&f.resp.body).Encode(map[string]string{"error": "internal error"})
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.resp = fn()
+	return f.resp, false
+}
+
+// flightKey identifies requests that would get the same response: same
+// caller permissions, config, question, reference time, tables hint and
+// settings. Requests without as_of differ only by when they arrived, which
+// doesn't matter for requests that overlap.
+func (h *Query) flightKey(r *http.Request, cfg *shared.Config, req QueryRequest, loc *time.Location) string {
+	keyID := ""
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		keyID = principal.KeyID
+	}
+	return strings.Join([]string{
+		keyID,
+		shared.SchemaCacheKey(cfg),
+		req.Query,
+		loc.String(),
+		req.AsOf,
+		strconv.FormatBool(req.Explain),
+		strings.Join(req.Tables, ","),
+		strconv.Itoa(req.Page),
+		strconv.Itoa(req.PageSize),
+		cfg.ClickHouseSettings,
+		compareKey(req.Compare),
+	}, "\x00")
+}
+
+// writeTo replays the buffered response to w
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// compareKey identifies a compare request's windows; "" for none
+func compareKey(spec *shared.CompareSpec) string {
+	if spec == nil {
+		return ""
+	}
+	b, _ := json.Marshal(spec)
+	return string(b)
+}
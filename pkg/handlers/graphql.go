@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/raindrop/nl2sql/pkg/graphql"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// GraphQL serves /api/graphql, a GraphQL facade over the REST handlers:
+//
+//	query { query(question: "total revenue") { sql rows data } schema { datasources { name } } }
+//
+// Each resolver calls the corresponding handler in-process with the
+// caller's context, so API keys, masking, cost limits and usage accounting
+// apply exactly as on the REST endpoints.
+type GraphQL struct {
+	Deps
+	query  http.Handler
+	schema http.Handler
+}
+
+// NewGraphQL creates the GraphQL handler
+func NewGraphQL(deps Deps) *GraphQL {
+	return &GraphQL{Deps: deps, query: NewQuery(deps), schema: NewSchema(deps)}
+}
+
+// errNoHistory is returned by resolvers for data the server doesn't keep
+var errNoHistory = graphql.CodedError{Code: "not_available", Err: errors.New("this server does not store query history or saved queries")}
+
+func (h *GraphQL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	var req graphql.Request
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(graphql.Response{Errors: []graphql.Error{{Message: "invalid variables"}}})
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(graphql.Response{Errors: []graphql.Error{{Message: "invalid request body"}}})
+			return
+		}
+	default:
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(graphql.Response{Errors: []graphql.Error{{Message: "method not allowed"}}})
+		return
+	}
+
+	resp := graphql.Execute(r.Context(), req, map[string]graphql.Resolver{
+		"query": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			question, _ := args["question"].(string)
+			explain, _ := args["explain"].(bool)
+			timezone, _ := args["timezone"].(string)
+			asOf, _ := args["asOf"].(string)
+			var tables []string
+			if list, ok := args["tables"].([]interface{}); ok {
+				for _, t := range list {
+					if name, ok := t.(string); ok {
+						tables = append(tables, name)
+					}
+				}
+			}
+			body, _ := json.Marshal(QueryRequest{Query: question, Explain: explain, Timezone: timezone, AsOf: asOf, Tables: tables})
+			var out QueryResponse
+			if err := serveInProcess(r.WithContext(ctx), h.query, http.MethodPost, body, &out); err != nil {
+				return nil, codedError(err)
+			}
+			if out.Error != "" {
+				return nil, graphql.CodedError{Code: out.Code, Err: errors.New(out.Error)}
+			}
+			return out, nil
+		},
+		"schema": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			var out shared.Schema
+			if err := serveInProcess(r.WithContext(ctx), h.schema, http.MethodGet, nil, &out); err != nil {
+				return nil, codedError(err)
+			}
+			return out, nil
+		},
+		"history": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			return nil, errNoHistory
+		},
+		"savedQueries": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			return nil, errNoHistory
+		},
+	})
+	if resp.Data == nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	log.Info("GraphQL request", "errors", len(resp.Errors))
+	json.NewEncoder(w).Encode(resp)
+}
+
+// codedError reports a failed handler's error code in extensions.code
+func codedError(err error) error {
+	var failed *handlerError
+	if errors.As(err, &failed) && failed.Code != "" {
+		return graphql.CodedError{Code: failed.Code, Err: err}
+	}
+	return err
+}
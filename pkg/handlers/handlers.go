@@ -0,0 +1,205 @@
+// Package handlers implements the HTTP API. The Vercel functions under api/
+// and `nl2sql serve` both serve the router from NewAPI, so every deployment
+// runs the same code path and middleware; only the injected Deps differ.
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Deps are the dependencies injected into every handler
+type Deps struct {
+	// LoadConfig resolves the configuration for a request. Serverless
+	// functions re-read the environment; a long-running server returns
+	// its live (reloadable) config.
+	LoadConfig func() (*shared.Config, error)
+
+	// Reloader re-resolves the live config for POST /api/admin/reload.
+	// Serverless functions re-read the environment on every request, so
+	// only nl2sql serve sets it; nil disables the endpoint.
+	Reloader *shared.ConfigReloader
+
+	NewGenerator func(*shared.Config) shared.SchemaGenerator
+	NewWarehouse func(*shared.Config) shared.Warehouse
+	NewCompleter func(*shared.Config) shared.Completer
+	// NewEmbedder embeds questions for FEW_SHOT_EXAMPLES; nil disables them
+	NewEmbedder func(*shared.Config) shared.Embedder
+
+	// Schemas caches fetched schemas for SCHEMA_CACHE_TTL; nil disables caching
+	Schemas *shared.SchemaCache
+
+	// Usage records per-request spend for /api/admin/usage; nil disables it
+	Usage *shared.UsageLedger
+
+	// Refusals records refused questions for /api/admin/refusals; nil disables it
+	Refusals *shared.RefusalLog
+
+	// History records answered questions for FEW_SHOT_EXAMPLES; nil disables it
+	History *shared.HistoryLog
+
+	// Notifier delivers WEBHOOK_URLS events; nil disables webhooks
+	Notifier *shared.Notifier
+
+	// Jobs runs async queries in the background. Serverless functions
+	// can't work after responding, so only nl2sql serve sets it; nil, or
+	// JOB_WORKERS=0, disables ?async=true.
+	Jobs *shared.JobQueue
+
+	// JWKS caches JWT_ISSUER's signing keys; nil fetches them for every
+	// JWT
+	JWKS *shared.JWKSCache
+
+	// Traces keeps request trace bundles for /api/admin/traces; nil
+	// disables tracing
+	Traces *shared.TraceStore
+
+	// Shadows runs SHADOW_FILE comparisons after the response is written,
+	// so, like Jobs, only nl2sql serve sets it; nil disables shadowing
+	Shadows *shared.ShadowRunner
+}
+
+// DefaultDeps loads config from the environment and talks to OpenAI and Tinybird
+func DefaultDeps() Deps {
+	return Deps{
+		LoadConfig:   shared.LoadConfig,
+		NewGenerator: func(cfg *shared.Config) shared.SchemaGenerator { return shared.NewOpenAIClient(cfg) },
+		NewWarehouse: func(cfg *shared.Config) shared.Warehouse { return shared.NewTinybirdClient(cfg) },
+		NewCompleter: func(cfg *shared.Config) shared.Completer { return shared.NewOpenAIClient(cfg) },
+		NewEmbedder:  func(cfg *shared.Config) shared.Embedder { return shared.NewOpenAIClient(cfg) },
+		Schemas:      shared.NewSchemaCache(),
+		Usage:        shared.NewUsageLedger(),
+		Refusals:     shared.NewRefusalLog(),
+		History:      shared.NewHistoryLog(),
+		JWKS:         shared.NewJWKSCache(),
+		Traces:       shared.NewTraceStore(),
+		Notifier:     shared.NewNotifier(),
+	}
+}
+
+// schema returns the warehouse schema, from the cache when it is fresh.
+// Freshly fetched schemas are recorded as versions; when tables or columns
+// changed since the last fetch it logs the change and sends
+// EventSchemaChanged.
+func (d Deps) schema(r *http.Request, cfg *shared.Config, warehouse shared.Warehouse) (*shared.Schema, bool, error) {
+	if d.Schemas == nil {
+		schema, err := warehouse.FetchSchema()
+		return schema, false, err
+	}
+	key := shared.SchemaCacheKey(cfg)
+	schema, hit, err := d.Schemas.Get(key, cfg.SchemaCacheTTL, warehouse)
+	if err != nil || hit {
+		return schema, hit, err
+	}
+	if change := d.Schemas.Record(key, schema); change != nil {
+		shared.Logger(r.Context()).Warn("Schema changed",
+			"from", change.From,
+			"to", change.To,
+			"breaking", change.Breaking(),
+			"added_tables", change.AddedTables,
+			"removed_tables", change.RemovedTables,
+			"added_columns", change.AddedColumns,
+			"removed_columns", change.RemovedColumns,
+			"retyped_columns", change.RetypedColumns,
+		)
+		d.Notifier.Notify(cfg, shared.EventSchemaChanged, change)
+	}
+	return schema, false, nil
+}
+
+// warehouse creates the warehouse client for a request. Queries it sends
+// are tagged with the request ID and tenant when it supports QUERY_TAG,
+// and traced when the request is.
+func (d Deps) warehouse(r *http.Request, cfg *shared.Config) shared.Warehouse {
+	warehouse := d.NewWarehouse(cfg)
+	traced(r, warehouse)
+	if tagger, ok := warehouse.(shared.QueryTagger); ok {
+		tenant := ""
+		if principal := PrincipalFrom(r.Context()); principal != nil {
+			tenant = principal.Tenant
+		}
+		tagger.TagQueries(RequestIDFrom(r.Context()), tenant)
+	}
+	return warehouse
+}
+
+// config returns the configuration stored by WithConfig, or loads it and
+// applies logging settings. On failure it writes a 500 response and
+// returns nil.
+func (d Deps) config(w http.ResponseWriter, r *http.Request) *shared.Config {
+	if cfg, ok := r.Context().Value(configKey).(*shared.Config); ok {
+		return cfg
+	}
+	cfg, err := d.LoadConfig()
+	if err != nil {
+		shared.Logger(r.Context()).Error("Failed to load config", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server configuration error"})
+		return nil
+	}
+	if err := shared.SetupLogging(cfg); err != nil {
+		shared.Logger(r.Context()).Error("Failed to configure logging", "error", err)
+	}
+	return cfg
+}
+
+// serveInProcess calls handler in-process with r's context (config,
+// principal, request ID) and decodes the JSON response into out. Non-2xx
+// responses are returned as *handlerError.
+func serveInProcess(r *http.Request, handler http.Handler, method string, body []byte, out interface{}) error {
+	sub, err := http.NewRequestWithContext(r.Context(), method, r.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sub.Header = r.Header.Clone()
+	sub.Header.Del("Accept-Encoding")
+
+	rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(rec, sub)
+
+	if rec.status >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		if json.Unmarshal(rec.body.Bytes(), &failure) == nil && failure.Error != "" {
+			return &handlerError{Status: rec.status, Code: failure.Code, Message: failure.Error}
+		}
+		return &handlerError{Status: rec.status, Message: http.StatusText(rec.status)}
+	}
+	return json.Unmarshal(rec.body.Bytes(), out)
+}
+
+// bufferedResponse collects a handler's response in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wrote {
+		b.status, b.wrote = status, true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wrote = true
+	return b.body.Write(p)
+}
+
+// handlerError is a failed in-process response
+type handlerError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *handlerError) Error() string { return e.Message }
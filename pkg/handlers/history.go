@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// fewShot shows generator up to FEW_SHOT_EXAMPLES of the tenant's earlier
+// questions most like question, with their SQL. It returns the question's
+// embedding and embedding model for recordHistory, or nil when history is
+// off or embedding failed; generation goes ahead either way.
+func (h *Query) fewShot(r *http.Request, cfg *shared.Config, generator shared.Generator, tenant, session, question string) ([]float64, string) {
+	eg, ok := generator.(shared.ExampleGenerator)
+	if !ok || cfg.FewShotExamples == 0 || h.NewEmbedder == nil || h.History == nil {
+		return nil, ""
+	}
+	log := shared.Logger(r.Context())
+	embedder := h.NewEmbedder(cfg)
+	traced(r, embedder)
+	start := time.Now()
+	embedding, usage, err := embedder.Embed(question)
+	if err != nil {
+		log.Warn("Failed to embed question, generating without examples", "error", err)
+		return nil, ""
+	}
+	model := embedder.EmbeddingModel()
+	examples, err := h.History.Examples(tenant, session, model, embedding, cfg.FewShotExamples, cfg.HistoryFile)
+	if err != nil {
+		log.Error("Failed to read history", "error", err)
+		return embedding, model
+	}
+	eg.SetExamples(examples)
+	fields := []any{"examples", len(examples), "embedding_model", model, "embedding_tokens", usage.InputTokens, shared.DurationMs(time.Since(start))}
+	if len(examples) > 0 {
+		fields = append(fields, "top_similarity", examples[0].Similarity)
+	}
+	log.Info("Few-shot examples selected", fields...)
+	return embedding, model
+}
+
+// recordHistory stores a question whose SQL returned rows, for later
+// few-shot selection. sql is the SQL as generated, before server rewrites.
+func (h *Query) recordHistory(r *http.Request, cfg *shared.Config, tenant, session, question, sql string, embedding []float64, model string) {
+	if embedding == nil {
+		return
+	}
+	err := h.History.Record(shared.HistoryRecord{
+		Tenant:         tenant,
+		Session:        session,
+		Question:       question,
+		SQL:            sql,
+		EmbeddingModel: model,
+		Embedding:      embedding,
+	}, cfg.HistoryFile)
+	if err != nil {
+		shared.Logger(r.Context()).Error("Failed to record history", "error", err)
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+	"github.com/raindrop/nl2sql/pkg/shared/fake"
+)
+
+// integrationAPI serves NewAPI with the production deps, whose real OpenAI
+// and Tinybird clients are pointed at openai and a Tinybird double of wh
+// through the environment, on top of env
+func integrationAPI(t *testing.T, openai *fake.OpenAIServer, wh *fake.Warehouse, env map[string]string) http.Handler {
+	t.Helper()
+	tinybird := fake.NewTinybirdServer(wh)
+	t.Cleanup(tinybird.Close)
+	settings := fake.Env(openai, tinybird)
+	for k, v := range env {
+		settings[k] = v
+	}
+	testConfig(t, settings)
+	return NewAPI(DefaultDeps())
+}
+
+func TestIntegrationQuery(t *testing.T) {
+	const (
+		countSQL  = "SELECT count() AS orders FROM orders"
+		sellerSQL = "SELECT seller_id, price FROM orders LIMIT 10"
+		starSQL   = "SELECT * FROM orders LIMIT 10"
+		// starRun is starSQL as executed, in a stable order
+		starRun = "SELECT * FROM orders ORDER BY order_id, seller_id, price LIMIT 10"
+	)
+	accessFile := filepath.Join(t.TempDir(), "access.json")
+	acl := `{"keys": {"sk_all": {"tenant": "acme", "allow": ["orders.*"]},
+	                  "sk_ids": {"tenant": "beta", "allow": ["orders.order_id", "orders.seller_id"]}}}`
+	if err := os.WriteFile(accessFile, []byte(acl), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		question string
+		// key authenticates against the access file; empty runs without one
+		key          string
+		openaiStatus int
+		tinybirdDown bool
+		wantStatus   int
+		wantCode     string
+		wantRows     int
+		wantExecuted bool
+	}{
+		{name: "answers a question", question: "how many orders", wantStatus: http.StatusOK, wantRows: 1, wantExecuted: true},
+		{name: "answers a key with every column", question: "orders", key: "sk_all", wantStatus: http.StatusOK, wantRows: 1, wantExecuted: true},
+		{name: "reports a refused question", question: "what is the weather", wantStatus: http.StatusBadRequest, wantCode: string(nlerrors.CodeUnsupportedQuery)},
+		{name: "rejects a response without a tool call", question: "something else", wantStatus: http.StatusInternalServerError, wantCode: string(nlerrors.CodeGrammarViolation)},
+		{name: "reports an OpenAI error", question: "how many orders", openaiStatus: http.StatusServiceUnavailable, wantStatus: http.StatusInternalServerError},
+		{name: "reports Tinybird down", question: "how many orders", tinybirdDown: true, wantStatus: http.StatusInternalServerError},
+		{name: "rejects a restricted column", question: "prices by seller", key: "sk_ids", wantStatus: http.StatusInternalServerError, wantCode: string(nlerrors.CodeGrammarViolation)},
+		{name: "rejects SELECT * over a restricted column", question: "orders", key: "sk_ids", wantStatus: http.StatusInternalServerError, wantCode: string(nlerrors.CodeGrammarViolation)},
+		{name: "rejects an unknown key", question: "how many orders", key: "sk_nope", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openai := fake.NewOpenAIServer()
+			defer openai.Close()
+			openai.SQL = map[string]string{"how many orders": countSQL, "prices by seller": sellerSQL, "orders": starSQL}
+			openai.Refusals = map[string]string{"what is the weather": "no weather data"}
+			openai.Status = tt.openaiStatus
+
+			wh := &fake.Warehouse{Schema: testSchema, Results: map[string]*shared.TinybirdResponse{
+				countSQL:  fake.Result(map[string]interface{}{"orders": 42}),
+				sellerSQL: fake.Result(map[string]interface{}{"seller_id": "s1", "price": 10}),
+				starRun:   fake.Result(map[string]interface{}{"order_id": "o1", "seller_id": "s1", "price": 10}),
+			}}
+			if tt.tinybirdDown {
+				wh.Err = errors.New("tinybird down")
+			}
+			env := map[string]string{"ACCESS_FILE": ""}
+			if tt.key != "" {
+				env["ACCESS_FILE"] = accessFile
+			}
+			api := integrationAPI(t, openai, wh, env)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/query", strings.NewReader(`{"query": "`+tt.question+`"}`))
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var resp QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if resp.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", resp.Code, tt.wantCode)
+			}
+			if resp.Rows != tt.wantRows {
+				t.Errorf("rows = %d, want %d", resp.Rows, tt.wantRows)
+			}
+			if executed := len(wh.Queries()) > 0; executed != tt.wantExecuted {
+				t.Errorf("executed = %v, want %v; queries %q", executed, tt.wantExecuted, wh.Queries())
+			}
+			if tt.wantStatus >= 300 && resp.Error == "" {
+				t.Error("error response without an error message")
+			}
+		})
+	}
+}
+
+func TestIntegrationGrammarFollowsAccess(t *testing.T) {
+	accessFile := filepath.Join(t.TempDir(), "access.json")
+	acl := `{"keys": {"sk_ids": {"tenant": "beta", "allow": ["orders.order_id", "orders.seller_id"]}}}`
+	if err := os.WriteFile(accessFile, []byte(acl), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	openai := fake.NewOpenAIServer()
+	defer openai.Close()
+	openai.SQL = map[string]string{"how many orders": "SELECT count() AS orders FROM orders"}
+	wh := &fake.Warehouse{Schema: testSchema, Results: map[string]*shared.TinybirdResponse{
+		"SELECT count() AS orders FROM orders": fake.Result(map[string]interface{}{"orders": 42}),
+	}}
+	api := integrationAPI(t, openai, wh, map[string]string{"ACCESS_FILE": accessFile})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/query", strings.NewReader(`{"query": "how many orders"}`))
+	req.Header.Set("Authorization", "Bearer sk_ids")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body %s", rec.Code, rec.Body)
+	}
+
+	requests := openai.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d OpenAI requests, want 1", len(requests))
+	}
+	var grammar string
+	for _, tool := range requests[0].Tools {
+		if tool.Format != nil && tool.Format.Definition != "" {
+			grammar = tool.Format.Definition
+		}
+	}
+	if grammar == "" {
+		t.Fatalf("request has no grammar tool: %+v", requests[0].Tools)
+	}
+	if strings.Contains(grammar, `"price"`) {
+		t.Error("grammar offers a column the key may not see")
+	}
+	if strings.Contains(grammar, "| column | star") {
+		t.Error("grammar offers SELECT * over a partly visible table")
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// JobAccepted is the response to POST /api/query?async=true
+type JobAccepted struct {
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"`
+	StatusURL string `json:"status_url"`
+}
+
+// jobPayload is what an async query job needs to run, possibly after a
+// restart: the request and what ServeHTTP resolved from it
+type jobPayload struct {
+	Request   QueryRequest `json:"request"`
+	Now       time.Time    `json:"now"`
+	RequestID string       `json:"request_id,omitempty"`
+	// Tenant and Subject are set for JWT callers, whose token may have
+	// expired by the time the job runs; their principal is rebuilt from
+	// the tenant
+	Tenant  string `json:"tenant,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// jobOutcome receives the error recordRequest records for a job's answer
+type jobOutcome struct {
+	err error
+}
+
+// submitJob queues req to be answered by a background worker and responds
+// 202 with the job ID
+func (h *Query) submitJob(w http.ResponseWriter, r *http.Request, req QueryRequest, now time.Time) {
+	log := shared.Logger(r.Context())
+	if !h.Jobs.Enabled() {
+		log.Warn("Async query without a job queue")
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "async queries need a long-running server (nl2sql serve) with JOB_WORKERS"})
+		return
+	}
+
+	keyID := ""
+	p := jobPayload{Request: req, Now: now, RequestID: RequestIDFrom(r.Context())}
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		keyID = principal.KeyID
+		if principal.Subject != "" {
+			p.Tenant, p.Subject = principal.Tenant, principal.Subject
+		}
+	}
+	payload, _ := json.Marshal(p)
+	job, err := h.Jobs.Submit(keyID, payload)
+	if errors.Is(err, shared.ErrJobQueueFull) {
+		log.Warn("Job queue full")
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to queue job", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "failed to queue job"})
+		return
+	}
+
+	statusURL := "/api/jobs/" + job.ID
+	log.Info("Query queued", "job_id", job.ID)
+	w.Header().Set("Location", statusURL)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(JobAccepted{JobID: job.ID, Status: job.Status, StatusURL: statusURL})
+}
+
+// RunJob is the shared.JobRunner for async queries. It rebuilds what the
+// middleware put on the original request from the live config: the
+// request ID for logs and the principal, looked up again by key (or, for
+// a JWT caller, by tenant) so a revoked key's queued jobs don't run. The
+// job has no deadline, so REQUEST_TIMEOUT doesn't apply.
+func (h *Query) RunJob(job shared.Job, payload json.RawMessage) shared.JobResult {
+	var p jobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return jobError(http.StatusInternalServerError, "invalid job payload")
+	}
+	cfg, err := h.LoadConfig()
+	if err != nil {
+		return jobError(http.StatusInternalServerError, "server configuration error")
+	}
+	// The settings are checked against the live config, whose limits may
+	// have been lowered since the job was queued
+	if cfg, err = shared.WithRequestSettings(cfg, p.Request.Settings); err != nil {
+		return jobError(http.StatusBadRequest, err.Error())
+	}
+	if err := shared.Features.SetConfig(cfg.FeatureFlags); err != nil {
+		shared.Logger(context.Background()).Error("Failed to load feature flags", "error", err)
+	}
+	// Jobs queued before maintenance began wait for no one, so they fail
+	if err := shared.ServiceMode.CheckGenerate(cfg); err != nil {
+		return jobError(nlerrors.HTTPStatus(err), err.Error())
+	}
+
+	outcome := &jobOutcome{}
+	ctx := context.WithValue(context.Background(), requestIDKey, p.RequestID)
+	ctx = context.WithValue(ctx, jobOutcomeKey, outcome)
+	ctx = shared.ContextWithLogAttrs(ctx, shared.LogRequestID, p.RequestID, "job_id", job.ID, "attempt", job.Attempts)
+	if job.Key != "" && (cfg.AccessFile != "" || p.Subject != "") {
+		var acl *shared.AccessList
+		if cfg.AccessFile != "" {
+			if acl, err = shared.LoadAccessList(cfg.AccessFile); err != nil {
+				return jobError(http.StatusInternalServerError, "server configuration error")
+			}
+		}
+		principal, err := jobPrincipal(cfg, acl, job.Key, p)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, shared.ErrForbidden) {
+				status = http.StatusForbidden
+			}
+			return jobError(status, err.Error())
+		}
+		ctx = withPrincipal(ctx, principal)
+	}
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/api/query", nil)
+
+	rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	h.answer(rec, r, cfg, p.Request, p.Now, time.Now())
+	return shared.JobResult{Status: rec.status, Body: rec.body.Bytes(), Err: outcome.err}
+}
+
+// jobPrincipal looks up the principal that submitted a job under the live
+// config. A key must still have the query role; a JWT's roles were checked
+// when the job was submitted.
+func jobPrincipal(cfg *shared.Config, acl *shared.AccessList, keyID string, p jobPayload) (*shared.Principal, error) {
+	if p.Subject == "" {
+		principal, ok := acl.ByKeyID(keyID)
+		if !ok {
+			return nil, shared.ErrUnauthorized
+		}
+		if !principal.HasRole(shared.RoleQuery) {
+			return nil, fmt.Errorf("%w: needs role %s", shared.ErrForbidden, shared.RoleQuery)
+		}
+		return principal, nil
+	}
+	// JWTs may have been turned off since
+	if cfg.JWTIssuer == "" || shared.JWTKeyID(cfg.JWTIssuer, p.Subject) != keyID {
+		return nil, shared.ErrUnauthorized
+	}
+	principal, err := acl.TenantPrincipal(p.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	principal.Subject, principal.KeyID = p.Subject, keyID
+	principal.Roles = []string{shared.RoleQuery}
+	return principal, nil
+}
+
+// jobError is a job that failed before it could be answered
+func jobError(status int, message string) shared.JobResult {
+	body, _ := json.Marshal(QueryResponse{Error: message})
+	return shared.JobResult{Status: status, Body: body}
+}
+
+// Jobs serves GET /api/jobs/{id}: the status of an async query and, once
+// it finished, its response
+type Jobs struct {
+	Deps
+}
+
+// NewJobs creates the job status handler
+func NewJobs(deps Deps) *Jobs {
+	return &Jobs{Deps: deps}
+}
+
+func (h *Jobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	// Jobs are only visible to the API key that submitted them; anyone
+	// else gets the same 404 as for an unknown ID
+	id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	keyID := ""
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		keyID = principal.KeyID
+	}
+	var job shared.Job
+	found := false
+	if id != "" && h.Jobs != nil {
+		job, found = h.Jobs.Get(id, keyID)
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "job not found"})
+		return
+	}
+	json.NewEncoder(w).Encode(job)
+}
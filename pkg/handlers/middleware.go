@@ -0,0 +1,393 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Middleware wraps a handler with a cross-cutting concern
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h so that the first middleware is the outermost
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	configKey
+	principalKey
+	jobOutcomeKey
+	traceKey
+)
+
+// RequestIDFrom returns the request ID set by the RequestID middleware
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// RequestID propagates the caller's X-Request-ID or assigns a new one, and
+// echoes it in the response
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = shared.ContextWithLogAttrs(ctx, shared.LogRequestID, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Recover turns a panic into a 500 JSON response instead of a dropped connection
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				shared.Logger(r.Context()).Error("Handler panic", "panic", v, "path", r.URL.Path, "stack", string(debug.Stack()))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "internal error"})
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CORS allows cross-origin calls with the given methods and answers preflight requests
+func CORS(methods ...string) Middleware {
+	allow := strings.Join(append(methods, http.MethodOptions), ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", allow)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithConfig loads the configuration once per request and makes it
+// available to later middleware and the handler
+func WithConfig(deps Deps) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := deps.config(w, r)
+			if cfg == nil {
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), configKey, cfg)))
+		})
+	}
+}
+
+// AdminOnly requires the admin bearer token, or an API key or JWT whose
+// principal has the admin role, and audit-logs refusals. Needs WithConfig.
+func AdminOnly(deps Deps) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg, _ := r.Context().Value(configKey).(*shared.Config)
+			w.Header().Set("Content-Type", "application/json")
+			if cfg == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "server configuration error"})
+				return
+			}
+			if shared.CheckAdminAuth(r, cfg) == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// Without keys or JWT admins, ADMIN_TOKEN is the only way in
+			if cfg.AccessFile == "" && (cfg.JWTIssuer == "" || cfg.JWTAdminRole == "") {
+				shared.RequireAdmin(w, r, cfg)
+				return
+			}
+
+			principal, err := deps.authenticate(r, cfg, true)
+			if err != nil {
+				authFailed(w, r, err)
+				return
+			}
+			r = r.WithContext(withPrincipal(r.Context(), principal))
+			if !principal.HasRole(shared.RoleAdmin) {
+				accessDenied(w, r, principal, shared.RoleAdmin)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PrincipalFrom returns the principal set by Authenticate, or nil when
+// access control is off
+func PrincipalFrom(ctx context.Context) *shared.Principal {
+	p, _ := ctx.Value(principalKey).(*shared.Principal)
+	return p
+}
+
+// withPrincipal attaches principal to ctx and its logs
+func withPrincipal(ctx context.Context, principal *shared.Principal) context.Context {
+	ctx = context.WithValue(ctx, principalKey, principal)
+	ctx = shared.ContextWithLogAttrs(ctx, shared.LogTenant, principal.Tenant)
+	if principal.Subject != "" {
+		ctx = shared.ContextWithLogAttrs(ctx, shared.LogSubject, principal.Subject)
+	}
+	return ctx
+}
+
+// Authenticate requires a bearer API key listed in ACCESS_FILE or, with
+// JWT_ISSUER set, a JWT the issuer signed, and attaches the caller's
+// principal (tenant, visible columns and roles) to the request. With
+// neither configured every request passes. Needs WithConfig.
+func Authenticate(deps Deps) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg, _ := r.Context().Value(configKey).(*shared.Config)
+			if cfg == nil || (cfg.AccessFile == "" && cfg.JWTIssuer == "") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			principal, err := deps.authenticate(r, cfg, false)
+			if err != nil {
+				authFailed(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// RequireRole refuses callers whose principal lacks role with a 403 and an
+// audit log line. Without access control there is no principal and every
+// caller passes. Needs Authenticate.
+func RequireRole(role string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if principal := PrincipalFrom(r.Context()); principal != nil && !principal.HasRole(role) {
+				accessDenied(w, r, principal, role)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// accessDenied writes the 403 for an authenticated caller without role
+func accessDenied(w http.ResponseWriter, r *http.Request, principal *shared.Principal, role string) {
+	shared.Logger(r.Context()).Warn("Access denied", "audit", true, "path", r.URL.Path, "method", r.Method,
+		"role", role, "roles", principal.Roles, "key_id", principal.KeyID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"error": "forbidden: needs role " + role})
+}
+
+// authenticate identifies the caller by API key or JWT. A JWT caller's
+// tenant must be in ACCESS_FILE, if there is one, unless anyTenant is
+// set: admin endpoints see no tenant data.
+func (d Deps) authenticate(r *http.Request, cfg *shared.Config, anyTenant bool) (*shared.Principal, error) {
+	var acl *shared.AccessList
+	if cfg.AccessFile != "" {
+		var err error
+		if acl, err = shared.LoadAccessList(cfg.AccessFile); err != nil {
+			return nil, fmt.Errorf("failed to load access file: %w", err)
+		}
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case cfg.JWTIssuer != "" && shared.LooksLikeJWT(token):
+		if anyTenant {
+			acl = nil
+		}
+		return d.jwtPrincipal(r, cfg, acl, token)
+	case acl != nil:
+		return acl.Authenticate(r)
+	}
+	return nil, shared.ErrUnauthorized
+}
+
+// jwtPrincipal verifies a JWT and maps its tenant claim to a principal and
+// its JWT_QUERY_ROLE and JWT_ADMIN_ROLE roles to the query and admin roles
+func (d Deps) jwtPrincipal(r *http.Request, cfg *shared.Config, acl *shared.AccessList, token string) (*shared.Principal, error) {
+	claims, err := d.JWKS.Verify(r.Context(), cfg, token)
+	if err != nil {
+		return nil, err
+	}
+	principal, err := acl.TenantPrincipal(claims.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	principal.Subject = claims.Subject
+	principal.KeyID = shared.JWTKeyID(cfg.JWTIssuer, claims.Subject)
+	principal.Roles = nil
+	if cfg.JWTQueryRole == "" || claims.HasRole(cfg.JWTQueryRole) {
+		principal.Roles = append(principal.Roles, shared.RoleQuery)
+	}
+	if cfg.JWTAdminRole != "" && claims.HasRole(cfg.JWTAdminRole) {
+		principal.Roles = append(principal.Roles, shared.RoleAdmin)
+	}
+	return principal, nil
+}
+
+// authFailed writes the response for a rejected credential: 401 or 403,
+// 503 when the identity provider is unreachable, and 500 for anything
+// else, which is a configuration problem
+func authFailed(w http.ResponseWriter, r *http.Request, err error) {
+	log := shared.Logger(r.Context())
+	status, message := http.StatusInternalServerError, "server configuration error"
+	switch {
+	case errors.Is(err, shared.ErrForbidden):
+		status, message = http.StatusForbidden, err.Error()
+	case errors.Is(err, shared.ErrUnauthorized):
+		status, message = http.StatusUnauthorized, err.Error()
+	case errors.Is(err, shared.ErrIdentityProvider):
+		status, message = http.StatusServiceUnavailable, shared.ErrIdentityProvider.Error()
+	}
+	if status >= http.StatusInternalServerError {
+		log.Error("Authentication failed", "path", r.URL.Path, "error", err)
+	} else {
+		log.Warn("Credential rejected", "audit", true, "path", r.URL.Path, "error", err)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// BodyLimit rejects request bodies over MAX_BODY_BYTES with a 413: up
+// front when Content-Length says so, otherwise when a handler reads past
+// the limit and fails to decode. Needs WithConfig.
+func BodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg, _ := r.Context().Value(configKey).(*shared.Config)
+		if cfg == nil || cfg.MaxBodyBytes <= 0 || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > cfg.MaxBodyBytes {
+			shared.Logger(r.Context()).Warn("Request body too large", "bytes", r.ContentLength, "limit", cfg.MaxBodyBytes, "path", r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": "request body too large"})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Timeout aborts requests that run longer than REQUEST_TIMEOUT with a 503.
+// It buffers the response, so it is skipped when STREAM_RESULTS is on.
+// Needs WithConfig.
+func Timeout(next http.Handler) http.Handler {
+	const body = `{"error":"request timed out"}`
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg, _ := r.Context().Value(configKey).(*shared.Config)
+		if cfg == nil || cfg.RequestTimeout <= 0 || cfg.StreamResults {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.TimeoutHandler(next, cfg.RequestTimeout, body).ServeHTTP(w, r)
+	})
+}
+
+// RateLimit allows RATE_LIMIT requests per client IP (see shared.ClientIP)
+// per minute, refilled continuously. Each call returns a limiter with its own buckets; routes
+// that share one share the budget. State is per process, so serverless
+// instances limit independently. Needs WithConfig.
+func RateLimit() Middleware {
+	var (
+		mu      sync.Mutex
+		buckets = make(map[string]*bucket)
+	)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg, _ := r.Context().Value(configKey).(*shared.Config)
+			if cfg == nil || cfg.RateLimit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Validated when the config was loaded
+			proxies, _ := shared.ParseTrustedProxies(cfg.TrustedProxies)
+			ip := shared.ClientIP(r, proxies)
+			now := time.Now()
+			mu.Lock()
+			b, ok := buckets[ip]
+			if !ok {
+				b = &bucket{tokens: float64(cfg.RateLimit), updated: now}
+				buckets[ip] = b
+			}
+			allowed := b.take(float64(cfg.RateLimit), now)
+			if len(buckets) > 10000 {
+				for ip, old := range buckets {
+					if now.Sub(old.updated) > time.Minute {
+						delete(buckets, ip)
+					}
+				}
+			}
+			mu.Unlock()
+
+			if !allowed {
+				shared.Logger(r.Context()).Warn("Rate limited", "client", ip, "path", r.URL.Path)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]string{"error": "rate limit exceeded"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bucket is a token bucket holding up to perMinute tokens
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *bucket) take(perMinute float64, now time.Time) bool {
+	b.tokens += now.Sub(b.updated).Minutes() * perMinute
+	if b.tokens > perMinute {
+		b.tokens = perMinute
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// pageInfo describes the page cur returned rows rows for, with a token for
+// the next page unless it was the last
+func (h *Query) pageInfo(r *http.Request, cfg *shared.Config, warehouse shared.Warehouse, cur shared.PageCursor, rows int) *shared.PageInfo {
+	info := &shared.PageInfo{Page: cur.Page, PageSize: cur.PageSize}
+	info.TotalRows, info.TotalEstimated = shared.PageTotal(warehouse, cur.Query, cur.Page, cur.PageSize, rows)
+	if cur.Query.More(cur.Page, cur.PageSize, rows) {
+		next := cur
+		next.Page++
+		keyID := ""
+		if principal := PrincipalFrom(r.Context()); principal != nil {
+			keyID = principal.KeyID
+		}
+		info.NextPageToken = shared.EncodePageToken(cfg, keyID, next)
+	}
+	return info
+}
+
+// nextPage serves a page_token request: it runs the page of the SQL the
+// first page was served with, without generating it again. The token is
+// signed, so the SQL is the one validated then; it is checked again
+// against the caller's access, masking and minimum group size as they are
+// now. A schema change since then invalidates the token, since the SQL may
+// no longer mean the same thing.
+func (h *Query) nextPage(w http.ResponseWriter, r *http.Request, cfg *shared.Config, token string, start time.Time) {
+	log := shared.Logger(r.Context())
+
+	keyID, tenant := "", ""
+	principal := PrincipalFrom(r.Context())
+	if principal != nil {
+		keyID, tenant = principal.KeyID, principal.Tenant
+	}
+	cur, err := shared.DecodePageToken(cfg, keyID, token)
+	if err != nil {
+		log.Warn("Invalid page token", "audit", true)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+		return
+	}
+
+	if err := shared.ServiceMode.CheckExecute(cfg); err != nil {
+		log.Warn("Execution paused", "error", err)
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error(), Code: string(nlerrors.CodeOf(err))})
+		return
+	}
+
+	tinybird := h.warehouse(r, cfg)
+	timing := newServerTiming(w, start)
+	schemaStart := time.Now()
+	schema, _, err := h.schema(r, cfg, tinybird)
+	timing.add(shared.PhaseSchema, time.Since(schemaStart))
+	if err != nil {
+		log.Error("Failed to fetch schema", "error", err, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "failed to fetch schema"})
+		return
+	}
+	if schemaVersion := schema.Version(); schemaVersion != cur.SchemaVersion {
+		log.Info("Page token outlived its schema", "token_version", cur.SchemaVersion, "schema_version", schemaVersion)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "the schema changed since the first page; ask the question again", SchemaVersion: schemaVersion})
+		return
+	}
+
+	sql := cur.Query.PageSQL(cur.Page, cur.PageSize)
+	pipeline, err := shared.NewPipeline(cfg, tenant)
+	if err != nil {
+		log.Error("Failed to load post-processors", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: "server configuration error", Timings: timing.result(), SchemaVersion: cur.SchemaVersion})
+		return
+	}
+	profile, err := shared.LoadTenantProfile(cfg, tenant)
+	if err != nil {
+		log.Error("Failed to load tenant profile", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: "server configuration error", Timings: timing.result(), SchemaVersion: cur.SchemaVersion})
+		return
+	}
+
+	// The signature only vouches for the SQL as it was checked for the
+	// first page. Access, masking and the minimum group size may have
+	// changed since, so the page is checked against them as they are now.
+	// The SQL includes the ORDER BY the first page added, which leaves out
+	// the columns masked then; one masked since is refused here.
+	err = pipeline.CheckSQL(cur.Query.SQL)
+	if err == nil && principal != nil {
+		permitted := profile.ApplyGrammar(principal.FilterSchema(schema))
+		err = shared.CheckSchemaAccess(cur.Query.SQL, schema, permitted)
+		pipeline.Restrict(cur.Query.SQL, schema, permitted)
+	}
+	if err == nil {
+		// Pages are row selects, which any minimum group size refuses
+		_, err = shared.EnforceMinGroupSize(cur.Query.SQL, shared.MinGroupSize(cfg, principal), cfg.MinGroupPolicy)
+	}
+	if err != nil {
+		log.Warn("Page refused", "audit", true, "error", err, shared.SQLFields(sql))
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: cur.SchemaVersion})
+		return
+	}
+
+	slow := &shared.SlowQuery{
+		RequestID: RequestIDFrom(r.Context()),
+		SQL:       sql,
+		Tenant:    tenant,
+		Columns:   shared.ReferencedColumns(sql, schema),
+	}
+	log.Info("Page requested", "page", cur.Page, "page_size", cur.PageSize, shared.SQLFields(sql))
+
+	dbStart := time.Now()
+	result, err := tinybird.ExecuteQuery(sql)
+	dbDuration := time.Since(dbStart)
+	timing.add(shared.PhaseExecute, dbDuration)
+	slow.ExecuteMs = dbDuration.Milliseconds()
+	if err != nil {
+		h.recordRequest(r, cfg, slow, err)
+		h.notifyWarehouseError(cfg, slow, err)
+		log.Error("Tinybird error", shared.Phase(shared.PhaseExecute), "error", err, "code", nlerrors.CodeOf(err), shared.SQLFields(sql), shared.DurationMs(dbDuration))
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: cur.SchemaVersion})
+		return
+	}
+
+	stats := result.Stats()
+	log.Info("Query executed",
+		shared.Phase(shared.PhaseExecute),
+		slog.String(shared.LogSQLHash, shared.SQLHash(sql)),
+		"rows", result.Rows,
+		"rows_read", stats.RowsRead,
+		"bytes_read", stats.BytesRead,
+		shared.DurationMs(dbDuration),
+		"total_duration_ms", time.Since(start).Milliseconds(),
+	)
+	slow.Rows, slow.RowsRead, slow.BytesRead = result.Rows, stats.RowsRead, stats.BytesRead
+
+	err = shared.CheckQueryCost(stats, cfg)
+	h.recordRequest(r, cfg, slow, err)
+	if err != nil {
+		log.Warn("Query over cost budget", shared.Phase(shared.PhaseExecute), "error", err, shared.SQLFields(sql))
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: cur.SchemaVersion})
+		return
+	}
+
+	pipeline.Process(result)
+	maskedColumns := pipeline.MaskedColumns()
+	if len(maskedColumns) > 0 {
+		log.Info("Result columns masked", "audit", true, "columns", maskedColumns, slog.String(shared.LogSQLHash, shared.SQLHash(sql)))
+	}
+
+	json.NewEncoder(w).Encode(QueryResponse{
+		SQL:               shared.FormatSQL(sql),
+		Data:              result.Data,
+		Rows:              result.Rows,
+		OrderApplied:      cur.OrderApplied,
+		MaskedColumns:     maskedColumns,
+		Page:              h.pageInfo(r, cfg, tinybird, cur, result.Rows),
+		ReferencedColumns: slow.Columns,
+		Display:           pipeline.Display(profile.ResultDisplay(sql)),
+		Timings:           timing.result(),
+		SchemaVersion:     cur.SchemaVersion,
+	})
+}
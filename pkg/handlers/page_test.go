@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+	"github.com/raindrop/nl2sql/pkg/shared/fake"
+)
+
+func TestNextPage(t *testing.T) {
+	const pageSQL = "SELECT * FROM orders LIMIT 10 OFFSET 10"
+	cursor := shared.PageCursor{
+		Query:         shared.PageQuery{SQL: "SELECT * FROM orders"},
+		Page:          2,
+		PageSize:      10,
+		SchemaVersion: testSchema.Version(),
+	}
+
+	tests := []struct {
+		name string
+		// env is the configuration the page is requested under; the token
+		// was issued under the defaults
+		env          map[string]string
+		issuedAt     time.Time
+		wantStatus   int
+		wantCode     string
+		wantExecuted bool
+	}{
+		{"serves the page", nil, time.Time{}, http.StatusOK, "", true},
+		{"expired", nil, time.Now().Add(-2 * time.Hour), http.StatusBadRequest, "", false},
+		{"minimum group size set since", map[string]string{"MIN_GROUP_SIZE": "5"}, time.Time{}, http.StatusBadRequest, string(nlerrors.CodeGroupTooSmall), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur := cursor
+			cur.IssuedAt = tt.issuedAt
+			token := shared.EncodePageToken(testConfig(t, nil), "", cur)
+
+			cfg := testConfig(t, tt.env)
+			wh := &fake.Warehouse{Schema: testSchema, Results: map[string]*shared.TinybirdResponse{
+				pageSQL: fake.Result(map[string]interface{}{"order_id": "o1", "seller_id": "s1", "price": 10}),
+			}}
+			h := NewQuery(testDeps(cfg, &fake.Generator{}, wh))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/query", strings.NewReader(`{"page_token": "`+token+`"}`)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var resp QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if resp.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", resp.Code, tt.wantCode)
+			}
+			if executed := len(wh.Queries()) > 0; executed != tt.wantExecuted {
+				t.Errorf("executed = %v, want %v; queries %q", executed, tt.wantExecuted, wh.Queries())
+			}
+		})
+	}
+}
+
+// TestPagesWithMaskedColumns pages through a row select with a masked
+// column: the order the server adds leaves it out, so every page passes the
+// masking check the first one did
+func TestPagesWithMaskedColumns(t *testing.T) {
+	const ordered = "SELECT * FROM orders ORDER BY order_id, price"
+	cfg := testConfig(t, map[string]string{"MASKED_COLUMNS": "seller_id"})
+	row := func(id string) *shared.TinybirdResponse {
+		return fake.Result(map[string]interface{}{"order_id": id, "seller_id": "s1", "price": 10})
+	}
+	wh := &fake.Warehouse{Schema: testSchema, Results: map[string]*shared.TinybirdResponse{
+		ordered + " LIMIT 1 OFFSET 0": row("o1"),
+		ordered + " LIMIT 1 OFFSET 1": row("o2"),
+		ordered + " LIMIT 1 OFFSET 2": row("o3"),
+	}}
+	h := NewQuery(testDeps(cfg, &fake.Generator{SQL: map[string]string{"orders": "SELECT * FROM orders"}}, wh))
+
+	body := `{"query": "orders", "page_size": 1}`
+	for page := 1; page <= 3; page++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/query", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("page %d: status = %d; body %s", page, rec.Code, rec.Body)
+		}
+		var resp QueryResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("page %d: decoding response: %v", page, err)
+		}
+		if resp.Page == nil || resp.Page.NextPageToken == "" {
+			t.Fatalf("page %d has no next page token: %s", page, rec.Body)
+		}
+		if got := resp.Data[0]["seller_id"]; got == "s1" {
+			t.Errorf("page %d returned seller_id unmasked", page)
+		}
+		body = `{"page_token": "` + resp.Page.NextPageToken + `"}`
+	}
+	if queries := wh.Queries(); len(queries) != 3 {
+		t.Errorf("queries = %q, want one per page", queries)
+	}
+}
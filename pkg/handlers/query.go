@@ -0,0 +1,834 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+type QueryRequest struct {
+	Query string `json:"query"`
+	// Explain asks for a plain-English description of the query plan
+	Explain bool `json:"explain,omitempty"`
+	// Timezone is the caller's IANA zone for relative dates like "today";
+	// DEFAULT_TIMEZONE when empty
+	Timezone string `json:"timezone,omitempty"`
+	// AsOf pins "now" for relative dates, e.g. "2018-06-01", so answers
+	// are reproducible; in Timezone unless it has an offset
+	AsOf string `json:"as_of,omitempty"`
+	// Tables narrows the grammar and prompt to these datasources, when
+	// the caller already knows where the answer is
+	Tables []string `json:"tables,omitempty"`
+	// Page and PageSize split a row select into pages of PageSize rows
+	// (DefaultPageSize when 0); Page is 1-based. PageToken, from a previous
+	// response, fetches the next page instead of asking Query again.
+	Page      int    `json:"page,omitempty"`
+	PageSize  int    `json:"page_size,omitempty"`
+	PageToken string `json:"page_token,omitempty"`
+	// Settings lower CLICKHOUSE_SETTINGS limits for this request, e.g.
+	// {"max_execution_time": 5}; see shared.RequestSettings
+	Settings map[string]int64 `json:"settings,omitempty"`
+	// Compare answers the question over two time windows, e.g.
+	// {"period": "week"} for this week so far against last week, and
+	// returns the rows merged with deltas
+	Compare *shared.CompareSpec `json:"compare,omitempty"`
+	// Session groups a client's questions, e.g. one conversation, so its
+	// own earlier questions are preferred as few-shot examples
+	Session string `json:"session,omitempty"`
+}
+
+type QueryResponse struct {
+	SQL  string                   `json:"sql"`
+	Data []map[string]interface{} `json:"data"`
+	Rows int                      `json:"rows"`
+	// LimitApplied is set when the server capped the query, so results may be truncated
+	LimitApplied int `json:"limit_applied,omitempty"`
+	// OrderApplied lists the ORDER BY columns the server added to a row
+	// select so the capped rows are the same every run
+	OrderApplied []string `json:"order_applied,omitempty"`
+	// MaskedColumns lists columns whose values were hashed or redacted
+	MaskedColumns []string `json:"masked_columns,omitempty"`
+	// Page is set when a page of a row select was requested
+	Page *shared.PageInfo `json:"page,omitempty"`
+	// Corrections are misspelled table/column names rewritten before generation
+	Corrections []shared.NearMiss `json:"corrections,omitempty"`
+	// FollowUps are drill-down questions derived from the executed SQL
+	FollowUps []string `json:"follow_ups,omitempty"`
+	// ReferencedColumns are the schema columns the SQL touched, as
+	// "table.column"
+	ReferencedColumns []string `json:"referenced_columns,omitempty"`
+	// MinGroupSize is set when groups of fewer rows were kept out of the
+	// result
+	MinGroupSize int `json:"min_group_size,omitempty"`
+	// Display holds the tenant's presentation hints for result columns
+	Display map[string]shared.ColumnDisplay `json:"display,omitempty"`
+	// Comparison describes the windows of a compare request; Data then
+	// holds each measure with its previous value and deltas
+	Comparison *shared.Comparison `json:"comparison,omitempty"`
+	// Suggestions are answerable alternatives to a refused question
+	Suggestions []string `json:"suggestions,omitempty"`
+	// Timings breaks down where the request's time went
+	Timings *Timings `json:"timings,omitempty"`
+	// Explanation describes how the query executes; set when requested
+	Explanation string `json:"explanation,omitempty"`
+	// SchemaVersion identifies the warehouse schema the query ran under
+	SchemaVersion string `json:"schema_version,omitempty"`
+	// Model generated the SQL; Cohort is "stable" or "canary" while a
+	// CANARY_MODEL is configured
+	Model  string `json:"model,omitempty"`
+	Cohort string `json:"cohort,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Code is the nlerrors code of a typed failure, e.g. "unsupported_query"
+	Code string `json:"code,omitempty"`
+	Hint string `json:"hint,omitempty"`
+}
+
+// Query serves /api/query: natural language in, SQL and rows out. POST
+// takes a JSON QueryRequest; GET takes its fields as URL parameters, with
+// the question as q. format=csv returns the rows as CSV instead of JSON.
+type Query struct {
+	Deps
+	flights *flightGroup
+}
+
+// NewQuery creates the query handler
+func NewQuery(deps Deps) *Query {
+	return &Query{Deps: deps, flights: newFlightGroup()}
+}
+
+func (h *Query) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		h.serve(w, r)
+	case "csv":
+		h.serveCSV(w, r)
+	default:
+		shared.Logger(r.Context()).Warn("Unknown format", "format", format)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "format must be json or csv"})
+	}
+}
+
+// serve answers a request with a JSON QueryResponse
+func (h *Query) serve(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	start := time.Now()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	var req QueryRequest
+	if r.Method == http.MethodGet {
+		var err error
+		if req, err = queryRequestFromURL(r.URL.Query()); err != nil {
+			log.Warn("Invalid query parameters", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Error("Invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "invalid request body"})
+		return
+	}
+
+	if req.Query == "" && req.PageToken == "" {
+		log.Warn("Empty query received")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "query is required"})
+		return
+	}
+
+	if req.Page < 0 {
+		log.Warn("Invalid page", "page", req.Page)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "page must not be negative"})
+		return
+	}
+	if _, err := shared.PageSize(req.PageSize, cfg.MaxDefaultLimit); err != nil {
+		log.Warn("Invalid page size", "page_size", req.PageSize)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+		return
+	}
+
+	cfg, err := shared.WithRequestSettings(cfg, req.Settings)
+	if err != nil {
+		log.Warn("Invalid settings", "settings", req.Settings, "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+		return
+	}
+
+	timezone := req.Timezone
+	if timezone == "" {
+		timezone = cfg.DefaultTimezone
+	}
+	loc, err := shared.LoadTimezone(timezone)
+	if err != nil {
+		log.Warn("Invalid time zone", "timezone", timezone)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+		return
+	}
+
+	now := time.Now().In(loc)
+	if req.AsOf != "" {
+		if now, err = shared.ParseReferenceTime(req.AsOf, loc); err != nil {
+			log.Warn("Invalid as_of", "as_of", req.AsOf)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	if req.Compare != nil {
+		err := errors.New("compare can't be combined with pages")
+		if req.Page == 0 && req.PageSize == 0 {
+			_, _, err = shared.ResolveWindows(*req.Compare, now)
+		}
+		if err != nil {
+			log.Warn("Invalid compare", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	log.Info("Query received", "query", req.Query, "timezone", loc.String(), "as_of", req.AsOf)
+
+	// An operator may have switched the service to maintenance
+	if err := shared.ServiceMode.CheckGenerate(cfg); err != nil {
+		log.Warn("Query refused in maintenance", "error", err)
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error(), Code: string(nlerrors.CodeOf(err))})
+		return
+	}
+
+	// Refuse keys that have used up their quota before spending anything
+	if principal := PrincipalFrom(r.Context()); principal != nil && principal.Quota != nil {
+		status, err := h.Usage.QuotaStatus(principal.KeyID, *principal.Quota, time.Now(), cfg.UsageFile)
+		if err != nil {
+			log.Error("Failed to check quota, allowing request", "error", err)
+		} else if err := status.Check(); err != nil {
+			var quotaErr nlerrors.ErrQuotaExceeded
+			if errors.As(err, &quotaErr) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(quotaErr.ResetsAt).Seconds())+1))
+			}
+			log.Warn("Quota exceeded", "audit", true, "error", err)
+			w.WriteHeader(nlerrors.HTTPStatus(err))
+			json.NewEncoder(w).Encode(QueryResponse{Error: err.Error(), Code: string(nlerrors.CodeOf(err))})
+			return
+		}
+	}
+	if err := shared.Features.SetConfig(cfg.FeatureFlags); err != nil {
+		log.Error("Failed to load feature flags", "error", err)
+	}
+
+	// Later pages run the SQL the first page was served with
+	if req.PageToken != "" {
+		h.nextPage(w, r, cfg, req.PageToken, start)
+		return
+	}
+
+	// Slow queries can be answered in the background and polled for
+	if r.URL.Query().Get("async") == "true" {
+		h.submitJob(w, r, req, now)
+		return
+	}
+
+	// Identical questions asked at the same time, e.g. by several widgets of
+	// one dashboard, share one generation and execution. Streamed responses
+	// are written as they arrive, so they can't be shared.
+	tenant := ""
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		tenant = principal.Tenant
+	}
+	if cfg.StreamResults || !shared.Features.EnabledFor(shared.FlagQueryDedup, tenant) {
+		h.answer(w, r, cfg, req, now, start)
+		return
+	}
+	resp, joined := h.flights.do(h.flightKey(r, cfg, req, loc), func() *bufferedResponse {
+		rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		h.answer(rec, r, cfg, req, now, start)
+		return rec
+	})
+	if joined {
+		log.Info("Identical query in flight, sharing its response", "status", resp.status)
+	}
+	resp.writeTo(w)
+}
+
+// answer generates and runs the SQL for req and writes the response
+func (h *Query) answer(w http.ResponseWriter, r *http.Request, cfg *shared.Config, req QueryRequest, now, start time.Time) {
+	log := shared.Logger(r.Context())
+
+	// Initialize clients. With a CANARY_MODEL, a share of requests generate
+	// with it instead and are tagged with their cohort for comparison.
+	tinybird := h.warehouse(r, cfg)
+	cohort, genCfg := shared.RouteCanary(cfg)
+	openai := h.NewGenerator(genCfg)
+	traced(r, openai)
+	if cohort != "" {
+		log = log.With("cohort", cohort)
+	}
+
+	// Fetch schema, reusing it across warm invocations for SCHEMA_CACHE_TTL
+	timing := newServerTiming(w, start)
+	schemaStart := time.Now()
+	schema, cached, err := h.schema(r, cfg, tinybird)
+	timing.add(shared.PhaseSchema, time.Since(schemaStart))
+	if err != nil {
+		log.Error("Failed to fetch schema", "error", err, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "failed to fetch schema"})
+		return
+	}
+
+	// Responses carry the version so results can be read against the schema
+	// they ran under
+	schemaVersion := schema.Version()
+
+	// API keys only see their permitted columns, so the grammar can't name the rest
+	visible := schema
+	tenant := ""
+	principal := PrincipalFrom(r.Context())
+	if principal != nil {
+		tenant = principal.Tenant
+		visible = principal.FilterSchema(schema)
+		if len(visible.Datasources) == 0 {
+			log.Warn("No visible data for API key", "audit", true)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(QueryResponse{Error: "no data is visible to this API key"})
+			return
+		}
+	}
+	// A tenant's profile shapes the prompt and narrows the grammar
+	profile, err := shared.LoadTenantProfile(cfg, tenant)
+	if err != nil {
+		log.Error("Failed to load tenant profile", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "server configuration error", SchemaVersion: schemaVersion})
+		return
+	}
+	visible = profile.ApplyGrammar(visible)
+	if len(visible.Datasources) == 0 {
+		log.Warn("No data left by tenant profile", "tenant", tenant)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(QueryResponse{Error: "no data is visible to this tenant", SchemaVersion: schemaVersion})
+		return
+	}
+	if pg, ok := openai.(shared.ProfileGenerator); ok {
+		pg.SetProfile(profile)
+	}
+	// A tables hint narrows the prompt, not what the key may read
+	permitted := visible
+	if len(req.Tables) > 0 {
+		subset, err := visible.Subset(req.Tables)
+		if err != nil {
+			log.Warn("Invalid tables hint", "tables", req.Tables, "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(QueryResponse{Error: err.Error(), Hint: visible.GenerateUserHint(), SchemaVersion: schemaVersion})
+			return
+		}
+		visible = subset
+	}
+	openai.SetSchema(visible)
+	log.Debug("Schema loaded", "tables", len(visible.Datasources), "hinted", len(req.Tables) > 0, "cached", cached, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+
+	// With QUERY_COMMENT, queries carry the question as asked, for the
+	// warehouse query log
+	if tagger, ok := tinybird.(shared.QuestionTagger); ok {
+		tagger.TagQuestion(req.Query)
+	}
+
+	// Spell-check table and column mentions against the visible schema
+	question := req.Query
+	misses := shared.FindNearMisses(question, visible)
+	var corrections []shared.NearMiss
+	if len(misses) > 0 && shared.Features.EnabledFor(shared.FlagFuzzyCorrection, tenant) {
+		question = shared.CorrectQuestion(question, misses)
+		corrections = misses
+		log.Info("Question corrected", "corrections", misses)
+	}
+
+	// With FEW_SHOT_EXAMPLES, the tenant's similar earlier questions go in
+	// the prompt. The embedding is kept to record this question if it works.
+	embedding, embeddingModel := h.fewShot(r, cfg, openai, tenant, req.Session, question)
+
+	// Generate SQL using GPT-5 with CFG
+	sqlStart := time.Now()
+	gen, err := openai.Generate(question, now)
+	sqlDuration := time.Since(sqlStart)
+	timing.add(shared.PhaseGenerate, sqlDuration)
+
+	// Filled in as the request progresses, then recorded for usage reporting
+	// and, if it crossed a threshold, the slow-query log. Refusals and
+	// failed generations are recorded too, since they spent tokens.
+	slow := &shared.SlowQuery{
+		RequestID:  RequestIDFrom(r.Context()),
+		Question:   req.Query,
+		GenerateMs: sqlDuration.Milliseconds(),
+		Tenant:     tenant,
+		Cohort:     cohort,
+		Model:      genCfg.OpenAIModel,
+	}
+	if gen != nil {
+		slow.Model = gen.Model
+		slow.InputTokens, slow.OutputTokens = gen.Usage.InputTokens, gen.Usage.OutputTokens
+		slow.PromptTokens = gen.PromptTokens
+	}
+
+	if err != nil {
+		var unsupportedErr nlerrors.ErrUnsupportedQuery
+		if errors.As(err, &unsupportedErr) {
+			log.Info("Unsupported query", shared.Phase(shared.PhaseGenerate), "reason", unsupportedErr.Reason, shared.PromptFields(gen), shared.DurationMs(sqlDuration))
+			w.WriteHeader(http.StatusBadRequest)
+			hint := unsupportedErr.AvailableData
+			if didYouMean := shared.DidYouMean(misses); didYouMean != "" {
+				hint = didYouMean + " " + hint
+			}
+			var suggestions []string
+			if h.NewCompleter != nil && shared.Features.EnabledFor(shared.FlagRefusalSuggestions, tenant) {
+				rewriteStart := time.Now()
+				var usage shared.Usage
+				completer := h.NewCompleter(cfg)
+				traced(r, completer)
+				suggestions, usage, err = shared.SuggestRewrites(completer, question, unsupportedErr.Reason, visible)
+				slow.InputTokens += usage.InputTokens
+				slow.OutputTokens += usage.OutputTokens
+				if err != nil {
+					log.Warn("Failed to suggest rewrites", "error", err)
+				} else {
+					log.Info("Rewrites suggested", "suggestions", len(suggestions), shared.DurationMs(time.Since(rewriteStart)))
+				}
+			}
+			h.recordRequest(r, cfg, slow, unsupportedErr)
+			if err := h.Refusals.Record(shared.RefusalRecord{
+				Tenant:   tenant,
+				Question: req.Query,
+				Reason:   unsupportedErr.Reason,
+			}, cfg.RefusalsFile); err != nil {
+				log.Error("Failed to record refusal", "error", err)
+			}
+			json.NewEncoder(w).Encode(QueryResponse{
+				Error:         unsupportedErr.Reason,
+				Code:          string(unsupportedErr.Code()),
+				Hint:          hint,
+				Corrections:   corrections,
+				Suggestions:   suggestions,
+				Timings:       timing.result(),
+				SchemaVersion: schemaVersion,
+				Model:         slow.Model,
+				Cohort:        cohort,
+			})
+			return
+		}
+
+		log.Error("OpenAI error", shared.Phase(shared.PhaseGenerate), "error", err, "code", nlerrors.CodeOf(err), shared.PromptFields(gen), shared.DurationMs(sqlDuration))
+		h.recordRequest(r, cfg, slow, err)
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: schemaVersion, Model: slow.Model, Cohort: cohort})
+		return
+	}
+	sql := gen.SQL
+	slow.SQL = sql
+
+	// Masking and the tenant's presentation steps run on every row before
+	// it is encoded
+	pipeline, err := shared.NewPipeline(cfg, tenant)
+	if err != nil {
+		log.Error("Failed to load post-processors", "error", err)
+		h.recordRequest(r, cfg, slow, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: "server configuration error", Timings: timing.result(), SchemaVersion: schemaVersion, Model: slow.Model, Cohort: cohort})
+		return
+	}
+
+	// Generators other than OpenAI may be injected, so check literals and
+	// column access here too. Masking matches result columns by name, so
+	// masked columns can't be aggregated or aliased.
+	err = shared.ValidateLiterals(sql)
+	if err == nil && principal != nil {
+		err = shared.CheckSchemaAccess(sql, schema, permitted)
+	}
+	if err == nil {
+		err = pipeline.CheckSQL(sql)
+	}
+	if err != nil {
+		log.Warn("Generated SQL rejected", shared.Phase(shared.PhaseGenerate), "error", err, shared.SQLFields(sql))
+		h.recordRequest(r, cfg, slow, err)
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: schemaVersion, Model: slow.Model, Cohort: cohort})
+		return
+	}
+	if principal != nil {
+		pipeline.Restrict(sql, schema, permitted)
+	}
+	log.Info("SQL generated", shared.Phase(shared.PhaseGenerate), shared.SQLFields(sql), shared.LogModel, gen.Model, shared.PromptFields(gen), shared.DurationMs(sqlDuration))
+
+	// A minimum group size keeps individual-level data out of the result:
+	// row selects are refused and small groups left out or refused
+	minGroup := shared.MinGroupSize(cfg, principal)
+	if minGroup > 0 {
+		enforced, err := shared.EnforceMinGroupSize(sql, minGroup, cfg.MinGroupPolicy)
+		if err != nil {
+			log.Warn("Query refused by minimum group size", "audit", true, "error", err, shared.SQLFields(sql))
+			h.recordRequest(r, cfg, slow, err)
+			w.WriteHeader(nlerrors.HTTPStatus(err))
+			json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: schemaVersion, Model: slow.Model, Cohort: cohort})
+			return
+		}
+		sql = enforced
+		slow.SQL = sql
+		log.Info("Minimum group size applied", "min_group_size", minGroup, "policy", cfg.MinGroupPolicy)
+	}
+
+	// A requested page of a row select is bounded by the page size instead
+	// of the default LIMIT, so the table can be browsed past it. Aggregates
+	// aren't paginated.
+	limitApplied := 0
+	var orderApplied []string
+	var pageQuery shared.PageQuery
+	paginated := false
+	pageNum, pageSize := max(req.Page, 1), 0
+	if req.Page > 0 || req.PageSize > 0 {
+		pageSize, _ = shared.PageSize(req.PageSize, cfg.MaxDefaultLimit)
+		pageQuery, paginated = shared.NewPageQuery(sql)
+	}
+	if paginated {
+		var ordered string
+		ordered, orderApplied, _ = shared.BoundRowSelect(pageQuery.SQL, visible, pageSize, pipeline.Unordered())
+		pageQuery.SQL = strings.TrimSuffix(ordered, ";")
+		sql = pageQuery.PageSQL(pageNum, pageSize)
+		log.Info("Page requested", "page", pageNum, "page_size", pageSize, "order_by", orderApplied)
+		slow.SQL = sql
+	} else {
+		// Row selects like SELECT * get a stable order and at most the
+		// default LIMIT, so the client never gets the whole table
+		bounded, orderBy, lowered := shared.BoundRowSelect(sql, visible, cfg.MaxDefaultLimit, pipeline.Unordered())
+		if bounded != sql {
+			sql, orderApplied = bounded, orderBy
+			if lowered {
+				limitApplied = cfg.MaxDefaultLimit
+			}
+			log.Info("Row select bounded", "order_by", orderApplied, "limit_lowered", lowered)
+			slow.SQL = sql
+		}
+
+		// Cap multi-row queries that have no LIMIT
+		if capped, ok := shared.ApplyDefaultLimit(sql, cfg.MaxDefaultLimit); ok {
+			sql = capped
+			limitApplied = cfg.MaxDefaultLimit
+			log.Info("Default limit applied", "limit", limitApplied)
+			slow.SQL = sql
+		}
+	}
+
+	// Lineage of the final SQL, including any ORDER BY the server added
+	referenced := shared.ReferencedColumns(sql, visible)
+	slow.Columns = referenced
+
+	// In generate_only mode the SQL is the answer: nothing reaches the
+	// warehouse, not even EXPLAIN
+	if err := shared.ServiceMode.CheckExecute(cfg); err != nil {
+		log.Warn("Execution paused", shared.Phase(shared.PhaseExecute), "error", err, shared.SQLFields(sql))
+		h.recordRequest(r, cfg, slow, err)
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{
+			SQL:               shared.FormatSQL(sql),
+			LimitApplied:      limitApplied,
+			OrderApplied:      orderApplied,
+			Corrections:       corrections,
+			ReferencedColumns: referenced,
+			Error:             err.Error(),
+			Code:              string(nlerrors.CodeOf(err)),
+			Timings:           timing.result(),
+			SchemaVersion:     schemaVersion,
+			Model:             slow.Model,
+			Cohort:            cohort,
+		})
+		return
+	}
+
+	// Presentation hints for the result columns, by their SQL names
+	display := profile.ResultDisplay(sql)
+
+	// A compare request runs the SQL over two time windows instead
+	if req.Compare != nil {
+		h.answerComparison(w, r, cfg, tinybird, pipeline, visible, sql, *req.Compare, now, minGroup, timing, slow, QueryResponse{
+			LimitApplied:  limitApplied,
+			Corrections:   corrections,
+			MinGroupSize:  minGroup,
+			Display:       display,
+			SchemaVersion: schemaVersion,
+			Model:         slow.Model,
+			Cohort:        cohort,
+		})
+		return
+	}
+
+	// Described before the cost check so rejected queries are explained too
+	explanation := ""
+	if req.Explain {
+		explainStart := time.Now()
+		explanation = h.explainPlan(r, cfg, tinybird, sql, slow)
+		timing.add(phaseExplain, time.Since(explainStart))
+	}
+
+	// Reject queries estimated to read too much before running them
+	if err := shared.CheckEstimatedCost(tinybird, sql, cfg); err != nil {
+		if nlerrors.CodeOf(err) == nlerrors.CodeTooExpensive {
+			log.Warn("Query rejected by estimate", shared.Phase(shared.PhaseExecute), "error", err, shared.SQLFields(sql))
+			h.recordRequest(r, cfg, slow, err)
+			w.WriteHeader(nlerrors.HTTPStatus(err))
+			json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Explanation: explanation, Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: schemaVersion, Model: slow.Model, Cohort: cohort})
+			return
+		}
+		log.Warn("Cost estimate failed, executing anyway", shared.Phase(shared.PhaseExecute), "error", err)
+	}
+
+	// Suggested next questions only depend on the SQL and the visible schema
+	followUps := shared.SuggestFollowUps(sql, visible)
+
+	display = pipeline.Display(display)
+
+	// Stream large results row by row when enabled and supported. A page is
+	// already bounded, so it isn't streamed, and rows can't be withheld once
+	// streamed, so neither is a query under the reject policy.
+	rejectSmallGroups := minGroup > 0 && cfg.MinGroupPolicy == shared.GroupPolicyReject
+	if streamer, ok := tinybird.(shared.RowStreamer); ok && cfg.StreamResults && !paginated && !rejectSmallGroups {
+		h.streamQuery(w, r, cfg, streamer, pipeline, sql, streamTail{LimitApplied: limitApplied, OrderApplied: orderApplied, FollowUps: followUps, ReferencedColumns: referenced, MinGroupSize: minGroup, Display: display, Explanation: explanation, SchemaVersion: schemaVersion, Model: slow.Model, Cohort: cohort}, timing, slow)
+		return
+	}
+
+	// Execute against Tinybird
+	dbStart := time.Now()
+	result, err := tinybird.ExecuteQuery(sql)
+	dbDuration := time.Since(dbStart)
+	timing.add(shared.PhaseExecute, dbDuration)
+	slow.ExecuteMs = dbDuration.Milliseconds()
+
+	if err != nil {
+		h.recordRequest(r, cfg, slow, err)
+		h.notifyWarehouseError(cfg, slow, err)
+		log.Error("Tinybird error", shared.Phase(shared.PhaseExecute), "error", err, "code", nlerrors.CodeOf(err), shared.SQLFields(sql), shared.DurationMs(dbDuration))
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{
+			SQL:           shared.FormatSQL(sql),
+			Explanation:   explanation,
+			Error:         err.Error(),
+			Code:          string(nlerrors.CodeOf(err)),
+			Timings:       timing.result(),
+			SchemaVersion: schemaVersion,
+			Model:         slow.Model,
+			Cohort:        cohort,
+		})
+		return
+	}
+
+	stats := result.Stats()
+	log.Info("Query executed",
+		shared.Phase(shared.PhaseExecute),
+		slog.String(shared.LogSQLHash, shared.SQLHash(sql)),
+		"rows", result.Rows,
+		"rows_read", stats.RowsRead,
+		"bytes_read", stats.BytesRead,
+		shared.DurationMs(dbDuration),
+		"total_duration_ms", time.Since(start).Milliseconds(),
+	)
+	slow.Rows, slow.RowsRead, slow.BytesRead = result.Rows, stats.RowsRead, stats.BytesRead
+
+	// Withhold results of queries that read more than the budget allows or,
+	// under the reject policy, have a group below the minimum size
+	err = shared.CheckQueryCost(stats, cfg)
+	if err == nil && minGroup > 0 {
+		err = shared.CheckGroupSizes(result, minGroup, cfg.MinGroupPolicy)
+	}
+	h.recordRequest(r, cfg, slow, err)
+	if err != nil {
+		if nlerrors.CodeOf(err) == nlerrors.CodeGroupTooSmall {
+			log.Warn("Query results withheld by minimum group size", "audit", true, shared.Phase(shared.PhaseExecute), "error", err, shared.SQLFields(sql))
+		} else {
+			log.Warn("Query over cost budget", shared.Phase(shared.PhaseExecute), "error", err, shared.SQLFields(sql))
+		}
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: schemaVersion, Model: slow.Model, Cohort: cohort})
+		return
+	}
+
+	if result.Rows > 0 {
+		h.recordHistory(r, cfg, tenant, req.Session, question, gen.SQL, embedding, embeddingModel)
+	}
+
+	// A sample of answers is compared in the background with the
+	// SHADOW_FILE variant's. Pages aren't, as they hold only part of the rows.
+	if !paginated {
+		h.shadow(r, cfg, tinybird, shadowRequest{
+			question:    question,
+			now:         now,
+			profile:     profile,
+			schema:      schema,
+			permitted:   permitted,
+			visible:     visible,
+			checkAccess: principal != nil,
+			minGroup:    minGroup,
+			unordered:   pipeline.Unordered(),
+			sql:         sql,
+			result:      result,
+		})
+	}
+
+	// Mask sensitive columns before anything leaves the server, including
+	// logs, then format for presentation
+	pipeline.Process(result)
+	maskedColumns := pipeline.MaskedColumns()
+	if len(maskedColumns) > 0 {
+		log.Info("Result columns masked", "audit", true, "columns", maskedColumns, slog.String(shared.LogSQLHash, shared.SQLHash(sql)))
+	}
+
+	// Per-row lines are high volume; LOG_DEBUG_SAMPLE_RATE thins them out
+	for i, row := range result.Data {
+		log.Debug("Result row", shared.Phase(shared.PhaseExecute), "index", i, "row", row)
+	}
+
+	var page *shared.PageInfo
+	if paginated {
+		page = h.pageInfo(r, cfg, tinybird, shared.PageCursor{
+			Query:         pageQuery,
+			Page:          pageNum,
+			PageSize:      pageSize,
+			SchemaVersion: schemaVersion,
+			OrderApplied:  orderApplied,
+		}, result.Rows)
+	}
+
+	json.NewEncoder(w).Encode(QueryResponse{
+		SQL:               shared.FormatSQL(sql),
+		Data:              result.Data,
+		Rows:              result.Rows,
+		LimitApplied:      limitApplied,
+		OrderApplied:      orderApplied,
+		MaskedColumns:     maskedColumns,
+		Page:              page,
+		Corrections:       corrections,
+		FollowUps:         followUps,
+		ReferencedColumns: referenced,
+		MinGroupSize:      minGroup,
+		Display:           display,
+		Timings:           timing.result(),
+		Explanation:       explanation,
+		SchemaVersion:     schemaVersion,
+		Model:             slow.Model,
+		Cohort:            cohort,
+	})
+}
+
+// explainPlan runs EXPLAIN on sql and has the model describe the plan. It
+// is best-effort: if the warehouse can't explain or the model fails, the
+// response simply has no explanation.
+func (h *Query) explainPlan(r *http.Request, cfg *shared.Config, warehouse shared.Warehouse, sql string, slow *shared.SlowQuery) string {
+	log := shared.Logger(r.Context())
+	explainer, ok := warehouse.(shared.PlanExplainer)
+	if !ok || h.NewCompleter == nil {
+		return ""
+	}
+	start := time.Now()
+	plan, err := explainer.ExplainPlan(sql)
+	if err != nil {
+		log.Warn("EXPLAIN failed", "error", err, shared.SQLFields(sql))
+		return ""
+	}
+	estimated := int64(-1)
+	if estimator, ok := warehouse.(shared.RowEstimator); ok {
+		if rows, err := estimator.EstimateRows(sql); err == nil {
+			estimated = rows
+		}
+	}
+
+	completer := h.NewCompleter(cfg)
+	traced(r, completer)
+	text, usage, err := shared.DescribePlan(completer, sql, plan, estimated)
+	slow.InputTokens += usage.InputTokens
+	slow.OutputTokens += usage.OutputTokens
+	if err != nil {
+		log.Warn("Plan explanation failed", "error", err)
+		return ""
+	}
+	log.Info("Plan explained", "estimated_rows", estimated, shared.DurationMs(time.Since(start)))
+	return text
+}
+
+// recordRequest adds the request's spend and outcome (err, nil on success)
+// to the usage ledger and writes it to the slow-query log if it crossed a
+// threshold. Failing to persist either must not fail the request. For an
+// async job it also keeps err, so the worker knows whether to retry.
+func (h *Query) recordRequest(r *http.Request, cfg *shared.Config, slow *shared.SlowQuery, err error) {
+	log := shared.Logger(r.Context())
+	if err != nil {
+		slow.Code = string(nlerrors.CodeOf(err))
+		if slow.Code == "" {
+			slow.Code = "error"
+		}
+	}
+	if outcome, ok := r.Context().Value(jobOutcomeKey).(*jobOutcome); ok {
+		outcome.err = err
+	}
+	keyID := ""
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		keyID = principal.KeyID
+	}
+	if err := h.Usage.Record(shared.UsageRecord{
+		Tenant:       slow.Tenant,
+		Key:          keyID,
+		Model:        slow.Model,
+		InputTokens:  slow.InputTokens,
+		OutputTokens: slow.OutputTokens,
+		RowsRead:     slow.RowsRead,
+		BytesRead:    slow.BytesRead,
+		Cohort:       slow.Cohort,
+		Code:         slow.Code,
+		GenerateMs:   slow.GenerateMs,
+		Columns:      slow.Columns,
+	}, cfg.UsageFile); err != nil {
+		log.Error("Failed to record usage", "error", err)
+	}
+	if err := shared.RecordSlowQuery(r.Context(), cfg, slow); err != nil {
+		log.Error("Failed to record slow query", "error", err)
+	}
+}
+
+// notifyWarehouseError sends EventQueryFailed to webhooks if err is a
+// warehouse failure
+func (h *Query) notifyWarehouseError(cfg *shared.Config, slow *shared.SlowQuery, err error) {
+	if nlerrors.CodeOf(err) != nlerrors.CodeWarehouse {
+		return
+	}
+	h.Notifier.Notify(cfg, shared.EventQueryFailed, map[string]interface{}{
+		"request_id": slow.RequestID,
+		"tenant":     slow.Tenant,
+		"question":   slow.Question,
+		"sql":        slow.SQL,
+		"error":      err.Error(),
+	})
+}
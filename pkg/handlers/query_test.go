@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+	"github.com/raindrop/nl2sql/pkg/shared/fake"
+)
+
+// testSchema is a small warehouse schema shared by the handler tests
+var testSchema = &shared.Schema{Datasources: []shared.Datasource{{
+	Name: "orders",
+	Columns: []shared.Column{
+		{Name: "order_id", Type: "String"},
+		{Name: "seller_id", Type: "String"},
+		{Name: "price", Type: "Float64"},
+	},
+}}}
+
+// testConfig loads the configuration from env on top of the required
+// settings, the way the handlers would in production
+func testConfig(t *testing.T, env map[string]string) *shared.Config {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("OPENAI_API_KEY", fake.Token)
+	t.Setenv("TINYBIRD_HOST", "http://tinybird.invalid")
+	t.Setenv("TINYBIRD_TOKEN", fake.Token)
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := shared.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+// testDeps serves cfg with the in-memory generator and warehouse
+func testDeps(cfg *shared.Config, gen *fake.Generator, wh *fake.Warehouse) Deps {
+	return Deps{
+		LoadConfig:   func() (*shared.Config, error) { return cfg, nil },
+		NewGenerator: func(*shared.Config) shared.SchemaGenerator { return gen },
+		NewWarehouse: func(*shared.Config) shared.Warehouse { return wh },
+	}
+}
+
+func TestQuery(t *testing.T) {
+	const countSQL = "SELECT count() AS orders FROM orders"
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		gen        *fake.Generator
+		wh         *fake.Warehouse
+		wantStatus int
+		wantCode   string
+		wantRows   int
+		wantSQL    string
+		// wantExecuted is whether the SQL should have reached the warehouse
+		wantExecuted bool
+	}{
+		{
+			name:   "answers a question",
+			method: http.MethodPost,
+			body:   `{"query": "how many orders"}`,
+			gen:    &fake.Generator{SQL: map[string]string{"how many orders": countSQL}},
+			wh: &fake.Warehouse{Schema: testSchema, Results: map[string]*shared.TinybirdResponse{
+				countSQL: fake.Result(map[string]interface{}{"orders": 42}),
+			}},
+			wantStatus:   http.StatusOK,
+			wantRows:     1,
+			wantSQL:      countSQL,
+			wantExecuted: true,
+		},
+		{
+			name:       "rejects other methods",
+			method:     http.MethodDelete,
+			gen:        &fake.Generator{},
+			wh:         &fake.Warehouse{Schema: testSchema},
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "requires a question",
+			method:     http.MethodPost,
+			body:       `{"query": ""}`,
+			gen:        &fake.Generator{},
+			wh:         &fake.Warehouse{Schema: testSchema},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "rejects a malformed body",
+			method:     http.MethodPost,
+			body:       `{"query":`,
+			gen:        &fake.Generator{},
+			wh:         &fake.Warehouse{Schema: testSchema},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "reports a refused question",
+			method:     http.MethodPost,
+			body:       `{"query": "what is the weather"}`,
+			gen:        &fake.Generator{Refusals: map[string]string{"what is the weather": "no weather data"}},
+			wh:         &fake.Warehouse{Schema: testSchema},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   string(nlerrors.CodeUnsupportedQuery),
+		},
+		{
+			name:       "rejects generated SQL with a comment",
+			method:     http.MethodPost,
+			body:       `{"query": "how many orders"}`,
+			gen:        &fake.Generator{SQL: map[string]string{"how many orders": countSQL + " -- drop"}},
+			wh:         &fake.Warehouse{Schema: testSchema},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   string(nlerrors.CodeGrammarViolation),
+		},
+		{
+			name:       "fails when the schema can't be fetched",
+			method:     http.MethodPost,
+			body:       `{"query": "how many orders"}`,
+			gen:        &fake.Generator{SQL: map[string]string{"how many orders": countSQL}},
+			wh:         &fake.Warehouse{Err: errors.New("tinybird down")},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "reports a warehouse error",
+			method: http.MethodPost,
+			body:   `{"query": "how many orders"}`,
+			gen:    &fake.Generator{SQL: map[string]string{"how many orders": countSQL}},
+			// No canned result, so execution fails
+			wh:           &fake.Warehouse{Schema: testSchema},
+			wantStatus:   http.StatusInternalServerError,
+			wantSQL:      countSQL,
+			wantExecuted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			h := NewQuery(testDeps(cfg, tt.gen, tt.wh))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, "/api/query", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var resp QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if resp.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", resp.Code, tt.wantCode)
+			}
+			if resp.Rows != tt.wantRows {
+				t.Errorf("rows = %d, want %d", resp.Rows, tt.wantRows)
+			}
+			if tt.wantSQL != "" && resp.SQL != shared.FormatSQL(tt.wantSQL) {
+				t.Errorf("sql = %q, want %q", resp.SQL, tt.wantSQL)
+			}
+			if executed := len(tt.wh.Queries()) > 0; executed != tt.wantExecuted {
+				t.Errorf("executed = %v, want %v; queries %q", executed, tt.wantExecuted, tt.wh.Queries())
+			}
+			if tt.wantStatus >= 300 && resp.Error == "" {
+				t.Error("error response without an error message")
+			}
+		})
+	}
+}
+
+// TestQueryOrdersWithoutMaskedColumns checks the ORDER BY the server adds
+// to a row select leaves masked columns out, so their order isn't revealed
+func TestQueryOrdersWithoutMaskedColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		wantRun string
+	}{
+		{"select *", "SELECT * FROM orders", "SELECT * FROM orders ORDER BY order_id, price LIMIT 1000"},
+		{"masked column selected", "SELECT order_id, seller_id FROM orders", "SELECT order_id, seller_id FROM orders ORDER BY order_id LIMIT 1000"},
+		{"only masked columns", "SELECT seller_id FROM orders", "SELECT seller_id FROM orders LIMIT 1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"MASKED_COLUMNS": "seller_id"})
+			wh := &fake.Warehouse{Schema: testSchema, Results: map[string]*shared.TinybirdResponse{
+				tt.wantRun: fake.Result(map[string]interface{}{"order_id": "o1", "seller_id": "s1", "price": 10}),
+			}}
+			h := NewQuery(testDeps(cfg, &fake.Generator{SQL: map[string]string{"orders": tt.sql}}, wh))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/query", strings.NewReader(`{"query": "orders"}`)))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s; queries %q", rec.Code, rec.Body, wh.Queries())
+			}
+			var resp QueryResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if slices.Contains(resp.OrderApplied, "seller_id") {
+				t.Errorf("order_applied = %v, want no masked column", resp.OrderApplied)
+			}
+			if got := resp.Data[0]["seller_id"]; got == "s1" {
+				t.Error("seller_id returned unmasked")
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// queryRequestFromURL reads a GET /api/query request from its parameters:
+// q, and optionally timezone, as_of, tables (comma-separated), explain,
+// page, page_size, page_token and compare (a period: day, week or month)
+func queryRequestFromURL(params url.Values) (QueryRequest, error) {
+	req := QueryRequest{
+		Query:     params.Get("q"),
+		Timezone:  params.Get("timezone"),
+		AsOf:      params.Get("as_of"),
+		PageToken: params.Get("page_token"),
+	}
+	if period := params.Get("compare"); period != "" {
+		req.Compare = &shared.CompareSpec{Period: period}
+	}
+	if tables := params.Get("tables"); tables != "" {
+		for _, t := range strings.Split(tables, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				req.Tables = append(req.Tables, t)
+			}
+		}
+	}
+	var err error
+	if v := params.Get("explain"); v != "" {
+		if req.Explain, err = strconv.ParseBool(v); err != nil {
+			return QueryRequest{}, fmt.Errorf("explain must be true or false, got %q", v)
+		}
+	}
+	if v := params.Get("page"); v != "" {
+		if req.Page, err = strconv.Atoi(v); err != nil {
+			return QueryRequest{}, fmt.Errorf("page must be an integer, got %q", v)
+		}
+	}
+	if v := params.Get("page_size"); v != "" {
+		if req.PageSize, err = strconv.Atoi(v); err != nil {
+			return QueryRequest{}, fmt.Errorf("page_size must be an integer, got %q", v)
+		}
+	}
+	return req, nil
+}
+
+// serveCSV answers a format=csv request: the rows of the JSON response as
+// CSV. Failures keep their JSON body and status, so a client can still
+// tell why.
+func (h *Query) serveCSV(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+
+	rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	h.serve(rec, r)
+	var resp QueryResponse
+	if rec.status != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &resp) != nil {
+		rec.writeTo(w)
+		return
+	}
+	if resp.Error != "" {
+		// A stream that failed part-way; don't return a partial result
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(QueryResponse{SQL: resp.SQL, Error: resp.Error, Code: resp.Code})
+		return
+	}
+
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="result.csv"`)
+	if resp.Page != nil && resp.Page.NextPageToken != "" {
+		w.Header().Set("X-Next-Page-Token", resp.Page.NextPageToken)
+	}
+	if err := shared.WriteRowsCSV(w, resp.Data); err != nil {
+		log.Warn("Failed to write CSV", "error", err)
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// QuotaUsageResponse is the calling API key's usage and quota
+type QuotaUsageResponse struct {
+	Tenant string `json:"tenant"`
+	// Quota is nil when the key has no limits
+	Quota *shared.Quota       `json:"quota"`
+	Usage *shared.QuotaStatus `json:"usage"`
+}
+
+// QuotaUsage serves GET /api/usage: how much of its daily and monthly
+// quota the calling API key, or JWT user, has used. Usage is tracked per
+// caller, so it needs ACCESS_FILE or JWT_ISSUER.
+type QuotaUsage struct {
+	Deps
+}
+
+// NewQuotaUsage creates the quota usage handler
+func NewQuotaUsage(deps Deps) *QuotaUsage {
+	return &QuotaUsage{Deps: deps}
+}
+
+func (h *QuotaUsage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	principal := PrincipalFrom(r.Context())
+	if principal == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "usage is tracked per API key; none are configured"})
+		return
+	}
+	quota := shared.Quota{}
+	if principal.Quota != nil {
+		quota = *principal.Quota
+	}
+	status, err := h.Usage.QuotaStatus(principal.KeyID, quota, time.Now(), cfg.UsageFile)
+	if err != nil {
+		log.Error("Failed to read usage", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read usage"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(QuotaUsageResponse{Tenant: principal.Tenant, Quota: principal.Quota, Usage: status})
+}
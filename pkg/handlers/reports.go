@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/reports"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// reportStatus is a report with its next scheduled run
+type reportStatus struct {
+	reports.Report
+	NextRun time.Time `json:"next_run"`
+}
+
+// AdminReports serves /api/admin/reports. GET lists scheduled reports, POST
+// creates or replaces one, DELETE ?name= removes one and POST ?run=name runs
+// one immediately. Mount it behind AdminOnly.
+type AdminReports struct {
+	Deps
+}
+
+// NewAdminReports creates the scheduled reports admin handler
+func NewAdminReports(deps Deps) *AdminReports {
+	return &AdminReports{Deps: deps}
+}
+
+func (h *AdminReports) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+	if cfg.ReportsFile == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "reports are disabled: set REPORTS_FILE"})
+		return
+	}
+
+	writeError := func(status int, err error) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Get("run") != "":
+		name := r.URL.Query().Get("run")
+		all, err := reports.Load(cfg.ReportsFile)
+		if err != nil {
+			log.Error("Failed to load reports", "error", err)
+			writeError(http.StatusInternalServerError, err)
+			return
+		}
+		for _, report := range all {
+			if report.Name != name {
+				continue
+			}
+			runner := reports.NewRunner(func() (*shared.Config, error) { return cfg, nil })
+			res, err := runner.Run(r.Context(), report)
+			if err != nil {
+				log.Warn("Report run failed", "report", name, "error", err)
+			}
+			log.Info("Report run on demand", "audit", true, "report", name, "delivered", res.Delivered)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no such report"})
+		return
+
+	case r.Method == http.MethodPost:
+		var report reports.Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			writeError(http.StatusBadRequest, err)
+			return
+		}
+		if err := report.Validate(); err != nil {
+			writeError(http.StatusBadRequest, err)
+			return
+		}
+		if err := reports.Put(cfg.ReportsFile, report); err != nil {
+			log.Error("Failed to save report", "error", err)
+			writeError(http.StatusInternalServerError, err)
+			return
+		}
+		log.Info("Report saved", "audit", true, "report", report.Name, "cron", report.Cron, "destination", report.Destination.Type)
+
+	case r.Method == http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		found, err := reports.Delete(cfg.ReportsFile, name)
+		if err != nil {
+			log.Error("Failed to delete report", "error", err)
+			writeError(http.StatusInternalServerError, err)
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "no such report"})
+			return
+		}
+		log.Info("Report deleted", "audit", true, "report", name)
+	}
+
+	all, err := reports.Load(cfg.ReportsFile)
+	if err != nil {
+		log.Error("Failed to load reports", "error", err)
+		writeError(http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now().UTC()
+	statuses := make([]reportStatus, 0, len(all))
+	for _, report := range all {
+		status := reportStatus{Report: report}
+		if cron, err := reports.ParseCron(report.Cron); err == nil {
+			status.NextRun = cron.Next(now)
+		}
+		statuses = append(statuses, status)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reports": statuses,
+	})
+}
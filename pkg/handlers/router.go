@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Router registers handlers with per-route middleware on top of middleware
+// shared by every route
+type Router struct {
+	mux        *http.ServeMux
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{mux: http.NewServeMux()}
+}
+
+// Use appends middleware applied to every route, outermost first.
+// Call it before Handle.
+func (rt *Router) Use(mws ...Middleware) {
+	rt.middleware = append(rt.middleware, mws...)
+}
+
+// Handle registers h at pattern wrapped in the shared middleware and then mws
+func (rt *Router) Handle(pattern string, h http.Handler, mws ...Middleware) {
+	all := append(append([]Middleware(nil), rt.middleware...), mws...)
+	rt.mux.Handle(pattern, Chain(h, all...))
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// NewAPI registers every API route with its middleware. The Vercel
+// functions and `nl2sql serve` both serve this router, so every deployment
+// gets the same request IDs, CORS, body limit, auth and rate limit, all
+// driven by the request's config.
+func NewAPI(deps Deps) *Router {
+	rt := NewRouter()
+	rt.Use(RequestID, Recover)
+
+	// public is the stack of every caller-facing endpoint, which needs the
+	// query role. The rate limiter is shared, so RATE_LIMIT is one budget
+	// per client across endpoints.
+	limiter := RateLimit()
+	public := func(methods ...string) []Middleware {
+		return []Middleware{CORS(methods...), Compress, WithConfig(deps), BodyLimit, Authenticate(deps), RequireRole(shared.RoleQuery), limiter}
+	}
+	admin := []Middleware{WithConfig(deps), BodyLimit, AdminOnly(deps)}
+
+	// Trace sits outside Timeout so a timed-out request's trace is kept too
+	rt.Handle("/api/query", NewQuery(deps), append(public(http.MethodGet, http.MethodPost), Trace(deps), Timeout)...)
+	graphQL := NewGraphQL(deps)
+	rt.Handle("/api/graphql", graphQL, append(public(http.MethodGet, http.MethodPost), Trace(deps), Timeout)...)
+	rt.Handle("/graphql", graphQL, append(public(http.MethodGet, http.MethodPost), Trace(deps), Timeout)...)
+	rt.Handle("/api/export/sheets", NewExportSheets(deps), append(public(http.MethodPost), Trace(deps), Timeout)...)
+	rt.Handle("/api/schema", NewSchema(deps), public(http.MethodGet)...)
+	rt.Handle("/api/suggestions", NewSuggestions(deps), public(http.MethodGet)...)
+	eval := NewEval(deps)
+	rt.Handle("/api/eval", eval, public(http.MethodGet, http.MethodPost)...)
+	rt.Handle("/api/eval/metrics", NewEvalMetrics(eval), public(http.MethodGet)...)
+	rt.Handle("/api/usage", NewQuotaUsage(deps), public(http.MethodGet)...)
+	rt.Handle("/api/jobs/", NewJobs(deps), public(http.MethodGet)...)
+	rt.Handle("/api/admin/flags", NewAdminFlags(deps), admin...)
+	rt.Handle("/api/admin/mode", NewAdminMode(deps), admin...)
+	rt.Handle("/api/admin/config", NewAdminConfig(deps), admin...)
+	rt.Handle("/api/admin/reload", NewAdminReload(deps), admin...)
+	rt.Handle("/api/admin/reports", NewAdminReports(deps), admin...)
+	rt.Handle("/api/admin/usage", NewAdminUsage(deps), admin...)
+	rt.Handle("/api/admin/schema", NewAdminSchema(deps), admin...)
+	rt.Handle("/api/admin/refusals", NewAdminRefusals(deps), admin...)
+	rt.Handle("/api/admin/canary", NewAdminCanary(deps), admin...)
+	adminTraces := NewAdminTraces(deps)
+	rt.Handle("/api/admin/traces", adminTraces, admin...)
+	rt.Handle("/api/admin/traces/", adminTraces, admin...)
+	return rt
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Schema serves GET /api/schema: the datasources and columns the caller
+// can query. With API keys configured it is the key's filtered view.
+type Schema struct {
+	Deps
+}
+
+// NewSchema creates the schema handler
+func NewSchema(deps Deps) *Schema {
+	return &Schema{Deps: deps}
+}
+
+func (h *Schema) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	schemaStart := time.Now()
+	schema, cached, err := h.schema(r, cfg, h.NewWarehouse(cfg))
+	if err != nil {
+		log.Error("Failed to fetch schema", "error", err, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch schema"})
+		return
+	}
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		schema = principal.FilterSchema(schema)
+	}
+	log.Debug("Schema served", "tables", len(schema.Datasources), "cached", cached, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+
+	json.NewEncoder(w).Encode(schema)
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// shadowRequest is what the shadow generator needs from a primary answer
+type shadowRequest struct {
+	question string
+	now      time.Time
+	// profile is the tenant's, used unless the variant has its own
+	profile *shared.TenantProfile
+	// schema is the full schema; permitted and visible are the API key's
+	// columns and those the primary prompt was given
+	schema, permitted, visible *shared.Schema
+	checkAccess                bool
+	minGroup                   int
+	// unordered are the columns the primary query wasn't ordered by
+	unordered map[string]bool
+	// sql and result are the primary query and its rows, before
+	// post-processing
+	sql    string
+	result *shared.TinybirdResponse
+}
+
+// shadow answers a sample of requests again with the SHADOW_FILE variant,
+// in the background, and logs how its answer compares with the primary
+// one. Nothing it finds reaches the response.
+func (h *Query) shadow(r *http.Request, cfg *shared.Config, warehouse shared.Warehouse, req shadowRequest) {
+	if h.Shadows == nil || !shared.SampleShadow(cfg) {
+		return
+	}
+	log := shared.Logger(r.Context()).With("shadow", true)
+	variant, err := shared.LoadShadowVariant(cfg)
+	if err != nil {
+		log.Error("Failed to load shadow variant", "error", err)
+		return
+	}
+	// The primary rows are about to be masked and formatted in place
+	rows := shared.CopyRows(req.result.Data)
+	if !h.Shadows.Go(func() { h.runShadow(log, cfg, warehouse, variant, req, rows) }) {
+		log.Warn("Shadow comparison dropped", "variant", variant.Name, "reason", "too many in flight")
+	}
+}
+
+// runShadow compares the variant's answer with the primary rows and logs it
+func (h *Query) runShadow(log *slog.Logger, cfg *shared.Config, warehouse shared.Warehouse, variant *shared.ExperimentVariant, req shadowRequest, rows []map[string]interface{}) {
+	cmp := h.compareShadow(cfg, warehouse, variant, req, rows)
+	fields := []any{
+		"variant", cmp.Variant,
+		shared.LogModel, cmp.Model,
+		slog.String(shared.LogSQLHash, shared.SQLHash(req.sql)),
+		"shadow_sql", cmp.SQL,
+		"same_sql", cmp.SameSQL,
+		"agreed", cmp.Agreed,
+		"primary_rows", req.result.Rows,
+		"rows", cmp.Rows,
+		"cost_usd", cmp.CostUSD,
+		"generate_ms", cmp.GenerateMs,
+		"execute_ms", cmp.ExecuteMs,
+	}
+	switch {
+	case cmp.Err != nil:
+		log.Warn("Shadow failed", append(fields, "error", cmp.Err, "code", nlerrors.CodeOf(cmp.Err))...)
+	case cmp.Agreed:
+		log.Info("Shadow agreed", fields...)
+	default:
+		log.Warn("Shadow disagreed", fields...)
+	}
+}
+
+// compareShadow generates with the variant under the same constraints as
+// the primary answer, then executes the SQL unless it is the primary's
+func (h *Query) compareShadow(cfg *shared.Config, warehouse shared.Warehouse, variant *shared.ExperimentVariant, req shadowRequest, rows []map[string]interface{}) shared.ShadowComparison {
+	genCfg := cfg
+	if variant.Model != "" {
+		copied := *cfg
+		copied.OpenAIModel = variant.Model
+		genCfg = &copied
+	}
+	cmp := shared.ShadowComparison{Variant: variant.Name, Model: genCfg.OpenAIModel}
+
+	generator := h.NewGenerator(genCfg)
+	profile := variant.Profile
+	if profile == nil {
+		profile = req.profile
+	}
+	if pg, ok := generator.(shared.ProfileGenerator); ok {
+		pg.SetProfile(profile)
+	}
+	visible := variant.Profile.ApplyGrammar(req.visible)
+	if len(visible.Datasources) == 0 {
+		cmp.Err = errors.New("shadow grammar allows none of the visible tables")
+		return cmp
+	}
+	generator.SetSchema(visible)
+
+	genStart := time.Now()
+	gen, err := generator.Generate(req.question, req.now)
+	cmp.GenerateMs = time.Since(genStart).Milliseconds()
+	if gen != nil {
+		cmp.Model = gen.Model
+		cmp.CostUSD = shared.EstimateCost(gen.Model, gen.Usage)
+	}
+	if err != nil {
+		cmp.Err = err
+		return cmp
+	}
+
+	sql := gen.SQL
+	err = shared.ValidateLiterals(sql)
+	if err == nil && req.checkAccess {
+		err = shared.CheckSchemaAccess(sql, req.schema, req.permitted)
+	}
+	if err == nil && req.minGroup > 0 {
+		sql, err = shared.EnforceMinGroupSize(sql, req.minGroup, cfg.MinGroupPolicy)
+	}
+	if err != nil {
+		cmp.SQL, cmp.Err = sql, err
+		return cmp
+	}
+	// Bounded like the primary query, so the rows are comparable
+	sql, _, _ = shared.BoundRowSelect(sql, visible, cfg.MaxDefaultLimit, req.unordered)
+	if capped, ok := shared.ApplyDefaultLimit(sql, cfg.MaxDefaultLimit); ok {
+		sql = capped
+	}
+	cmp.SQL = sql
+	// The same SQL returns the same rows, so it isn't run twice
+	if shared.FormatSQL(sql) == shared.FormatSQL(req.sql) {
+		cmp.SameSQL, cmp.Agreed, cmp.Rows = true, true, req.result.Rows
+		return cmp
+	}
+
+	if err := shared.CheckEstimatedCost(warehouse, sql, cfg); err != nil && nlerrors.CodeOf(err) == nlerrors.CodeTooExpensive {
+		cmp.Err = err
+		return cmp
+	}
+	dbStart := time.Now()
+	result, err := warehouse.ExecuteQuery(sql)
+	cmp.ExecuteMs = time.Since(dbStart).Milliseconds()
+	if err != nil {
+		cmp.Err = err
+		return cmp
+	}
+	cmp.Rows = result.Rows
+	cmp.Agreed = shared.CompareRows(rows, result.Data)
+	return cmp
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// flushEvery is how many rows are written between flushes
+const flushEvery = 100
+
+// streamTail is the part of a QueryResponse written after the data array
+type streamTail struct {
+	Rows              int                             `json:"rows"`
+	LimitApplied      int                             `json:"limit_applied,omitempty"`
+	OrderApplied      []string                        `json:"order_applied,omitempty"`
+	MaskedColumns     []string                        `json:"masked_columns,omitempty"`
+	FollowUps         []string                        `json:"follow_ups,omitempty"`
+	ReferencedColumns []string                        `json:"referenced_columns,omitempty"`
+	MinGroupSize      int                             `json:"min_group_size,omitempty"`
+	Display           map[string]shared.ColumnDisplay `json:"display,omitempty"`
+	Timings           *Timings                        `json:"timings,omitempty"`
+	Explanation       string                          `json:"explanation,omitempty"`
+	SchemaVersion     string                          `json:"schema_version,omitempty"`
+	Model             string                          `json:"model,omitempty"`
+	Cohort            string                          `json:"cohort,omitempty"`
+	Error             string                          `json:"error,omitempty"`
+	Code              string                          `json:"code,omitempty"`
+}
+
+// streamQuery executes sql and writes a QueryResponse-shaped body row by
+// row as Tinybird returns them, ending with the fields in tail. Errors
+// before the first byte get a normal error response; later errors can only
+// be reported in the body's trailing "error" field, because the 200 status
+// is already sent. The rows/bytes read budget can't withhold results that
+// were already streamed, so it is only logged here; use the EXPLAIN
+// estimate to reject queries up front.
+func (h *Query) streamQuery(w http.ResponseWriter, r *http.Request, cfg *shared.Config, streamer shared.RowStreamer, pipeline *shared.Pipeline, sql string, tail streamTail, timing *serverTiming, slow *shared.SlowQuery) {
+	log := shared.Logger(r.Context())
+	flusher, _ := w.(http.Flusher)
+
+	started := false
+	rows := 0
+	dbStart := time.Now()
+	result, err := streamer.StreamQuery(sql, func(row map[string]interface{}) error {
+		pipeline.ProcessRow(row)
+		if !started {
+			timing.add(phaseFirstRow, time.Since(dbStart))
+			w.WriteHeader(http.StatusOK)
+			sqlJSON, _ := json.Marshal(shared.FormatSQL(sql))
+			w.Write([]byte(`{"sql":` + string(sqlJSON) + `,"data":[`))
+			started = true
+		} else {
+			w.Write([]byte(","))
+		}
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		rows++
+		if flusher != nil && rows%flushEvery == 0 {
+			flusher.Flush()
+		}
+		log.Debug("Result row", shared.Phase(shared.PhaseExecute), "index", rows-1, "row", row)
+		return nil
+	})
+	dbDuration := time.Since(dbStart)
+	slow.ExecuteMs = dbDuration.Milliseconds()
+	slow.Rows = rows
+
+	if err != nil && !started {
+		timing.add(shared.PhaseExecute, dbDuration)
+		log.Error("Tinybird error", shared.Phase(shared.PhaseExecute), "error", err, "code", nlerrors.CodeOf(err), shared.SQLFields(sql), shared.DurationMs(dbDuration))
+		h.recordRequest(r, cfg, slow, err)
+		h.notifyWarehouseError(cfg, slow, err)
+		w.WriteHeader(nlerrors.HTTPStatus(err))
+		json.NewEncoder(w).Encode(QueryResponse{SQL: shared.FormatSQL(sql), Explanation: tail.Explanation, Error: err.Error(), Code: string(nlerrors.CodeOf(err)), Timings: timing.result(), SchemaVersion: tail.SchemaVersion, Model: tail.Model, Cohort: tail.Cohort})
+		return
+	}
+	if !started {
+		// No rows: nothing has been written yet
+		timing.add(shared.PhaseExecute, dbDuration)
+		w.Write([]byte(`{"sql":`))
+		sqlJSON, _ := json.Marshal(shared.FormatSQL(sql))
+		w.Write(sqlJSON)
+		w.Write([]byte(`,"data":[`))
+	}
+
+	tail.Rows, tail.MaskedColumns = rows, pipeline.MaskedColumns()
+	if started {
+		// Streamed rows were timed as they went; this covers the whole stream
+		timing.add(shared.PhaseExecute, dbDuration)
+	}
+	if err != nil {
+		log.Error("Stream aborted", shared.Phase(shared.PhaseExecute), "error", err, "rows_written", rows, shared.SQLFields(sql))
+		h.notifyWarehouseError(cfg, slow, err)
+		tail.Error = err.Error()
+		tail.Code = string(nlerrors.CodeOf(err))
+	} else {
+		tail.Rows = result.Rows
+		stats := result.Stats()
+		slow.Rows, slow.RowsRead, slow.BytesRead = result.Rows, stats.RowsRead, stats.BytesRead
+		log.Info("Query executed",
+			shared.Phase(shared.PhaseExecute),
+			slog.String(shared.LogSQLHash, shared.SQLHash(sql)),
+			"rows", result.Rows,
+			"rows_read", stats.RowsRead,
+			"bytes_read", stats.BytesRead,
+			"streamed", true,
+			shared.DurationMs(dbDuration),
+		)
+		if err := shared.CheckQueryCost(stats, cfg); err != nil {
+			log.Warn("Streamed query over cost budget", shared.Phase(shared.PhaseExecute), "error", err, shared.SQLFields(sql))
+		}
+	}
+	h.recordRequest(r, cfg, slow, err)
+	if len(tail.MaskedColumns) > 0 {
+		log.Info("Result columns masked", "audit", true, "columns", tail.MaskedColumns, slog.String(shared.LogSQLHash, shared.SQLHash(sql)))
+	}
+
+	tail.Timings = timing.result()
+	tailJSON, _ := json.Marshal(tail)
+	w.Write([]byte("],"))
+	w.Write(tailJSON[1:])
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Suggestions serves GET /api/suggestions: example questions per
+// datasource for the frontend, limited to what the caller's API key can see,
+// or the tenant's TENANTS_FILE examples
+type Suggestions struct {
+	Deps
+}
+
+// NewSuggestions creates the question suggestion handler
+func NewSuggestions(deps Deps) *Suggestions {
+	return &Suggestions{Deps: deps}
+}
+
+func (h *Suggestions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+	if err := shared.Features.SetConfig(cfg.FeatureFlags); err != nil {
+		log.Error("Failed to load feature flags", "error", err)
+	}
+
+	// A tenant's curated examples replace the generated questions
+	tenant := ""
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		tenant = principal.Tenant
+	}
+	profile, err := shared.LoadTenantProfile(cfg, tenant)
+	if err != nil {
+		log.Error("Failed to load tenant profile", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server configuration error"})
+		return
+	}
+	if examples := profile.Suggestions(); examples != nil {
+		w.Header().Set("Cache-Control", "private, max-age=300")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"suggestions": examples,
+		})
+		return
+	}
+
+	schemaStart := time.Now()
+	schema, _, err := h.schema(r, cfg, h.NewWarehouse(cfg))
+	if err != nil {
+		log.Error("Failed to fetch schema", "error", err, shared.Phase(shared.PhaseSchema), shared.DurationMs(time.Since(schemaStart)))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch schema"})
+		return
+	}
+
+	// Suggestions are cached per schema, so build them from the full schema
+	// and filter per key afterwards
+	var llm shared.Completer
+	if shared.Features.Enabled(shared.FlagSuggestionPolish) {
+		llm = h.NewCompleter(cfg)
+	}
+	suggestions, err := shared.CachedSuggestions(schema, llm)
+	if err != nil {
+		log.Warn("Suggestion polish failed, serving templates", "error", err)
+	}
+
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		visible := make(map[string]bool)
+		for _, ds := range principal.FilterSchema(schema).Datasources {
+			visible[ds.Name] = true
+		}
+		allowed := make([]shared.Suggestion, 0, len(suggestions))
+		for _, s := range suggestions {
+			ok := visible[s.Datasource]
+			for _, col := range s.Columns {
+				ok = ok && principal.Allows(s.Datasource, col)
+			}
+			if ok {
+				allowed = append(allowed, s)
+			}
+		}
+		suggestions = allowed
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"suggestions": suggestions,
+	})
+}
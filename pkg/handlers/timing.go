@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Timings is the per-phase latency breakdown returned with query responses
+type Timings struct {
+	SchemaMs     int64 `json:"schema_ms"`
+	GenerationMs int64 `json:"generation_ms"`
+	// ExplainMs is set when a plan explanation was requested
+	ExplainMs   int64 `json:"explain_ms,omitempty"`
+	ExecutionMs int64 `json:"execution_ms"`
+	// FirstRowMs is the time to the first streamed row
+	FirstRowMs int64 `json:"first_row_ms,omitempty"`
+	TotalMs    int64 `json:"total_ms"`
+}
+
+// serverTiming reports phase durations in the Server-Timing header and the
+// response's timings. The header is rewritten after each phase, so an early
+// error response still carries the phases that completed.
+type serverTiming struct {
+	w       http.ResponseWriter
+	start   time.Time
+	parts   []string
+	timings Timings
+}
+
+func newServerTiming(w http.ResponseWriter, start time.Time) *serverTiming {
+	return &serverTiming{w: w, start: start}
+}
+
+func (t *serverTiming) add(phase string, d time.Duration) {
+	t.parts = append(t.parts, fmt.Sprintf("%s;dur=%.1f", phase, float64(d.Microseconds())/1000))
+	t.w.Header().Set("Server-Timing", strings.Join(t.parts, ", "))
+
+	ms := d.Milliseconds()
+	switch phase {
+	case shared.PhaseSchema:
+		t.timings.SchemaMs = ms
+	case shared.PhaseGenerate:
+		t.timings.GenerationMs = ms
+	case phaseExplain:
+		t.timings.ExplainMs = ms
+	case shared.PhaseExecute:
+		t.timings.ExecutionMs = ms
+	case phaseFirstRow:
+		t.timings.FirstRowMs = ms
+	}
+}
+
+// result returns the phases so far, with the total measured from the start
+// of the request
+func (t *serverTiming) result() *Timings {
+	timings := t.timings
+	timings.TotalMs = time.Since(t.start).Milliseconds()
+	return &timings
+}
+
+// Server-Timing phases that are not log phases
+const (
+	phaseExplain  = "explain"
+	phaseFirstRow = "first_row"
+)
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// maxTracedBody bounds the request and response bodies kept in a trace
+const maxTracedBody = 1 << 20
+
+// Trace records a bundle of each request when TRACE_BUFFER or TRACE_DIR
+// is set: the request, every call it made to OpenAI and Tinybird, and the
+// response without its rows, for /api/admin/traces. Needs WithConfig.
+func Trace(deps Deps) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg, _ := r.Context().Value(configKey).(*shared.Config)
+			if cfg == nil || deps.Traces == nil || !shared.Tracing(cfg) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			trace := &shared.Trace{}
+			// The request body is kept as the handler reads it
+			var reqBody limitedBuffer
+			if r.Body != nil {
+				r.Body = &teeBody{Reader: io.TeeReader(r.Body, &reqBody), Closer: r.Body}
+			}
+			tw := &traceWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), traceKey, trace)))
+
+			bundle := &shared.TraceBundle{
+				RequestID:    RequestIDFrom(r.Context()),
+				Time:         start.UTC(),
+				Method:       r.Method,
+				Path:         r.URL.RequestURI(),
+				Request:      shared.TraceJSON(reqBody.Bytes(), false),
+				Status:       tw.status,
+				ServerTiming: w.Header().Get("Server-Timing"),
+				DurationMs:   time.Since(start).Milliseconds(),
+			}
+			if principal := PrincipalFrom(r.Context()); principal != nil {
+				bundle.Tenant = principal.Tenant
+			}
+			// Streamed and CSV responses aren't kept, only their status
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+				bundle.Response = shared.TraceJSON(tw.body.Bytes(), true)
+			}
+			bundle.Finish(trace.Calls())
+			if err := deps.Traces.Save(cfg, bundle); err != nil {
+				shared.Logger(r.Context()).Error("Failed to save trace", "error", err)
+			}
+		})
+	}
+}
+
+// traced makes client record its calls to the request's trace, if it is
+// being traced and client supports it
+func traced(r *http.Request, client interface{}) {
+	trace, _ := r.Context().Value(traceKey).(*shared.Trace)
+	if tracer, ok := client.(shared.Tracer); ok && trace != nil {
+		tracer.TraceTo(trace)
+	}
+}
+
+// limitedBuffer keeps the first maxTracedBody bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxTracedBody - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// traceWriter keeps the status and body of a response as it is written
+type traceWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        limitedBuffer
+}
+
+func (w *traceWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *traceWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// AdminTraces serves the trace bundles recorded by Trace:
+// GET /api/admin/traces lists those held in memory, newest first, and
+// GET /api/admin/traces/{request_id} (or ?request_id=) downloads one.
+// Mount it behind AdminOnly.
+type AdminTraces struct {
+	Deps
+}
+
+// NewAdminTraces creates the trace bundle admin handler
+func NewAdminTraces(deps Deps) *AdminTraces {
+	return &AdminTraces{Deps: deps}
+}
+
+func (h *AdminTraces) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := shared.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		log.Warn("Method not allowed", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	cfg := h.config(w, r)
+	if cfg == nil {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/traces"), "/")
+	if id == "" {
+		id = r.URL.Query().Get("request_id")
+	}
+	if id == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"traces": h.Traces.Recent()})
+		return
+	}
+
+	data, err := h.Traces.Get(cfg, id)
+	if errors.Is(err, shared.ErrTraceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "trace not found"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to read trace", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read trace"})
+		return
+	}
+
+	log.Info("Trace downloaded", "audit", true, "trace_request_id", id)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+shared.TraceFileName(id)+`"`)
+	w.Write(data)
+}
@@ -0,0 +1,161 @@
+// Package nl2sql embeds the natural-language-to-SQL pipeline in other Go
+// services without running the HTTP API.
+//
+//	cfg, _ := shared.LoadConfig()
+//	svc := nl2sql.NewFromConfig(cfg)
+//	if err := svc.LoadSchema(); err != nil { ... }
+//	res, err := svc.Query("What is the total revenue?")
+package nl2sql
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Re-exported types so callers don't need to import pkg/shared directly
+type (
+	Schema              = shared.Schema
+	Generation          = shared.Generation
+	EvalCase            = shared.EvalCase
+	EvalResult          = shared.EvalResult
+	EvalOptions         = shared.EvalOptions
+	WarehouseResult     = shared.TinybirdResponse
+	ErrUnsupportedQuery = shared.ErrUnsupportedQuery
+)
+
+// Provider generates SQL constrained by the current schema.
+// *shared.OpenAIClient is the production implementation.
+type Provider = shared.SchemaGenerator
+
+// Warehouse executes SQL and describes the available data.
+// *shared.TinybirdClient is the production implementation.
+type Warehouse = shared.Warehouse
+
+// ErrSchemaNotLoaded is returned when Generate or Query is called before LoadSchema
+var ErrSchemaNotLoaded = errors.New("schema not loaded: call LoadSchema first")
+
+// QueryResult is the outcome of Query
+type QueryResult struct {
+	SQL          string
+	Data         []map[string]interface{}
+	Rows         int
+	LimitApplied int
+	// OrderApplied lists the ORDER BY columns added to a row select
+	OrderApplied []string
+}
+
+// Service runs the generate → execute pipeline. Safe for concurrent use
+// once the schema is loaded.
+type Service struct {
+	provider  Provider
+	warehouse Warehouse
+
+	// MaxDefaultLimit is appended as LIMIT to multi-row queries without one,
+	// and lowers larger LIMITs on row selects. Zero disables the cap.
+	MaxDefaultLimit int
+
+	// Check, if set, vets generated SQL before Query runs it, e.g. a
+	// shared.Pipeline's CheckSQL; Query returns its error
+	Check func(sql string) error
+
+	mu     sync.RWMutex
+	schema *Schema
+}
+
+// New creates a Service from a provider and a warehouse
+func New(provider Provider, warehouse Warehouse) *Service {
+	return &Service{
+		provider:  provider,
+		warehouse: warehouse,
+	}
+}
+
+// NewFromConfig creates a Service backed by OpenAI and Tinybird
+func NewFromConfig(cfg *shared.Config) *Service {
+	svc := New(shared.NewOpenAIClient(cfg), shared.NewTinybirdClient(cfg))
+	svc.MaxDefaultLimit = cfg.MaxDefaultLimit
+	return svc
+}
+
+// LoadSchema fetches the schema from the warehouse and installs it in the
+// provider. Call it once at startup and again whenever the schema changes.
+func (s *Service) LoadSchema() error {
+	schema, err := s.warehouse.FetchSchema()
+	if err != nil {
+		return fmt.Errorf("failed to fetch schema: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.provider.SetSchema(schema)
+	s.schema = schema
+	return nil
+}
+
+// Schema returns the loaded schema, or nil before LoadSchema
+func (s *Service) Schema() *Schema {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.schema
+}
+
+// Generate converts a question to SQL using the current time as reference
+func (s *Service) Generate(question string) (*Generation, error) {
+	return s.GenerateAt(question, time.Now().UTC())
+}
+
+// GenerateAt converts a question to SQL with a fixed reference time
+func (s *Service) GenerateAt(question string, referenceTime time.Time) (*Generation, error) {
+	if s.Schema() == nil {
+		return nil, ErrSchemaNotLoaded
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.provider.Generate(question, referenceTime)
+}
+
+// Execute runs SQL against the warehouse as-is
+func (s *Service) Execute(sql string) (*WarehouseResult, error) {
+	return s.warehouse.ExecuteQuery(sql)
+}
+
+// Query generates SQL for a question, checks it with Check, bounds row
+// selects, applies the default LIMIT and executes it.
+// Refusals are returned as ErrUnsupportedQuery.
+func (s *Service) Query(question string) (*QueryResult, error) {
+	gen, err := s.Generate(question)
+	if err != nil {
+		return nil, err
+	}
+	if s.Check != nil {
+		if err := s.Check(gen.SQL); err != nil {
+			return &QueryResult{SQL: gen.SQL}, err
+		}
+	}
+
+	sql, orderBy, lowered := shared.BoundRowSelect(gen.SQL, s.Schema(), s.MaxDefaultLimit, nil)
+	res := &QueryResult{SQL: sql, OrderApplied: orderBy}
+	if capped, ok := shared.ApplyDefaultLimit(sql, s.MaxDefaultLimit); ok || lowered {
+		res.SQL = capped
+		res.LimitApplied = s.MaxDefaultLimit
+	}
+
+	out, err := s.Execute(res.SQL)
+	if err != nil {
+		return res, err
+	}
+	res.Data = out.Data
+	res.Rows = out.Rows
+	return res, nil
+}
+
+// Evals runs the eval suite against this service's provider and warehouse
+func (s *Service) Evals(opts EvalOptions) ([]EvalResult, error) {
+	if s.Schema() == nil {
+		return nil, ErrSchemaNotLoaded
+	}
+	return shared.RunEvalsWithOptions(s.provider, s.warehouse, opts)
+}
@@ -0,0 +1,234 @@
+// Package nlerrors defines the typed errors returned across the pipeline.
+// Each carries a stable Code and whether retrying may succeed, so callers
+// branch with errors.As (or CodeOf/IsRetryable) instead of matching strings.
+package nlerrors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Code identifies an error kind in API responses, logs and eval results
+type Code string
+
+const (
+	CodeUnsupportedQuery Code = "unsupported_query"
+	CodeGrammarViolation Code = "grammar_violation"
+	CodeWarehouse        Code = "warehouse_error"
+	CodeLLMTimeout       Code = "llm_timeout"
+	CodeRateLimited      Code = "rate_limited"
+	CodeTooExpensive     Code = "query_too_expensive"
+	CodeQuotaExceeded    Code = "quota_exceeded"
+	CodePromptTooLarge   Code = "prompt_too_large"
+	CodeServicePaused    Code = "service_paused"
+	CodeGroupTooSmall    Code = "group_too_small"
+)
+
+// Error is implemented by every error in this package
+type Error interface {
+	error
+	Code() Code
+	Retryable() bool
+}
+
+// ErrUnsupportedQuery is returned when the LLM determines the query
+// cannot be answered with the available schema.
+type ErrUnsupportedQuery struct {
+	Reason        string
+	AvailableData string
+}
+
+func (e ErrUnsupportedQuery) Error() string   { return e.Reason }
+func (e ErrUnsupportedQuery) Code() Code      { return CodeUnsupportedQuery }
+func (e ErrUnsupportedQuery) Retryable() bool { return false }
+
+// ErrGrammarViolation is returned when the model's output isn't SQL the
+// grammar allows, e.g. no tool call or an empty statement.
+type ErrGrammarViolation struct {
+	SQL    string
+	Reason string
+}
+
+func (e ErrGrammarViolation) Error() string   { return "grammar violation: " + e.Reason }
+func (e ErrGrammarViolation) Code() Code      { return CodeGrammarViolation }
+func (e ErrGrammarViolation) Retryable() bool { return false }
+
+// ErrWarehouse is a failed warehouse call. Status is the HTTP status, or 0
+// when the request never got a response.
+type ErrWarehouse struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e ErrWarehouse) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("tinybird error: %v", e.Err)
+	}
+	return fmt.Sprintf("tinybird error (%d): %s", e.Status, e.Message)
+}
+func (e ErrWarehouse) Unwrap() error   { return e.Err }
+func (e ErrWarehouse) Code() Code      { return CodeWarehouse }
+func (e ErrWarehouse) Retryable() bool { return e.Status == 0 || e.Status >= 500 }
+
+// ErrLLMTimeout is returned when the LLM call exceeds the client timeout
+type ErrLLMTimeout struct {
+	Err error
+}
+
+func (e ErrLLMTimeout) Error() string   { return fmt.Sprintf("llm timeout: %v", e.Err) }
+func (e ErrLLMTimeout) Unwrap() error   { return e.Err }
+func (e ErrLLMTimeout) Code() Code      { return CodeLLMTimeout }
+func (e ErrLLMTimeout) Retryable() bool { return true }
+
+// ErrRateLimited is returned when an upstream (openai or tinybird) still
+// answers 429 after retries
+type ErrRateLimited struct {
+	Service string
+}
+
+func (e ErrRateLimited) Error() string   { return e.Service + " rate limited" }
+func (e ErrRateLimited) Code() Code      { return CodeRateLimited }
+func (e ErrRateLimited) Retryable() bool { return true }
+
+// ErrQueryTooExpensive is returned when a query reads, or is estimated to
+// read, more than the configured ceiling
+type ErrQueryTooExpensive struct {
+	// Measure is "rows_read", "bytes_read" or "estimated_rows"
+	Measure string
+	Value   int64
+	Limit   int64
+}
+
+func (e ErrQueryTooExpensive) Error() string {
+	return fmt.Sprintf("query too expensive: %s %d exceeds limit %d; try narrowing the time range or adding filters", e.Measure, e.Value, e.Limit)
+}
+func (e ErrQueryTooExpensive) Code() Code      { return CodeTooExpensive }
+func (e ErrQueryTooExpensive) Retryable() bool { return false }
+
+// ErrQuotaExceeded is returned when an API key has used up its daily or
+// monthly allowance of queries or tokens
+type ErrQuotaExceeded struct {
+	// Measure is "queries" or "tokens"
+	Measure string
+	// Period is "day" or "month"
+	Period   string
+	Limit    int
+	ResetsAt time.Time
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	period := "daily"
+	if e.Period == "month" {
+		period = "monthly"
+	}
+	return fmt.Sprintf("%s quota of %d %s used up; it resets at %s", period, e.Limit, e.Measure, e.ResetsAt.UTC().Format(time.RFC3339))
+}
+func (e ErrQuotaExceeded) Code() Code      { return CodeQuotaExceeded }
+func (e ErrQuotaExceeded) Retryable() bool { return false }
+
+// ErrPromptTooLarge is returned before generation when the prompt, mostly
+// the schema's tool description and grammar, is estimated to exceed the
+// token limit even with descriptions left out
+type ErrPromptTooLarge struct {
+	Tokens int
+	Limit  int
+}
+
+func (e ErrPromptTooLarge) Error() string {
+	return fmt.Sprintf("prompt too large: about %d tokens exceeds the limit of %d; the schema visible to this request needs fewer tables or columns", e.Tokens, e.Limit)
+}
+func (e ErrPromptTooLarge) Code() Code      { return CodePromptTooLarge }
+func (e ErrPromptTooLarge) Retryable() bool { return false }
+
+// ErrServicePaused is returned while an operator has switched the service
+// to a restricted mode: Mode is "generate_only", where SQL is generated but
+// not run, or "maintenance", where no query is accepted
+type ErrServicePaused struct {
+	Mode   string
+	Reason string
+}
+
+func (e ErrServicePaused) Error() string {
+	msg := "the service is in maintenance and not accepting queries"
+	if e.Mode == "generate_only" {
+		msg = "query execution is paused; SQL is generated but not run"
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+func (e ErrServicePaused) Code() Code      { return CodeServicePaused }
+func (e ErrServicePaused) Retryable() bool { return false }
+
+// ErrGroupTooSmall is returned under a minimum group size policy for a
+// query that would return individual rows, or, with the reject policy, a
+// group of fewer than MinSize rows
+type ErrGroupTooSmall struct {
+	MinSize int
+	// RowLevel is set for a query that doesn't aggregate at all
+	RowLevel bool
+	// Conditional is set for a query with a conditional aggregate such as
+	// countIf, which can describe fewer rows than the group it is in
+	Conditional bool
+	// Unchecked is set for a result under the reject policy that doesn't
+	// report its group sizes
+	Unchecked bool
+}
+
+func (e ErrGroupTooSmall) Error() string {
+	if e.RowLevel {
+		return fmt.Sprintf("only aggregates over groups of at least %d rows may be queried; ask for a count, sum or average instead of individual rows", e.MinSize)
+	}
+	if e.Conditional {
+		return fmt.Sprintf("conditional aggregates like countIf can describe fewer than %d rows of a group; filter the whole query instead", e.MinSize)
+	}
+	if e.Unchecked {
+		return fmt.Sprintf("the result doesn't report its group sizes, so groups of at least %d rows can't be confirmed", e.MinSize)
+	}
+	return fmt.Sprintf("a group in the result covers fewer than %d rows; group by fewer or broader columns", e.MinSize)
+}
+func (e ErrGroupTooSmall) Code() Code      { return CodeGroupTooSmall }
+func (e ErrGroupTooSmall) Retryable() bool { return false }
+
+// CodeOf returns the code of the first typed error in err's chain, or ""
+func CodeOf(err error) Code {
+	var e Error
+	if errors.As(err, &e) {
+		return e.Code()
+	}
+	return ""
+}
+
+// IsRetryable reports whether retrying the operation may succeed
+func IsRetryable(err error) bool {
+	var e Error
+	return errors.As(err, &e) && e.Retryable()
+}
+
+// HTTPStatus maps err to the status an API handler should respond with
+func HTTPStatus(err error) int {
+	switch CodeOf(err) {
+	case CodeUnsupportedQuery, CodeTooExpensive, CodeGroupTooSmall:
+		return http.StatusBadRequest
+	case CodeLLMTimeout:
+		return http.StatusGatewayTimeout
+	case CodePromptTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case CodeServicePaused:
+		return http.StatusServiceUnavailable
+	case CodeRateLimited:
+		return http.StatusTooManyRequests
+	case CodeQuotaExceeded:
+		// Out of queries is a rate limit; out of tokens is out of budget
+		var quota ErrQuotaExceeded
+		if errors.As(err, &quota) && quota.Measure == "tokens" {
+			return http.StatusPaymentRequired
+		}
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,145 @@
+package reports
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// maxEmailedRows bounds the rows rendered into an email
+const maxEmailedRows = 100
+
+// emailData is what emailTemplate renders
+type emailData struct {
+	*Result
+	Headline string
+	Columns  []string
+	Cells    [][]string
+	Shown    int
+}
+
+var emailTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html><body style="font-family: sans-serif; color: #222">
+<h2 style="margin-bottom: 4px">{{.Report}}</h2>
+<p style="color: #666; margin-top: 0">{{.Question}}</p>
+{{if .ConditionMet}}<p style="color: #b00020"><strong>Alert condition met</strong></p>{{end}}
+{{if .Headline}}<p style="font-size: 16px"><strong>{{.Headline}}</strong></p>{{end}}
+{{if .Columns}}<table style="border-collapse: collapse; font-size: 13px">
+<tr>{{range .Columns}}<th style="border: 1px solid #ddd; padding: 4px 8px; background: #f5f5f5; text-align: left">{{.}}</th>{{end}}</tr>
+{{range .Cells}}<tr>{{range .}}<td style="border: 1px solid #ddd; padding: 4px 8px">{{.}}</td>{{end}}</tr>
+{{end}}</table>{{else}}<p>(no rows)</p>{{end}}
+{{if lt .Shown .Rows}}<p style="color: #666"><em>{{.Shown}} of {{.Rows}} rows shown</em></p>{{end}}
+<p style="color: #999; font-size: 12px">Ran at {{.RanAt.Format "2006-01-02 15:04 MST"}}</p>
+</body></html>
+`))
+
+// sendEmail renders res as an HTML table, with a plain-text alternative,
+// and sends it through SMTP_HOST to every recipient
+func (rn *Runner) sendEmail(cfg *shared.Config, to []string, res *Result, headline string) error {
+	if cfg.SMTPHost == "" {
+		return ErrEmailNotConfigured
+	}
+	from := cfg.SMTPFrom
+	if from == "" {
+		from = cfg.SMTPUsername
+	}
+	if from == "" {
+		return errors.New("SMTP_FROM is not set")
+	}
+	msg, err := emailMessage(from, to, res, headline)
+	if err != nil {
+		return err
+	}
+
+	// The envelope needs bare addresses; headers keep display names
+	rcpt := make([]string, len(to))
+	for i, addr := range to {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("invalid email recipient %q: %w", addr, err)
+		}
+		rcpt[i] = parsed.Address
+	}
+	envelopeFrom := from
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		envelopeFrom = parsed.Address
+	}
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+	return rn.SendMail(addr, auth, envelopeFrom, rcpt, msg)
+}
+
+// emailMessage builds the multipart/alternative MIME message
+func emailMessage(from string, to []string, res *Result, headline string) ([]byte, error) {
+	data := emailData{Result: res, Headline: headline}
+	data.Columns, data.Cells = tableCells(res.Data, maxEmailedRows)
+	data.Shown = len(data.Cells)
+
+	var html bytes.Buffer
+	if err := emailTemplate.Execute(&html, data); err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	text.WriteString(res.Question + "\n\n")
+	if headline != "" {
+		text.WriteString(headline + "\n\n")
+	}
+	text.WriteString(formatTable(res.Data, maxEmailedRows))
+
+	subject := "Report: " + res.Report
+	if res.ConditionMet != nil {
+		subject = "Alert: " + res.Report
+	}
+
+	var msg bytes.Buffer
+	body := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@nl2sql>\r\n", messageID())
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", body.Boundary())
+
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text.String()},
+		{"text/html; charset=utf-8", html.String()},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write([]byte(strings.ReplaceAll(part.content, "\n", "\r\n")))
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+func messageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
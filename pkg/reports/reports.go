@@ -0,0 +1,223 @@
+// Package reports runs natural-language questions on a cron schedule and
+// delivers the results, optionally only when a threshold condition is met.
+// Reports are kept in the JSON file named by REPORTS_FILE and run by the
+// scheduler inside `nl2sql serve`.
+package reports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Destination types
+const (
+	DestinationWebhook = "webhook"
+	DestinationSlack   = "slack"
+	DestinationEmail   = "email"
+)
+
+// Report is a question run on a schedule
+type Report struct {
+	Name        string      `json:"name"`
+	Question    string      `json:"question"`
+	Cron        string      `json:"cron"`
+	Destination Destination `json:"destination"`
+	// Condition, when set, turns the report into an alert: results are only
+	// delivered when some row satisfies it
+	Condition *Condition `json:"condition,omitempty"`
+}
+
+// Destination is where results are delivered
+type Destination struct {
+	Type string `json:"type"`
+	// URL is the webhook or Slack incoming-webhook URL
+	URL string `json:"url,omitempty"`
+	// To lists email recipients
+	To []string `json:"to,omitempty"`
+}
+
+// Condition compares a result column against a threshold, e.g.
+// {"column": "total", "op": ">", "value": 1000}
+type Condition struct {
+	Column string  `json:"column"`
+	Op     string  `json:"op"`
+	Value  float64 `json:"value"`
+}
+
+// Validate checks the report can be scheduled and delivered
+func (r *Report) Validate() error {
+	if r.Name == "" || r.Question == "" {
+		return errors.New("report needs a name and a question")
+	}
+	if _, err := ParseCron(r.Cron); err != nil {
+		return err
+	}
+	switch r.Destination.Type {
+	case DestinationWebhook, DestinationSlack:
+		if r.Destination.URL == "" {
+			return fmt.Errorf("%s destination needs a url", r.Destination.Type)
+		}
+	case DestinationEmail:
+		if len(r.Destination.To) == 0 {
+			return errors.New("email destination needs recipients in to")
+		}
+		for _, to := range r.Destination.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return fmt.Errorf("invalid email recipient %q: %w", to, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown destination type %q (want webhook, slack or email)", r.Destination.Type)
+	}
+	if c := r.Condition; c != nil {
+		if c.Column == "" {
+			return errors.New("condition needs a column")
+		}
+		switch c.Op {
+		case ">", ">=", "<", "<=", "==", "!=":
+		default:
+			return fmt.Errorf("unknown condition op %q", c.Op)
+		}
+	}
+	return nil
+}
+
+// Met reports whether any row's column compares true against the threshold.
+// Non-numeric values never match.
+func (c *Condition) Met(data []map[string]interface{}) bool {
+	for _, row := range data {
+		v, ok := toFloat(row[c.Column])
+		if !ok {
+			continue
+		}
+		var met bool
+		switch c.Op {
+		case ">":
+			met = v > c.Value
+		case ">=":
+			met = v >= c.Value
+		case "<":
+			met = v < c.Value
+		case "<=":
+			met = v <= c.Value
+		case "==":
+			met = v == c.Value
+		case "!=":
+			met = v != c.Value
+		}
+		if met {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		// ClickHouse returns 64-bit integers as strings in JSON
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// fileMu serializes read-modify-write cycles on the reports file
+var fileMu sync.Mutex
+
+// Load reads the reports in path. A missing file means no reports.
+func Load(path string) ([]Report, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reports file: %w", err)
+	}
+	var reports []Report
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, fmt.Errorf("failed to parse reports file %s: %w", path, err)
+	}
+	return reports, nil
+}
+
+// Put adds report to path, replacing any report with the same name
+func Put(path string, report Report) error {
+	if err := report.Validate(); err != nil {
+		return err
+	}
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	reports, err := Load(path)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range reports {
+		if reports[i].Name == report.Name {
+			reports[i] = report
+			replaced = true
+		}
+	}
+	if !replaced {
+		reports = append(reports, report)
+	}
+	return save(path, reports)
+}
+
+// Delete removes the named report from path and reports whether it existed
+func Delete(path, name string) (bool, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	reports, err := Load(path)
+	if err != nil {
+		return false, err
+	}
+	kept := reports[:0]
+	for _, r := range reports {
+		if r.Name != name {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == len(reports) {
+		return false, nil
+	}
+	return true, save(path, kept)
+}
+
+// save writes reports atomically so the scheduler never reads a partial file
+func save(path string, reports []Report) error {
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode reports: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".reports-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write reports file: %w", err)
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write reports file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write reports file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,280 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nl2sql"
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// maxDeliveredRows bounds the rows rendered into a Slack message
+const maxDeliveredRows = 20
+
+// ErrEmailNotConfigured is returned when an email destination is run
+// without SMTP_HOST
+var ErrEmailNotConfigured = errors.New("email delivery is not configured (set SMTP_HOST)")
+
+// Result is the outcome of one report run. It is also the JSON payload
+// posted to webhook destinations.
+type Result struct {
+	Report       string                   `json:"report"`
+	Question     string                   `json:"question"`
+	RanAt        time.Time                `json:"ran_at"`
+	SQL          string                   `json:"sql,omitempty"`
+	Rows         int                      `json:"rows"`
+	Data         []map[string]interface{} `json:"data,omitempty"`
+	LimitApplied int                      `json:"limit_applied,omitempty"`
+	// ConditionMet is set for alerts
+	ConditionMet *bool  `json:"condition_met,omitempty"`
+	Delivered    bool   `json:"delivered"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Runner runs reports against the configured OpenAI and Tinybird
+type Runner struct {
+	// Config resolves the configuration for each run
+	Config     func() (*shared.Config, error)
+	HTTPClient *http.Client
+	// SendMail delivers email destinations; smtp.SendMail by default
+	SendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewRunner creates a runner that resolves config with loadConfig
+func NewRunner(loadConfig func() (*shared.Config, error)) *Runner {
+	return &Runner{Config: loadConfig, HTTPClient: &http.Client{Timeout: 30 * time.Second}, SendMail: smtp.SendMail}
+}
+
+// Run answers the report's question and delivers the result unless the
+// report's condition is not met. SQL that could reveal masked columns is
+// refused, and rows are masked and post-processed, as in the API.
+// The returned Result describes the run even when err is non-nil.
+func (rn *Runner) Run(ctx context.Context, report Report) (*Result, error) {
+	res := &Result{Report: report.Name, Question: report.Question, RanAt: time.Now().UTC()}
+	fail := func(err error) (*Result, error) {
+		res.Error = err.Error()
+		return res, err
+	}
+
+	cfg, err := rn.Config()
+	if err != nil {
+		return fail(fmt.Errorf("failed to load config: %w", err))
+	}
+	if err := shared.ServiceMode.CheckExecute(cfg); err != nil {
+		return fail(err)
+	}
+	// Reports have no API key, so they get the default post-processing
+	pipeline, err := shared.NewPipeline(cfg, "")
+	if err != nil {
+		return fail(err)
+	}
+	svc := nl2sql.NewFromConfig(cfg)
+	svc.Check = pipeline.CheckSQL
+	if err := svc.LoadSchema(); err != nil {
+		return fail(err)
+	}
+
+	out, err := svc.Query(report.Question)
+	if out != nil {
+		res.SQL = out.SQL
+		res.LimitApplied = out.LimitApplied
+	}
+	if err != nil {
+		return fail(err)
+	}
+	// The condition compares the values as queried, before presentation
+	// steps format them
+	met := report.Condition == nil || report.Condition.Met(out.Data)
+	result := &shared.TinybirdResponse{Data: out.Data, Rows: out.Rows}
+	pipeline.Process(result)
+	res.Data, res.Rows = result.Data, result.Rows
+
+	if report.Condition != nil {
+		res.ConditionMet = &met
+		if !met {
+			return res, nil
+		}
+	}
+
+	if err := rn.deliver(ctx, cfg, report.Destination, res); err != nil {
+		return fail(fmt.Errorf("failed to deliver report: %w", err))
+	}
+	res.Delivered = true
+	return res, nil
+}
+
+func (rn *Runner) deliver(ctx context.Context, cfg *shared.Config, dest Destination, res *Result) error {
+	switch dest.Type {
+	case DestinationWebhook:
+		return rn.post(ctx, dest.URL, res)
+	case DestinationSlack:
+		return rn.post(ctx, dest.URL, map[string]string{"text": slackText(res)})
+	case DestinationEmail:
+		return rn.sendEmail(cfg, dest.To, res, headline(cfg, res))
+	}
+	return fmt.Errorf("unknown destination type %q", dest.Type)
+}
+
+// headline summarizes the result in a sentence for the top of an email.
+// It is best-effort: without an OpenAI key or on failure there is none.
+func headline(cfg *shared.Config, res *Result) string {
+	if cfg.OpenAIAPIKey == "" || len(res.Data) == 0 {
+		return ""
+	}
+	text, _, err := shared.SummarizeResult(shared.NewOpenAIClient(cfg), res.Question, res.Data, res.Rows)
+	if err != nil {
+		slog.Warn("Failed to summarize report", "report", res.Report, "error", err)
+		return ""
+	}
+	return text
+}
+
+func (rn *Runner) post(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rn.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("destination returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// slackText renders a result as Slack mrkdwn: the question, then up to
+// maxDeliveredRows rows as a fixed-width table
+func slackText(res *Result) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%s*\n%s\n", res.Report, res.Question)
+	if res.ConditionMet != nil {
+		sb.WriteString(":rotating_light: Alert condition met\n")
+	}
+	sb.WriteString("```\n")
+	sb.WriteString(formatTable(res.Data, maxDeliveredRows))
+	sb.WriteString("```")
+	if res.Rows > maxDeliveredRows {
+		fmt.Fprintf(&sb, "\n_%d of %d rows shown_", maxDeliveredRows, res.Rows)
+	}
+	return sb.String()
+}
+
+// formatTable renders rows as aligned plain-text columns, sorted by name
+func formatTable(data []map[string]interface{}, limit int) string {
+	columns, rows := tableCells(data, limit)
+	if len(columns) == 0 {
+		return "(no rows)\n"
+	}
+	cells := append([][]string{columns}, rows...)
+	widths := make([]int, len(columns))
+	for _, row := range cells {
+		for j, cell := range row {
+			widths[j] = max(widths[j], len(cell))
+		}
+	}
+
+	var sb strings.Builder
+	for _, row := range cells {
+		for j, cell := range row {
+			if j > 0 {
+				sb.WriteString("  ")
+			}
+			fmt.Fprintf(&sb, "%-*s", widths[j], cell)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// tableCells returns the column names, sorted, and up to limit rows of
+// cell text
+func tableCells(data []map[string]interface{}, limit int) ([]string, [][]string) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var columns []string
+	for col := range data[0] {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+
+	if len(data) > limit {
+		data = data[:limit]
+	}
+	cells := make([][]string, len(data))
+	for i, row := range data {
+		cells[i] = make([]string, len(columns))
+		for j, col := range columns {
+			cells[i][j] = fmt.Sprint(row[col])
+		}
+	}
+	return columns, cells
+}
+
+// Scheduler runs due reports once a minute
+type Scheduler struct {
+	Runner *Runner
+	// Load returns the current reports; it is called every minute so edits
+	// take effect without a restart
+	Load func() ([]Report, error)
+}
+
+// Run blocks until ctx is done, starting each report whose cron expression
+// matches the current minute (UTC)
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		s.runDue(ctx, next)
+	}
+}
+
+func (s *Scheduler) runDue(ctx context.Context, at time.Time) {
+	reports, err := s.Load()
+	if err != nil {
+		slog.Error("Failed to load reports", "error", err)
+		return
+	}
+	for _, report := range reports {
+		cron, err := ParseCron(report.Cron)
+		if err != nil {
+			slog.Error("Invalid report schedule", "report", report.Name, "error", err)
+			continue
+		}
+		if !cron.Matches(at) {
+			continue
+		}
+		go func(report Report) {
+			res, err := s.Runner.Run(ctx, report)
+			if err != nil {
+				slog.Error("Report failed", "report", report.Name, "error", err, "sql", res.SQL)
+				return
+			}
+			slog.Info("Report ran", "report", report.Name, "rows", res.Rows, "delivered", res.Delivered, shared.SQLFields(res.SQL))
+		}(report)
+	}
+}
@@ -0,0 +1,283 @@
+package shared
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// Roles a principal can hold. The public endpoints need RoleQuery and
+// /api/admin/* RoleAdmin.
+const (
+	RoleQuery = "query"
+	RoleAdmin = "admin"
+)
+
+// AccessList maps API keys to the data they may query. It is loaded from
+// the JSON file named by ACCESS_FILE:
+//
+//	{"keys": {"sk_live_abc": {"tenant": "acme", "allow": ["order_items.*", "customers.name"],
+//	                          "quota": {"daily_queries": 500, "monthly_tokens": 2000000}},
+//	          "sk_ops_xyz": {"tenant": "ops", "roles": ["admin"]}}}
+//
+// Allow entries are "datasource.column", "datasource.*" or "*.*". Quota is
+// optional. Roles default to query.
+//
+// Tenants grant callers signed in with a JWT (JWT_ISSUER) what a key would,
+// by the tenant claim of their token, except for roles, which the token
+// carries. Their quota applies to each user:
+//
+//	{"tenants": {"acme": {"allow": ["order_items.*"], "quota": {"daily_queries": 100}}}}
+type AccessList struct {
+	Keys    map[string]Principal `json:"keys"`
+	Tenants map[string]Principal `json:"tenants,omitempty"`
+}
+
+// Principal is the caller identified by an API key or JWT
+type Principal struct {
+	Tenant string   `json:"tenant"`
+	Allow  []string `json:"allow"`
+	Quota  *Quota   `json:"quota,omitempty"`
+	// MinGroupSize raises MIN_GROUP_SIZE for this key, e.g. for keys handed
+	// to a broader audience
+	MinGroupSize int `json:"min_group_size,omitempty"`
+	// Roles are the endpoints the caller may reach
+	Roles []string `json:"roles,omitempty"`
+	// KeyID is a hash of the API key, or of a JWT's issuer and subject,
+	// safe to log and persist
+	KeyID string `json:"-"`
+	// Subject is the user a JWT was issued to; empty for API keys
+	Subject string `json:"-"`
+}
+
+// LoadAccessList reads and validates an ACCESS_FILE
+func LoadAccessList(path string) (*AccessList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access file: %w", err)
+	}
+	var acl AccessList
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, fmt.Errorf("failed to parse access file %s: %w", path, err)
+	}
+	for key, p := range acl.Keys {
+		if key == "" || p.Tenant == "" {
+			return nil, fmt.Errorf("access file %s: every key needs a tenant", path)
+		}
+		if err := checkAllow(p.Allow); err != nil {
+			return nil, fmt.Errorf("access file %s: %w for tenant %s", path, err, p.Tenant)
+		}
+		for _, role := range p.Roles {
+			if role != RoleQuery && role != RoleAdmin {
+				return nil, fmt.Errorf("access file %s: unknown role %q for tenant %s", path, role, p.Tenant)
+			}
+		}
+		if len(p.Roles) == 0 {
+			p.Roles = []string{RoleQuery}
+			acl.Keys[key] = p
+		}
+	}
+	for tenant, p := range acl.Tenants {
+		if tenant == "" {
+			return nil, fmt.Errorf("access file %s: empty tenant name", path)
+		}
+		if err := checkAllow(p.Allow); err != nil {
+			return nil, fmt.Errorf("access file %s: %w for tenant %s", path, err, tenant)
+		}
+		if len(p.Roles) > 0 {
+			return nil, fmt.Errorf("access file %s: tenant %s has roles, but JWT callers' roles come from their token", path, tenant)
+		}
+	}
+	return &acl, nil
+}
+
+func checkAllow(allow []string) error {
+	for _, entry := range allow {
+		if table, col, ok := strings.Cut(entry, "."); !ok || table == "" || col == "" {
+			return fmt.Errorf("invalid allow entry %q", entry)
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the principal for the request's "Authorization:
+// Bearer <key>" header, or ErrUnauthorized
+func (a *AccessList) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, ErrUnauthorized
+	}
+	for key, p := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			p := p
+			p.KeyID = SQLHash(key)
+			return &p, nil
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+// ByKeyID returns the principal whose API key hashes to keyID, for work
+// that outlives the request that authenticated it
+func (a *AccessList) ByKeyID(keyID string) (*Principal, bool) {
+	for key, p := range a.Keys {
+		if SQLHash(key) == keyID {
+			p := p
+			p.KeyID = keyID
+			return &p, true
+		}
+	}
+	return nil, false
+}
+
+// TenantPrincipal returns the principal of a JWT caller of tenant: its
+// Tenants entry, or, without an access list, every column. A tenant the
+// access list doesn't name gets ErrForbidden.
+func (a *AccessList) TenantPrincipal(tenant string) (*Principal, error) {
+	if a == nil {
+		return &Principal{Tenant: tenant, Allow: []string{"*.*"}}, nil
+	}
+	p, ok := a.Tenants[tenant]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown tenant %s", ErrForbidden, tenant)
+	}
+	p.Tenant = tenant
+	return &p, nil
+}
+
+// JWTKeyID is the Principal.KeyID of a JWT's user
+func JWTKeyID(issuer, subject string) string {
+	return SQLHash("jwt#" + issuer + "#" + subject)
+}
+
+// HasRole reports whether the principal holds role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the principal may see column of datasource
+func (p *Principal) Allows(datasource, column string) bool {
+	for _, entry := range p.Allow {
+		table, col, _ := strings.Cut(entry, ".")
+		if (table == "*" || table == datasource) && (col == "*" || col == column) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterSchema returns the part of schema the principal may see. Datasources
+// with no visible columns are dropped, and those with some marked Partial.
+// Generating the grammar and tool
+// description from the filtered schema means the model can't reference
+// restricted columns at all.
+func (p *Principal) FilterSchema(schema *Schema) *Schema {
+	filtered := &Schema{}
+	for _, ds := range schema.Datasources {
+		visible := Datasource{Name: ds.Name, Description: ds.Description}
+		for _, col := range ds.Columns {
+			if p.Allows(ds.Name, col.Name) {
+				visible.Columns = append(visible.Columns, col)
+			} else {
+				visible.Partial = true
+			}
+		}
+		if len(visible.Columns) > 0 {
+			filtered.Datasources = append(filtered.Datasources, visible)
+		}
+	}
+	for _, rel := range schema.Relationships {
+		if p.Allows(rel.From, rel.FromColumn) && p.Allows(rel.To, rel.ToColumn) {
+			filtered.Relationships = append(filtered.Relationships, rel)
+		}
+	}
+	for _, m := range schema.Metrics {
+		allowed := true
+		for _, col := range m.Columns() {
+			allowed = allowed && p.Allows(m.Table, col)
+		}
+		if allowed {
+			filtered.Metrics = append(filtered.Metrics, m)
+		}
+	}
+	return filtered
+}
+
+// CheckSchemaAccess rejects SQL that names a datasource or column present in
+// full but not in visible. Columns are checked against the tables the SQL
+// references, with SELECT * naming all of theirs, so a column visible in
+// one table doesn't open up another's. It backs up the grammar in case a
+// generator wasn't given the filtered schema.
+func CheckSchemaAccess(sql string, full, visible *Schema) error {
+	allowed := make(map[string]bool)
+	for _, ds := range visible.Datasources {
+		allowed[ds.Name] = true
+		for _, col := range ds.Columns {
+			allowed[col.Name] = true
+			allowed[ds.Name+"."+col.Name] = true
+		}
+	}
+	restricted := make(map[string]bool)
+	for _, ds := range full.Datasources {
+		if !allowed[ds.Name] {
+			restricted[ds.Name] = true
+		}
+		for _, col := range ds.Columns {
+			if !allowed[col.Name] {
+				restricted[col.Name] = true
+			}
+		}
+	}
+
+	for _, w := range wordRe.FindAllString(literalRe.ReplaceAllString(sql, "''"), -1) {
+		if restricted[w] {
+			return nlerrors.ErrGrammarViolation{SQL: sql, Reason: "references restricted data " + w}
+		}
+	}
+	for _, col := range ReferencedColumns(sql, full) {
+		if !allowed[col] {
+			return nlerrors.ErrGrammarViolation{SQL: sql, Reason: "references restricted data " + col}
+		}
+	}
+	return nil
+}
+
+// restrictedResultColumns returns the columns of the tables sql references
+// that visible leaves out of all of them: the result columns that would
+// carry restricted data under their own name
+func restrictedResultColumns(sql string, full, visible *Schema) map[string]bool {
+	seen := make(map[string]bool)
+	for _, w := range wordRe.FindAllString(literalRe.ReplaceAllString(sql, "''"), -1) {
+		seen[w] = true
+	}
+	shown := make(map[string]bool)
+	for _, ds := range visible.Datasources {
+		if seen[ds.Name] {
+			for _, col := range ds.Columns {
+				shown[col.Name] = true
+			}
+		}
+	}
+	restricted := make(map[string]bool)
+	for _, ds := range full.Datasources {
+		if !seen[ds.Name] {
+			continue
+		}
+		for _, col := range ds.Columns {
+			if !shown[col.Name] {
+				restricted[col.Name] = true
+			}
+		}
+	}
+	return restricted
+}
@@ -0,0 +1,79 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+// accessSchema has a column name, price, in two tables, so a grant on one
+// must not open up the other
+var accessSchema = &Schema{Datasources: []Datasource{
+	{Name: "orders", Columns: []Column{{Name: "order_id", Type: "String"}, {Name: "price", Type: "Float64"}}},
+	{Name: "payroll", Columns: []Column{{Name: "employee", Type: "String"}, {Name: "price", Type: "Float64"}, {Name: "salary", Type: "Float64"}}},
+}}
+
+func TestCheckSchemaAccess(t *testing.T) {
+	principal := &Principal{Allow: []string{"orders.*", "payroll.employee"}}
+	visible := principal.FilterSchema(accessSchema)
+
+	tests := []struct {
+		sql     string
+		allowed bool
+	}{
+		{"SELECT order_id, price FROM orders", true},
+		{"SELECT * FROM orders", true},
+		{"SELECT employee, count() FROM payroll GROUP BY employee", true},
+		{"SELECT count(*) FROM payroll", true},
+		{"SELECT employee FROM payroll WHERE employee != 'salary'", true},
+		{"SELECT salary FROM payroll", false},
+		{"SELECT price FROM payroll", false},
+		{"SELECT payroll.price FROM orders JOIN payroll ON orders.order_id = payroll.employee", false},
+		{"SELECT * FROM payroll", false},
+		{"SELECT employee, * FROM payroll", false},
+		{"SELECT p.* FROM payroll AS p", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			err := CheckSchemaAccess(tt.sql, accessSchema, visible)
+			if (err == nil) != tt.allowed {
+				t.Errorf("CheckSchemaAccess = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestGrammarOffersStarOnlyForWholeTables(t *testing.T) {
+	whole := (&Principal{Allow: []string{"orders.*"}}).FilterSchema(accessSchema)
+	if grammar := whole.GenerateGrammar(); !strings.Contains(grammar, "| column | star") {
+		t.Errorf("grammar for whole tables has no SELECT *:\n%s", grammar)
+	}
+	partial := (&Principal{Allow: []string{"orders.*", "payroll.employee"}}).FilterSchema(accessSchema)
+	grammar := partial.GenerateGrammar()
+	if strings.Contains(grammar, "| column | star") {
+		t.Errorf("grammar for a partly visible table offers SELECT *:\n%s", grammar)
+	}
+	if !strings.Contains(grammar, "agg_arg: column | star") {
+		t.Errorf("grammar for a partly visible table lost count(*):\n%s", grammar)
+	}
+}
+
+func TestPipelineRestrictDropsRestrictedColumns(t *testing.T) {
+	principal := &Principal{Allow: []string{"orders.*", "payroll.employee"}}
+	visible := principal.FilterSchema(accessSchema)
+	pipeline := &Pipeline{}
+	pipeline.Restrict("SELECT * FROM payroll", accessSchema, visible)
+
+	result := &TinybirdResponse{
+		Meta: []map[string]string{{"name": "employee"}, {"name": "price"}, {"name": "salary"}},
+		Data: []map[string]interface{}{{"employee": "ana", "price": 1.5, "salary": 100}},
+	}
+	pipeline.Process(result)
+
+	if row := result.Data[0]; len(row) != 1 || row["employee"] != "ana" {
+		t.Errorf("row = %v, want only employee", row)
+	}
+	if len(result.Meta) != 1 || result.Meta[0]["name"] != "employee" {
+		t.Errorf("meta = %v, want only employee", result.Meta)
+	}
+}
@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ErrAdminDisabled is returned when no ADMIN_TOKEN is configured
+var ErrAdminDisabled = errors.New("admin endpoints are disabled")
+
+// ErrUnauthorized is returned for a missing or wrong admin token
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrForbidden is returned for a valid credential that doesn't grant
+// access, e.g. a JWT without the required role
+var ErrForbidden = errors.New("forbidden")
+
+// CheckAdminAuth verifies the request carries "Authorization: Bearer <ADMIN_TOKEN>"
+func CheckAdminAuth(r *http.Request, cfg *Config) error {
+	if cfg.AdminToken == "" {
+		return ErrAdminDisabled
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// RequireAdmin checks admin auth and, on failure, writes a JSON error
+// response and audit-logs the attempt. Returns true if the caller may proceed.
+func RequireAdmin(w http.ResponseWriter, r *http.Request, cfg *Config) bool {
+	err := CheckAdminAuth(r, cfg)
+	if err == nil {
+		return true
+	}
+
+	status := http.StatusUnauthorized
+	if errors.Is(err, ErrAdminDisabled) {
+		status = http.StatusNotFound
+	}
+	slog.Warn("Admin request rejected", "audit", true, "path", r.URL.Path, "error", err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	return false
+}
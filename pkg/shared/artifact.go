@@ -0,0 +1,130 @@
+package shared
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// EvalRecord is one case of one run, flattened for artifact export
+type EvalRecord struct {
+	RunStartedAt time.Time `json:"run_started_at"`
+	Model        string    `json:"model"`
+	Name         string    `json:"name"`
+	Outcome      string    `json:"outcome"`
+	Query        string    `json:"query"`
+	ExpectedSQL  string    `json:"expected_sql"`
+	GeneratedSQL string    `json:"generated_sql"`
+	DurationMs   int64     `json:"duration_ms"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	CostUSD      float64   `json:"cost_usd"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Records flattens the run into one record per case
+func (run *EvalRun) Records() []EvalRecord {
+	records := make([]EvalRecord, 0, len(run.Results))
+	for _, r := range run.Results {
+		outcome := "fail"
+		switch {
+		case r.Skipped:
+			outcome = "skip"
+		case r.Passed:
+			outcome = "pass"
+		}
+		model := r.Model
+		if model == "" {
+			model = run.Model
+		}
+		records = append(records, EvalRecord{
+			RunStartedAt: run.StartedAt,
+			Model:        model,
+			Name:         r.Name,
+			Outcome:      outcome,
+			Query:        r.Query,
+			ExpectedSQL:  r.ExpectedSQL,
+			GeneratedSQL: r.GeneratedSQL,
+			DurationMs:   r.DurationMs,
+			InputTokens:  r.InputTokens,
+			OutputTokens: r.OutputTokens,
+			CostUSD:      r.CostUSD,
+			Error:        r.Error,
+		})
+	}
+	return records
+}
+
+// WriteEvalJSONL writes one JSON record per line
+func WriteEvalJSONL(w io.Writer, run *EvalRun) error {
+	enc := json.NewEncoder(w)
+	for _, rec := range run.Records() {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var evalCSVHeader = []string{
+	"run_started_at", "model", "name", "outcome", "query", "expected_sql", "generated_sql",
+	"duration_ms", "input_tokens", "output_tokens", "cost_usd", "error",
+}
+
+// WriteEvalCSV writes a header row followed by one row per case
+func WriteEvalCSV(w io.Writer, run *EvalRun) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(evalCSVHeader); err != nil {
+		return err
+	}
+	for _, rec := range run.Records() {
+		row := []string{
+			rec.RunStartedAt.Format(time.RFC3339),
+			rec.Model,
+			rec.Name,
+			rec.Outcome,
+			rec.Query,
+			rec.ExpectedSQL,
+			rec.GeneratedSQL,
+			strconv.FormatInt(rec.DurationMs, 10),
+			strconv.Itoa(rec.InputTokens),
+			strconv.Itoa(rec.OutputTokens),
+			strconv.FormatFloat(rec.CostUSD, 'f', 6, 64),
+			rec.Error,
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteEvalArtifact writes the run to path as JSONL or CSV, chosen by the
+// file extension (.jsonl or .csv)
+func WriteEvalArtifact(path string, run *EvalRun) error {
+	var write func(io.Writer, *EvalRun) error
+	switch filepath.Ext(path) {
+	case ".jsonl":
+		write = WriteEvalJSONL
+	case ".csv":
+		write = WriteEvalCSV
+	default:
+		return fmt.Errorf("unsupported artifact extension %q (want .jsonl or .csv)", filepath.Ext(path))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create artifact: %w", err)
+	}
+	if err := write(f, run); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write artifact: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,128 @@
+package shared
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pooledHTTPClient is shared by every client that isn't given its own, so
+// keep-alive connections to OpenAI and Tinybird survive across requests and
+// warm serverless invocations
+var pooledHTTPClient = func() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 32
+	return &http.Client{Transport: t}
+}()
+
+// SchemaCache keeps fetched schemas for a TTL. Held in a package-level
+// variable it survives warm serverless invocations, so only cold starts
+// and expired entries pay for the datasources call.
+type SchemaCache struct {
+	mu      sync.Mutex
+	entries map[string]schemaEntry
+	history map[string]*schemaHistory
+}
+
+type schemaEntry struct {
+	schema  *Schema
+	fetched time.Time
+	// pinned entries never expire, see Pin
+	pinned bool
+}
+
+func NewSchemaCache() *SchemaCache {
+	return &SchemaCache{entries: make(map[string]schemaEntry), history: make(map[string]*schemaHistory)}
+}
+
+// Get returns the schema cached under key if it is younger than ttl, or
+// pinned, and otherwise fetches it from warehouse. hit reports whether the
+// cache answered. A non-positive ttl always fetches.
+func (c *SchemaCache) Get(key string, ttl time.Duration, warehouse Warehouse) (schema *Schema, hit bool, err error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && (entry.pinned || ttl > 0 && time.Since(entry.fetched) < ttl) {
+		return entry.schema, true, nil
+	}
+
+	schema, err = warehouse.FetchSchema()
+	if err != nil {
+		return nil, false, err
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		c.entries[key] = schemaEntry{schema: schema, fetched: time.Now()}
+		c.mu.Unlock()
+	}
+	return schema, false, nil
+}
+
+// Pin caches schema under key until Set or Invalidate replaces it, whatever
+// the TTL, so requests don't try a warehouse known to be down
+func (c *SchemaCache) Pin(key string, schema *Schema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = schemaEntry{schema: schema, fetched: time.Now(), pinned: true}
+}
+
+// Set caches schema, fetched elsewhere, under key as if Get had fetched it
+func (c *SchemaCache) Set(key string, schema *Schema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = schemaEntry{schema: schema, fetched: time.Now()}
+}
+
+// Invalidate drops every cached schema
+func (c *SchemaCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]schemaEntry)
+}
+
+// SchemaCacheKey identifies the warehouse a config points at, and the
+// descriptions, relationships, metrics and column stats (which leave out
+// masked columns) applied on top of it. The token is hashed so it doesn't
+// sit in memory twice.
+func SchemaCacheKey(cfg *Config) string {
+	return cfg.TinybirdHost + cfg.TinybirdAPIBase + "#" + SQLHash(cfg.TinybirdToken) + "#" + cfg.SchemaDescriptionsFile + "#" + cfg.SchemaRelationships + "#" + cfg.MetricsFile + "#" + strconv.FormatBool(cfg.ColumnStats) + "#" + cfg.MaskedColumns
+}
+
+// compiledSchema holds the prompt artifacts derived from a schema
+type compiledSchema struct {
+	grammar         string
+	toolDescription string
+	// compactToolDescription leaves out descriptions, for prompts over
+	// the token limit
+	compactToolDescription string
+	userHint               string
+}
+
+var (
+	compiledMu    sync.Mutex
+	compiledCache = make(map[*Schema]compiledSchema)
+)
+
+// compile returns the grammar, tool description and user hint for schema,
+// reusing earlier results for the same (cached, treated as immutable) schema
+func compile(schema *Schema) compiledSchema {
+	compiledMu.Lock()
+	defer compiledMu.Unlock()
+	if c, ok := compiledCache[schema]; ok {
+		return c
+	}
+	c := compiledSchema{
+		grammar:         schema.GenerateGrammar(),
+		toolDescription: schema.GenerateToolDescription(),
+		userHint:        schema.GenerateUserHint(),
+	}
+	c.compactToolDescription = schema.withoutDescriptions().GenerateToolDescription()
+	// Schemas are replaced when the cache refreshes; bound the map rather
+	// than track every pointer's lifetime
+	if len(compiledCache) >= 32 {
+		compiledCache = make(map[*Schema]compiledSchema)
+	}
+	compiledCache[schema] = c
+	return c
+}
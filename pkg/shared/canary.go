@@ -0,0 +1,116 @@
+package shared
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Canary cohorts. Requests are only tagged with a cohort while a
+// CANARY_MODEL is configured.
+const (
+	CohortStable = "stable"
+	CohortCanary = "canary"
+)
+
+// RouteCanary picks the cohort of one request: CANARY_PERCENT of requests
+// go to CANARY_MODEL, the rest to OPENAI_MODEL. It returns the cohort and
+// the config to build the generator from, which is cfg itself unless the
+// request is in the canary. Without a canary it returns "" and cfg.
+func RouteCanary(cfg *Config) (string, *Config) {
+	if cfg.CanaryModel == "" || cfg.CanaryPercent <= 0 {
+		return "", cfg
+	}
+	if rand.Float64()*100 >= cfg.CanaryPercent {
+		return CohortStable, cfg
+	}
+	canary := *cfg
+	canary.OpenAIModel = cfg.CanaryModel
+	return CohortCanary, &canary
+}
+
+// CohortStats compares one cohort's requests: how many succeeded, how many
+// failed by error code, and how long generation took
+type CohortStats struct {
+	Cohort   string   `json:"cohort"`
+	Models   []string `json:"models"`
+	Requests int      `json:"requests"`
+	// SuccessRate is the percentage of requests that returned rows (0-100)
+	SuccessRate float64        `json:"success_rate"`
+	Errors      map[string]int `json:"errors"`
+	// GenerateP50Ms and GenerateP95Ms are generation latency percentiles
+	GenerateP50Ms int64 `json:"generate_p50_ms"`
+	GenerateP95Ms int64 `json:"generate_p95_ms"`
+	// CostUSD is the average estimated LLM cost per request
+	CostUSD float64 `json:"avg_cost_usd"`
+}
+
+// CanaryReport compares the stable and canary cohorts since a point in time
+type CanaryReport struct {
+	Since   time.Time     `json:"since"`
+	Cohorts []CohortStats `json:"cohorts"`
+}
+
+// CanaryReport compares cohorts using the records at or after since,
+// reading path when it is non-empty. Records without a cohort, from before
+// the canary or from other endpoints, are left out.
+func (l *UsageLedger) CanaryReport(since time.Time, path string) (*CanaryReport, error) {
+	records, err := l.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type cohort struct {
+		stats     CohortStats
+		latencies []int64
+		succeeded int
+		cost      float64
+	}
+	cohorts := make(map[string]*cohort)
+	for _, rec := range records {
+		if rec.Cohort == "" || rec.Time.Before(since) {
+			continue
+		}
+		c := cohorts[rec.Cohort]
+		if c == nil {
+			c = &cohort{stats: CohortStats{Cohort: rec.Cohort, Errors: make(map[string]int)}}
+			cohorts[rec.Cohort] = c
+		}
+		c.stats.Requests++
+		if rec.Model != "" {
+			c.stats.Models = appendUnique(c.stats.Models, rec.Model)
+		}
+		if rec.Code == "" {
+			c.succeeded++
+		} else {
+			c.stats.Errors[rec.Code]++
+		}
+		c.latencies = append(c.latencies, rec.GenerateMs)
+		c.cost += rec.CostUSD
+	}
+
+	report := &CanaryReport{Since: since, Cohorts: []CohortStats{}}
+	for _, c := range cohorts {
+		sort.Slice(c.latencies, func(i, j int) bool { return c.latencies[i] < c.latencies[j] })
+		c.stats.SuccessRate = float64(c.succeeded) / float64(c.stats.Requests) * 100
+		c.stats.GenerateP50Ms = percentileMs(c.latencies, 50)
+		c.stats.GenerateP95Ms = percentileMs(c.latencies, 95)
+		c.stats.CostUSD = c.cost / float64(c.stats.Requests)
+		sort.Strings(c.stats.Models)
+		report.Cohorts = append(report.Cohorts, c.stats)
+	}
+	sort.Slice(report.Cohorts, func(i, j int) bool { return report.Cohorts[i].Cohort > report.Cohorts[j].Cohort })
+	return report, nil
+}
+
+// percentileMs returns the p-th percentile of sorted, nearest-rank
+func percentileMs(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
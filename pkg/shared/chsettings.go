@@ -0,0 +1,156 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RequestSettings are the ClickHouse settings a request may set. They are
+// all limits, and a request may only lower one CLICKHOUSE_SETTINGS sets.
+var RequestSettings = []string{
+	"max_execution_time",
+	"max_rows_to_read",
+	"max_bytes_to_read",
+	"max_result_rows",
+	"max_result_bytes",
+}
+
+var (
+	settingNameRe  = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	settingValueRe = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+	settingNumRe   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+// ClickHouseSetting is one name=value entry of CLICKHOUSE_SETTINGS
+type ClickHouseSetting struct {
+	Name  string
+	Value string
+}
+
+// ParseClickHouseSettings parses a comma-separated list of name=value
+// settings, e.g. "max_execution_time=10,readonly=1". Values are numbers or
+// bare words, so they can be written into SQL without escaping.
+func ParseClickHouseSettings(spec string) ([]ClickHouseSetting, error) {
+	var settings []ClickHouseSetting
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !settingNameRe.MatchString(name) || !settingValueRe.MatchString(value) {
+			return nil, fmt.Errorf("invalid ClickHouse setting %q: want name=value", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("ClickHouse setting %s is set twice", name)
+		}
+		seen[name] = true
+		settings = append(settings, ClickHouseSetting{Name: name, Value: value})
+	}
+	return settings, nil
+}
+
+// formatClickHouseSettings is the inverse of ParseClickHouseSettings
+func formatClickHouseSettings(settings []ClickHouseSetting) string {
+	entries := make([]string, len(settings))
+	for i, s := range settings {
+		entries[i] = s.Name + "=" + s.Value
+	}
+	return strings.Join(entries, ",")
+}
+
+// WithRequestSettings returns the config to run a request with: cfg itself
+// when the request sets no ClickHouse settings, otherwise a copy whose
+// CLICKHOUSE_SETTINGS include them. Only RequestSettings may be set, to a
+// positive value no higher than the configured one.
+func WithRequestSettings(cfg *Config, requested map[string]int64) (*Config, error) {
+	if len(requested) == 0 {
+		return cfg, nil
+	}
+	settings, err := ParseClickHouseSettings(cfg.ClickHouseSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(requested))
+	for name := range requested {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := requested[name]
+		if !isRequestSetting(name) {
+			return nil, fmt.Errorf("setting %s can't be set per request (allowed: %s)", name, strings.Join(RequestSettings, ", "))
+		}
+		if value <= 0 {
+			return nil, fmt.Errorf("setting %s must be positive", name)
+		}
+		i := settingIndex(settings, name)
+		if i < 0 {
+			settings = append(settings, ClickHouseSetting{Name: name, Value: strconv.FormatInt(value, 10)})
+			continue
+		}
+		if limit, err := strconv.ParseInt(settings[i].Value, 10, 64); err == nil && limit > 0 && value > limit {
+			return nil, fmt.Errorf("setting %s=%d exceeds the server's limit of %d", name, value, limit)
+		}
+		settings[i].Value = strconv.FormatInt(value, 10)
+	}
+
+	withSettings := *cfg
+	withSettings.ClickHouseSettings = formatClickHouseSettings(settings)
+	return &withSettings, nil
+}
+
+func isRequestSetting(name string) bool {
+	for _, s := range RequestSettings {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func settingIndex(settings []ClickHouseSetting, name string) int {
+	for i, s := range settings {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// appendSettings adds a SETTINGS clause to sql. It runs after
+// CheckStatement, which rejects SETTINGS in generated SQL, so the clause
+// is always the server's. readonly goes last: once it applies, ClickHouse
+// refuses to change other settings.
+func appendSettings(sql string, settings []ClickHouseSetting) string {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	if len(settings) == 0 {
+		return sql
+	}
+	ordered := make([]ClickHouseSetting, 0, len(settings))
+	var readonly []ClickHouseSetting
+	for _, s := range settings {
+		if s.Name == "readonly" {
+			readonly = append(readonly, s)
+		} else {
+			ordered = append(ordered, s)
+		}
+	}
+	ordered = append(ordered, readonly...)
+
+	clauses := make([]string, len(ordered))
+	for i, s := range ordered {
+		value := s.Value
+		if !settingNumRe.MatchString(value) {
+			value = "'" + value + "'"
+		}
+		clauses[i] = s.Name + " = " + value
+	}
+	return sql + " SETTINGS " + strings.Join(clauses, ", ")
+}
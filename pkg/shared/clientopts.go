@@ -0,0 +1,205 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls retries of transient failures (network errors,
+// 429 and 5xx responses). MaxAttempts <= 1 disables retries.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// NoRetry makes a single attempt
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// DefaultRetryPolicy retries transient failures twice with exponential backoff
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second}
+
+// clientOptions are shared by OpenAIClient and TinybirdClient
+type clientOptions struct {
+	httpClient *http.Client
+	model      string
+	timeout    time.Duration
+	retry      RetryPolicy
+	logger     *slog.Logger
+	limiter    *CallLimiter
+	// trace, when set by TraceTo, records every attempt as a call to
+	// traceService
+	trace        *Trace
+	traceService string
+}
+
+// ClientOption customizes NewOpenAIClient and NewTinybirdClient
+type ClientOption func(*clientOptions)
+
+// WithHTTPClient sets the HTTP client used for API calls
+func WithHTTPClient(c *http.Client) ClientOption {
+	return func(o *clientOptions) { o.httpClient = c }
+}
+
+// WithModel overrides the configured model. Ignored by TinybirdClient.
+func WithModel(model string) ClientOption {
+	return func(o *clientOptions) { o.model = model }
+}
+
+// WithTimeout bounds each HTTP attempt
+func WithTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) { o.timeout = d }
+}
+
+// WithRetryPolicy sets how transient failures are retried
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(o *clientOptions) { o.retry = p }
+}
+
+// WithLimiter shares a CallLimiter between clients. NewOpenAIClient uses
+// OpenAILimiter by default.
+func WithLimiter(l *CallLimiter) ClientOption {
+	return func(o *clientOptions) { o.limiter = l }
+}
+
+// WithLogger sets the logger used for retries and request diagnostics
+func WithLogger(l *slog.Logger) ClientOption {
+	return func(o *clientOptions) { o.logger = l }
+}
+
+func newClientOptions(opts []ClientOption) clientOptions {
+	o := clientOptions{retry: NoRetry}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.httpClient == nil {
+		o.httpClient = pooledHTTPClient
+	}
+	if o.timeout > 0 {
+		c := *o.httpClient
+		c.Timeout = o.timeout
+		o.httpClient = &c
+	}
+	if o.logger == nil {
+		o.logger = slog.Default()
+	}
+	return o
+}
+
+// do sends the request built by newReq, retrying transient failures per the
+// retry policy, and returns the final status code and body. newReq is called
+// once per attempt so request bodies can be replayed.
+func (o *clientOptions) do(newReq func() (*http.Request, error)) (int, []byte, error) {
+	attempts := o.retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := o.retry.InitialBackoff
+
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		release := o.limiter.Acquire()
+		var req *http.Request
+		start := time.Now()
+		status, body, err := o.doOnce(func() (*http.Request, error) {
+			var err error
+			req, err = newReq()
+			return req, err
+		})
+		o.trace.record(o.traceService, req, attempt, status, body, err, time.Since(start))
+		release()
+		if status == http.StatusTooManyRequests {
+			o.limiter.Pause(backoff)
+		}
+		retryable := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt >= attempts {
+			return status, body, err
+		}
+
+		lastErr = err
+		if lastErr == nil {
+			lastErr = fmt.Errorf("status %d", status)
+		}
+		o.logger.Warn("Retrying request", "attempt", attempt, "backoff", backoff, "error", lastErr)
+		time.Sleep(backoff)
+		backoff *= 2
+		if o.retry.MaxBackoff > 0 && backoff > o.retry.MaxBackoff {
+			backoff = o.retry.MaxBackoff
+		}
+	}
+}
+
+func (o *clientOptions) doOnce(newReq func() (*http.Request, error)) (int, []byte, error) {
+	req, err := newReq()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// isTimeout reports whether err is a client-side timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// doStream is like do but hands the response to fn instead of buffering the
+// body. Retries happen only before fn is called: on network errors, 429 and
+// 5xx. For any other status fn receives the response; it must not close it.
+func (o *clientOptions) doStream(newReq func() (*http.Request, error), fn func(*http.Response) error) error {
+	attempts := o.retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := o.retry.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		start := time.Now()
+		resp, err := o.httpClient.Do(req)
+		if err != nil {
+			err = fmt.Errorf("failed to execute request: %w", err)
+			o.trace.record(o.traceService, req, attempt, 0, nil, err, time.Since(start))
+		} else if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 || attempt >= attempts {
+			// The streamed body isn't kept, only how long it took to start
+			o.trace.record(o.traceService, req, attempt, resp.StatusCode, nil, nil, time.Since(start))
+			defer resp.Body.Close()
+			return fn(resp)
+		} else {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+			o.trace.record(o.traceService, req, attempt, resp.StatusCode, body, nil, time.Since(start))
+		}
+		if attempt >= attempts {
+			return err
+		}
+
+		o.logger.Warn("Retrying request", "attempt", attempt, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if o.retry.MaxBackoff > 0 && backoff > o.retry.MaxBackoff {
+			backoff = o.retry.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ColumnStats describe a column's values, so the model can pick sensible
+// filters and notice a question asking for a range the data doesn't have
+type ColumnStats struct {
+	// Min and Max are set for numeric and date columns
+	Min interface{} `json:"min,omitempty"`
+	Max interface{} `json:"max,omitempty"`
+	// Distinct is ClickHouse's uniq() estimate of the distinct values
+	Distinct int64 `json:"distinct,omitempty"`
+}
+
+// statsColumnRe matches column names that can go in the stats query as is
+var statsColumnRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// collectColumnStats fills in Stats for the columns of every datasource,
+// one query per datasource. Masked columns are skipped, since their values
+// must not reach the prompt or /api/schema. A failed query only costs that
+// datasource its stats.
+func (c *TinybirdClient) collectColumnStats(schema *Schema) {
+	for i := range schema.Datasources {
+		ds := &schema.Datasources[i]
+		if !statsColumnRe.MatchString(ds.Name) {
+			continue
+		}
+
+		var selects []string
+		for _, col := range ds.Columns {
+			if !statsColumnRe.MatchString(col.Name) || c.masked[col.Name] != "" {
+				continue
+			}
+			t := baseType(col.Type)
+			if strings.HasPrefix(t, "Array") || strings.HasPrefix(t, "Map") || strings.HasPrefix(t, "Tuple") || strings.HasPrefix(t, "JSON") {
+				continue
+			}
+			if isNumericType(col.Type) || isDateType(col.Type) {
+				selects = append(selects, fmt.Sprintf("min(%s) AS %s__min", col.Name, col.Name), fmt.Sprintf("max(%s) AS %s__max", col.Name, col.Name))
+			}
+			selects = append(selects, fmt.Sprintf("uniq(%s) AS %s__distinct", col.Name, col.Name))
+		}
+		if len(selects) == 0 {
+			continue
+		}
+
+		result, err := c.ExecuteQuery(fmt.Sprintf("SELECT %s FROM %s", strings.Join(selects, ", "), ds.Name))
+		if err != nil || len(result.Data) == 0 {
+			c.logger.Warn("Column statistics failed", "datasource", ds.Name, "error", err)
+			continue
+		}
+		row := result.Data[0]
+		for j := range ds.Columns {
+			col := &ds.Columns[j]
+			distinct, ok := numericValue(row[col.Name+"__distinct"])
+			if !ok {
+				continue
+			}
+			col.Stats = &ColumnStats{Min: row[col.Name+"__min"], Max: row[col.Name+"__max"], Distinct: int64(distinct)}
+		}
+	}
+}
+
+// statsNote describes the column's stats for the tool description, e.g.
+// "values 0.85 to 6735, ~5968 distinct", or "" without stats
+func (col Column) statsNote() string {
+	if col.Stats == nil {
+		return ""
+	}
+	var parts []string
+	if col.Stats.Min != nil && col.Stats.Max != nil {
+		parts = append(parts, fmt.Sprintf("values %s to %s", formatStat(col.Stats.Min), formatStat(col.Stats.Max)))
+	}
+	if col.Stats.Distinct > 0 {
+		parts = append(parts, fmt.Sprintf("~%d distinct", col.Stats.Distinct))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatStat writes numbers without exponents, so large values stay readable
+func formatStat(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
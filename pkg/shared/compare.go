@@ -0,0 +1,327 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Compare periods: the period so far against the same stretch of the one
+// before, e.g. this week up to now against last week up to the same point
+var comparePeriods = map[string]bool{"day": true, "week": true, "month": true}
+
+// CompareSpec asks for a question to be answered over two time windows.
+// Either Period or Current is set; Previous defaults to the window of the
+// same length right before Current.
+type CompareSpec struct {
+	Period   string      `json:"period,omitempty"`
+	Current  *TimeWindow `json:"current,omitempty"`
+	Previous *TimeWindow `json:"previous,omitempty"`
+	// Column is the Date or DateTime column the windows filter on; the
+	// table's first one when empty
+	Column string `json:"column,omitempty"`
+}
+
+// TimeWindow is a time range; From is inclusive and To exclusive. Bounds
+// are dates or date-times in the request's time zone, like as_of.
+type TimeWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Comparison describes a compared response. Keys are the columns rows are
+// matched on and Measures the numeric columns compared; for each measure m
+// a row has m (current), m_previous, m_delta and m_delta_pct.
+type Comparison struct {
+	Column   string           `json:"column"`
+	Current  ComparisonWindow `json:"current"`
+	Previous ComparisonWindow `json:"previous"`
+	Keys     []string         `json:"keys,omitempty"`
+	Measures []string         `json:"measures"`
+}
+
+// ComparisonWindow is one resolved window and what ran over it
+type ComparisonWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	SQL  string `json:"sql,omitempty"`
+	Rows int    `json:"rows"`
+}
+
+// windowLayout formats window bounds as ClickHouse DateTime literals
+const windowLayout = "2006-01-02 15:04:05"
+
+// ResolveWindows turns spec into the current and previous windows, with
+// periods relative to now and bounds in now's location
+func ResolveWindows(spec CompareSpec, now time.Time) (current, previous ComparisonWindow, err error) {
+	var from, to time.Time
+	switch {
+	case spec.Period != "" && spec.Current != nil:
+		return current, previous, fmt.Errorf("compare takes a period or a current window, not both")
+	case spec.Period != "":
+		if !comparePeriods[spec.Period] {
+			return current, previous, fmt.Errorf("compare period must be day, week or month, got %q", spec.Period)
+		}
+		from, to = periodStart(spec.Period, now), now
+	case spec.Current != nil:
+		if from, to, err = parseWindow(*spec.Current, now.Location()); err != nil {
+			return current, previous, err
+		}
+	default:
+		return current, previous, fmt.Errorf("compare needs a period or a current window")
+	}
+
+	var prevFrom, prevTo time.Time
+	switch {
+	case spec.Previous != nil:
+		if prevFrom, prevTo, err = parseWindow(*spec.Previous, now.Location()); err != nil {
+			return current, previous, err
+		}
+	case spec.Period != "":
+		// Like for like: the previous period up to the same point
+		prevFrom = previousPeriodStart(spec.Period, from)
+		prevTo = prevFrom.Add(to.Sub(from))
+	default:
+		prevFrom, prevTo = from.Add(-to.Sub(from)), from
+	}
+
+	current = ComparisonWindow{From: from.Format(windowLayout), To: to.Format(windowLayout)}
+	previous = ComparisonWindow{From: prevFrom.Format(windowLayout), To: prevTo.Format(windowLayout)}
+	return current, previous, nil
+}
+
+func parseWindow(w TimeWindow, loc *time.Location) (time.Time, time.Time, error) {
+	from, err := ParseReferenceTime(w.From, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid window start %q (want RFC 3339, YYYY-MM-DD HH:MM:SS or YYYY-MM-DD)", w.From)
+	}
+	to, err := ParseReferenceTime(w.To, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid window end %q (want RFC 3339, YYYY-MM-DD HH:MM:SS or YYYY-MM-DD)", w.To)
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("window %s to %s ends before it starts", w.From, w.To)
+	}
+	return from.In(loc), to.In(loc), nil
+}
+
+// periodStart is the start of the day, ISO week or month containing t
+func periodStart(period string, t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+// previousPeriodStart is the start of the period before the one starting at start
+func previousPeriodStart(period string, start time.Time) time.Time {
+	switch period {
+	case "week":
+		return start.AddDate(0, 0, -7)
+	case "month":
+		return start.AddDate(0, -1, 0)
+	}
+	return start.AddDate(0, 0, -1)
+}
+
+// CompareColumn picks the column to filter sql's table on: requested, if it
+// is a Date or DateTime column of the table, else the table's first one
+func CompareColumn(sql string, schema *Schema, requested string) (string, error) {
+	m := fromRe.FindStringSubmatch(sql)
+	if m == nil {
+		return "", fmt.Errorf("can't compare: the query has no table")
+	}
+	for _, ds := range schema.Datasources {
+		if ds.Name != m[1] {
+			continue
+		}
+		for _, col := range ds.Columns {
+			if isDateType(col.Type) && (requested == "" || col.Name == requested) {
+				return col.Name, nil
+			}
+		}
+		if requested != "" {
+			return "", fmt.Errorf("can't compare on %s: it isn't a date column of %s", requested, ds.Name)
+		}
+		return "", fmt.Errorf("can't compare: %s has no date column", ds.Name)
+	}
+	return "", fmt.Errorf("can't compare: unknown table %s", m[1])
+}
+
+var (
+	whereRe      = regexp.MustCompile(`(?i)\bWHERE\b`)
+	afterWhereRe = regexp.MustCompile(`(?i)\s+(GROUP\s+BY|HAVING|ORDER\s+BY|LIMIT)\b`)
+)
+
+// WindowSQL restricts sql to rows whose column falls in window. An existing
+// WHERE condition is kept, parenthesized so an OR in it can't widen the
+// window.
+func WindowSQL(sql, column string, window ComparisonWindow) string {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	cond := fmt.Sprintf("%s >= '%s' AND %s < '%s'", column, window.From, column, window.To)
+	if loc := whereRe.FindStringIndex(sql); loc != nil {
+		end := len(sql)
+		if tail := afterWhereRe.FindStringIndex(sql[loc[1]:]); tail != nil {
+			end = loc[1] + tail[0]
+		}
+		existing := strings.TrimSpace(sql[loc[1]:end])
+		return sql[:loc[1]] + " " + cond + " AND (" + existing + ")" + sql[end:] + ";"
+	}
+	at := len(sql)
+	if loc := afterWhereRe.FindStringIndex(sql); loc != nil {
+		at = loc[0]
+	}
+	return sql[:at] + " WHERE " + cond + sql[at:] + ";"
+}
+
+// CompareResults merges the results of the same query over two windows.
+// Rows are matched on sql's GROUP BY columns; every other column whose
+// values are numbers is a measure and gets its previous value, absolute
+// delta and percentage delta. A group missing from one window has nulls
+// there. Rows follow the current result, then groups only in the previous.
+func CompareResults(sql string, current, previous *TinybirdResponse) ([]map[string]interface{}, []string, []string) {
+	var keys []string
+	if m := groupColsRe.FindStringSubmatch(sql); m != nil {
+		for _, col := range splitTopLevel(m[1]) {
+			keys = append(keys, strings.TrimSpace(col))
+		}
+	}
+	isKey := make(map[string]bool)
+	for _, k := range keys {
+		isKey[k] = true
+	}
+
+	// Measures are the non-key columns that are numeric wherever set, in
+	// result column order
+	numeric := make(map[string]bool)
+	for _, result := range []*TinybirdResponse{current, previous} {
+		for _, row := range result.Data {
+			for col, v := range row {
+				if isKey[col] {
+					continue
+				}
+				_, isNum := numericValue(v)
+				isNum = isNum || v == nil
+				if was, ok := numeric[col]; ok {
+					isNum = isNum && was
+				}
+				numeric[col] = isNum
+			}
+		}
+	}
+	var columns []string
+	for _, result := range []*TinybirdResponse{current, previous} {
+		for _, m := range result.Meta {
+			if !containsString(columns, m["name"]) {
+				columns = append(columns, m["name"])
+			}
+		}
+	}
+	var unlisted []string
+	for col := range numeric {
+		if !containsString(columns, col) {
+			unlisted = append(unlisted, col)
+		}
+	}
+	sort.Strings(unlisted)
+	var measures []string
+	for _, col := range append(columns, unlisted...) {
+		if numeric[col] {
+			measures = append(measures, col)
+		}
+	}
+
+	keyOf := func(row map[string]interface{}) string {
+		values := make([]interface{}, len(keys))
+		for i, k := range keys {
+			values[i] = row[k]
+		}
+		b, _ := json.Marshal(values)
+		return string(b)
+	}
+	prevByKey := make(map[string]map[string]interface{})
+	for _, row := range previous.Data {
+		prevByKey[keyOf(row)] = row
+	}
+
+	var merged []map[string]interface{}
+	matched := make(map[string]bool)
+	for _, row := range current.Data {
+		k := keyOf(row)
+		matched[k] = true
+		merged = append(merged, compareRow(row, prevByKey[k], keys, measures))
+	}
+	for _, row := range previous.Data {
+		if k := keyOf(row); !matched[k] {
+			matched[k] = true
+			merged = append(merged, compareRow(nil, row, keys, measures))
+		}
+	}
+	return merged, keys, measures
+}
+
+// ComparisonDisplay extends display to the columns CompareResults adds: a
+// measure's previous value and delta are in its unit, its percentage delta
+// in percent
+func ComparisonDisplay(display map[string]ColumnDisplay, measures []string) map[string]ColumnDisplay {
+	out := make(map[string]ColumnDisplay, len(display))
+	for col, d := range display {
+		out[col] = d
+	}
+	oneDecimal := 1
+	for _, m := range measures {
+		if d, ok := display[m]; ok {
+			out[m+"_previous"], out[m+"_delta"] = d, d
+		}
+		out[m+"_delta_pct"] = ColumnDisplay{Unit: "%", Decimals: &oneDecimal}
+	}
+	return out
+}
+
+func compareRow(cur, prev map[string]interface{}, keys, measures []string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for col, v := range cur {
+		out[col] = v
+	}
+	if cur == nil {
+		for _, k := range keys {
+			out[k] = prev[k]
+		}
+	}
+	for _, m := range measures {
+		c, cOK := numericValue(cur[m])
+		p, pOK := numericValue(prev[m])
+		out[m] = nil
+		if cOK {
+			out[m] = c
+		}
+		out[m+"_previous"] = nil
+		if pOK {
+			out[m+"_previous"] = p
+		}
+		out[m+"_delta"], out[m+"_delta_pct"] = nil, nil
+		if cOK && pOK {
+			out[m+"_delta"] = c - p
+			if p != 0 {
+				out[m+"_delta_pct"] = (c - p) / p * 100
+			}
+		}
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
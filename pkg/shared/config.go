@@ -1,45 +1,1036 @@
 package shared
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds all application configuration
 type Config struct {
-	OpenAIAPIKey  string
-	TinybirdHost  string
-	TinybirdToken string
+	// AppEnv selects a profile of defaults: development, staging or production
+	AppEnv string
+
+	OpenAIAPIKey    string
+	OpenAIModel     string
+	OpenAIBaseURL   string
+	TinybirdHost    string
+	TinybirdToken   string
+	TinybirdAPIBase string
+
+	// CanaryModel receives CanaryPercent (0-100) of /api/query generations
+	// instead of OpenAIModel; empty disables the canary
+	CanaryModel   string
+	CanaryPercent float64
+
+	// ShadowFile holds an alternative generator that also answers
+	// ShadowPercent (0-100) of /api/query requests, for comparison only
+	ShadowFile    string
+	ShadowPercent float64
+
+	// OpenAIMaxConcurrency caps OpenAI calls in flight across the process;
+	// zero leaves them unbounded
+	OpenAIMaxConcurrency int
+	// EvalStagger spaces out the launch of eval cases, with jitter, so a
+	// run doesn't open with a burst of calls
+	EvalStagger time.Duration
+
+	// Long-running server settings
+	Host         string
+	Port         string
+	ListenAddr   string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// Preflight makes `nl2sql serve` generate one query and run SELECT 1
+	// before it starts listening, so bad credentials fail the start-up
+	Preflight bool
+	// StartupMode is what `nl2sql serve` does when Tinybird can't be
+	// reached at start-up: fail, retry for up to StartupTimeout, or serve
+	// degraded. SchemaFallbackFile is the schema degraded mode generates
+	// against until Tinybird is back.
+	StartupMode        string
+	StartupTimeout     time.Duration
+	SchemaFallbackFile string
+
+	// Logging
+	LogLevel  string
+	LogFormat string
+	LogOutput string
+	// LogDebugSampleRate is the fraction (0-1) of debug lines that are written
+	LogDebugSampleRate float64
+
+	// AdminToken guards /api/admin endpoints alongside admin-role API keys
+	// and JWTs; with none of them the endpoints are disabled
+	AdminToken string
+	// AccessFile maps API keys to tenants and visible columns; empty leaves /api/query open
+	AccessFile string
+	// JWTIssuer, when set, also accepts bearer JWTs it signed, verified
+	// against its JWKS and mapped to a tenant and roles by their claims
+	JWTIssuer      string
+	JWTAudience    string
+	JWTJWKSURL     string
+	JWKSCacheTTL   time.Duration
+	JWTTenantClaim string
+	JWTRolesClaim  string
+	// JWTQueryRole and JWTAdminRole are the token roles mapped to the query
+	// and admin roles; every valid token has the query role when
+	// JWTQueryRole is empty, and none the admin role when JWTAdminRole is
+	JWTQueryRole string
+	JWTAdminRole string
+	// MaxDefaultLimit is appended as LIMIT to multi-row queries without one
+	MaxDefaultLimit int
+	// MaxPromptTokens caps the estimated generation prompt; zero means the
+	// model's context window
+	MaxPromptTokens int
+	// DefaultTimezone is the IANA zone relative dates are resolved in when a
+	// request doesn't name one
+	DefaultTimezone string
+
+	// MaxRowsRead and MaxBytesRead reject queries that read more; zero disables
+	MaxRowsRead  int64
+	MaxBytesRead int64
+	// ClickHouseSettings are appended to every executed query as a SETTINGS
+	// clause, e.g. "max_execution_time=10,readonly=1", so the warehouse
+	// enforces limits itself
+	ClickHouseSettings string
+	// QueryTag is the app name tagged on every warehouse query, or "off"
+	QueryTag string
+	// QueryComment prefixes executed queries with the question they answer
+	// as a SQL comment, for readers of the warehouse query log
+	QueryComment bool
+	// MinGroupSize keeps results to aggregates over at least this many
+	// rows; zero disables. MinGroupPolicy is suppress or reject.
+	MinGroupSize   int
+	MinGroupPolicy string
+
+	// Slow-query log thresholds (zero disables) and optional JSONL file
+	SlowGenerateThreshold time.Duration
+	SlowExecuteThreshold  time.Duration
+	SlowQueryLog          string
+
+	// Webhooks notified of events, the events they get (empty = all) and
+	// the secret deliveries are signed with
+	WebhookURLs   string
+	WebhookEvents string
+	WebhookSecret string
+
+	// PageTokenSecret signs next-page tokens; TINYBIRD_TOKEN when empty
+	PageTokenSecret string
+	// PageTokenTTL is how long after the first page its next-page tokens work
+	PageTokenTTL time.Duration
+
+	// GoogleServiceAccount is a service-account key (JSON, or a path to
+	// it) used for Google Sheets export; empty disables export.
+	// SheetsShareWith lists who new spreadsheets are shared with.
+	GoogleServiceAccount string
+	SheetsShareWith      string
+
+	// SMTP server for emailed reports; empty SMTPHost disables email
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// ReportsFile holds scheduled reports, managed via /api/admin/reports
+	ReportsFile string
+
+	// UsageFile persists per-request usage as JSON lines for /api/admin/usage
+	UsageFile string
+	// RefusalsFile persists refused questions as JSON lines for /api/admin/refusals
+	RefusalsFile string
+	// HistoryFile persists answered questions as JSON lines, for few-shot
+	// examples
+	HistoryFile string
+	// FewShotExamples is how many similar earlier questions from the same
+	// tenant go in the prompt; zero disables history
+	FewShotExamples int
+	// EmbeddingModel embeds questions to find similar ones
+	EmbeddingModel string
+	// TraceBuffer is how many recent request traces are kept in memory for
+	// /api/admin/traces; TraceDir also writes each to a file. Tracing is off
+	// when both are unset.
+	TraceBuffer int
+	TraceDir    string
+
+	// Async query jobs under nl2sql serve: JobsFile persists them across
+	// restarts, JobWorkers run them (0 disables async queries), up to
+	// JobQueueSize more wait, transient failures are retried JobRetries
+	// times, and finished jobs are kept for JobTTL
+	JobsFile     string
+	JobWorkers   int
+	JobQueueSize int
+	JobRetries   int
+	JobTTL       time.Duration
+
+	// StreamResults writes /api/query rows as they arrive from Tinybird
+	// instead of buffering the whole result
+	StreamResults bool
+
+	// SchemaCacheTTL is how long a fetched schema is reused; zero disables caching
+	SchemaCacheTTL time.Duration
+	// SchemaDescriptionsFile is a JSON file of datasource and column
+	// descriptions that override those stored in Tinybird
+	SchemaDescriptionsFile string
+	// SchemaRelationships declares foreign keys the column-name heuristics
+	// miss, e.g. "order_items.order_id=orders.order_id"
+	SchemaRelationships string
+	// MetricsFile is a JSON file of named business metrics offered to the
+	// model as fixed select expressions
+	MetricsFile string
+	// ColumnStats adds per-column min/max and distinct counts, computed
+	// when the schema is fetched, to the tool description
+	ColumnStats bool
+
+	// RequestTimeout bounds /api/query requests; zero disables it
+	RequestTimeout time.Duration
+	// RateLimit is the number of API requests allowed per client per minute; zero disables it
+	RateLimit int
+	// TrustedProxies lists the proxies, as IPs or CIDRs, whose
+	// X-Forwarded-For is believed when identifying a client, e.g.
+	// "10.0.0.0/8"; see ClientIP
+	TrustedProxies string
+	// MaxBodyBytes rejects larger request bodies with a 413; zero disables it
+	MaxBodyBytes int64
+
+	// MaskedColumns lists sensitive result columns, e.g. "seller_id,email=mask"
+	MaskedColumns string
+	// MaskingSalt keys the hash used for MaskHash columns
+	MaskingSalt string
+	// PostProcessorsFile lists the result post-processing steps, per tenant
+	PostProcessorsFile string
+	// TenantsFile holds per-tenant prompt, glossary, grammar and example
+	// overrides
+	TenantsFile string
+
+	// FeatureFlags is a spec like "eval_diagnosis=true,acme:smoke_evals=false"
+	FeatureFlags string
+	// ServiceMode is normal, generate_only or maintenance; an admin runtime
+	// override takes precedence
+	ServiceMode string
 }
 
-// LoadConfig loads and validates all required environment variables.
-// Returns an error if any required variable is missing.
-func LoadConfig() (*Config, error) {
-	var missing []string
+// configField describes one setting. Key is the environment variable name;
+// the config file uses the same name in lower case and flags use it in
+// lower case with dashes (OPENAI_MODEL -> openai_model -> -openai-model).
+type configField struct {
+	Key     string
+	Usage   string
+	Default string
+	Secret  bool
+	// Reloadable settings may change at runtime via ConfigReloader
+	Reloadable bool
+	set        func(c *Config, v string) error
+	get        func(c *Config) string
+}
+
+// configFields are resolved in order; APP_ENV comes first so its profile
+// can supply defaults for everything after it.
+var configFields = []configField{
+	{Key: "APP_ENV", Usage: "profile of defaults: development, staging or production",
+		set: func(c *Config, v string) error {
+			env, ok := appEnvAliases[strings.ToLower(v)]
+			if !ok {
+				return fmt.Errorf("unknown environment %q", v)
+			}
+			c.AppEnv = env
+			return nil
+		},
+		get: func(c *Config) string { return c.AppEnv }},
+	{Key: "OPENAI_API_KEY", Usage: "OpenAI API key", Secret: true,
+		set: func(c *Config, v string) error { c.OpenAIAPIKey = v; return nil },
+		get: func(c *Config) string { return c.OpenAIAPIKey }},
+	{Key: "OPENAI_MODEL", Usage: "model used for generation", Default: DefaultModel, Reloadable: true,
+		set: func(c *Config, v string) error { c.OpenAIModel = v; return nil },
+		get: func(c *Config) string { return c.OpenAIModel }},
+	intField("OPENAI_MAX_CONCURRENCY", "OpenAI calls in flight at once across the process; a 429 pauses them all (0 = unbounded)", "0",
+		func(c *Config) *int { return &c.OpenAIMaxConcurrency }),
+	durationField("EVAL_STAGGER", "delay between launching eval cases, with up to 50% jitter (0 launches them at once)", "250ms",
+		func(c *Config) *time.Duration { return &c.EvalStagger }),
+	{Key: "CANARY_MODEL", Usage: "candidate model that gets CANARY_PERCENT of /api/query requests (empty disables)", Reloadable: true,
+		set: func(c *Config, v string) error { c.CanaryModel = v; return nil },
+		get: func(c *Config) string { return c.CanaryModel }},
+	{Key: "CANARY_PERCENT", Usage: "percentage (0-100) of /api/query requests routed to CANARY_MODEL", Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 100 {
+				return fmt.Errorf("must be a number from 0 to 100, got %q", v)
+			}
+			c.CanaryPercent = f
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatFloat(c.CanaryPercent, 'g', -1, 64) }},
+	{Key: "SHADOW_FILE", Usage: "JSON file with a shadow variant (model and/or profile) compared against SHADOW_PERCENT of /api/query requests (empty disables)", Reloadable: true,
+		set: func(c *Config, v string) error { c.ShadowFile = v; return nil },
+		get: func(c *Config) string { return c.ShadowFile }},
+	{Key: "SHADOW_PERCENT", Usage: "percentage (0-100) of /api/query requests also answered by the SHADOW_FILE variant", Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 100 {
+				return fmt.Errorf("must be a number from 0 to 100, got %q", v)
+			}
+			c.ShadowPercent = f
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatFloat(c.ShadowPercent, 'g', -1, 64) }},
+	{Key: "OPENAI_BASE_URL", Usage: "OpenAI API base URL (for proxies, gateways and mocks)", Default: DefaultOpenAIBaseURL,
+		set: func(c *Config, v string) error {
+			u, err := parseBaseURL(v)
+			c.OpenAIBaseURL = u
+			return err
+		},
+		get: func(c *Config) string { return c.OpenAIBaseURL }},
+	{Key: "TINYBIRD_HOST", Usage: "Tinybird API host",
+		set: func(c *Config, v string) error {
+			u, err := parseBaseURL(v)
+			c.TinybirdHost = u
+			return err
+		},
+		get: func(c *Config) string { return c.TinybirdHost }},
+	{Key: "TINYBIRD_API_BASE", Usage: "Tinybird API version path appended to the host", Default: DefaultTinybirdAPIBase,
+		set: func(c *Config, v string) error {
+			if !strings.HasPrefix(v, "/") {
+				return fmt.Errorf("must start with /, got %q", v)
+			}
+			c.TinybirdAPIBase = strings.TrimSuffix(v, "/")
+			return nil
+		},
+		get: func(c *Config) string { return c.TinybirdAPIBase }},
+	{Key: "TINYBIRD_TOKEN", Usage: "Tinybird read token", Secret: true,
+		set: func(c *Config, v string) error { c.TinybirdToken = v; return nil },
+		get: func(c *Config) string { return c.TinybirdToken }},
+	{Key: "HOST", Usage: "interface the server binds to (empty = all)",
+		set: func(c *Config, v string) error { c.Host = v; return nil },
+		get: func(c *Config) string { return c.Host }},
+	{Key: "PORT", Usage: "port the server listens on", Default: "8080",
+		set: func(c *Config, v string) error {
+			if _, err := strconv.ParseUint(v, 10, 16); err != nil {
+				return fmt.Errorf("not a port number: %q", v)
+			}
+			c.Port = v
+			return nil
+		},
+		get: func(c *Config) string { return c.Port }},
+	{Key: "LISTEN_ADDR", Usage: "full listen address, overrides HOST/PORT (host:port or unix:/path/to.sock)",
+		set: func(c *Config, v string) error { c.ListenAddr = v; return nil },
+		get: func(c *Config) string { return c.ListenAddr }},
+	durationField("HTTP_READ_TIMEOUT", "max time to read a request", "10s",
+		func(c *Config) *time.Duration { return &c.ReadTimeout }),
+	durationField("HTTP_WRITE_TIMEOUT", "max time to write a response (generation can take tens of seconds)", "120s",
+		func(c *Config) *time.Duration { return &c.WriteTimeout }),
+	durationField("HTTP_IDLE_TIMEOUT", "keep-alive idle timeout", "120s",
+		func(c *Config) *time.Duration { return &c.IdleTimeout }),
+	{Key: "PREFLIGHT", Usage: "generate a test query and run SELECT 1 before serving; exit if either fails", Default: "false",
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("must be true or false, got %q", v)
+			}
+			c.Preflight = b
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatBool(c.Preflight) }},
+	{Key: "STARTUP_MODE", Usage: "when Tinybird is down at start-up: fail (exit if PREFLIGHT fails), retry (wait with backoff for STARTUP_TIMEOUT) or degraded (serve generate_only until it is back)", Default: StartupFail,
+		set: func(c *Config, v string) error {
+			switch v {
+			case StartupFail, StartupRetry, StartupDegraded:
+				c.StartupMode = v
+				return nil
+			}
+			return fmt.Errorf("must be %s, %s or %s, got %q", StartupFail, StartupRetry, StartupDegraded, v)
+		},
+		get: func(c *Config) string { return c.StartupMode }},
+	durationField("STARTUP_TIMEOUT", "how long STARTUP_MODE=retry waits for Tinybird before exiting (0 waits forever)", "5m",
+		func(c *Config) *time.Duration { return &c.StartupTimeout }),
+	{Key: "SCHEMA_FALLBACK_FILE", Usage: "schema JSON (as written by schema dump) that STARTUP_MODE=degraded generates against until Tinybird is reachable",
+		set: func(c *Config, v string) error { c.SchemaFallbackFile = v; return nil },
+		get: func(c *Config) string { return c.SchemaFallbackFile }},
+	{Key: "LOG_LEVEL", Usage: "debug, info, warn or error", Default: "info", Reloadable: true,
+		set: func(c *Config, v string) error {
+			v = strings.ToLower(v)
+			if _, err := parseLogLevel(v); err != nil {
+				return err
+			}
+			c.LogLevel = v
+			return nil
+		},
+		get: func(c *Config) string { return c.LogLevel }},
+	{Key: "LOG_FORMAT", Usage: "text or json", Default: "text",
+		set: func(c *Config, v string) error {
+			if v != "text" && v != "json" {
+				return fmt.Errorf("must be text or json, got %q", v)
+			}
+			c.LogFormat = v
+			return nil
+		},
+		get: func(c *Config) string { return c.LogFormat }},
+	{Key: "LOG_OUTPUT", Usage: "stderr, stdout or a file path to append to", Default: "stderr",
+		set: func(c *Config, v string) error { c.LogOutput = v; return nil },
+		get: func(c *Config) string { return c.LogOutput }},
+	{Key: "LOG_DEBUG_SAMPLE_RATE", Usage: "fraction of debug lines written, 0-1", Default: "1", Reloadable: true,
+		set: func(c *Config, v string) error {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				return fmt.Errorf("must be a number between 0 and 1, got %q", v)
+			}
+			c.LogDebugSampleRate = f
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatFloat(c.LogDebugSampleRate, 'g', -1, 64) }},
+	{Key: "ADMIN_TOKEN", Usage: "bearer token for /api/admin endpoints, besides admin-role API keys and JWTs (empty disables them unless there are any)", Secret: true,
+		set: func(c *Config, v string) error { c.AdminToken = v; return nil },
+		get: func(c *Config) string { return c.AdminToken }},
+	{Key: "ACCESS_FILE", Usage: "JSON file mapping API keys to tenants and visible columns (empty = open access)", Reloadable: true,
+		set: func(c *Config, v string) error { c.AccessFile = v; return nil },
+		get: func(c *Config) string { return c.AccessFile }},
+	{Key: "JWT_ISSUER", Usage: "OIDC issuer whose bearer JWTs are accepted alongside API keys (empty disables JWTs)", Reloadable: true,
+		set: func(c *Config, v string) error { c.JWTIssuer = v; return nil },
+		get: func(c *Config) string { return c.JWTIssuer }},
+	{Key: "JWT_AUDIENCE", Usage: "audience JWTs must be issued for; required with JWT_ISSUER", Reloadable: true,
+		set: func(c *Config, v string) error { c.JWTAudience = v; return nil },
+		get: func(c *Config) string { return c.JWTAudience }},
+	{Key: "JWT_JWKS_URL", Usage: "URL of the issuer's signing keys (empty = from its OpenID discovery document)", Reloadable: true,
+		set: func(c *Config, v string) error { c.JWTJWKSURL = v; return nil },
+		get: func(c *Config) string { return c.JWTJWKSURL }},
+	durationField("JWKS_CACHE_TTL", "how long the issuer's signing keys are reused before refetching", "1h",
+		func(c *Config) *time.Duration { return &c.JWKSCacheTTL }),
+	{Key: "JWT_TENANT_CLAIM", Usage: "JWT claim holding the caller's tenant; dots reach into nested claims", Default: "tenant", Reloadable: true,
+		set: func(c *Config, v string) error { c.JWTTenantClaim = v; return nil },
+		get: func(c *Config) string { return c.JWTTenantClaim }},
+	{Key: "JWT_ROLES_CLAIM", Usage: "JWT claim holding the caller's roles, an array or space-separated; dots reach into nested claims", Default: "roles", Reloadable: true,
+		set: func(c *Config, v string) error { c.JWTRolesClaim = v; return nil },
+		get: func(c *Config) string { return c.JWTRolesClaim }},
+	{Key: "JWT_QUERY_ROLE", Usage: "JWT role mapped to the query role, for the public endpoints (empty = every valid token has it)", Reloadable: true,
+		set: func(c *Config, v string) error { c.JWTQueryRole = v; return nil },
+		get: func(c *Config) string { return c.JWTQueryRole }},
+	{Key: "JWT_ADMIN_ROLE", Usage: "JWT role mapped to the admin role, for /api/admin (empty = no JWT is admin)", Reloadable: true,
+		set: func(c *Config, v string) error { c.JWTAdminRole = v; return nil },
+		get: func(c *Config) string { return c.JWTAdminRole }},
+	{Key: "MAX_DEFAULT_LIMIT", Usage: "LIMIT injected into multi-row queries that lack one (0 disables)", Default: "1000", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			c.MaxDefaultLimit = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.MaxDefaultLimit) }},
+	{Key: "MAX_PROMPT_TOKENS", Usage: "largest estimated generation prompt; descriptions are dropped, then the request refused (0 = model context window)", Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			c.MaxPromptTokens = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.MaxPromptTokens) }},
+	{Key: "DEFAULT_TIMEZONE", Usage: "IANA time zone for \"today\" and other relative dates when a request sets none", Default: "UTC", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if _, err := LoadTimezone(v); err != nil {
+				return err
+			}
+			c.DefaultTimezone = v
+			return nil
+		},
+		get: func(c *Config) string { return c.DefaultTimezone }},
+	int64Field("MAX_ROWS_READ", "reject queries that read more rows (0 disables)",
+		func(c *Config) *int64 { return &c.MaxRowsRead }),
+	int64Field("MAX_BYTES_READ", "reject queries that read more bytes (0 disables)",
+		func(c *Config) *int64 { return &c.MaxBytesRead }),
+	{Key: "CLICKHOUSE_SETTINGS", Usage: "comma-separated ClickHouse settings added to executed queries, e.g. max_execution_time=10,readonly=1", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if _, err := ParseClickHouseSettings(v); err != nil {
+				return err
+			}
+			c.ClickHouseSettings = v
+			return nil
+		},
+		get: func(c *Config) string { return c.ClickHouseSettings }},
+	{Key: "QUERY_TAG", Usage: "app name sent with request ID and tenant as log_comment on every warehouse query, or off", Default: "nl2sql", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if tagUnsafeRe.MatchString(v) {
+				return fmt.Errorf("may only contain letters, digits and _ . : @ / -, got %q", v)
+			}
+			c.QueryTag = v
+			return nil
+		},
+		get: func(c *Config) string { return c.QueryTag }},
+	{Key: "QUERY_COMMENT", Usage: "prefix executed queries with the question they answer as a /* */ comment, visible in warehouse query logs", Default: "false", Reloadable: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("must be true or false, got %q", v)
+			}
+			c.QueryComment = b
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatBool(c.QueryComment) }},
+	{Key: "MIN_GROUP_SIZE", Usage: "only answer with aggregates over groups of at least this many rows (0 disables)", Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			c.MinGroupSize = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.MinGroupSize) }},
+	{Key: "MIN_GROUP_POLICY", Usage: "what to do with groups below MIN_GROUP_SIZE: suppress (leave them out) or reject (fail the query)", Default: GroupPolicySuppress, Reloadable: true,
+		set: func(c *Config, v string) error {
+			if v != GroupPolicySuppress && v != GroupPolicyReject {
+				return fmt.Errorf("must be %s or %s, got %q", GroupPolicySuppress, GroupPolicyReject, v)
+			}
+			c.MinGroupPolicy = v
+			return nil
+		},
+		get: func(c *Config) string { return c.MinGroupPolicy }},
+	durationField("SLOW_GENERATE_THRESHOLD", "log queries whose SQL generation takes at least this long (0 disables)", "20s",
+		func(c *Config) *time.Duration { return &c.SlowGenerateThreshold }),
+	durationField("SLOW_EXECUTE_THRESHOLD", "log queries whose execution takes at least this long (0 disables)", "2s",
+		func(c *Config) *time.Duration { return &c.SlowExecuteThreshold }),
+	{Key: "SLOW_QUERY_LOG", Usage: "file to append slow queries to as JSON lines (empty = log only)",
+		set: func(c *Config, v string) error { c.SlowQueryLog = v; return nil },
+		get: func(c *Config) string { return c.SlowQueryLog }},
+	{Key: "WEBHOOK_URLS", Usage: "comma-separated URLs notified of events (empty disables webhooks)", Reloadable: true,
+		set: func(c *Config, v string) error { c.WebhookURLs = v; return nil },
+		get: func(c *Config) string { return c.WebhookURLs }},
+	{Key: "WEBHOOK_EVENTS", Usage: "comma-separated events sent to WEBHOOK_URLS (empty = all)", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if err := parseWebhookEvents(v); err != nil {
+				return err
+			}
+			c.WebhookEvents = v
+			return nil
+		},
+		get: func(c *Config) string { return c.WebhookEvents }},
+	{Key: "WEBHOOK_SECRET", Usage: "secret for the X-NL2SQL-Signature HMAC on webhook deliveries", Secret: true,
+		set: func(c *Config, v string) error { c.WebhookSecret = v; return nil },
+		get: func(c *Config) string { return c.WebhookSecret }},
+	{Key: "PAGE_TOKEN_SECRET", Usage: "secret next-page tokens are signed with (empty uses one derived from TINYBIRD_TOKEN)", Secret: true,
+		set: func(c *Config, v string) error { c.PageTokenSecret = v; return nil },
+		get: func(c *Config) string { return c.PageTokenSecret }},
+	durationField("PAGE_TOKEN_TTL", "how long after the first page next-page tokens keep working", "1h",
+		func(c *Config) *time.Duration { return &c.PageTokenTTL }),
+	{Key: "GOOGLE_SERVICE_ACCOUNT", Usage: "Google service-account key JSON, or a path to it, for Sheets export (empty disables export)", Secret: true,
+		set: func(c *Config, v string) error {
+			if v != "" {
+				if _, err := parseServiceAccount(v); err != nil {
+					return err
+				}
+			}
+			c.GoogleServiceAccount = v
+			return nil
+		},
+		get: func(c *Config) string { return c.GoogleServiceAccount }},
+	{Key: "SHEETS_SHARE_WITH", Usage: "comma-separated emails (or @domain) given edit access to exported spreadsheets", Reloadable: true,
+		set: func(c *Config, v string) error { c.SheetsShareWith = v; return nil },
+		get: func(c *Config) string { return c.SheetsShareWith }},
+	{Key: "SMTP_HOST", Usage: "SMTP server for emailed reports (empty disables email)", Reloadable: true,
+		set: func(c *Config, v string) error { c.SMTPHost = v; return nil },
+		get: func(c *Config) string { return c.SMTPHost }},
+	{Key: "SMTP_PORT", Usage: "SMTP port; STARTTLS is used when the server offers it", Default: "587", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("must be a port number, got %q", v)
+			}
+			c.SMTPPort = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.SMTPPort) }},
+	{Key: "SMTP_USERNAME", Usage: "SMTP username (empty sends without authentication)", Reloadable: true,
+		set: func(c *Config, v string) error { c.SMTPUsername = v; return nil },
+		get: func(c *Config) string { return c.SMTPUsername }},
+	{Key: "SMTP_PASSWORD", Usage: "SMTP password", Secret: true, Reloadable: true,
+		set: func(c *Config, v string) error { c.SMTPPassword = v; return nil },
+		get: func(c *Config) string { return c.SMTPPassword }},
+	{Key: "SMTP_FROM", Usage: "From address of emailed reports (default SMTP_USERNAME)", Reloadable: true,
+		set: func(c *Config, v string) error { c.SMTPFrom = v; return nil },
+		get: func(c *Config) string { return c.SMTPFrom }},
+	{Key: "REPORTS_FILE", Usage: "JSON file of scheduled reports run by nl2sql serve (empty disables reports)", Reloadable: true,
+		set: func(c *Config, v string) error { c.ReportsFile = v; return nil },
+		get: func(c *Config) string { return c.ReportsFile }},
+	{Key: "USAGE_FILE", Usage: "file to append per-request token and bytes_read usage to (empty = in memory)",
+		set: func(c *Config, v string) error { c.UsageFile = v; return nil },
+		get: func(c *Config) string { return c.UsageFile }},
+	{Key: "REFUSALS_FILE", Usage: "file to append refused questions to (empty = in memory)",
+		set: func(c *Config, v string) error { c.RefusalsFile = v; return nil },
+		get: func(c *Config) string { return c.RefusalsFile }},
+	{Key: "HISTORY_FILE", Usage: "file to append answered questions and their SQL to, for FEW_SHOT_EXAMPLES (empty = in memory)",
+		set: func(c *Config, v string) error { c.HistoryFile = v; return nil },
+		get: func(c *Config) string { return c.HistoryFile }},
+	{Key: "FEW_SHOT_EXAMPLES", Usage: "similar earlier questions of the same tenant, with their SQL, to put in the prompt (0 disables)", Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxFewShotExamples {
+				return fmt.Errorf("must be an integer from 0 to %d, got %q", maxFewShotExamples, v)
+			}
+			c.FewShotExamples = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.FewShotExamples) }},
+	{Key: "EMBEDDING_MODEL", Usage: "OpenAI model that embeds questions for FEW_SHOT_EXAMPLES", Default: DefaultEmbeddingModel, Reloadable: true,
+		set: func(c *Config, v string) error { c.EmbeddingModel = v; return nil },
+		get: func(c *Config) string { return c.EmbeddingModel }},
+	{Key: "TRACE_BUFFER", Usage: "recent /api/query, /api/graphql and /api/export request traces kept in memory for /api/admin/traces (0 disables)", Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			c.TraceBuffer = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.TraceBuffer) }},
+	{Key: "TRACE_DIR", Usage: "directory each request trace is also written to as <request_id>.json (empty = memory only)", Reloadable: true,
+		set: func(c *Config, v string) error { c.TraceDir = v; return nil },
+		get: func(c *Config) string { return c.TraceDir }},
+	{Key: "JOBS_FILE", Usage: "file async query jobs are persisted to, so they survive restarts (empty = in memory)",
+		set: func(c *Config, v string) error { c.JobsFile = v; return nil },
+		get: func(c *Config) string { return c.JobsFile }},
+	intField("JOB_WORKERS", "async query jobs run at once by nl2sql serve (0 disables async queries)", "4",
+		func(c *Config) *int { return &c.JobWorkers }),
+	intField("JOB_QUEUE_SIZE", "async query jobs that can wait for a worker before submitting fails", "100",
+		func(c *Config) *int { return &c.JobQueueSize }),
+	intField("JOB_RETRIES", "times an async query job is retried after a transient failure", "2",
+		func(c *Config) *int { return &c.JobRetries }),
+	durationField("JOB_TTL", "how long finished async query jobs are kept", "24h",
+		func(c *Config) *time.Duration { return &c.JobTTL }),
+	{Key: "STREAM_RESULTS", Usage: "stream query result rows instead of buffering them", Default: "false", Reloadable: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("must be true or false, got %q", v)
+			}
+			c.StreamResults = b
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatBool(c.StreamResults) }},
+	durationField("SCHEMA_CACHE_TTL", "how long a fetched schema is reused (0 disables)", "5m",
+		func(c *Config) *time.Duration { return &c.SchemaCacheTTL }),
+	{Key: "SCHEMA_DESCRIPTIONS_FILE", Usage: "JSON file of datasource and column descriptions added to the prompt", Reloadable: true,
+		set: func(c *Config, v string) error { c.SchemaDescriptionsFile = v; return nil },
+		get: func(c *Config) string { return c.SchemaDescriptionsFile }},
+	{Key: "SCHEMA_RELATIONSHIPS", Usage: "comma-separated foreign keys, e.g. order_items.order_id=orders.order_id", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if _, err := ParseRelationships(v); err != nil {
+				return err
+			}
+			c.SchemaRelationships = v
+			return nil
+		},
+		get: func(c *Config) string { return c.SchemaRelationships }},
+	{Key: "METRICS_FILE", Usage: "JSON file of named metrics such as revenue = SUM(price) the model selects by name", Reloadable: true,
+		set: func(c *Config, v string) error { c.MetricsFile = v; return nil },
+		get: func(c *Config) string { return c.MetricsFile }},
+	{Key: "COLUMN_STATS", Usage: "compute column min/max and approximate distinct counts when the schema is fetched and show them to the model (one query per datasource)", Default: "false", Reloadable: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("must be true or false, got %q", v)
+			}
+			c.ColumnStats = b
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatBool(c.ColumnStats) }},
+	durationField("REQUEST_TIMEOUT", "max time to answer a query request (0 disables)", "60s",
+		func(c *Config) *time.Duration { return &c.RequestTimeout }),
+	{Key: "MAX_BODY_BYTES", Usage: "largest request body accepted (0 disables)", Default: "1048576", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			c.MaxBodyBytes = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatInt(c.MaxBodyBytes, 10) }},
+	{Key: "RATE_LIMIT", Usage: "API requests allowed per client per minute (0 disables)", Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			c.RateLimit = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.RateLimit) }},
+	{Key: "TRUSTED_PROXIES", Usage: "comma-separated IPs or CIDRs of proxies whose X-Forwarded-For identifies the client (empty = trust none)", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if _, err := ParseTrustedProxies(v); err != nil {
+				return err
+			}
+			c.TrustedProxies = v
+			return nil
+		},
+		get: func(c *Config) string { return c.TrustedProxies }},
+	{Key: "MASKED_COLUMNS", Usage: "result columns to mask: column (hashed) or column=mask, comma-separated", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if _, err := parseMaskSpec(v); err != nil {
+				return err
+			}
+			c.MaskedColumns = v
+			return nil
+		},
+		get: func(c *Config) string { return c.MaskedColumns }},
+	{Key: "MASKING_SALT", Usage: "secret key for hashing masked columns", Secret: true,
+		set: func(c *Config, v string) error { c.MaskingSalt = v; return nil },
+		get: func(c *Config) string { return c.MaskingSalt }},
+	{Key: "POSTPROCESSORS_FILE", Usage: "JSON file of result post-processing steps (currency, rename, derive, mask), per tenant", Reloadable: true,
+		set: func(c *Config, v string) error { c.PostProcessorsFile = v; return nil },
+		get: func(c *Config) string { return c.PostProcessorsFile }},
+	{Key: "TENANTS_FILE", Usage: "JSON file of per-tenant prompt, glossary, grammar profile and example question overrides", Reloadable: true,
+		set: func(c *Config, v string) error { c.TenantsFile = v; return nil },
+		get: func(c *Config) string { return c.TenantsFile }},
+	{Key: "FEATURE_FLAGS", Usage: "comma-separated flag=bool entries, optionally tenant:flag=bool", Reloadable: true,
+		set: func(c *Config, v string) error {
+			if _, err := parseFlagSpec(v); err != nil {
+				return err
+			}
+			c.FeatureFlags = v
+			return nil
+		},
+		get: func(c *Config) string { return c.FeatureFlags }},
+	{Key: "SERVICE_MODE", Usage: "normal, generate_only (return SQL without running it) or maintenance (refuse queries)", Default: ModeNormal, Reloadable: true,
+		set: func(c *Config, v string) error {
+			if err := validServiceMode(v); err != nil {
+				return err
+			}
+			c.ServiceMode = v
+			return nil
+		},
+		get: func(c *Config) string { return c.ServiceMode }},
+}
 
-	openaiKey := os.Getenv("OPENAI_API_KEY")
-	if openaiKey == "" {
-		missing = append(missing, "OPENAI_API_KEY")
+func durationField(key, usage, def string, field func(c *Config) *time.Duration) configField {
+	return configField{
+		Key: key, Usage: usage, Default: def,
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			*field(c) = d
+			return nil
+		},
+		get: func(c *Config) string { return field(c).String() },
 	}
+}
 
-	tinybirdHost := os.Getenv("TINYBIRD_HOST")
-	if tinybirdHost == "" {
-		missing = append(missing, "TINYBIRD_HOST")
+// intField is a non-negative count
+func intField(key, usage, def string, field func(c *Config) *int) configField {
+	return configField{
+		Key: key, Usage: usage, Default: def,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			*field(c) = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
 	}
+}
 
-	tinybirdToken := os.Getenv("TINYBIRD_TOKEN")
-	if tinybirdToken == "" {
-		missing = append(missing, "TINYBIRD_TOKEN")
+// int64Field is a reloadable non-negative limit that defaults to 0 (disabled)
+func int64Field(key, usage string, field func(c *Config) *int64) configField {
+	return configField{
+		Key: key, Usage: usage, Default: "0", Reloadable: true,
+		set: func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer, got %q", v)
+			}
+			*field(c) = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
 	}
+}
+
+// Default endpoints
+const (
+	DefaultOpenAIBaseURL   = "https://api.openai.com/v1"
+	DefaultTinybirdAPIBase = "/v0"
+)
+
+// Environment profiles
+const (
+	EnvDevelopment = "development"
+	EnvStaging     = "staging"
+	EnvProduction  = "production"
+)
+
+var appEnvAliases = map[string]string{
+	"dev": EnvDevelopment, "development": EnvDevelopment,
+	"staging": EnvStaging, "stage": EnvStaging,
+	"prod": EnvProduction, "production": EnvProduction,
+}
 
+// profiles override built-in defaults per APP_ENV. Anything set in the
+// config file, environment or flags still wins.
+var profiles = map[string]map[string]string{
+	EnvDevelopment: {
+		"LOG_LEVEL":     "debug",
+		"LOG_FORMAT":    "text",
+		"FEATURE_FLAGS": "eval_diagnosis=true",
+	},
+	EnvStaging: {
+		"LOG_LEVEL":     "debug",
+		"LOG_FORMAT":    "json",
+		"FEATURE_FLAGS": "eval_diagnosis=true",
+	},
+	EnvProduction: {
+		"LOG_LEVEL":         "info",
+		"LOG_FORMAT":        "json",
+		"MAX_DEFAULT_LIMIT": "1000",
+	},
+}
+
+var (
+	requiredAll      = []string{"OPENAI_API_KEY", "TINYBIRD_HOST", "TINYBIRD_TOKEN"}
+	requiredTinybird = []string{"TINYBIRD_HOST", "TINYBIRD_TOKEN"}
+)
+
+// ConfigFlags holds values set on the command line. Only flags that were
+// explicitly passed override lower-precedence sources.
+type ConfigFlags struct {
+	fs     *flag.FlagSet
+	file   *string
+	values map[string]*string
+}
+
+// BindConfigFlags registers -config plus one flag per setting on fs.
+// Call Load after fs.Parse.
+func BindConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	cf := &ConfigFlags{
+		fs:     fs,
+		file:   fs.String("config", "", "config file (defaults to $CONFIG_FILE)"),
+		values: make(map[string]*string),
+	}
+	for _, f := range configFields {
+		cf.values[f.Key] = fs.String(flagName(f.Key), "", f.Usage)
+	}
+	return cf
+}
+
+// explicit returns the settings whose flags were passed
+func (cf *ConfigFlags) explicit() map[string]string {
+	out := make(map[string]string)
+	if cf == nil {
+		return out
+	}
+	cf.fs.Visit(func(fl *flag.Flag) {
+		for key, v := range cf.values {
+			if fl.Name == flagName(key) {
+				out[key] = *v
+			}
+		}
+	})
+	return out
+}
+
+// Load resolves the full configuration including command-line overrides
+func (cf *ConfigFlags) Load() (*Config, error) {
+	return loadConfig(cf, requiredAll)
+}
+
+// LoadTinybird is Load for tools that never call OpenAI
+func (cf *ConfigFlags) LoadTinybird() (*Config, error) {
+	return loadConfig(cf, requiredTinybird)
+}
+
+// LoadConfig loads and validates all required settings from the config
+// file and environment. Returns an error if any required setting is missing.
+//
+// Precedence, highest first: command-line flags (CLIs only), environment
+// variables, the config file named by CONFIG_FILE (or -config), the APP_ENV
+// profile, built-in defaults.
+func LoadConfig() (*Config, error) {
+	return loadConfig(nil, requiredAll)
+}
+
+// LoadTinybirdConfig loads only the Tinybird settings, for tools that
+// execute SQL but never call OpenAI.
+func LoadTinybirdConfig() (*Config, error) {
+	return loadConfig(nil, requiredTinybird)
+}
+
+func loadConfig(cf *ConfigFlags, required []string) (*Config, error) {
+	flagValues := cf.explicit()
+
+	path := os.Getenv("CONFIG_FILE")
+	if cf != nil && *cf.file != "" {
+		path = *cf.file
+	}
+	var fileValues map[string]string
+	if path != "" {
+		var err error
+		fileValues, err = readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &Config{}
+	resolved := make(map[string]string)
+	for _, f := range configFields {
+		v := f.Default
+		if pv, ok := profiles[cfg.AppEnv][f.Key]; ok {
+			v = pv
+		}
+		if fv, ok := fileValues[strings.ToLower(f.Key)]; ok {
+			v = fv
+		}
+		if ev := os.Getenv(f.Key); ev != "" {
+			v = ev
+		}
+		if f.Secret {
+			secret, err := readSecretFile(f.Key)
+			if err != nil {
+				return nil, err
+			}
+			if secret != "" {
+				v = secret
+			}
+		}
+		if fl, ok := flagValues[f.Key]; ok {
+			v = fl
+		}
+		resolved[f.Key] = v
+		if v == "" {
+			continue
+		}
+		if err := f.set(cfg, v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", f.Key, err)
+		}
+	}
+
+	var missing []string
+	for _, key := range required {
+		if resolved[key] == "" {
+			missing = append(missing, key)
+		}
+	}
 	if len(missing) > 0 {
 		return nil, fmt.Errorf("missing required environment variables: %v", missing)
 	}
 
-	return &Config{
-		OpenAIAPIKey:  openaiKey,
-		TinybirdHost:  tinybirdHost,
-		TinybirdToken: tinybirdToken,
-	}, nil
+	return cfg, nil
 }
 
+// readConfigFile parses a flat TOML-style file of `key = value` lines.
+// Keys are the lower-case environment variable names; values may be quoted;
+// blank lines, `#` comments and [section] headers are ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	known := make(map[string]bool, len(configFields))
+	for _, field := range configFields {
+		known[strings.ToLower(field.Key)] = true
+	}
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !known[key] {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, key)
+		}
+
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value: %w", path, lineNo, err)
+			}
+			value = unquoted
+		} else if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return values, nil
+}
+
+// ConfigSetting is one resolved setting with secrets masked
+type ConfigSetting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+// Redacted returns every setting in declaration order with secrets masked
+func (c *Config) Redacted() []ConfigSetting {
+	settings := make([]ConfigSetting, 0, len(configFields))
+	for _, f := range configFields {
+		v := f.get(c)
+		if f.Secret {
+			v = redact(v)
+		}
+		settings = append(settings, ConfigSetting{Key: f.Key, Value: v, Secret: f.Secret})
+	}
+	return settings
+}
+
+// readSecretFile resolves KEY_FILE indirection for secrets mounted as files
+// (Docker/Kubernetes secrets). Setting both KEY and KEY_FILE is an error.
+func readSecretFile(key string) (string, error) {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	if os.Getenv(key) != "" {
+		return "", fmt.Errorf("both %s and %s_FILE are set", key, key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", key, err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s_FILE %s is empty", key, path)
+	}
+	return secret, nil
+}
+
+// parseBaseURL validates an absolute http(s) URL and strips any trailing slash
+func parseBaseURL(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("must be an absolute http(s) URL, got %q", v)
+	}
+	return strings.TrimSuffix(v, "/"), nil
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
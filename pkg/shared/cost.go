@@ -0,0 +1,70 @@
+package shared
+
+import "sync"
+
+// ModelPrice is the USD price per million tokens
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// modelPrices lists known per-model prices. Unknown models are priced as gpt-5.
+var modelPrices = map[string]ModelPrice{
+	"gpt-5":      {Input: 1.25, Output: 10.00},
+	"gpt-5-mini": {Input: 0.25, Output: 2.00},
+	"gpt-5-nano": {Input: 0.05, Output: 0.40},
+}
+
+// EstimateCost returns the USD cost of the given usage for a model.
+func EstimateCost(model string, usage Usage) float64 {
+	price, ok := modelPrices[model]
+	if !ok {
+		price = modelPrices[DefaultModel]
+	}
+	return (float64(usage.InputTokens)*price.Input + float64(usage.OutputTokens)*price.Output) / 1_000_000
+}
+
+// Budget tracks cumulative spend against optional USD and token ceilings.
+// A nil *Budget is unlimited. Safe for concurrent use.
+type Budget struct {
+	MaxUSD    float64
+	MaxTokens int
+
+	mu       sync.Mutex
+	spentUSD float64
+	tokens   int
+}
+
+// Add records the usage of one call.
+func (b *Budget) Add(model string, usage Usage) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spentUSD += EstimateCost(model, usage)
+	b.tokens += usage.InputTokens + usage.OutputTokens
+}
+
+// Exceeded reports whether either ceiling has been reached.
+func (b *Budget) Exceeded() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.MaxUSD > 0 && b.spentUSD >= b.MaxUSD {
+		return true
+	}
+	return b.MaxTokens > 0 && b.tokens >= b.MaxTokens
+}
+
+// Spent returns the spend recorded so far.
+func (b *Budget) Spent() (usd float64, tokens int) {
+	if b == nil {
+		return 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.spentUSD, b.tokens
+}
@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// QueryStats is the work Tinybird reports for an executed query
+type QueryStats struct {
+	RowsRead  int64
+	BytesRead int64
+	Elapsed   float64
+}
+
+// Stats extracts rows_read, bytes_read and elapsed from the response statistics
+func (r *TinybirdResponse) Stats() QueryStats {
+	num := func(key string) float64 {
+		f, _ := r.Statistics[key].(float64)
+		return f
+	}
+	return QueryStats{
+		RowsRead:  int64(num("rows_read")),
+		BytesRead: int64(num("bytes_read")),
+		Elapsed:   num("elapsed"),
+	}
+}
+
+// CheckQueryCost returns nlerrors.ErrQueryTooExpensive if the query read
+// more than MAX_ROWS_READ or MAX_BYTES_READ
+func CheckQueryCost(stats QueryStats, cfg *Config) error {
+	if cfg.MaxRowsRead > 0 && stats.RowsRead > cfg.MaxRowsRead {
+		return nlerrors.ErrQueryTooExpensive{Measure: "rows_read", Value: stats.RowsRead, Limit: cfg.MaxRowsRead}
+	}
+	if cfg.MaxBytesRead > 0 && stats.BytesRead > cfg.MaxBytesRead {
+		return nlerrors.ErrQueryTooExpensive{Measure: "bytes_read", Value: stats.BytesRead, Limit: cfg.MaxBytesRead}
+	}
+	return nil
+}
+
+// RowEstimator is implemented by warehouses that can estimate the rows a
+// query would read without running it
+type RowEstimator interface {
+	EstimateRows(sql string) (int64, error)
+}
+
+// CheckEstimatedCost estimates sql with warehouse, if it supports it, and
+// rejects it when the estimate exceeds MAX_ROWS_READ. Estimation failures
+// are returned as-is so callers can decide to proceed.
+func CheckEstimatedCost(warehouse Warehouse, sql string, cfg *Config) error {
+	estimator, ok := warehouse.(RowEstimator)
+	if !ok || cfg.MaxRowsRead <= 0 {
+		return nil
+	}
+	rows, err := estimator.EstimateRows(sql)
+	if err != nil {
+		return err
+	}
+	if rows > cfg.MaxRowsRead {
+		return nlerrors.ErrQueryTooExpensive{Measure: "estimated_rows", Value: rows, Limit: cfg.MaxRowsRead}
+	}
+	return nil
+}
+
+// EstimateRows runs EXPLAIN ESTIMATE and sums the rows ClickHouse expects
+// to read across all tables
+func (c *TinybirdClient) EstimateRows(sql string) (int64, error) {
+	if err := CheckStatement(sql); err != nil {
+		return 0, err
+	}
+	result, err := c.query(appendSettings("EXPLAIN ESTIMATE "+sql, c.tagSettings(nil)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate query: %w", err)
+	}
+	var total int64
+	for _, row := range result.Data {
+		switch v := row["rows"].(type) {
+		case float64:
+			total += int64(v)
+		case string:
+			// UInt64 values are quoted in ClickHouse JSON output
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				total += n
+			}
+		}
+	}
+	return total, nil
+}
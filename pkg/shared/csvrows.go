@@ -0,0 +1,45 @@
+package shared
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteRowsCSV writes result rows as CSV: a header row of the column names,
+// sorted as in Sheets exports, then one line per row. Text that a
+// spreadsheet would run as a formula is prefixed with a quote.
+func WriteRowsCSV(w io.Writer, data []map[string]interface{}) error {
+	cw := csv.NewWriter(w)
+	for _, cells := range sheetValues(data) {
+		record := make([]string, len(cells))
+		for i, cell := range cells {
+			record[i] = csvCell(cell)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvCell(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		if v != "" && (v[0] == '=' || v[0] == '+' || v[0] == '-' || v[0] == '@') {
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return "'" + v
+			}
+		}
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,52 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DatasourceDescription documents one datasource and its columns
+type DatasourceDescription struct {
+	Description string            `json:"description,omitempty"`
+	Columns     map[string]string `json:"columns,omitempty"`
+}
+
+// SchemaDescriptions maps datasource names to their descriptions, e.g.
+//
+//	{"order_items": {"description": "One row per item sold",
+//	                 "columns": {"freight_value": "Shipping cost in BRL"}}}
+type SchemaDescriptions map[string]DatasourceDescription
+
+// LoadSchemaDescriptions reads a SCHEMA_DESCRIPTIONS_FILE
+func LoadSchemaDescriptions(path string) (SchemaDescriptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema descriptions: %w", err)
+	}
+	var descriptions SchemaDescriptions
+	if err := json.Unmarshal(data, &descriptions); err != nil {
+		return nil, fmt.Errorf("invalid schema descriptions file %s: %w", path, err)
+	}
+	return descriptions, nil
+}
+
+// Apply sets descriptions on schema, replacing any fetched from Tinybird.
+// Entries for unknown datasources or columns are ignored.
+func (d SchemaDescriptions) Apply(schema *Schema) {
+	for i := range schema.Datasources {
+		ds := &schema.Datasources[i]
+		desc, ok := d[ds.Name]
+		if !ok {
+			continue
+		}
+		if desc.Description != "" {
+			ds.Description = desc.Description
+		}
+		for j := range ds.Columns {
+			if text, ok := desc.Columns[ds.Columns[j].Name]; ok && text != "" {
+				ds.Columns[j].Description = text
+			}
+		}
+	}
+}
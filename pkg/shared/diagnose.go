@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"fmt"
+	"sync"
+)
+
+const diagnosisPrompt = `An NL-to-SQL eval case failed. Explain in 2-3 sentences the most likely cause of the discrepancy between the expected and generated SQL (e.g. wrong column, missing filter, wrong aggregation, time window off-by-one, or a bad golden query). Be specific.
+
+Question: %s
+Expected SQL: %s
+Generated SQL: %s
+Failure: %s`
+
+// Completer answers free-form prompts. *OpenAIClient implements it.
+type Completer interface {
+	Complete(prompt string) (string, Usage, error)
+	Model() string
+}
+
+// DiagnoseFailures asks the model to explain each failed result and stores
+// the explanation in EvalResult.Diagnosis. Skipped cases are ignored.
+func DiagnoseFailures(llm Completer, results []EvalResult, budget *Budget) {
+	var wg sync.WaitGroup
+	for i := range results {
+		r := &results[i]
+		if r.Passed || r.Skipped || budget.Exceeded() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *EvalResult) {
+			defer wg.Done()
+			generated := r.GeneratedSQL
+			if generated == "" {
+				generated = "(none)"
+			}
+			text, usage, err := llm.Complete(fmt.Sprintf(diagnosisPrompt, r.Query, r.ExpectedSQL, generated, r.Error))
+			budget.Add(llm.Model(), usage)
+			if err != nil {
+				r.Diagnosis = fmt.Sprintf("(diagnosis failed: %v)", err)
+				return
+			}
+			r.Diagnosis = text
+		}(r)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ColumnDisplay says how to present a column's values, so consumers don't
+// each hard-code "price is BRL with two decimals". Empty fields carry no
+// hint.
+type ColumnDisplay struct {
+	// Currency is an ISO 4217 code, e.g. "BRL"
+	Currency string `json:"currency,omitempty"`
+	// Decimals is how many decimal places to show
+	Decimals *int `json:"decimals,omitempty"`
+	// Unit follows the value, e.g. "g" or "%"
+	Unit string `json:"unit,omitempty"`
+	// DateFormat is a display pattern such as "YYYY-MM-DD"
+	DateFormat string `json:"date_format,omitempty"`
+}
+
+var (
+	currencyCodeRe = regexp.MustCompile(`^[A-Z]{3}$`)
+	// displaySourceRe finds the column an aggregate keeps the unit of; a
+	// count has no unit, so it isn't matched
+	displaySourceRe = regexp.MustCompile(`(?i)^(?:SUM|AVG|MIN|MAX|sumIf|avgIf)\s*\(\s*(\w+)\s*[,)]`)
+	bareColumnRe    = regexp.MustCompile(`^\w+$`)
+)
+
+func (d ColumnDisplay) validate() error {
+	if d.Currency != "" && !currencyCodeRe.MatchString(d.Currency) {
+		return fmt.Errorf("currency must be an ISO 4217 code such as BRL, got %q", d.Currency)
+	}
+	if d.Decimals != nil && (*d.Decimals < 0 || *d.Decimals > 10) {
+		return fmt.Errorf("decimals must be between 0 and 10, got %d", *d.Decimals)
+	}
+	return nil
+}
+
+// ResultDisplay maps the result columns of sql to the profile's display
+// hints. A selected column keeps its hint under its result name, alias
+// included, and so does a SUM, AVG, MIN or MAX of it (sumIf and avgIf too),
+// since those are in the column's unit; counts are not. SELECT * gets every
+// hint. Returns nil when nothing matches or the profile has no hints.
+func (p *TenantProfile) ResultDisplay(sql string) map[string]ColumnDisplay {
+	if p == nil || len(p.Display) == 0 {
+		return nil
+	}
+	m := selectFromRe.FindStringSubmatch(sql)
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]ColumnDisplay)
+	for _, item := range splitTopLevel(m[1]) {
+		expr := strings.TrimSpace(item)
+		name := expr
+		if a := aliasRe.FindStringSubmatchIndex(expr); a != nil {
+			name = expr[a[2]:a[3]]
+			expr = strings.TrimSpace(expr[:a[0]])
+		}
+		if expr == "*" {
+			for col, d := range p.Display {
+				out[col] = d
+			}
+			continue
+		}
+		source := ""
+		if bareColumnRe.MatchString(expr) {
+			source = expr
+		} else if s := displaySourceRe.FindStringSubmatch(expr); s != nil {
+			source = s[1]
+		}
+		if d, ok := p.Display[source]; ok && source != "" {
+			out[name] = d
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// Display renames display's columns the way the pipeline's rename steps
+// rename result columns, so each hint stays next to its values
+func (p *Pipeline) Display(display map[string]ColumnDisplay) map[string]ColumnDisplay {
+	if p == nil || len(display) == 0 {
+		return display
+	}
+	out := make(map[string]ColumnDisplay, len(display))
+	for col, d := range display {
+		out[col] = d
+	}
+	for _, step := range p.steps {
+		if rename, ok := step.(*renameStep); ok {
+			for from, to := range rename.columns {
+				if d, ok := out[from]; ok {
+					delete(out, from)
+					out[to] = d
+				}
+			}
+		}
+	}
+	return out
+}
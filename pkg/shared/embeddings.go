@@ -0,0 +1,87 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// DefaultEmbeddingModel is used when EMBEDDING_MODEL is not set
+const DefaultEmbeddingModel = "text-embedding-3-small"
+
+// embeddingDimensions shortens embeddings, which keeps HISTORY_FILE small;
+// text-embedding-3 models keep most of their accuracy at this size
+const embeddingDimensions = 256
+
+// Embedder turns text into a vector, so similar questions can be found
+type Embedder interface {
+	Embed(text string) ([]float64, Usage, error)
+	EmbeddingModel() string
+}
+
+type embeddingRequest struct {
+	Model      string `json:"model"`
+	Input      string `json:"input"`
+	Dimensions int    `json:"dimensions,omitempty"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// EmbeddingModel returns the model used by Embed
+func (c *OpenAIClient) EmbeddingModel() string {
+	if c.embeddingModel == "" {
+		return DefaultEmbeddingModel
+	}
+	return c.embeddingModel
+}
+
+// Embed returns the embedding of text from the Embeddings API
+func (c *OpenAIClient) Embed(text string) ([]float64, Usage, error) {
+	jsonBody, err := json.Marshal(embeddingRequest{Model: c.EmbeddingModel(), Input: text, Dimensions: embeddingDimensions})
+	if err != nil {
+		return nil, Usage{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	status, body, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", c.baseURL+"/embeddings", bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+		return req, nil
+	})
+	if err != nil {
+		if isTimeout(err) {
+			return nil, Usage{}, nlerrors.ErrLLMTimeout{Err: err}
+		}
+		return nil, Usage{}, err
+	}
+	if status == http.StatusTooManyRequests {
+		return nil, Usage{}, nlerrors.ErrRateLimited{Service: "openai"}
+	}
+	if status != http.StatusOK {
+		return nil, Usage{}, fmt.Errorf("openai error (%d): %s", status, string(body))
+	}
+
+	var result embeddingResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, Usage{}, fmt.Errorf("failed to parse embedding: %w", err)
+	}
+	usage := Usage{InputTokens: result.Usage.PromptTokens, TotalTokens: result.Usage.TotalTokens}
+	if len(result.Data) == 0 || len(result.Data[0].Embedding) == 0 {
+		return nil, usage, fmt.Errorf("no embedding in response")
+	}
+	return result.Data[0].Embedding, usage, nil
+}
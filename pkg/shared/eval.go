@@ -3,42 +3,82 @@ package shared
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
 )
 
 // EvalCase is a test: natural language query + known-correct SQL
 type EvalCase struct {
-	Name              string
-	Query             string
-	ExpectedSQL       string
-	ReferenceTime     *time.Time
-	ExpectUnsupported bool
+	Name              string     `json:"name"`
+	Query             string     `json:"query"`
+	ExpectedSQL       string     `json:"expected_sql,omitempty"`
+	ReferenceTime     *time.Time `json:"reference_time,omitempty"`
+	ExpectUnsupported bool       `json:"expect_unsupported,omitempty"`
+	// ExpectedReasonContains, if set, must appear in the refusal reason
+	// (case-insensitive). Only used with ExpectUnsupported.
+	ExpectedReasonContains string `json:"expected_reason_contains,omitempty"`
+	// ExpectedReasonPattern, if set, is a regexp the refusal reason must match.
+	ExpectedReasonPattern string `json:"expected_reason_pattern,omitempty"`
+	// Expect, if set, asserts the shape of the generated SQL's result. With
+	// ExpectedSQL the result must also match its rows; without, the
+	// assertions alone decide the case.
+	Expect *ResultAssertions `json:"expect,omitempty"`
 }
 
 // EvalResult holds pass/fail for a single test
 type EvalResult struct {
-	Name         string `json:"name"`
-	Passed       bool   `json:"passed"`
-	Query        string `json:"query"`
-	ExpectedSQL  string `json:"expected_sql"`
-	GeneratedSQL string `json:"generated_sql"`
-	Error        string `json:"error,omitempty"`
+	Name         string  `json:"name"`
+	Passed       bool    `json:"passed"`
+	Query        string  `json:"query"`
+	ExpectedSQL  string  `json:"expected_sql"`
+	GeneratedSQL string  `json:"generated_sql"`
+	Skipped      bool    `json:"skipped,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	DurationMs   int64   `json:"duration_ms"`
+	Error        string  `json:"error,omitempty"`
+	// ErrorCode is the nlerrors code of the failure, if it was a typed error
+	ErrorCode string `json:"error_code,omitempty"`
+	Diagnosis string `json:"diagnosis,omitempty"`
+	// SchemaVersion is the version of the schema the case ran against
+	SchemaVersion string `json:"schema_version,omitempty"`
+	// SuspectExpected is set when recomputing an aggregate case's expected
+	// value another way disagreed with ExpectedSQL; VerifyNote says how
+	SuspectExpected bool   `json:"suspect_expected,omitempty"`
+	VerifyNote      string `json:"verify_note,omitempty"`
 }
 
-// EvalSummary is just counts
+// EvalSummary is just counts. PassRate excludes skipped cases.
 type EvalSummary struct {
 	Total    int     `json:"total"`
 	Passed   int     `json:"passed"`
 	Failed   int     `json:"failed"`
+	Skipped  int     `json:"skipped,omitempty"`
 	PassRate float64 `json:"pass_rate"`
+	// Suspect counts cases whose expected SQL failed verification
+	Suspect int `json:"suspect,omitempty"`
 }
 
 func refTime(t time.Time) *time.Time {
 	return &t
 }
 
+func mustLoadTimezone(name string) *time.Location {
+	loc, err := LoadTimezone(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
 // DefaultEvalCases returns the test cases
 func DefaultEvalCases() []EvalCase {
 	fixedTime := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
@@ -70,46 +110,194 @@ func DefaultEvalCases() []EvalCase {
 			ExpectedSQL:   "SELECT SUM(price) FROM order_items WHERE shipping_limit_date > '2024-06-08 12:00:00';",
 			ReferenceTime: refTime(fixedTime),
 		},
+		// The same instant is a different "today" per zone: the day starts
+		// at 15:00 UTC the day before in Tokyo and at 04:00 UTC in New York
+		{
+			Name:          "revenue_today_tokyo",
+			Query:         "What is the total revenue today?",
+			ExpectedSQL:   "SELECT SUM(price) FROM order_items WHERE shipping_limit_date >= '2024-06-14 15:00:00';",
+			ReferenceTime: refTime(fixedTime.In(mustLoadTimezone("Asia/Tokyo"))),
+		},
+		{
+			Name:          "revenue_today_new_york",
+			Query:         "What is the total revenue today?",
+			ExpectedSQL:   "SELECT SUM(price) FROM order_items WHERE shipping_limit_date >= '2024-06-15 04:00:00';",
+			ReferenceTime: refTime(fixedTime.In(mustLoadTimezone("America/New_York"))),
+		},
 		{
 			Name:              "unsupported_weather",
 			Query:             "What's the weather like in Tokyo?",
 			ExpectUnsupported: true,
 		},
 		{
-			Name:              "unsupported_nonexistent_table",
-			Query:             "How many customers are from California?",
-			ExpectUnsupported: true,
+			Name:                   "unsupported_nonexistent_table",
+			Query:                  "How many customers are from California?",
+			ExpectUnsupported:      true,
+			ExpectedReasonContains: "customer",
 		},
 	}
 }
 
+// Generator turns a natural-language question into SQL. *OpenAIClient is
+// the production implementation; eval-check also drives a deployed API.
+type Generator interface {
+	Generate(naturalLanguage string, currentTime time.Time) (*Generation, error)
+}
+
+// SchemaGenerator is a Generator whose grammar and prompt are built from a
+// Schema. SetSchema may be called while Generate runs, as the schema is
+// reloaded, and must not race it.
+type SchemaGenerator interface {
+	Generator
+	SetSchema(schema *Schema)
+}
+
+// ProfileGenerator is a Generator whose prompt a TenantProfile can shape
+type ProfileGenerator interface {
+	SetProfile(profile *TenantProfile)
+}
+
+// ExampleGenerator is a Generator that can show the model few-shot examples
+type ExampleGenerator interface {
+	SetExamples(examples []FewShotExample)
+}
+
+// Warehouse executes SQL and describes the available data.
+// *TinybirdClient is the production implementation.
+type Warehouse interface {
+	ExecuteQuery(sql string) (*TinybirdResponse, error)
+	FetchSchema() (*Schema, error)
+}
+
+// EvalOptions controls how RunEvalsWithOptions schedules cases
+type EvalOptions struct {
+	// Cases to run; nil runs DefaultEvalCases.
+	Cases []EvalCase
+	// Filter, if set, runs only the cases whose name matches.
+	Filter *regexp.Regexp
+	// Concurrency caps in-flight cases; 0 runs every case at once.
+	Concurrency int
+	// Stagger spaces out case launches by this much, give or take half,
+	// so a run doesn't open with a burst of calls; 0 launches them at once.
+	Stagger time.Duration
+	// Budget, if set, stops launching new cases once it is exceeded.
+	Budget *Budget
+	// BudgetMode is BudgetAbort (default) or BudgetSample.
+	BudgetMode string
+	// SchemaVersion, if set, is recorded on every result.
+	SchemaVersion string
+	// VerifyExpected, if set, recomputes the expected value of aggregate
+	// cases with a GROUP BY over a column of this schema and flags cases
+	// where the two disagree.
+	VerifyExpected *Schema
+	// OnResult, if set, is called with each case's index and result as it
+	// finishes, skipped cases included. Calls are never concurrent.
+	OnResult func(index int, result EvalResult)
+}
+
+// Budget modes for EvalOptions
+const (
+	// BudgetAbort fails the run when the budget is exceeded.
+	BudgetAbort = "abort"
+	// BudgetSample shuffles the cases and treats the ones that fit in the
+	// budget as a sampled subset; skipped cases don't fail the run.
+	BudgetSample = "sample"
+)
+
+// ErrBudgetExceeded is returned when an eval run stops early on its budget
+var ErrBudgetExceeded = errors.New("eval budget exceeded")
+
 // RunEvals runs all eval cases
-func RunEvals(openai *OpenAIClient, tinybird *TinybirdClient) ([]EvalResult, error) {
-	cases := DefaultEvalCases()
+func RunEvals(generator Generator, warehouse Warehouse) ([]EvalResult, error) {
+	return RunEvalsWithOptions(generator, warehouse, EvalOptions{})
+}
+
+// RunEvalsWithOptions runs all eval cases with concurrency and budget limits
+func RunEvalsWithOptions(generator Generator, warehouse Warehouse, opts EvalOptions) ([]EvalResult, error) {
+	cases := opts.Cases
+	if cases == nil {
+		cases = DefaultEvalCases()
+	}
+	cases = filterCases(cases, opts.Filter)
+	if opts.Budget != nil && opts.BudgetMode == BudgetSample {
+		// Shuffle a copy, so the caller's cases keep their order
+		cases = append([]EvalCase(nil), cases...)
+		rand.Shuffle(len(cases), func(i, j int) { cases[i], cases[j] = cases[j], cases[i] })
+	}
 	results := make([]EvalResult, len(cases))
 
+	var progressMu sync.Mutex
+	finished := func(idx int) {
+		results[idx].SchemaVersion = opts.SchemaVersion
+		if opts.OnResult != nil {
+			progressMu.Lock()
+			defer progressMu.Unlock()
+			opts.OnResult(idx, results[idx])
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = len(cases)
+	}
+	sem := make(chan struct{}, concurrency)
+
 	var wg sync.WaitGroup
 	for i, tc := range cases {
+		if i > 0 && opts.Stagger > 0 {
+			time.Sleep(opts.Stagger/2 + time.Duration(rand.Int63n(int64(opts.Stagger))))
+		}
+		sem <- struct{}{}
+		if opts.Budget.Exceeded() {
+			<-sem
+			results[i] = EvalResult{
+				Name:        tc.Name,
+				Query:       tc.Query,
+				ExpectedSQL: tc.ExpectedSQL,
+				Skipped:     true,
+				Error:       ErrBudgetExceeded.Error(),
+			}
+			finished(i)
+			continue
+		}
+
 		wg.Add(1)
 		go func(idx int, tc EvalCase) {
 			defer wg.Done()
-			results[idx] = runEval(openai, tinybird, tc)
+			defer func() { <-sem }()
+			start := time.Now()
+			results[idx] = runEval(generator, warehouse, tc, opts.VerifyExpected)
+			results[idx].DurationMs = time.Since(start).Milliseconds()
+			opts.Budget.Add(results[idx].Model, Usage{
+				InputTokens:  results[idx].InputTokens,
+				OutputTokens: results[idx].OutputTokens,
+			})
+			finished(idx)
 		}(i, tc)
 	}
 	wg.Wait()
 
 	var firstErr error
+	skipped := false
 	for _, r := range results {
+		if r.Skipped {
+			skipped = true
+			continue
+		}
 		if !r.Passed {
 			firstErr = fmt.Errorf("eval %s failed: %s", r.Name, r.Error)
 			break
 		}
 	}
+	if firstErr == nil && skipped && opts.BudgetMode != BudgetSample {
+		usd, tokens := opts.Budget.Spent()
+		firstErr = fmt.Errorf("%w: spent $%.4f (%d tokens)", ErrBudgetExceeded, usd, tokens)
+	}
 
 	return results, firstErr
 }
 
-func runEval(openai *OpenAIClient, tinybird *TinybirdClient, tc EvalCase) EvalResult {
+func runEval(generator Generator, warehouse Warehouse, tc EvalCase, verify *Schema) EvalResult {
 	result := EvalResult{
 		Name:        tc.Name,
 		Query:       tc.Query,
@@ -117,30 +305,49 @@ func runEval(openai *OpenAIClient, tinybird *TinybirdClient, tc EvalCase) EvalRe
 	}
 
 	if tc.ExpectUnsupported {
-		return runUnsupportedEval(openai, tc)
+		return runUnsupportedEval(generator, tc)
 	}
 
-	expected, err := tinybird.ExecuteQuery(tc.ExpectedSQL)
-	if err != nil {
-		result.Error = fmt.Sprintf("expected SQL failed: %v", err)
-		return result
+	// Cases with only assertions have no expected rows
+	var expected *TinybirdResponse
+	if tc.ExpectedSQL != "" {
+		var err error
+		expected, err = warehouse.ExecuteQuery(tc.ExpectedSQL)
+		if err != nil {
+			result.Error = fmt.Sprintf("expected SQL failed: %v", err)
+			result.ErrorCode = string(nlerrors.CodeOf(err))
+			return result
+		}
+		if verify != nil {
+			verifyExpected(warehouse, verify, tc, expected, &result)
+		}
 	}
 
-	var generatedSQL string
-	if tc.ReferenceTime != nil {
-		generatedSQL, err = openai.GenerateSQLWithTime(tc.Query, *tc.ReferenceTime)
-	} else {
-		generatedSQL, err = openai.GenerateSQL(tc.Query)
-	}
+	gen, err := generator.Generate(tc.Query, evalReferenceTime(tc))
+	recordUsage(&result, gen)
 	if err != nil {
 		result.Error = fmt.Sprintf("generation failed: %v", err)
+		result.ErrorCode = string(nlerrors.CodeOf(err))
 		return result
 	}
+	generatedSQL := gen.SQL
 	result.GeneratedSQL = generatedSQL
 
-	generated, err := tinybird.ExecuteQuery(generatedSQL)
+	generated, err := warehouse.ExecuteQuery(generatedSQL)
 	if err != nil {
 		result.Error = fmt.Sprintf("generated SQL failed: %v", err)
+		result.ErrorCode = string(nlerrors.CodeOf(err))
+		return result
+	}
+
+	if tc.Expect != nil {
+		if err := tc.Expect.Check(generated); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	if expected == nil {
+		result.Passed = true
 		return result
 	}
 
@@ -158,19 +365,15 @@ func runEval(openai *OpenAIClient, tinybird *TinybirdClient, tc EvalCase) EvalRe
 	return result
 }
 
-func runUnsupportedEval(openai *OpenAIClient, tc EvalCase) EvalResult {
+func runUnsupportedEval(generator Generator, tc EvalCase) EvalResult {
 	result := EvalResult{
 		Name:        tc.Name,
 		Query:       tc.Query,
 		ExpectedSQL: "(expected to be unsupported)",
 	}
 
-	var err error
-	if tc.ReferenceTime != nil {
-		_, err = openai.GenerateSQLWithTime(tc.Query, *tc.ReferenceTime)
-	} else {
-		_, err = openai.GenerateSQL(tc.Query)
-	}
+	gen, err := generator.Generate(tc.Query, evalReferenceTime(tc))
+	recordUsage(&result, gen)
 
 	if err == nil {
 		result.Error = "expected ErrUnsupportedQuery but got valid SQL"
@@ -180,14 +383,60 @@ func runUnsupportedEval(openai *OpenAIClient, tc EvalCase) EvalResult {
 	var unsupportedErr ErrUnsupportedQuery
 	if !errors.As(err, &unsupportedErr) {
 		result.Error = fmt.Sprintf("expected ErrUnsupportedQuery but got: %v", err)
+		result.ErrorCode = string(nlerrors.CodeOf(err))
 		return result
 	}
 
 	result.GeneratedSQL = fmt.Sprintf("(refused: %s)", unsupportedErr.Reason)
+
+	if tc.ExpectedReasonContains != "" &&
+		!strings.Contains(strings.ToLower(unsupportedErr.Reason), strings.ToLower(tc.ExpectedReasonContains)) {
+		result.Error = fmt.Sprintf("refusal reason does not mention %q", tc.ExpectedReasonContains)
+		return result
+	}
+	if tc.ExpectedReasonPattern != "" {
+		re, err := regexp.Compile(tc.ExpectedReasonPattern)
+		if err != nil {
+			result.Error = fmt.Sprintf("invalid ExpectedReasonPattern: %v", err)
+			return result
+		}
+		if !re.MatchString(unsupportedErr.Reason) {
+			result.Error = fmt.Sprintf("refusal reason does not match %q", tc.ExpectedReasonPattern)
+			return result
+		}
+	}
+
 	result.Passed = true
 	return result
 }
 
+func filterCases(cases []EvalCase, filter *regexp.Regexp) []EvalCase {
+	out := make([]EvalCase, 0, len(cases))
+	for _, tc := range cases {
+		if filter == nil || filter.MatchString(tc.Name) {
+			out = append(out, tc)
+		}
+	}
+	return out
+}
+
+func evalReferenceTime(tc EvalCase) time.Time {
+	if tc.ReferenceTime != nil {
+		return *tc.ReferenceTime
+	}
+	return time.Now().UTC()
+}
+
+func recordUsage(result *EvalResult, gen *Generation) {
+	if gen == nil {
+		return
+	}
+	result.Model = gen.Model
+	result.InputTokens = gen.Usage.InputTokens
+	result.OutputTokens = gen.Usage.OutputTokens
+	result.CostUSD = EstimateCost(gen.Model, gen.Usage)
+}
+
 func dataEqual(a, b []map[string]interface{}) bool {
 	if len(a) != len(b) {
 		return false
@@ -265,14 +514,20 @@ func toFloat(v interface{}) (float64, bool) {
 func ComputeSummary(results []EvalResult) EvalSummary {
 	s := EvalSummary{Total: len(results)}
 	for _, r := range results {
-		if r.Passed {
+		if r.SuspectExpected {
+			s.Suspect++
+		}
+		switch {
+		case r.Skipped:
+			s.Skipped++
+		case r.Passed:
 			s.Passed++
-		} else {
+		default:
 			s.Failed++
 		}
 	}
-	if s.Total > 0 {
-		s.PassRate = float64(s.Passed) / float64(s.Total) * 100
+	if ran := s.Passed + s.Failed; ran > 0 {
+		s.PassRate = float64(s.Passed) / float64(ran) * 100
 	}
 	return s
 }
@@ -0,0 +1,223 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Operators of a ValueAssertion
+const (
+	OpEq       = "="
+	OpNe       = "!="
+	OpGt       = ">"
+	OpGte      = ">="
+	OpLt       = "<"
+	OpLte      = "<="
+	OpContains = "contains"
+	OpNotNull  = "not_null"
+)
+
+// ResultAssertions describe the shape a case's result must have, for
+// questions whose exact answer is hard to pin down with ExpectedSQL, e.g.
+// "top sellers" or anything relative to the current time. Every assertion
+// set must hold.
+type ResultAssertions struct {
+	// MinRows and MaxRows bound the row count; nil leaves a side open
+	MinRows *int `json:"min_rows,omitempty"`
+	MaxRows *int `json:"max_rows,omitempty"`
+	// Columns must all be in the result
+	Columns []string `json:"columns,omitempty"`
+	// Values are checked against the result's rows
+	Values []ValueAssertion `json:"values,omitempty"`
+}
+
+// ValueAssertion checks a column's values: Column Op Value must hold in
+// every row, or only in row Row (0-based) when it is set. Against a number,
+// values compare as numbers, quoted ones included; otherwise as strings.
+type ValueAssertion struct {
+	Column string      `json:"column"`
+	Op     string      `json:"op"`
+	Value  interface{} `json:"value,omitempty"`
+	Row    *int        `json:"row,omitempty"`
+}
+
+// Validate reports assertions that can never be checked
+func (a *ResultAssertions) Validate() error {
+	if a.MinRows != nil && a.MaxRows != nil && *a.MinRows > *a.MaxRows {
+		return fmt.Errorf("min_rows %d is above max_rows %d", *a.MinRows, *a.MaxRows)
+	}
+	for i, v := range a.Values {
+		if v.Column == "" {
+			return fmt.Errorf("values[%d]: column is required", i)
+		}
+		switch v.Op {
+		case OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpContains:
+			if v.Value == nil {
+				return fmt.Errorf("values[%d]: %s needs a value", i, v.Op)
+			}
+		case OpNotNull:
+		default:
+			return fmt.Errorf("values[%d]: unknown op %q", i, v.Op)
+		}
+		if v.Row != nil && *v.Row < 0 {
+			return fmt.Errorf("values[%d]: row must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// Check returns an error describing the first assertion result breaks
+func (a *ResultAssertions) Check(result *TinybirdResponse) error {
+	if a.MinRows != nil && result.Rows < *a.MinRows {
+		return fmt.Errorf("row count: expected at least %d, got %d", *a.MinRows, result.Rows)
+	}
+	if a.MaxRows != nil && result.Rows > *a.MaxRows {
+		return fmt.Errorf("row count: expected at most %d, got %d", *a.MaxRows, result.Rows)
+	}
+
+	columns := resultColumns(result)
+	for _, col := range a.Columns {
+		if !columns[col] {
+			return fmt.Errorf("missing column %q", col)
+		}
+	}
+
+	for _, v := range a.Values {
+		if !columns[v.Column] {
+			return fmt.Errorf("missing column %q", v.Column)
+		}
+		if v.Row != nil {
+			if *v.Row >= len(result.Data) {
+				return fmt.Errorf("row %d: only %d rows", *v.Row, len(result.Data))
+			}
+			if !v.holds(result.Data[*v.Row][v.Column]) {
+				return fmt.Errorf("row %d: %s = %v, expected %s", *v.Row, v.Column, result.Data[*v.Row][v.Column], v)
+			}
+			continue
+		}
+		for i, row := range result.Data {
+			if !v.holds(row[v.Column]) {
+				return fmt.Errorf("row %d: %s = %v, expected %s", i, v.Column, row[v.Column], v)
+			}
+		}
+	}
+	return nil
+}
+
+func (v ValueAssertion) String() string {
+	if v.Op == OpNotNull {
+		return v.Column + " not null"
+	}
+	return fmt.Sprintf("%s %s %v", v.Column, v.Op, v.Value)
+}
+
+// holds reports whether got satisfies the assertion
+func (v ValueAssertion) holds(got interface{}) bool {
+	if v.Op == OpNotNull {
+		return got != nil
+	}
+	if got == nil {
+		return false
+	}
+	if v.Op == OpContains {
+		return strings.Contains(fmt.Sprint(got), fmt.Sprint(v.Value))
+	}
+
+	var cmp int
+	gf, gok := toFloat(got)
+	wf, wok := toFloat(v.Value)
+	if s, ok := got.(string); ok && wok {
+		// ClickHouse quotes 64-bit integers in JSON
+		var err error
+		gf, err = strconv.ParseFloat(s, 64)
+		gok = err == nil
+	}
+	switch {
+	case gok && wok:
+		cmp = compareFloats(gf, wf)
+	default:
+		cmp = strings.Compare(fmt.Sprint(got), fmt.Sprint(v.Value))
+	}
+	switch v.Op {
+	case OpEq:
+		return cmp == 0
+	case OpNe:
+		return cmp != 0
+	case OpGt:
+		return cmp > 0
+	case OpGte:
+		return cmp >= 0
+	case OpLt:
+		return cmp < 0
+	case OpLte:
+		return cmp <= 0
+	}
+	return false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// resultColumns returns the result's column names, from its metadata or,
+// without any, its first row
+func resultColumns(result *TinybirdResponse) map[string]bool {
+	columns := make(map[string]bool)
+	for _, m := range result.Meta {
+		columns[m["name"]] = true
+	}
+	if len(columns) == 0 && len(result.Data) > 0 {
+		for k := range result.Data[0] {
+			columns[k] = true
+		}
+	}
+	return columns
+}
+
+// LoadEvalCases reads eval cases from a JSON file: an array of cases with
+// the fields of EvalCase, e.g.
+//
+//	[{"name": "top_sellers", "query": "Top 5 sellers by revenue",
+//	  "expect": {"min_rows": 1, "max_rows": 5, "columns": ["seller_id"]}}]
+func LoadEvalCases(path string) ([]EvalCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read eval cases: %w", err)
+	}
+	var cases []EvalCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("invalid eval cases file %s: %w", path, err)
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("eval cases file %s has no cases", path)
+	}
+	seen := make(map[string]bool)
+	for i, tc := range cases {
+		switch {
+		case tc.Name == "":
+			return nil, fmt.Errorf("case %d: name is required", i)
+		case seen[tc.Name]:
+			return nil, fmt.Errorf("case %s: duplicate name", tc.Name)
+		case tc.Query == "":
+			return nil, fmt.Errorf("case %s: query is required", tc.Name)
+		case !tc.ExpectUnsupported && tc.ExpectedSQL == "" && tc.Expect == nil:
+			return nil, fmt.Errorf("case %s: needs expected_sql, expect or expect_unsupported", tc.Name)
+		}
+		if tc.Expect != nil {
+			if err := tc.Expect.Validate(); err != nil {
+				return nil, fmt.Errorf("case %s: %w", tc.Name, err)
+			}
+		}
+		seen[tc.Name] = true
+	}
+	return cases, nil
+}
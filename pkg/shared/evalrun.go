@@ -0,0 +1,158 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// EvalRun is a persisted eval run, used to compare runs across models or prompts
+type EvalRun struct {
+	Model      string       `json:"model"`
+	StartedAt  time.Time    `json:"started_at"`
+	DurationMs int64        `json:"duration_ms"`
+	CostUSD    float64      `json:"cost_usd"`
+	Summary    EvalSummary  `json:"summary"`
+	Results    []EvalResult `json:"results"`
+}
+
+// NewEvalRun builds an EvalRun from the results of RunEvals
+func NewEvalRun(model string, startedAt time.Time, results []EvalResult) *EvalRun {
+	run := &EvalRun{
+		Model:      model,
+		StartedAt:  startedAt.UTC(),
+		DurationMs: time.Since(startedAt).Milliseconds(),
+		Summary:    ComputeSummary(results),
+		Results:    results,
+	}
+	for _, r := range results {
+		run.CostUSD += r.CostUSD
+	}
+	return run
+}
+
+// SaveEvalRun writes the run as indented JSON
+func SaveEvalRun(path string, run *EvalRun) error {
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal eval run: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write eval run: %w", err)
+	}
+	return nil
+}
+
+// LoadEvalRun reads a run written by SaveEvalRun
+func LoadEvalRun(path string) (*EvalRun, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read eval run: %w", err)
+	}
+	var run EvalRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse eval run %s: %w", path, err)
+	}
+	return &run, nil
+}
+
+// Case statuses reported by DiffEvalRuns
+const (
+	DiffFixed     = "fixed"
+	DiffRegressed = "regressed"
+	DiffPassing   = "passing"
+	DiffFailing   = "failing"
+	DiffAdded     = "added"
+	DiffRemoved   = "removed"
+)
+
+// CaseDiff compares a single case between two runs
+type CaseDiff struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	SQLA            string  `json:"sql_a,omitempty"`
+	SQLB            string  `json:"sql_b,omitempty"`
+	SQLChanged      bool    `json:"sql_changed"`
+	DurationDeltaMs int64   `json:"duration_delta_ms"`
+	CostDeltaUSD    float64 `json:"cost_delta_usd"`
+}
+
+// EvalDiff is the comparison of two eval runs
+type EvalDiff struct {
+	ModelA          string      `json:"model_a"`
+	ModelB          string      `json:"model_b"`
+	SummaryA        EvalSummary `json:"summary_a"`
+	SummaryB        EvalSummary `json:"summary_b"`
+	DurationDeltaMs int64       `json:"duration_delta_ms"`
+	CostDeltaUSD    float64     `json:"cost_delta_usd"`
+	Cases           []CaseDiff  `json:"cases"`
+}
+
+// DiffEvalRuns compares run a (baseline) against run b (candidate)
+func DiffEvalRuns(a, b *EvalRun) EvalDiff {
+	diff := EvalDiff{
+		ModelA:          a.Model,
+		ModelB:          b.Model,
+		SummaryA:        a.Summary,
+		SummaryB:        b.Summary,
+		DurationDeltaMs: b.DurationMs - a.DurationMs,
+		CostDeltaUSD:    b.CostUSD - a.CostUSD,
+	}
+
+	byName := make(map[string]EvalResult, len(b.Results))
+	for _, r := range b.Results {
+		byName[r.Name] = r
+	}
+
+	seen := make(map[string]bool, len(a.Results))
+	for _, ra := range a.Results {
+		seen[ra.Name] = true
+		rb, ok := byName[ra.Name]
+		if !ok {
+			diff.Cases = append(diff.Cases, CaseDiff{Name: ra.Name, Status: DiffRemoved, SQLA: ra.GeneratedSQL})
+			continue
+		}
+
+		cd := CaseDiff{
+			Name:            ra.Name,
+			SQLA:            ra.GeneratedSQL,
+			SQLB:            rb.GeneratedSQL,
+			SQLChanged:      ra.GeneratedSQL != rb.GeneratedSQL,
+			DurationDeltaMs: rb.DurationMs - ra.DurationMs,
+			CostDeltaUSD:    rb.CostUSD - ra.CostUSD,
+		}
+		switch {
+		case ra.Passed && rb.Passed:
+			cd.Status = DiffPassing
+		case ra.Passed:
+			cd.Status = DiffRegressed
+		case rb.Passed:
+			cd.Status = DiffFixed
+		default:
+			cd.Status = DiffFailing
+		}
+		diff.Cases = append(diff.Cases, cd)
+	}
+
+	for _, rb := range b.Results {
+		if !seen[rb.Name] {
+			diff.Cases = append(diff.Cases, CaseDiff{Name: rb.Name, Status: DiffAdded, SQLB: rb.GeneratedSQL})
+		}
+	}
+
+	sort.Slice(diff.Cases, func(i, j int) bool { return diff.Cases[i].Name < diff.Cases[j].Name })
+	return diff
+}
+
+// Regressions returns the cases that passed in run a but fail in run b
+func (d EvalDiff) Regressions() []CaseDiff {
+	var out []CaseDiff
+	for _, c := range d.Cases {
+		if c.Status == DiffRegressed {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// aggregateCaseRe matches the expected SQL VerifyExpected can recompute: a
+// single aggregate over one table, optionally filtered
+var aggregateCaseRe = regexp.MustCompile(`(?is)^\s*SELECT\s+(SUM|COUNT|AVG|MIN|MAX)\s*\(\s*(\*|[A-Za-z_][A-Za-z0-9_]*)\s*\)\s+FROM\s+([A-Za-z_][A-Za-z0-9_.]*)(\s+WHERE\s+.*?)?\s*;?\s*$`)
+
+// unverifiableRe rejects WHERE clauses that hide a second statement shape
+var unverifiableRe = regexp.MustCompile(`(?i)\b(GROUP|HAVING|JOIN|UNION|ORDER|LIMIT|SELECT)\b`)
+
+// RecomputeAggregate rewrites a single-aggregate expected SQL into an
+// independent form: the aggregate is computed per group of partition and
+// the partials combined again, e.g. SUM(price) becomes the sum of
+// SUM(price) GROUP BY partition. The second form shares no aggregate with
+// the first at the top level, so a typo in one rarely reproduces in the
+// other. It returns false for SQL it can't rewrite.
+func RecomputeAggregate(sql, partition string) (string, bool) {
+	m := aggregateCaseRe.FindStringSubmatch(sql)
+	if m == nil || unverifiableRe.MatchString(m[4]) {
+		return "", false
+	}
+	fn, arg, table, where := strings.ToUpper(m[1]), m[2], m[3], m[4]
+	inner := fmt.Sprintf("FROM %s%s GROUP BY %s", table, where, partition)
+
+	switch fn {
+	case "SUM", "COUNT":
+		return fmt.Sprintf("SELECT sum(part) FROM (SELECT %s(%s) AS part %s)", fn, arg, inner), true
+	case "MIN", "MAX":
+		return fmt.Sprintf("SELECT %s(part) FROM (SELECT %s(%s) AS part %s)", strings.ToLower(fn), fn, arg, inner), true
+	case "AVG":
+		if arg == "*" {
+			return "", false
+		}
+		return fmt.Sprintf("SELECT sum(total) / sum(n) FROM (SELECT SUM(%s) AS total, COUNT(%s) AS n %s)", arg, arg, inner), true
+	}
+	return "", false
+}
+
+// partitionColumn picks the column to regroup a table by: the first one
+// that isn't the aggregated column, since grouping by the value itself
+// would leave MIN/MAX trivially right
+func partitionColumn(schema *Schema, sql string) string {
+	m := aggregateCaseRe.FindStringSubmatch(sql)
+	if m == nil || schema == nil {
+		return ""
+	}
+	for _, ds := range schema.Datasources {
+		if ds.Name != m[3] {
+			continue
+		}
+		for _, col := range ds.Columns {
+			if col.Name != m[2] {
+				return col.Name
+			}
+		}
+	}
+	return ""
+}
+
+// verifyExpected recomputes an aggregate case's expected value and flags
+// the case when the two forms disagree, which points at a wrong golden
+// answer rather than a wrong generation. Cases it can't rewrite are left
+// unflagged.
+func verifyExpected(warehouse Warehouse, schema *Schema, tc EvalCase, expected *TinybirdResponse, result *EvalResult) {
+	partition := partitionColumn(schema, tc.ExpectedSQL)
+	if partition == "" {
+		return
+	}
+	sql, ok := RecomputeAggregate(tc.ExpectedSQL, partition)
+	if !ok || expected.Rows != 1 || len(expected.Data) != 1 {
+		return
+	}
+
+	recomputed, err := warehouse.ExecuteQuery(sql)
+	if err != nil {
+		result.SuspectExpected = true
+		result.VerifyNote = fmt.Sprintf("recomputation failed: %v", err)
+		return
+	}
+	if len(recomputed.Data) != 1 || !rowEqual(expected.Data[0], recomputed.Data[0]) {
+		result.SuspectExpected = true
+		result.VerifyNote = fmt.Sprintf("expected SQL returned %v but %s returned %v", singleValue(expected.Data[0]), sql, firstRow(recomputed.Data))
+	}
+}
+
+// singleValue returns the value of a one-column row
+func singleValue(row map[string]interface{}) interface{} {
+	for _, v := range row {
+		return v
+	}
+	return nil
+}
+
+func firstRow(data []map[string]interface{}) interface{} {
+	if len(data) == 0 {
+		return "no rows"
+	}
+	return singleValue(data[0])
+}
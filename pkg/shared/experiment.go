@@ -0,0 +1,446 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Experiment compares two prompt variants over the eval suite, so a prompt
+// change ships with a measured effect rather than a hunch
+type Experiment struct {
+	Name      string            `json:"name"`
+	Baseline  ExperimentVariant `json:"baseline"`
+	Candidate ExperimentVariant `json:"candidate"`
+	// Repeats runs the suite this many times per variant (default 1).
+	// Generation isn't deterministic, so more repeats give the test more
+	// pairs to work with.
+	Repeats int `json:"repeats,omitempty"`
+	// Alpha is the significance level of the verdict (default 0.05)
+	Alpha float64 `json:"alpha,omitempty"`
+}
+
+// ExperimentVariant is one arm of an experiment: a prompt profile and,
+// optionally, a model. Without a profile the default prompt is used.
+type ExperimentVariant struct {
+	Name    string         `json:"name"`
+	Model   string         `json:"model,omitempty"`
+	Profile *TenantProfile `json:"profile,omitempty"`
+}
+
+// Experiment verdicts
+const (
+	VerdictBetter       = "candidate_better"
+	VerdictWorse        = "candidate_worse"
+	VerdictInconclusive = "inconclusive"
+)
+
+// ExperimentUnchanged is the status of a case both variants passed equally
+// often, but not always or never
+const ExperimentUnchanged = "unchanged"
+
+// LoadExperiment reads and validates an experiment file
+func LoadExperiment(path string) (*Experiment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read experiment: %w", err)
+	}
+	var exp Experiment
+	if err := json.Unmarshal(data, &exp); err != nil {
+		return nil, fmt.Errorf("invalid experiment file %s: %w", path, err)
+	}
+	if exp.Baseline.Name == "" {
+		exp.Baseline.Name = "baseline"
+	}
+	if exp.Candidate.Name == "" {
+		exp.Candidate.Name = "candidate"
+	}
+	if exp.Repeats < 0 {
+		return nil, fmt.Errorf("experiment %s: repeats must not be negative, got %d", path, exp.Repeats)
+	}
+	if exp.Alpha < 0 || exp.Alpha >= 1 {
+		return nil, fmt.Errorf("experiment %s: alpha must be between 0 and 1, got %g", path, exp.Alpha)
+	}
+	for _, v := range []ExperimentVariant{exp.Baseline, exp.Candidate} {
+		if v.Profile == nil || v.Profile.Grammar == nil {
+			continue
+		}
+		for _, agg := range v.Profile.Grammar.Aggregates {
+			if !containsString(Aggregates, strings.ToUpper(agg)) {
+				return nil, fmt.Errorf("experiment %s: variant %s: unknown aggregate %q", path, v.Name, agg)
+			}
+		}
+	}
+	return &exp, nil
+}
+
+// ExperimentOptions control RunExperiment
+type ExperimentOptions struct {
+	// Eval is applied to every suite run. Its Cases, Filter, Concurrency
+	// and Budget are shared by both variants.
+	Eval EvalOptions
+	// Questions, when set, are also answered by both variants, as a shadow
+	// of real traffic: there is no expected SQL, so the variants are
+	// compared with each other
+	Questions []string
+	// ClientOptions are passed to each variant's OpenAI client
+	ClientOptions []ClientOption
+}
+
+// VariantReport summarizes one variant over all repeats
+type VariantReport struct {
+	Name  string `json:"name"`
+	Model string `json:"model"`
+	// Trials are the case runs that weren't skipped
+	Trials   int     `json:"trials"`
+	Passed   int     `json:"passed"`
+	PassRate float64 `json:"pass_rate"`
+	// PassRateLow and PassRateHigh are the 95% Wilson interval of PassRate
+	PassRateLow    float64 `json:"pass_rate_low"`
+	PassRateHigh   float64 `json:"pass_rate_high"`
+	CostUSD        float64 `json:"cost_usd"`
+	MeanDurationMs float64 `json:"mean_duration_ms"`
+	// Runs are the suite runs, one per repeat
+	Runs []*EvalRun `json:"runs"`
+}
+
+// ExperimentCase compares one case across all repeats
+type ExperimentCase struct {
+	Name            string `json:"name"`
+	Repeats         int    `json:"repeats"`
+	BaselinePassed  int    `json:"baseline_passed"`
+	CandidatePassed int    `json:"candidate_passed"`
+	// Status is fixed or regressed when the candidate passed more or less
+	// often, else passing, failing or unchanged
+	Status string `json:"status"`
+}
+
+// ShadowResult compares both variants' answers to one traffic question
+type ShadowResult struct {
+	Question       string `json:"question"`
+	BaselineSQL    string `json:"baseline_sql,omitempty"`
+	CandidateSQL   string `json:"candidate_sql,omitempty"`
+	BaselineError  string `json:"baseline_error,omitempty"`
+	CandidateError string `json:"candidate_error,omitempty"`
+	// Agreed is set when both answered with the same rows
+	Agreed bool `json:"agreed"`
+}
+
+// ShadowReport summarizes the traffic shadow of an experiment
+type ShadowReport struct {
+	Questions       int            `json:"questions"`
+	Agreed          int            `json:"agreed"`
+	AgreementRate   float64        `json:"agreement_rate"`
+	BaselineErrors  int            `json:"baseline_errors"`
+	CandidateErrors int            `json:"candidate_errors"`
+	Results         []ShadowResult `json:"results"`
+}
+
+// ExperimentReport is the outcome of RunExperiment. Cases are paired by
+// name and repeat, and McNemar's exact test on the discordant pairs says
+// whether the difference in pass rate is more than noise.
+type ExperimentReport struct {
+	Name      string        `json:"name"`
+	StartedAt time.Time     `json:"started_at"`
+	Repeats   int           `json:"repeats"`
+	Baseline  VariantReport `json:"baseline"`
+	Candidate VariantReport `json:"candidate"`
+	// BaselineOnly and CandidateOnly count the pairs only that variant passed
+	BaselineOnly  int     `json:"baseline_only"`
+	CandidateOnly int     `json:"candidate_only"`
+	PValue        float64 `json:"p_value"`
+	Alpha         float64 `json:"alpha"`
+	Verdict       string  `json:"verdict"`
+	// PassRateDelta, CostDeltaUSD and DurationDeltaMs are candidate minus baseline
+	PassRateDelta   float64          `json:"pass_rate_delta"`
+	CostDeltaUSD    float64          `json:"cost_delta_usd"`
+	DurationDeltaMs float64          `json:"duration_delta_ms"`
+	Cases           []ExperimentCase `json:"cases"`
+	Shadow          *ShadowReport    `json:"shadow,omitempty"`
+}
+
+// generator builds the variant's OpenAI client for schema, narrowed by the
+// variant's grammar
+func (v ExperimentVariant) generator(cfg *Config, schema *Schema, opts []ClientOption) (*OpenAIClient, error) {
+	if v.Model != "" {
+		opts = append(append([]ClientOption{}, opts...), WithModel(v.Model))
+	}
+	client := NewOpenAIClient(cfg, opts...)
+	narrowed := v.Profile.ApplyGrammar(schema)
+	if len(narrowed.Datasources) == 0 {
+		return nil, fmt.Errorf("variant %s: grammar allows none of the schema's tables", v.Name)
+	}
+	client.SetProfile(v.Profile)
+	client.SetSchema(narrowed)
+	return client, nil
+}
+
+// RunExperiment runs the eval suite for both variants of exp, Repeats times
+// each, and compares them. The variants alternate which goes first, so
+// drift in the model or warehouse doesn't favour one of them.
+func RunExperiment(cfg *Config, schema *Schema, warehouse Warehouse, exp *Experiment, opts ExperimentOptions) (*ExperimentReport, error) {
+	repeats := exp.Repeats
+	if repeats == 0 {
+		repeats = 1
+	}
+	alpha := exp.Alpha
+	if alpha == 0 {
+		alpha = 0.05
+	}
+	baseline, err := exp.Baseline.generator(cfg, schema, opts.ClientOptions)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := exp.Candidate.generator(cfg, schema, opts.ClientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ExperimentReport{
+		Name:      exp.Name,
+		StartedAt: time.Now().UTC(),
+		Repeats:   repeats,
+		Alpha:     alpha,
+		Baseline:  VariantReport{Name: exp.Baseline.Name, Model: baseline.Model()},
+		Candidate: VariantReport{Name: exp.Candidate.Name, Model: candidate.Model()},
+	}
+	evalOpts := opts.Eval
+	evalOpts.SchemaVersion = schema.Version()
+
+	arms := []struct {
+		client *OpenAIClient
+		report *VariantReport
+	}{{baseline, &report.Baseline}, {candidate, &report.Candidate}}
+	for i := 0; i < repeats; i++ {
+		order := []int{0, 1}
+		if i%2 == 1 {
+			order = []int{1, 0}
+		}
+		for _, arm := range order {
+			start := time.Now()
+			results, err := RunEvalsWithOptions(arms[arm].client, warehouse, evalOpts)
+			// A failing case is data here, not an error; only a run that
+			// couldn't finish, like an exhausted budget, ends the experiment
+			if err != nil && evalOpts.Budget != nil && evalOpts.Budget.Exceeded() && evalOpts.BudgetMode != BudgetSample {
+				return nil, fmt.Errorf("experiment stopped in repeat %d: %w", i+1, err)
+			}
+			arms[arm].report.Runs = append(arms[arm].report.Runs, NewEvalRun(arms[arm].report.Model, start, results))
+		}
+	}
+
+	report.Baseline.summarize()
+	report.Candidate.summarize()
+	report.compare()
+
+	if len(opts.Questions) > 0 {
+		report.Shadow = runShadow(baseline, candidate, warehouse, opts.Questions, evalOpts.Concurrency)
+	}
+	return report, nil
+}
+
+// summarize totals the variant's runs
+func (v *VariantReport) summarize() {
+	var durationMs int64
+	for _, run := range v.Runs {
+		v.CostUSD += run.CostUSD
+		for _, r := range run.Results {
+			if r.Skipped {
+				continue
+			}
+			v.Trials++
+			durationMs += r.DurationMs
+			if r.Passed {
+				v.Passed++
+			}
+		}
+	}
+	if v.Trials > 0 {
+		v.PassRate = float64(v.Passed) / float64(v.Trials) * 100
+		v.MeanDurationMs = float64(durationMs) / float64(v.Trials)
+	}
+	low, high := wilsonInterval(v.Passed, v.Trials)
+	v.PassRateLow, v.PassRateHigh = low*100, high*100
+}
+
+// compare pairs the variants' results by repeat and case name and fills in
+// the test, the deltas and the per-case table
+func (r *ExperimentReport) compare() {
+	cases := make(map[string]*ExperimentCase)
+	for i := range r.Baseline.Runs {
+		byName := make(map[string]EvalResult)
+		for _, res := range r.Candidate.Runs[i].Results {
+			byName[res.Name] = res
+		}
+		for _, a := range r.Baseline.Runs[i].Results {
+			b, ok := byName[a.Name]
+			if !ok || a.Skipped || b.Skipped {
+				continue
+			}
+			c := cases[a.Name]
+			if c == nil {
+				c = &ExperimentCase{Name: a.Name}
+				cases[a.Name] = c
+			}
+			c.Repeats++
+			if a.Passed {
+				c.BaselinePassed++
+			}
+			if b.Passed {
+				c.CandidatePassed++
+			}
+			switch {
+			case a.Passed && !b.Passed:
+				r.BaselineOnly++
+			case b.Passed && !a.Passed:
+				r.CandidateOnly++
+			}
+		}
+	}
+
+	for _, c := range cases {
+		switch {
+		case c.CandidatePassed > c.BaselinePassed:
+			c.Status = DiffFixed
+		case c.CandidatePassed < c.BaselinePassed:
+			c.Status = DiffRegressed
+		case c.BaselinePassed == c.Repeats:
+			c.Status = DiffPassing
+		case c.BaselinePassed == 0:
+			c.Status = DiffFailing
+		default:
+			c.Status = ExperimentUnchanged
+		}
+		r.Cases = append(r.Cases, *c)
+	}
+	sort.Slice(r.Cases, func(i, j int) bool { return r.Cases[i].Name < r.Cases[j].Name })
+
+	r.PValue = mcNemarExact(r.BaselineOnly, r.CandidateOnly)
+	switch {
+	case r.PValue >= r.Alpha:
+		r.Verdict = VerdictInconclusive
+	case r.CandidateOnly > r.BaselineOnly:
+		r.Verdict = VerdictBetter
+	default:
+		r.Verdict = VerdictWorse
+	}
+	r.PassRateDelta = r.Candidate.PassRate - r.Baseline.PassRate
+	r.CostDeltaUSD = r.Candidate.CostUSD - r.Baseline.CostUSD
+	r.DurationDeltaMs = r.Candidate.MeanDurationMs - r.Baseline.MeanDurationMs
+}
+
+// Regressions returns the cases the candidate passed less often than the
+// baseline
+func (r *ExperimentReport) Regressions() []ExperimentCase {
+	var out []ExperimentCase
+	for _, c := range r.Cases {
+		if c.Status == DiffRegressed {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// runShadow answers every question with both generators and executes the
+// SQL, at most concurrency questions at a time (0 = 4)
+func runShadow(baseline, candidate Generator, warehouse Warehouse, questions []string, concurrency int) *ShadowReport {
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	report := &ShadowReport{Questions: len(questions), Results: make([]ShadowResult, len(questions))}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, q := range questions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, q string) {
+			defer func() { <-sem; wg.Done() }()
+			now := time.Now()
+			res := ShadowResult{Question: q}
+			a, aSQL, aErr := shadowAnswer(baseline, warehouse, q, now)
+			b, bSQL, bErr := shadowAnswer(candidate, warehouse, q, now)
+			res.BaselineSQL, res.CandidateSQL = aSQL, bSQL
+			if aErr != nil {
+				res.BaselineError = aErr.Error()
+			}
+			if bErr != nil {
+				res.CandidateError = bErr.Error()
+			}
+			res.Agreed = aErr == nil && bErr == nil && a.Rows == b.Rows && dataEqual(a.Data, b.Data)
+			report.Results[i] = res
+		}(i, q)
+	}
+	wg.Wait()
+
+	for _, res := range report.Results {
+		if res.Agreed {
+			report.Agreed++
+		}
+		if res.BaselineError != "" {
+			report.BaselineErrors++
+		}
+		if res.CandidateError != "" {
+			report.CandidateErrors++
+		}
+	}
+	if report.Questions > 0 {
+		report.AgreementRate = float64(report.Agreed) / float64(report.Questions) * 100
+	}
+	return report
+}
+
+// shadowAnswer generates and executes the SQL for question
+func shadowAnswer(generator Generator, warehouse Warehouse, question string, now time.Time) (*TinybirdResponse, string, error) {
+	gen, err := generator.Generate(question, now)
+	if err != nil {
+		return nil, "", err
+	}
+	if gen.SQL == "" {
+		return nil, "", errors.New("no SQL generated")
+	}
+	result, err := warehouse.ExecuteQuery(gen.SQL)
+	return result, gen.SQL, err
+}
+
+// mcNemarExact is the two-sided exact McNemar p-value for b and c
+// discordant pairs: the binomial probability, at p = 0.5, of a split at
+// least as uneven as the one observed
+func mcNemarExact(b, c int) float64 {
+	n := b + c
+	if n == 0 {
+		return 1
+	}
+	k := min(b, c)
+	var p float64
+	for i := 0; i <= k; i++ {
+		p += math.Exp(logChoose(n, i) - float64(n)*math.Ln2)
+	}
+	return math.Min(1, 2*p)
+}
+
+func logChoose(n, k int) float64 {
+	a, _ := math.Lgamma(float64(n + 1))
+	b, _ := math.Lgamma(float64(k + 1))
+	c, _ := math.Lgamma(float64(n - k + 1))
+	return a - b - c
+}
+
+// wilsonInterval is the 95% Wilson score interval of passed/trials, which
+// unlike the normal approximation stays sensible near 0% and 100%
+func wilsonInterval(passed, trials int) (float64, float64) {
+	if trials == 0 {
+		return 0, 0
+	}
+	const z = 1.96
+	n := float64(trials)
+	p := float64(passed) / n
+	denom := 1 + z*z/n
+	center := (p + z*z/(2*n)) / denom
+	half := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n)) / denom
+	return math.Max(0, center-half), math.Min(1, center+half)
+}
@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+const planPrompt = `Explain in 2-3 plain-English sentences how this ClickHouse query will execute, for a business user wondering whether it will be slow. Say whether it scans the whole table or uses the primary key or a skip index to read only some parts, and mention the estimated rows if known. Do not suggest rewrites.
+
+SQL: %s
+Estimated rows to read: %s
+EXPLAIN indexes = 1:
+%s`
+
+// PlanExplainer is implemented by warehouses that can show the plan for a
+// query without running it
+type PlanExplainer interface {
+	ExplainPlan(sql string) (string, error)
+}
+
+// ExplainPlan returns ClickHouse's EXPLAIN indexes = 1 output for sql, one
+// plan line per line
+func (c *TinybirdClient) ExplainPlan(sql string) (string, error) {
+	if err := CheckStatement(sql); err != nil {
+		return "", err
+	}
+	result, err := c.query(appendSettings("EXPLAIN indexes = 1 "+sql, c.tagSettings(nil)))
+	if err != nil {
+		return "", fmt.Errorf("failed to explain query: %w", err)
+	}
+	lines := make([]string, 0, len(result.Data))
+	for _, row := range result.Data {
+		if line, ok := row["explain"].(string); ok {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// DescribePlan asks the model to translate a query plan into a short
+// explanation. estimatedRows below zero means no estimate is available.
+func DescribePlan(llm Completer, sql, plan string, estimatedRows int64) (string, Usage, error) {
+	estimate := "unknown"
+	if estimatedRows >= 0 {
+		estimate = fmt.Sprintf("%d", estimatedRows)
+	}
+	return llm.Complete(fmt.Sprintf(planPrompt, sql, estimate, plan))
+}
@@ -0,0 +1,174 @@
+// Package fake provides in-memory implementations of the shared client
+// interfaces, so handlers, evals and embedders can run without network access.
+package fake
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Generator answers questions from a fixed table. Questions not in SQL or
+// Refusals get an error. Implements shared.SchemaGenerator.
+type Generator struct {
+	// SQL maps a question to the SQL to return
+	SQL map[string]string
+	// Refusals maps a question to an unsupported-query reason
+	Refusals map[string]string
+	// Usage is reported with every generation
+	Usage shared.Usage
+	// Err, if set, is returned for every call
+	Err error
+
+	mu     sync.Mutex
+	schema *shared.Schema
+	calls  []string
+}
+
+// SetSchema records the schema
+func (g *Generator) SetSchema(schema *shared.Schema) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.schema = schema
+}
+
+// Schema returns the last schema passed to SetSchema
+func (g *Generator) Schema() *shared.Schema {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.schema
+}
+
+// Calls returns the questions received so far
+func (g *Generator) Calls() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.calls...)
+}
+
+// Generate looks the question up in SQL and Refusals
+func (g *Generator) Generate(naturalLanguage string, currentTime time.Time) (*shared.Generation, error) {
+	g.mu.Lock()
+	g.calls = append(g.calls, naturalLanguage)
+	g.mu.Unlock()
+
+	gen := &shared.Generation{Model: "fake", Usage: g.Usage}
+	if g.Err != nil {
+		return gen, g.Err
+	}
+	if reason, ok := g.Refusals[naturalLanguage]; ok {
+		return gen, shared.ErrUnsupportedQuery{Reason: reason, AvailableData: "Available data: fake"}
+	}
+	sql, ok := g.SQL[naturalLanguage]
+	if !ok {
+		return gen, fmt.Errorf("fake generator: no SQL for %q", naturalLanguage)
+	}
+	gen.SQL = sql
+	return gen, nil
+}
+
+// Completer returns a fixed answer. Implements shared.Completer.
+type Completer struct {
+	Answer string
+	Err    error
+}
+
+func (c *Completer) Complete(prompt string) (string, shared.Usage, error) {
+	return c.Answer, shared.Usage{}, c.Err
+}
+
+func (c *Completer) Model() string { return "fake" }
+
+// Embedder embeds text with Embedding. Implements shared.Embedder.
+type Embedder struct {
+	Err error
+}
+
+func (e *Embedder) Embed(text string) ([]float64, shared.Usage, error) {
+	if e.Err != nil {
+		return nil, shared.Usage{}, e.Err
+	}
+	return Embedding(text, 0), shared.Usage{}, nil
+}
+
+func (e *Embedder) EmbeddingModel() string { return "fake" }
+
+// Embedding is a bag of words hashed into dimensions buckets (64 when 0),
+// so texts sharing words are similar, as with a real embedding
+func Embedding(text string, dimensions int) []float64 {
+	if dimensions <= 0 {
+		dimensions = 64
+	}
+	v := make([]float64, dimensions)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		v[h.Sum32()%uint32(dimensions)]++
+	}
+	return v
+}
+
+// Warehouse returns canned results per SQL statement. Implements shared.Warehouse.
+type Warehouse struct {
+	// Results maps normalized SQL (trimmed, no trailing semicolon) to its result
+	Results map[string]*shared.TinybirdResponse
+	// Schema is returned by FetchSchema
+	Schema *shared.Schema
+	// Err, if set, is returned for every call
+	Err error
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// Queries returns the SQL executed so far
+func (w *Warehouse) Queries() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.queries...)
+}
+
+// ExecuteQuery returns the canned result for sql
+func (w *Warehouse) ExecuteQuery(sql string) (*shared.TinybirdResponse, error) {
+	key := strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	w.mu.Lock()
+	w.queries = append(w.queries, key)
+	w.mu.Unlock()
+
+	if w.Err != nil {
+		return nil, w.Err
+	}
+	result, ok := w.Results[key]
+	if !ok {
+		return nil, fmt.Errorf("fake warehouse: no result for %q", key)
+	}
+	return result, nil
+}
+
+// FetchSchema returns Schema, or an empty schema if unset
+func (w *Warehouse) FetchSchema() (*shared.Schema, error) {
+	if w.Err != nil {
+		return nil, w.Err
+	}
+	if w.Schema == nil {
+		return &shared.Schema{}, nil
+	}
+	return w.Schema, nil
+}
+
+// Result builds a single-row result
+func Result(row map[string]interface{}) *shared.TinybirdResponse {
+	return &shared.TinybirdResponse{Data: []map[string]interface{}{row}, Rows: 1}
+}
+
+// Compile-time interface checks
+var (
+	_ shared.SchemaGenerator = (*Generator)(nil)
+	_ shared.Completer       = (*Completer)(nil)
+	_ shared.Warehouse       = (*Warehouse)(nil)
+)
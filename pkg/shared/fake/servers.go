@@ -0,0 +1,191 @@
+package fake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/raindrop/nl2sql/pkg/shared"
+)
+
+// Token is the API key and read token the fake servers expect
+const Token = "fake-token"
+
+// OpenAIServer speaks the OpenAI Responses API over HTTP, so the real
+// OpenAIClient, with its request building, retries and response parsing,
+// can run against it. Set the fields before the first request.
+type OpenAIServer struct {
+	*httptest.Server
+
+	// SQL maps a question to the SQL returned as a sql_generator call
+	SQL map[string]string
+	// Refusals maps a question to the reason returned as a cannot_answer call
+	Refusals map[string]string
+	// Text is the answer to requests without tools, e.g. plan explanations
+	Text string
+	// Usage is reported with every response
+	Usage shared.Usage
+	// Status, if not zero, is returned with an error body for every request
+	Status int
+
+	mu       sync.Mutex
+	requests []shared.ResponsesRequest
+}
+
+// NewOpenAIServer starts an OpenAIServer. Close it when done.
+func NewOpenAIServer() *OpenAIServer {
+	s := &OpenAIServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Requests returns the Responses API requests received so far
+func (s *OpenAIServer) Requests() []shared.ResponsesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]shared.ResponsesRequest(nil), s.requests...)
+}
+
+// questionRe finds the question at the end of a generation prompt
+var questionRe = regexp.MustCompile(`(?s)\nQuery: (.*)$`)
+
+func (s *OpenAIServer) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeError(w, http.StatusUnauthorized, "invalid api key")
+		return
+	}
+	if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/models/") {
+		json.NewEncoder(w).Encode(map[string]string{"id": strings.TrimPrefix(r.URL.Path, "/models/"), "object": "model"})
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/embeddings" {
+		var req struct {
+			Input      string `json:"input"`
+			Dimensions int    `json:"dimensions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data":  []map[string]interface{}{{"embedding": Embedding(req.Input, req.Dimensions)}},
+			"usage": map[string]int{"prompt_tokens": len(strings.Fields(req.Input)), "total_tokens": len(strings.Fields(req.Input))},
+		})
+		return
+	}
+	if r.Method != http.MethodPost || r.URL.Path != "/responses" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	var req shared.ResponsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+	if s.Status != 0 {
+		writeError(w, s.Status, http.StatusText(s.Status))
+		return
+	}
+
+	resp := shared.ResponsesResponse{ID: "resp_fake", Usage: s.Usage}
+	if len(req.Tools) == 0 {
+		resp.Output = append(resp.Output, shared.OutputItem{Type: "message", Content: []shared.OutputContent{{Type: "output_text", Text: s.Text}}})
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	question := ""
+	if m := questionRe.FindStringSubmatch(req.Input); m != nil {
+		question = strings.TrimSpace(m[1])
+	}
+	if sql, ok := s.SQL[question]; ok {
+		resp.Output = append(resp.Output, shared.OutputItem{Type: "custom_tool_call", Name: "sql_generator", Input: sql, CallID: "call_fake"})
+	} else if reason, ok := s.Refusals[question]; ok {
+		args, _ := json.Marshal(shared.CannotAnswerInput{Reason: reason})
+		resp.Output = append(resp.Output, shared.OutputItem{Type: "function_call", Name: "cannot_answer", Arguments: string(args), CallID: "call_fake"})
+	}
+	// A question in neither table gets no tool call, which the client
+	// reports as a grammar violation
+	json.NewEncoder(w).Encode(resp)
+}
+
+// TinybirdServer speaks the Tinybird datasources and SQL APIs over HTTP,
+// answering from a Warehouse, so the real TinybirdClient can run against
+// it. Set the fields before the first request.
+type TinybirdServer struct {
+	*httptest.Server
+
+	// Warehouse holds the schema and the canned results. Queries are looked
+	// up without the FORMAT and SETTINGS clauses the client adds; one with
+	// no result is a 400, like a ClickHouse error.
+	Warehouse *Warehouse
+	// Status, if not zero, is returned with an error body for every request
+	Status int
+}
+
+// NewTinybirdServer starts a TinybirdServer for warehouse. Close it when done.
+func NewTinybirdServer(warehouse *Warehouse) *TinybirdServer {
+	s := &TinybirdServer{Warehouse: warehouse}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// clientClausesRe matches what TinybirdClient appends to a query, and the
+// QUERY_COMMENT it puts before it
+var clientClausesRe = regexp.MustCompile(`(?s)^/\* question: .*? \*/ |( SETTINGS .*)? FORMAT JSON$`)
+
+func (s *TinybirdServer) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeError(w, http.StatusForbidden, "invalid token")
+		return
+	}
+	if s.Status != 0 {
+		writeError(w, s.Status, http.StatusText(s.Status))
+		return
+	}
+
+	switch r.URL.Path {
+	case shared.DefaultTinybirdAPIBase + "/datasources":
+		schema, err := s.Warehouse.FetchSchema()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(schema)
+	case shared.DefaultTinybirdAPIBase + "/sql":
+		sql := clientClausesRe.ReplaceAllString(r.URL.Query().Get("q"), "")
+		result, err := s.Warehouse.ExecuteQuery(sql)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Env returns the settings that point the real clients at openai and
+// tinybird, e.g. for t.Setenv before shared.LoadConfig
+func Env(openai *OpenAIServer, tinybird *TinybirdServer) map[string]string {
+	return map[string]string{
+		"OPENAI_API_KEY":  Token,
+		"OPENAI_BASE_URL": openai.URL,
+		"TINYBIRD_HOST":   tinybird.URL,
+		"TINYBIRD_TOKEN":  Token,
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,197 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Known feature flags
+const (
+	// FlagEvalDiagnosis allows /api/eval?diagnose=true (one extra LLM call per failure)
+	FlagEvalDiagnosis = "eval_diagnosis"
+	// FlagSmokeEvals allows /api/eval?smoke=true (schema-sized eval runs)
+	FlagSmokeEvals = "smoke_evals"
+	// FlagSuggestionPolish rewords /api/suggestions with the LLM (one call per schema refresh)
+	FlagSuggestionPolish = "suggestion_polish"
+	// FlagFuzzyCorrection rewrites misspelled table/column names in questions before generation
+	FlagFuzzyCorrection = "fuzzy_correction"
+	// FlagRefusalSuggestions offers answerable alternatives when /api/query refuses (one extra LLM call per refusal)
+	FlagRefusalSuggestions = "refusal_suggestions"
+	// FlagQueryDedup has identical concurrent /api/query requests share one generation and execution
+	FlagQueryDedup = "query_dedup"
+)
+
+// knownFlags lists every flag with its built-in default
+var knownFlags = map[string]bool{
+	FlagEvalDiagnosis:      false,
+	FlagSmokeEvals:         true,
+	FlagSuggestionPolish:   false,
+	FlagFuzzyCorrection:    true,
+	FlagRefusalSuggestions: true,
+	FlagQueryDedup:         true,
+}
+
+// FeatureFlags resolves flags from, highest precedence first: runtime
+// overrides for a tenant, runtime overrides for everyone, FEATURE_FLAGS
+// tenant entries, FEATURE_FLAGS global entries, built-in defaults.
+type FeatureFlags struct {
+	mu        sync.RWMutex
+	config    map[string]bool
+	overrides map[string]bool
+}
+
+// Features is the process-wide flag set. Runtime overrides live in memory,
+// so on serverless they only affect the warm instance that received them.
+var Features = NewFeatureFlags()
+
+func NewFeatureFlags() *FeatureFlags {
+	return &FeatureFlags{
+		config:    make(map[string]bool),
+		overrides: make(map[string]bool),
+	}
+}
+
+// SetConfig replaces the config-backed values with a FEATURE_FLAGS spec,
+// keeping runtime overrides
+func (f *FeatureFlags) SetConfig(spec string) error {
+	parsed, err := parseFlagSpec(spec)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config = parsed
+	return nil
+}
+
+// Enabled reports whether a flag is on globally
+func (f *FeatureFlags) Enabled(name string) bool {
+	return f.EnabledFor(name, "")
+}
+
+// EnabledFor reports whether a flag is on for a tenant ("" for none)
+func (f *FeatureFlags) EnabledFor(name, tenant string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if tenant != "" {
+		if v, ok := f.overrides[flagKey(tenant, name)]; ok {
+			return v
+		}
+	}
+	if v, ok := f.overrides[name]; ok {
+		return v
+	}
+	if tenant != "" {
+		if v, ok := f.config[flagKey(tenant, name)]; ok {
+			return v
+		}
+	}
+	if v, ok := f.config[name]; ok {
+		return v
+	}
+	return knownFlags[name]
+}
+
+// Override sets a runtime value for a flag, optionally for one tenant
+func (f *FeatureFlags) Override(name, tenant string, enabled bool) error {
+	if _, ok := knownFlags[name]; !ok {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overrides[flagKey(tenant, name)] = enabled
+	return nil
+}
+
+// ClearOverride removes a runtime value so config and defaults apply again
+func (f *FeatureFlags) ClearOverride(name, tenant string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.overrides, flagKey(tenant, name))
+}
+
+// FlagState is the resolved value of a flag and where it came from
+type FlagState struct {
+	Name    string          `json:"name"`
+	Enabled bool            `json:"enabled"`
+	Source  string          `json:"source"`
+	Tenants map[string]bool `json:"tenants,omitempty"`
+}
+
+// Snapshot returns the global state of every known flag plus any
+// tenant-specific values
+func (f *FeatureFlags) Snapshot() []FlagState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	names := make([]string, 0, len(knownFlags))
+	for name := range knownFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	states := make([]FlagState, 0, len(names))
+	for _, name := range names {
+		state := FlagState{Name: name, Enabled: knownFlags[name], Source: "default"}
+		if v, ok := f.config[name]; ok {
+			state.Enabled, state.Source = v, "config"
+		}
+		if v, ok := f.overrides[name]; ok {
+			state.Enabled, state.Source = v, "override"
+		}
+		for _, values := range []map[string]bool{f.config, f.overrides} {
+			for key, v := range values {
+				tenant, flag, ok := strings.Cut(key, ":")
+				if ok && flag == name {
+					if state.Tenants == nil {
+						state.Tenants = make(map[string]bool)
+					}
+					state.Tenants[tenant] = v
+				}
+			}
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// parseFlagSpec parses "name=true,tenant:name=false"; a bare name means true
+func parseFlagSpec(spec string) (map[string]bool, error) {
+	out := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(entry, "=")
+		enabled := true
+		if hasValue {
+			v, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for flag %q: %w", key, err)
+			}
+			enabled = v
+		}
+		key = strings.TrimSpace(key)
+		name := key
+		if _, n, ok := strings.Cut(key, ":"); ok {
+			name = n
+		}
+		if _, ok := knownFlags[name]; !ok {
+			return nil, fmt.Errorf("unknown feature flag %q", name)
+		}
+		out[key] = enabled
+	}
+	return out, nil
+}
+
+func flagKey(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + ":" + name
+}
@@ -0,0 +1,142 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxFollowUps bounds the follow-up questions attached to a response
+const maxFollowUps = 3
+
+var (
+	fromRe      = regexp.MustCompile(`(?i)\bFROM\s+(\w+)`)
+	aggCallRe   = regexp.MustCompile(`(?i)\b(SUM|COUNT|AVG|MIN|MAX)\s*\(\s*(\w+|\*)\s*\)`)
+	groupColsRe = regexp.MustCompile(`(?i)\bGROUP\s+BY\s+(.+?)\s*(?:\bHAVING\b|\bORDER\b|\bLIMIT\b|;|$)`)
+	orderByRe   = regexp.MustCompile(`(?i)\bORDER\s+BY\b`)
+	whereColsRe = regexp.MustCompile(`(?i)\bWHERE\s+(.+?)\s*(?:\bGROUP\b|\bORDER\b|\bLIMIT\b|;|$)`)
+)
+
+// SuggestFollowUps derives drill-down questions from the structure of an
+// executed query: a total broken down by a dimension, a breakdown ranked or
+// re-cut by another dimension, a listing summarized. Only columns in schema
+// are used, so pass the caller's visible schema, and every question stays
+// within what the grammar can express.
+func SuggestFollowUps(sql string, schema *Schema) []string {
+	m := fromRe.FindStringSubmatch(sql)
+	if m == nil {
+		return nil
+	}
+	var ds *Datasource
+	for i := range schema.Datasources {
+		if schema.Datasources[i].Name == m[1] {
+			ds = &schema.Datasources[i]
+		}
+	}
+	if ds == nil {
+		return nil
+	}
+	table := humanize(ds.Name)
+
+	// Columns the query already groups or filters by aren't useful cuts
+	used := make(map[string]bool)
+	var grouped []string
+	if g := groupColsRe.FindStringSubmatch(sql); g != nil {
+		for _, col := range strings.Split(g[1], ",") {
+			col = strings.TrimSpace(col)
+			grouped = append(grouped, col)
+			used[col] = true
+		}
+	}
+	if w := whereColsRe.FindStringSubmatch(sql); w != nil {
+		for _, word := range wordRe.FindAllString(literalRe.ReplaceAllString(w[1], "''"), -1) {
+			used[word] = true
+		}
+	}
+
+	// Text columns make better cuts than ids, and the table's own id (order_id
+	// in order_items) is unique per row, so it is never a useful cut
+	var dimensions, ids []string
+	var measure, date string
+	for _, col := range ds.Columns {
+		switch {
+		case isNumericType(col.Type) && !isIdentifier(col.Name):
+			if measure == "" {
+				measure = col.Name
+			}
+		case isDateType(col.Type):
+			if date == "" {
+				date = col.Name
+			}
+		case used[col.Name]:
+		case isIdentifier(col.Name):
+			if !strings.HasPrefix(ds.Name, strings.TrimSuffix(col.Name, "id")) {
+				ids = append(ids, col.Name)
+			}
+		case strings.HasPrefix(baseType(col.Type), "String"):
+			dimensions = append(dimensions, col.Name)
+		}
+	}
+	dimensions = append(dimensions, ids...)
+
+	var followUps []string
+	add := func(format string, args ...interface{}) {
+		if len(followUps) < maxFollowUps {
+			followUps = append(followUps, fmt.Sprintf(format, args...))
+		}
+	}
+
+	agg := aggCallRe.FindStringSubmatch(sql)
+	switch {
+	case agg != nil && len(grouped) == 0:
+		// A single total: break it down
+		phrase := aggregatePhrase(agg[1], agg[2], table)
+		if len(dimensions) > 0 {
+			add("What is the %s by %s?", phrase, humanize(dimensions[0]))
+		}
+		if date != "" && !used[date] {
+			add("What is the %s in the last 30 days?", phrase)
+		}
+		for _, d := range dimensions[min(1, len(dimensions)):] {
+			add("What is the %s by %s?", phrase, humanize(d))
+		}
+	case agg != nil:
+		// A breakdown: rank it, re-cut it, or roll it back up
+		phrase := aggregatePhrase(agg[1], agg[2], table)
+		if !orderByRe.MatchString(sql) {
+			add("Show the top 10 %s by %s", humanize(grouped[0]), phrase)
+		}
+		for _, d := range dimensions {
+			add("What is the %s by %s?", phrase, humanize(d))
+		}
+		add("What is the overall %s?", phrase)
+	default:
+		// A listing: summarize it
+		add("How many %s are there?", table)
+		if measure != "" {
+			add("What is the total %s?", humanize(measure))
+			for _, d := range dimensions {
+				add("What is the total %s by %s?", humanize(measure), humanize(d))
+			}
+		}
+	}
+	return followUps
+}
+
+// aggregatePhrase renders an aggregate call as English, e.g. SUM(price) as
+// "total price" and COUNT(*) as "number of order items"
+func aggregatePhrase(fn, arg, table string) string {
+	if arg == "*" || strings.EqualFold(fn, "COUNT") {
+		return "number of " + table
+	}
+	switch strings.ToUpper(fn) {
+	case "SUM":
+		return "total " + humanize(arg)
+	case "AVG":
+		return "average " + humanize(arg)
+	case "MIN":
+		return "minimum " + humanize(arg)
+	default:
+		return "maximum " + humanize(arg)
+	}
+}
@@ -0,0 +1,137 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// NearMiss is a phrase in a question that is probably a misspelled table or
+// column name
+type NearMiss struct {
+	// Mention is the phrase as written in the question
+	Mention string `json:"mention"`
+	// Name is the table or column it most likely refers to
+	Name string `json:"name"`
+}
+
+var questionWordRe = regexp.MustCompile(`[A-Za-z0-9_]+`)
+
+// FindNearMisses looks for phrases of up to three words in question that are
+// within a small edit distance of a table or column name (compared both as
+// written, e.g. freight_value, and humanized, e.g. "freight value") without
+// matching it exactly. Short words and plurals are ignored so ordinary
+// English doesn't trigger corrections.
+func FindNearMisses(question string, schema *Schema) []NearMiss {
+	names := make(map[string]string) // lowercased form -> schema name
+	for _, ds := range schema.Datasources {
+		names[strings.ToLower(ds.Name)] = ds.Name
+		names[strings.ToLower(humanize(ds.Name))] = ds.Name
+		for _, col := range ds.Columns {
+			names[strings.ToLower(col.Name)] = col.Name
+			names[strings.ToLower(humanize(col.Name))] = col.Name
+		}
+	}
+
+	locs := questionWordRe.FindAllStringIndex(question, -1)
+	words := make([]string, len(locs))
+	for i, loc := range locs {
+		words[i] = strings.ToLower(question[loc[0]:loc[1]])
+	}
+
+	var misses []NearMiss
+	for i := 0; i < len(words); {
+		matched := 0
+		for n := 3; n >= 1 && matched == 0; n-- {
+			if i+n > len(words) {
+				continue
+			}
+			phrase := strings.Join(words[i:i+n], " ")
+			if _, exact := names[phrase]; exact {
+				matched = n
+				break
+			}
+			if name, ok := closestName(phrase, names); ok {
+				misses = append(misses, NearMiss{Mention: question[locs[i][0]:locs[i+n-1][1]], Name: name})
+				matched = n
+			}
+		}
+		if matched == 0 {
+			matched = 1
+		}
+		i += matched
+	}
+	return misses
+}
+
+// closestName returns the schema name whose form is nearest to phrase, if
+// it is close enough to be a typo
+func closestName(phrase string, names map[string]string) (string, bool) {
+	if len(phrase) < 4 {
+		return "", false
+	}
+	maxDist := 1
+	if len(phrase) > 6 {
+		maxDist = 2
+	}
+
+	best, bestDist := "", maxDist+1
+	for form, name := range names {
+		if form[0] != phrase[0] || phrase == form+"s" || phrase == form+"es" {
+			continue
+		}
+		if d := editDistance(phrase, form); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	return best, bestDist <= maxDist
+}
+
+// editDistance is the optimal string alignment distance: insertions,
+// deletions, substitutions and adjacent transpositions ("frieght") each
+// cost one
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// CorrectQuestion rewrites each near miss in question as its schema name,
+// so the model sees e.g. "freight_value" instead of "frieght value"
+func CorrectQuestion(question string, misses []NearMiss) string {
+	for _, m := range misses {
+		question = strings.Replace(question, m.Mention, m.Name, 1)
+	}
+	return question
+}
+
+// DidYouMean renders near misses as a hint, e.g. `Did you mean
+// "freight_value" for "frieght value"?`
+func DidYouMean(misses []NearMiss) string {
+	if len(misses) == 0 {
+		return ""
+	}
+	parts := make([]string, len(misses))
+	for i, m := range misses {
+		parts[i] = fmt.Sprintf("%q for %q", m.Name, m.Mention)
+	}
+	return "Did you mean " + strings.Join(parts, ", ") + "?"
+}
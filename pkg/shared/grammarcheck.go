@@ -0,0 +1,191 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// larkDefRe matches a rule or terminal definition line, e.g. `select_list: ...`
+var larkDefRe = regexp.MustCompile(`^([?!]?[A-Za-z_][A-Za-z0-9_]*)(\.[0-9]+)?\s*:(.*)$`)
+
+// CheckGrammar statically validates a Lark grammar as produced by
+// GenerateGrammar: every referenced rule and terminal is defined exactly
+// once, a start rule exists, literals and regexes are well formed and
+// parentheses balance. With a schema it also checks every table and column
+// is reachable as a literal. It catches mistakes such as two column names
+// sanitizing to the same terminal without calling OpenAI. All problems are
+// returned joined.
+func CheckGrammar(grammar string, schema *Schema) error {
+	var errs []error
+	defined := make(map[string]int)
+	referenced := make(map[string]int)
+	literals := make(map[string]bool)
+
+	var current string
+	for i, line := range strings.Split(grammar, "\n") {
+		lineNo := i + 1
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "//") {
+			continue
+		}
+
+		var expansion string
+		if strings.HasPrefix(trimmed, "|") && current != "" {
+			// Continuation of the previous definition's alternatives
+			expansion = trimmed[1:]
+		} else if m := larkDefRe.FindStringSubmatch(trimmed); m != nil {
+			current = strings.TrimLeft(m[1], "?!")
+			if first, ok := defined[current]; ok {
+				errs = append(errs, fmt.Errorf("line %d: %s is already defined on line %d", lineNo, current, first))
+			} else {
+				defined[current] = lineNo
+			}
+			expansion = m[3]
+		} else {
+			errs = append(errs, fmt.Errorf("line %d: not a definition: %q", lineNo, trimmed))
+			continue
+		}
+
+		refs, lits, err := scanLarkExpansion(expansion)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d (%s): %w", lineNo, current, err))
+			continue
+		}
+		for _, ref := range refs {
+			if _, ok := referenced[ref]; !ok {
+				referenced[ref] = lineNo
+			}
+		}
+		for _, lit := range lits {
+			literals[lit] = true
+		}
+	}
+
+	if _, ok := defined["start"]; !ok {
+		errs = append(errs, errors.New("no start rule"))
+	}
+	for _, ref := range sortedKeys(referenced) {
+		if _, ok := defined[ref]; !ok {
+			errs = append(errs, fmt.Errorf("line %d: %s is referenced but never defined", referenced[ref], ref))
+		}
+	}
+
+	if schema != nil {
+		for _, ds := range schema.Datasources {
+			if !literals[ds.Name] {
+				errs = append(errs, fmt.Errorf("table %s is missing from the grammar", ds.Name))
+			}
+			for _, col := range ds.Columns {
+				if !literals[col.Name] {
+					errs = append(errs, fmt.Errorf("column %s.%s is missing from the grammar", ds.Name, col.Name))
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// scanLarkExpansion tokenizes the right-hand side of a definition and
+// returns the names it references and the string literals it contains
+func scanLarkExpansion(s string) (refs, literals []string, err error) {
+	depth := 0
+	expectItem := true
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, nil, fmt.Errorf("unterminated string literal %s", s[i:])
+			}
+			if end == i+1 {
+				return nil, nil, errors.New("empty string literal")
+			}
+			literals = append(literals, s[i+1:end])
+			i = end + 1
+			expectItem = false
+		case c == '/':
+			end := i + 1
+			for end < len(s) && s[end] != '/' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, nil, fmt.Errorf("unterminated regexp %s", s[i:])
+			}
+			if _, err := regexp.Compile(s[i+1 : end]); err != nil {
+				return nil, nil, fmt.Errorf("invalid regexp %s: %w", s[i:end+1], err)
+			}
+			i = end + 1
+			for i < len(s) && unicode.IsLetter(rune(s[i])) {
+				i++ // flags such as /.../i
+			}
+			expectItem = false
+		case c == '(' || c == '[':
+			depth++
+			i++
+			expectItem = true
+		case c == ')' || c == ']':
+			if expectItem {
+				return nil, nil, errors.New("empty group or alternative")
+			}
+			depth--
+			if depth < 0 {
+				return nil, nil, errors.New("unbalanced parentheses")
+			}
+			i++
+		case c == '|':
+			if expectItem {
+				return nil, nil, errors.New("empty alternative")
+			}
+			i++
+			expectItem = true
+		case c == '?' || c == '*' || c == '+':
+			if expectItem {
+				return nil, nil, fmt.Errorf("operator %q applies to nothing", c)
+			}
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(s) && (s[end] == '_' || unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end]))) {
+				end++
+			}
+			refs = append(refs, s[i:end])
+			i = end
+			expectItem = false
+		default:
+			return nil, nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	if depth != 0 {
+		return nil, nil, errors.New("unbalanced parentheses")
+	}
+	if expectItem {
+		return nil, nil, errors.New("empty expansion or trailing alternative")
+	}
+	return refs, literals, nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
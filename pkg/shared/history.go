@@ -0,0 +1,226 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxHistoryRecords bounds the in-memory history when no HISTORY_FILE is set
+	maxHistoryRecords = 10_000
+	// maxFewShotExamples bounds FEW_SHOT_EXAMPLES, since every example
+	// lengthens the prompt
+	maxFewShotExamples = 10
+	// minFewShotSimilarity leaves out examples too unlike the question to
+	// be worth their tokens
+	minFewShotSimilarity = 0.5
+	// sessionBoost ranks a session's own earlier questions ahead of equally
+	// similar ones from the rest of the tenant
+	sessionBoost = 0.05
+)
+
+// HistoryRecord is one answered question: its SQL returned rows
+type HistoryRecord struct {
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Question string    `json:"question"`
+	// SQL is the SQL as generated, before limits and other rewrites
+	SQL string `json:"sql"`
+	// Embedding is the question's embedding by EmbeddingModel. Embeddings
+	// of different models can't be compared, so records of another model
+	// are ignored.
+	EmbeddingModel string    `json:"embedding_model"`
+	Embedding      []float64 `json:"embedding"`
+}
+
+// FewShotExample is an earlier question and its SQL, shown to the model
+type FewShotExample struct {
+	Question string `json:"question"`
+	SQL      string `json:"sql"`
+	// Similarity is the cosine similarity of the two questions' embeddings
+	Similarity float64 `json:"similarity"`
+}
+
+// HistoryLog records answered questions. Like RefusalLog it keeps recent
+// records in memory unless given a file, in which case every record is
+// appended as a JSON line and lookups read the file. Safe for concurrent
+// use.
+type HistoryLog struct {
+	mu      sync.Mutex
+	records []HistoryRecord
+}
+
+func NewHistoryLog() *HistoryLog {
+	return &HistoryLog{}
+}
+
+// Record stores rec, appending it to path when path is non-empty. A nil
+// log ignores the record.
+func (l *HistoryLog) Record(rec HistoryRecord, path string) error {
+	if l == nil {
+		return nil
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if path == "" {
+		l.records = append(l.records, rec)
+		if len(l.records) > maxHistoryRecords {
+			l.records = append([]HistoryRecord(nil), l.records[len(l.records)-maxHistoryRecords:]...)
+		}
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history record: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	return nil
+}
+
+// Examples returns up to k of tenant's earlier questions most similar to
+// the one embedded as embedding by model, most similar first, reading path
+// when it is non-empty. Questions from session rank slightly higher.
+// Rephrasings of one question count once, with their latest SQL.
+func (l *HistoryLog) Examples(tenant, session, model string, embedding []float64, k int, path string) ([]FewShotExample, error) {
+	if k <= 0 || len(embedding) == 0 {
+		return nil, nil
+	}
+	records, err := l.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		example FewShotExample
+		score   float64
+		time    time.Time
+	}
+	best := make(map[string]*candidate)
+	for _, rec := range records {
+		if rec.Tenant != tenant || rec.EmbeddingModel != model || len(rec.Embedding) != len(embedding) {
+			continue
+		}
+		similarity := cosineSimilarity(embedding, rec.Embedding)
+		if similarity < minFewShotSimilarity {
+			continue
+		}
+		score := similarity
+		if session != "" && rec.Session == session {
+			score += sessionBoost
+		}
+		key := strings.Join(refusalWords(rec.Question), " ")
+		c := best[key]
+		if c == nil {
+			c = &candidate{}
+			best[key] = c
+		} else if rec.Time.Before(c.time) {
+			continue
+		}
+		*c = candidate{example: FewShotExample{Question: rec.Question, SQL: rec.SQL, Similarity: similarity}, score: score, time: rec.Time}
+	}
+
+	candidates := make([]*candidate, 0, len(best))
+	for _, c := range best {
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].time.After(candidates[j].time)
+	})
+	var out []FewShotExample
+	for _, c := range candidates {
+		if len(out) == k {
+			break
+		}
+		out = append(out, c.example)
+	}
+	return out, nil
+}
+
+// load returns the in-memory records, or every record in path
+func (l *HistoryLog) load(path string) ([]HistoryRecord, error) {
+	if path == "" {
+		if l == nil {
+			return nil, nil
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return append([]HistoryRecord(nil), l.records...), nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(f)
+	// Embeddings make for long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Skip a line torn by a crash mid-write rather than fail the lookup
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file: %w", err)
+	}
+	return records, nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// fewShotPrompt renders examples as prompt lines
+func fewShotPrompt(examples []FewShotExample) string {
+	if len(examples) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("Similar questions asked before, with the SQL that answered them (follow their conventions where they apply):\n")
+	for _, ex := range examples {
+		sb.WriteString(fmt.Sprintf("Question: %s\nSQL: %s\n", ex.Question, strings.Join(strings.Fields(ex.SQL), " ")))
+	}
+	return sb.String()
+}
@@ -0,0 +1,337 @@
+package shared
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// Job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// jobCleanupInterval is how often Run drops expired jobs
+const jobCleanupInterval = time.Minute
+
+// ErrJobQueueFull is returned by Submit when every worker is busy and the
+// queue is at capacity
+var ErrJobQueueFull = errors.New("job queue is full")
+
+// Job is one query run in the background. Result is the response body the
+// query would have returned synchronously, with HTTPStatus its status; a
+// job that didn't answer with a 2xx is JobFailed.
+type Job struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Attempts   int             `json:"attempts,omitempty"`
+	HTTPStatus int             `json:"http_status,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+
+	// Key is the API key that submitted the job; only it may read the job
+	Key string `json:"-"`
+}
+
+// JobResult is the outcome of one attempt at a job. Err is the failure
+// behind a non-2xx status, if any; a retryable one is tried again.
+type JobResult struct {
+	Status int
+	Body   []byte
+	Err    error
+}
+
+// JobRunner runs a job from the payload it was submitted with. The payload
+// is all a runner gets, since a job may resume after a restart.
+type JobRunner func(job Job, payload json.RawMessage) JobResult
+
+// jobRecord is a job as persisted to JOBS_FILE: every state change is
+// appended as one line, and the last line for an ID wins
+type jobRecord struct {
+	Job
+	Key     string          `json:"key,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// JobQueue runs jobs on a bounded pool of workers and keeps them for
+// polling until JOB_TTL after they finish. With a JOBS_FILE every change
+// is appended to it, and jobs that were queued or running when the process
+// stopped run again on the next start. Safe for concurrent use.
+type JobQueue struct {
+	mu       sync.Mutex
+	jobs     map[string]*jobRecord
+	tasks    chan string
+	pending  []string
+	path     string
+	workers  int
+	retries  int
+	ttl      time.Duration
+	capacity int
+}
+
+// NewJobQueue returns a queue for cfg's JOB_* settings, loading the jobs in
+// JOBS_FILE. Jobs start running with Run.
+func NewJobQueue(cfg *Config) (*JobQueue, error) {
+	q := &JobQueue{
+		jobs:     make(map[string]*jobRecord),
+		path:     cfg.JobsFile,
+		workers:  cfg.JobWorkers,
+		retries:  cfg.JobRetries,
+		ttl:      cfg.JobTTL,
+		capacity: max(cfg.JobQueueSize, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	// Jobs interrupted by the last shutdown go first and don't count
+	// against the queue size
+	q.tasks = make(chan string, q.capacity+len(q.pending))
+	return q, nil
+}
+
+// Enabled reports whether the queue has workers to run jobs
+func (q *JobQueue) Enabled() bool {
+	return q != nil && q.workers > 0
+}
+
+// Run starts the workers, requeues interrupted jobs and drops expired ones
+// every minute until ctx is done. Jobs running at that point finish in the
+// background or, with a JOBS_FILE, run again on the next start.
+func (q *JobQueue) Run(ctx context.Context, runner JobRunner) {
+	for i := 0; i < q.workers; i++ {
+		go q.work(runner)
+	}
+	q.mu.Lock()
+	for _, id := range q.pending {
+		q.tasks <- id
+	}
+	q.pending = nil
+	q.mu.Unlock()
+
+	ticker := time.NewTicker(jobCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.cleanup(time.Now()); err != nil {
+				Logger(ctx).Error("Failed to clean up jobs", "error", err)
+			}
+		}
+	}
+}
+
+// Submit queues a job for key. payload is handed to the JobRunner as is.
+func (q *JobQueue) Submit(key string, payload json.RawMessage) (Job, error) {
+	rec := &jobRecord{
+		Job:     Job{ID: newJobID(), Status: JobQueued, CreatedAt: time.Now().UTC(), Key: key},
+		Key:     key,
+		Payload: payload,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.tasks) >= q.capacity {
+		return Job{}, ErrJobQueueFull
+	}
+	if err := q.persist(rec); err != nil {
+		return Job{}, err
+	}
+	q.jobs[rec.ID] = rec
+	q.tasks <- rec.ID
+	return rec.Job, nil
+}
+
+// Get returns the job with id, if key submitted it
+func (q *JobQueue) Get(id, key string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rec, ok := q.jobs[id]
+	if !ok || rec.Key != key {
+		return Job{}, false
+	}
+	return rec.Job, true
+}
+
+// work runs queued jobs, retrying transient failures with exponential
+// backoff starting at a second
+func (q *JobQueue) work(runner JobRunner) {
+	for id := range q.tasks {
+		q.mu.Lock()
+		rec, ok := q.jobs[id]
+		var job Job
+		var payload json.RawMessage
+		if ok {
+			now := time.Now().UTC()
+			rec.Status, rec.StartedAt = JobRunning, &now
+			q.persistLogged(rec)
+			job, payload = rec.Job, rec.Payload
+		}
+		q.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		var result JobResult
+		for attempt := 0; ; attempt++ {
+			job.Attempts = attempt + 1
+			result = runner(job, payload)
+			if attempt >= q.retries || !nlerrors.IsRetryable(result.Err) {
+				break
+			}
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+
+		q.mu.Lock()
+		now := time.Now().UTC()
+		rec.Status, rec.FinishedAt = JobDone, &now
+		if result.Status < 200 || result.Status > 299 {
+			rec.Status = JobFailed
+		}
+		rec.Attempts, rec.HTTPStatus, rec.Result = job.Attempts, result.Status, result.Body
+		// The payload is only needed to run the job again
+		rec.Payload = nil
+		q.persistLogged(rec)
+		q.mu.Unlock()
+	}
+}
+
+// cleanup drops jobs that finished more than JOB_TTL before now and
+// rewrites JOBS_FILE without them
+func (q *JobQueue) cleanup(now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dropped := false
+	for id, rec := range q.jobs {
+		if rec.FinishedAt != nil && now.Sub(*rec.FinishedAt) > q.ttl {
+			delete(q.jobs, id)
+			dropped = true
+		}
+	}
+	if !dropped || q.path == "" {
+		return nil
+	}
+	return q.compact()
+}
+
+// load reads JOBS_FILE, keeping the last state of each unexpired job, and
+// rewrites it compacted. Jobs that never finished are queued again.
+func (q *JobQueue) load() error {
+	if q.path == "" {
+		return nil
+	}
+	f, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open jobs file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var rec jobRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.ID == "" {
+			// Skip a line torn by a crash mid-write
+			continue
+		}
+		rec.Job.Key = rec.Key
+		q.jobs[rec.ID] = &rec
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read jobs file: %w", err)
+	}
+
+	now := time.Now()
+	for id, rec := range q.jobs {
+		switch {
+		case rec.FinishedAt != nil && now.Sub(*rec.FinishedAt) > q.ttl:
+			delete(q.jobs, id)
+		case rec.FinishedAt == nil:
+			rec.Status, rec.StartedAt = JobQueued, nil
+			q.pending = append(q.pending, id)
+		}
+	}
+	sort.Slice(q.pending, func(i, j int) bool {
+		return q.jobs[q.pending[i]].CreatedAt.Before(q.jobs[q.pending[j]].CreatedAt)
+	})
+	return q.compact()
+}
+
+// compact rewrites JOBS_FILE with one line per job. Callers hold q.mu.
+func (q *JobQueue) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to compact jobs file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range q.jobs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to marshal job: %w", err)
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to compact jobs file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to compact jobs file: %w", err)
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// persist appends rec's current state to JOBS_FILE. Callers hold q.mu.
+func (q *JobQueue) persist(rec *jobRecord) error {
+	if q.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open jobs file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write jobs file: %w", err)
+	}
+	return nil
+}
+
+// persistLogged persists a state change a worker can't report to anyone.
+// The in-memory job is still updated, so polling keeps working.
+func (q *JobQueue) persistLogged(rec *jobRecord) {
+	if err := q.persist(rec); err != nil {
+		Logger(context.Background()).Error("Failed to persist job", "job_id", rec.ID, "error", err)
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
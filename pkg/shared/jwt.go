@@ -0,0 +1,420 @@
+package shared
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtLeeway absorbs clock skew between nl2sql and the identity provider
+	jwtLeeway = time.Minute
+	// jwksMinRefresh bounds refetches for tokens signed by unknown keys, so
+	// garbage tokens can't hammer the identity provider
+	jwksMinRefresh = time.Minute
+	// maxJWKSBody bounds discovery documents and key sets
+	maxJWKSBody = 1 << 20
+)
+
+// ErrIdentityProvider is returned when JWT_ISSUER's signing keys can't be
+// fetched and none are cached
+var ErrIdentityProvider = errors.New("identity provider unavailable")
+
+// JWTClaims are what nl2sql takes from a verified token
+type JWTClaims struct {
+	Subject string
+	Tenant  string
+	Roles   []string
+	Expiry  time.Time
+}
+
+// HasRole reports whether the token carries role
+func (c *JWTClaims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// LooksLikeJWT reports whether a bearer token is shaped like a JWT rather
+// than an API key: three base64url segments
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// JWKSCache verifies JWTs issued by JWT_ISSUER against its signing keys
+// (JWKS), fetched from JWT_JWKS_URL or the issuer's OpenID discovery
+// document and kept for JWKS_CACHE_TTL. A token signed by a key not in the
+// cache triggers a refetch, so key rotation needs no restart. When a
+// refetch fails the cached keys stay in use. Safe for concurrent use.
+type JWKSCache struct {
+	mu     sync.Mutex
+	sets   map[string]*jwks
+	client *http.Client
+}
+
+// jwks is one issuer's fetched signing keys
+type jwks struct {
+	mu      sync.Mutex
+	keys    []jwk
+	fetched time.Time
+	// tried is the last fetch attempt, successful or not
+	tried time.Time
+}
+
+type jwk struct {
+	kid string
+	key crypto.PublicKey
+}
+
+func NewJWKSCache() *JWKSCache {
+	return &JWKSCache{sets: make(map[string]*jwks), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Verify checks token's signature, issuer, audience and validity period
+// against cfg's JWT settings and returns its claims. Invalid tokens are an
+// ErrUnauthorized; unreachable keys an ErrIdentityProvider. A nil cache
+// fetches the keys every time.
+func (c *JWKSCache) Verify(ctx context.Context, cfg *Config, token string) (*JWTClaims, error) {
+	if c == nil {
+		c = NewJWKSCache()
+	}
+	if cfg.JWTIssuer == "" || cfg.JWTAudience == "" {
+		return nil, errors.New("JWT_ISSUER and JWT_AUDIENCE must both be set")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalidToken("malformed header")
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, invalidToken("unsupported algorithm " + header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed signature")
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	set := c.set(cfg)
+	keys, err := set.get(ctx, c.client, cfg, header.Kid, false)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyWithAny(keys, header.Alg, hash, digest, sig) {
+		// The issuer may have rotated in a key we haven't seen
+		if keys, err = set.get(ctx, c.client, cfg, header.Kid, true); err != nil {
+			return nil, err
+		}
+		if !verifyWithAny(keys, header.Alg, hash, digest, sig) {
+			return nil, invalidToken("invalid signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalidToken("malformed claims")
+	}
+	return checkClaims(cfg, claims, time.Now())
+}
+
+// set returns the cached keys of cfg's issuer
+func (c *JWKSCache) set(cfg *Config) *jwks {
+	key := cfg.JWTIssuer + "#" + cfg.JWTJWKSURL
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.sets[key]
+	if !ok {
+		s = &jwks{}
+		c.sets[key] = s
+	}
+	return s
+}
+
+// get returns the keys that may have signed a token with kid. They are
+// fetched when none are cached; otherwise at most every jwksMinRefresh,
+// when they are older than JWKS_CACHE_TTL, kid is unknown or refresh is set.
+func (s *jwks) get(ctx context.Context, client *http.Client, cfg *Config, kid string, refresh bool) ([]jwk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	due := refresh || now.Sub(s.fetched) > cfg.JWKSCacheTTL || len(s.matching(kid)) == 0
+	if s.fetched.IsZero() || (due && now.Sub(s.tried) > jwksMinRefresh) {
+		s.tried = now
+		keys, err := fetchJWKS(ctx, client, cfg)
+		switch {
+		case err == nil:
+			s.keys, s.fetched = keys, now
+		case s.fetched.IsZero():
+			return nil, fmt.Errorf("%w: %v", ErrIdentityProvider, err)
+		default:
+			Logger(ctx).Warn("Failed to refresh JWKS, using cached keys", "issuer", cfg.JWTIssuer, "error", err)
+		}
+	}
+	return s.matching(kid), nil
+}
+
+// matching returns the keys with kid, or every key for a token without one
+func (s *jwks) matching(kid string) []jwk {
+	if kid == "" {
+		return s.keys
+	}
+	var out []jwk
+	for _, k := range s.keys {
+		if k.kid == kid {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// fetchJWKS downloads cfg's signing keys, discovering the JWKS URL from
+// the issuer when JWT_JWKS_URL isn't set
+func fetchJWKS(ctx context.Context, client *http.Client, cfg *Config) ([]jwk, error) {
+	jwksURL := cfg.JWTJWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(ctx, client, strings.TrimSuffix(cfg.JWTIssuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OpenID discovery: %w", err)
+		}
+		if discovery.Issuer != cfg.JWTIssuer {
+			return nil, fmt.Errorf("OpenID discovery: issuer is %q, expected %q", discovery.Issuer, cfg.JWTIssuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("OpenID discovery: no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, client, jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := decodeBigInt(k.N)
+			e, errE := decodeBigInt(k.E)
+			if errN != nil || errE != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+				continue
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			curve, ok := jwkCurves[k.Crv]
+			x, errX := decodeBigInt(k.X)
+			y, errY := decodeBigInt(k.Y)
+			if !ok || errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+				continue
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		default:
+			continue
+		}
+		keys = append(keys, jwk{kid: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBody)).Decode(v)
+}
+
+// jwtHashes are the supported signing algorithms. Symmetric algorithms
+// and "none" are deliberately absent: only the issuer may sign.
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521(),
+}
+
+// verifyWithAny reports whether one of keys made sig over digest with alg
+func verifyWithAny(keys []jwk, alg string, hash crypto.Hash, digest, sig []byte) bool {
+	for _, k := range keys {
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			switch alg[:2] {
+			case "RS":
+				if rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+					return true
+				}
+			case "PS":
+				if rsa.VerifyPSS(key, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+					return true
+				}
+			}
+		case *ecdsa.PublicKey:
+			// ES signatures are r and s back to back, each the curve's size
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if alg[:2] != "ES" || len(sig) != 2*size || key.Curve != jwkCurves[esCurves[alg]] {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// esCurves is the curve each ES algorithm signs with
+var esCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+// checkClaims validates the registered claims and maps the rest to
+// JWTClaims with JWT_TENANT_CLAIM and JWT_ROLES_CLAIM
+func checkClaims(cfg *Config, claims map[string]interface{}, now time.Time) (*JWTClaims, error) {
+	if iss, _ := claims["iss"].(string); iss != cfg.JWTIssuer {
+		return nil, invalidToken("wrong issuer")
+	}
+	if !audienceIncludes(claims["aud"], cfg.JWTAudience) {
+		return nil, invalidToken("wrong audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, invalidToken("token has no expiry")
+	}
+	expiry := time.Unix(int64(exp), 0)
+	if now.After(expiry.Add(jwtLeeway)) {
+		return nil, invalidToken("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, invalidToken("token not valid yet")
+	}
+
+	out := &JWTClaims{Expiry: expiry}
+	out.Subject, _ = claims["sub"].(string)
+	if out.Subject == "" {
+		return nil, invalidToken("token has no subject")
+	}
+	out.Tenant, _ = claimPath(claims, cfg.JWTTenantClaim).(string)
+	if out.Tenant == "" {
+		return nil, invalidToken("token has no " + cfg.JWTTenantClaim + " claim")
+	}
+	// Roles are an array, or space-separated like OAuth scopes
+	switch roles := claimPath(claims, cfg.JWTRolesClaim).(type) {
+	case []interface{}:
+		for _, r := range roles {
+			if s, ok := r.(string); ok {
+				out.Roles = append(out.Roles, s)
+			}
+		}
+	case string:
+		out.Roles = strings.Fields(roles)
+	}
+	return out, nil
+}
+
+// claimPath looks up a dotted claim path such as "realm_access.roles"
+func claimPath(claims map[string]interface{}, path string) interface{} {
+	var v interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// audienceIncludes reports whether an aud claim, a string or an array of
+// them, names audience
+func audienceIncludes(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func invalidToken(reason string) error {
+	return fmt.Errorf("%w: %s", ErrUnauthorized, reason)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,147 @@
+package shared
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jwtSegment encodes v as a base64url JWT segment
+func jwtSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signRS256 returns a token for claims signed by key under kid
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	signed := jwtSegment(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + jwtSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWKSCacheVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		JWTIssuer:      "https://issuer.test",
+		JWTAudience:    "nl2sql",
+		JWTJWKSURL:     server.URL,
+		JWTTenantClaim: "tenant",
+		JWTRolesClaim:  "roles",
+		JWKSCacheTTL:   time.Hour,
+	}
+	now := time.Now()
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    cfg.JWTIssuer,
+			"aud":    cfg.JWTAudience,
+			"sub":    "user-1",
+			"tenant": "acme",
+			"roles":  []string{"query"},
+			"exp":    now.Add(time.Hour).Unix(),
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		valid bool
+	}{
+		{"valid", func() string { return signRS256(t, key, "k1", claims(nil)) }, true},
+		{"audience in a list", func() string {
+			return signRS256(t, key, "k1", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "nl2sql"} }))
+		}, true},
+		{"expired within leeway", func() string {
+			return signRS256(t, key, "k1", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-30 * time.Second).Unix() }))
+		}, true},
+		{"alg none", func() string {
+			return jwtSegment(t, map[string]string{"alg": "none", "kid": "k1"}) + "." + jwtSegment(t, claims(nil)) + "."
+		}, false},
+		{"HS256 keyed with the public key", func() string {
+			signed := jwtSegment(t, map[string]string{"alg": "HS256", "kid": "k1"}) + "." + jwtSegment(t, claims(nil))
+			mac := hmac.New(sha256.New, key.N.Bytes())
+			mac.Write([]byte(signed))
+			return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}, false},
+		{"claims altered after signing", func() string {
+			parts := strings.Split(signRS256(t, key, "k1", claims(nil)), ".")
+			return parts[0] + "." + jwtSegment(t, claims(func(c map[string]interface{}) { c["tenant"] = "beta" })) + "." + parts[2]
+		}, false},
+		{"signed by another key", func() string { return signRS256(t, other, "k1", claims(nil)) }, false},
+		{"wrong audience", func() string {
+			return signRS256(t, key, "k1", claims(func(c map[string]interface{}) { c["aud"] = "someone-else" }))
+		}, false},
+		{"wrong issuer", func() string {
+			return signRS256(t, key, "k1", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.test" }))
+		}, false},
+		{"expired", func() string {
+			return signRS256(t, key, "k1", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-2 * time.Hour).Unix() }))
+		}, false},
+		{"no expiry", func() string {
+			return signRS256(t, key, "k1", claims(func(c map[string]interface{}) { delete(c, "exp") }))
+		}, false},
+		{"not valid yet", func() string {
+			return signRS256(t, key, "k1", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(2 * time.Hour).Unix() }))
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewJWKSCache().Verify(context.Background(), cfg, tt.token())
+			if !tt.valid {
+				if !errors.Is(err, ErrUnauthorized) {
+					t.Fatalf("Verify = %+v, %v; want ErrUnauthorized", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if got.Subject != "user-1" || got.Tenant != "acme" || !got.HasRole("query") {
+				t.Errorf("claims = %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"sync"
+	"time"
+)
+
+// CallLimiter bounds the calls in flight to an API and applies
+// backpressure: after a 429 every caller waits out the backoff, instead of
+// each retrying on its own schedule into the same limit. Safe for
+// concurrent use; a nil CallLimiter does nothing.
+type CallLimiter struct {
+	slots chan struct{}
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+// NewCallLimiter returns a limiter allowing concurrency calls at once
+func NewCallLimiter(concurrency int) *CallLimiter {
+	return &CallLimiter{slots: make(chan struct{}, max(concurrency, 1))}
+}
+
+// Acquire waits for a free slot and for any pause to end. Call the
+// returned function when the call is done.
+func (l *CallLimiter) Acquire() func() {
+	if l == nil {
+		return func() {}
+	}
+	l.slots <- struct{}{}
+	l.mu.Lock()
+	wait := time.Until(l.pausedUntil)
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return func() { <-l.slots }
+}
+
+// Pause holds every caller for d, e.g. after a rate-limited response
+func (l *CallLimiter) Pause(d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+var (
+	openAILimiterMu sync.Mutex
+	openAILimiter   *CallLimiter
+	openAILimit     int
+)
+
+// OpenAILimiter returns the process-wide limiter for OPENAI_MAX_CONCURRENCY,
+// or nil when it is 0. Every OpenAIClient shares it, so evals, queries and
+// reports draw from one budget. A changed setting takes effect for clients
+// created afterwards.
+func OpenAILimiter(cfg *Config) *CallLimiter {
+	if cfg.OpenAIMaxConcurrency <= 0 {
+		return nil
+	}
+	openAILimiterMu.Lock()
+	defer openAILimiterMu.Unlock()
+	if openAILimiter == nil || openAILimit != cfg.OpenAIMaxConcurrency {
+		openAILimiter, openAILimit = NewCallLimiter(cfg.OpenAIMaxConcurrency), cfg.OpenAIMaxConcurrency
+	}
+	return openAILimiter
+}
@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"regexp"
+	"sort"
+)
+
+var (
+	// starRe matches a bare * in a select list, as opposed to COUNT(*) or
+	// multiplication
+	starRe = regexp.MustCompile(`(?i)(?:\bSELECT|\bDISTINCT|,)\s*\*\s*(?:,|\bFROM\b)`)
+	// qualifiedStarRe matches table.* in a select list
+	qualifiedStarRe = regexp.MustCompile(`(\w+)\s*\.\s*\*`)
+	// qualifierRe finds the t. before a qualified column name
+	qualifierRe = regexp.MustCompile(`(\w+)\s*\.\s*$`)
+)
+
+// ReferencedColumns lists the schema columns sql touches, as "table.column",
+// sorted. A column qualified by a table name counts for that table only;
+// an unqualified or alias-qualified one counts for every referenced table
+// that has it, since the SQL alone can't tell them apart. SELECT * counts
+// every column of the referenced tables. Names inside string literals are
+// ignored.
+func ReferencedColumns(sql string, schema *Schema) []string {
+	if schema == nil {
+		return nil
+	}
+	body := literalRe.ReplaceAllString(sql, "''")
+	locs := wordRe.FindAllStringIndex(body, -1)
+
+	tables := make(map[string]*Datasource)
+	for i := range schema.Datasources {
+		tables[schema.Datasources[i].Name] = &schema.Datasources[i]
+	}
+	var referenced []*Datasource
+	seenTable := make(map[string]bool)
+	for _, loc := range locs {
+		name := body[loc[0]:loc[1]]
+		if ds, ok := tables[name]; ok && !seenTable[name] {
+			seenTable[name] = true
+			referenced = append(referenced, ds)
+		}
+	}
+
+	columns := make(map[string]bool)
+	addAll := func(ds *Datasource) {
+		for _, col := range ds.Columns {
+			columns[ds.Name+"."+col.Name] = true
+		}
+	}
+
+	for _, loc := range locs {
+		word := body[loc[0]:loc[1]]
+		qualifier := ""
+		if m := qualifierRe.FindStringSubmatch(body[:loc[0]]); m != nil {
+			qualifier = m[1]
+		}
+		for _, ds := range referenced {
+			if qualifier != "" && tables[qualifier] != nil && qualifier != ds.Name {
+				continue
+			}
+			for _, col := range ds.Columns {
+				if col.Name == word {
+					columns[ds.Name+"."+col.Name] = true
+				}
+			}
+		}
+	}
+
+	if starRe.MatchString(body) {
+		for _, ds := range referenced {
+			addAll(ds)
+		}
+	}
+	for _, m := range qualifiedStarRe.FindAllStringSubmatch(body, -1) {
+		if ds, ok := tables[m[1]]; ok {
+			addAll(ds)
+			continue
+		}
+		// An alias: any referenced table could be behind it
+		for _, ds := range referenced {
+			addAll(ds)
+		}
+	}
+
+	if len(columns) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(columns))
+	for c := range columns {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,86 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Standard log field names. Use these keys (or the helpers below) so lines
+// from every component can be filtered and joined the same way.
+const (
+	LogRequestID  = "request_id"
+	LogTenant     = "tenant"
+	LogSubject    = "subject"
+	LogPhase      = "phase"
+	LogModel      = "model"
+	LogSQLHash    = "sql_hash"
+	LogDurationMs = "duration_ms"
+)
+
+// Pipeline phases for the phase field
+const (
+	PhaseSchema   = "schema"
+	PhaseGenerate = "generate"
+	PhaseExecute  = "execute"
+	PhaseEval     = "eval"
+)
+
+// SQLHash returns a short stable fingerprint of sql, ignoring surrounding
+// whitespace and a trailing semicolon, for grouping identical queries in logs
+func SQLHash(sql string) string {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	sum := sha256.Sum256([]byte(sql))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Phase returns the phase field
+func Phase(phase string) slog.Attr {
+	return slog.String(LogPhase, phase)
+}
+
+// DurationMs returns the duration_ms field
+func DurationMs(d time.Duration) slog.Attr {
+	return slog.Int64(LogDurationMs, d.Milliseconds())
+}
+
+// SQLFields returns the sql and sql_hash fields
+func SQLFields(sql string) slog.Attr {
+	return slog.Group("", slog.String("sql", sql), slog.String(LogSQLHash, SQLHash(sql)))
+}
+
+// PromptFields returns the prompt_tokens, prompt_cost_usd and
+// prompt_trimmed fields of a generation's estimated prompt, or nothing if
+// gen is nil
+func PromptFields(gen *Generation) slog.Attr {
+	if gen == nil || gen.PromptTokens == 0 {
+		return slog.Attr{}
+	}
+	return slog.Group("",
+		slog.Int("prompt_tokens", gen.PromptTokens),
+		slog.Float64("prompt_cost_usd", EstimateCost(gen.Model, Usage{InputTokens: gen.PromptTokens})),
+		slog.Bool("prompt_trimmed", gen.PromptTrimmed),
+	)
+}
+
+type logAttrsKey struct{}
+
+// ContextWithLogAttrs returns ctx carrying attrs (typically request_id and
+// tenant) in addition to any it already carries
+func ContextWithLogAttrs(ctx context.Context, attrs ...any) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]any)
+	return context.WithValue(ctx, logAttrsKey{}, append(append([]any(nil), prev...), attrs...))
+}
+
+// Logger returns the default logger with the attrs carried by ctx. The
+// default is resolved at call time, so SetupLogging changes take effect.
+func Logger(ctx context.Context) *slog.Logger {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]any)
+	if len(attrs) == 0 {
+		return slog.Default()
+	}
+	return slog.Default().With(attrs...)
+}
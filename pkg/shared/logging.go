@@ -0,0 +1,117 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	logMu     sync.Mutex
+	logLevel  = new(slog.LevelVar)
+	logSample atomic.Uint64 // math.Float64bits of LOG_DEBUG_SAMPLE_RATE
+	logFormat string
+	logOutput string
+	logFile   *os.File
+)
+
+func init() {
+	logSample.Store(math.Float64bits(1))
+}
+
+// SetupLogging installs the default slog logger from LOG_LEVEL, LOG_FORMAT
+// and LOG_OUTPUT. It is cheap to call on every request: the handler is only
+// rebuilt when format or destination change, and the level is swapped in place.
+func SetupLogging(cfg *Config) error {
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	logLevel.Set(level)
+	logSample.Store(math.Float64bits(cfg.LogDebugSampleRate))
+	if cfg.LogFormat == logFormat && cfg.LogOutput == logOutput {
+		return nil
+	}
+
+	var w io.Writer
+	var file *os.File
+	switch cfg.LogOutput {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		file, err = os.OpenFile(cfg.LogOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		w = file
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(samplingHandler{handler}))
+
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	logFormat = cfg.LogFormat
+	logOutput = cfg.LogOutput
+	return nil
+}
+
+func parseLogLevel(v string) (slog.Level, error) {
+	switch strings.ToLower(v) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", v)
+}
+
+// samplingHandler drops debug records at random so that only
+// LOG_DEBUG_SAMPLE_RATE of them are written. Other levels pass through.
+type samplingHandler struct {
+	slog.Handler
+}
+
+func (h samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if !h.Handler.Enabled(ctx, level) {
+		return false
+	}
+	if level > slog.LevelDebug {
+		return true
+	}
+	rate := math.Float64frombits(logSample.Load())
+	return rate >= 1 || rand.Float64() < rate
+}
+
+func (h samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return samplingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h samplingHandler) WithGroup(name string) slog.Handler {
+	return samplingHandler{h.Handler.WithGroup(name)}
+}
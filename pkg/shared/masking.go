@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// Masking modes for MASKED_COLUMNS
+const (
+	// MaskHash replaces values with a keyed hash, so rows can still be
+	// grouped and joined by the caller without revealing the value
+	MaskHash = "hash"
+	// MaskRedact replaces values with a fixed placeholder
+	MaskRedact = "mask"
+)
+
+const redactedValue = "***"
+
+// parseMaskSpec parses "seller_id,customer_email=mask" into column -> mode.
+// A bare column name uses MaskHash.
+func parseMaskSpec(spec string) (map[string]string, error) {
+	rules := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		col, mode, ok := strings.Cut(entry, "=")
+		col = strings.TrimSpace(col)
+		mode = strings.TrimSpace(mode)
+		if !ok {
+			mode = MaskHash
+		}
+		if col == "" || (mode != MaskHash && mode != MaskRedact) {
+			return nil, fmt.Errorf("invalid masked column %q: want column or column=hash|mask", entry)
+		}
+		rules[col] = mode
+	}
+	return rules, nil
+}
+
+// Masker masks the configured sensitive columns row by row, so it works
+// for streamed results as well as buffered ones
+type Masker struct {
+	rules  map[string]string
+	salt   string
+	masked map[string]bool
+}
+
+// NewMasker returns a masker for MASKED_COLUMNS, or nil when none are configured
+func NewMasker(cfg *Config) *Masker {
+	if cfg.MaskedColumns == "" {
+		return nil
+	}
+	rules, err := parseMaskSpec(cfg.MaskedColumns)
+	if err != nil || len(rules) == 0 {
+		return nil
+	}
+	return &Masker{rules: rules, salt: cfg.MaskingSalt, masked: make(map[string]bool)}
+}
+
+// MaskRow masks sensitive values in row in place. Safe to call on a nil Masker.
+func (m *Masker) MaskRow(row map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	for col, v := range row {
+		mode, ok := m.rules[col]
+		if !ok || v == nil {
+			continue
+		}
+		if mode == MaskRedact {
+			row[col] = redactedValue
+		} else {
+			row[col] = hashValue(m.salt, v)
+		}
+		m.masked[col] = true
+	}
+}
+
+// Columns returns the names of the columns masked so far, sorted
+func (m *Masker) Columns() []string {
+	if m == nil || len(m.masked) == 0 {
+		return nil
+	}
+	cols := make([]string, 0, len(m.masked))
+	for col := range m.masked {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// hashValue returns a short HMAC of v keyed by salt. Without a salt, low
+// entropy values such as numeric IDs could be recovered by brute force.
+func hashValue(salt string, v interface{}) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	fmt.Fprint(mac, v)
+	return "h_" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// countCallRe matches a select item that only counts, e.g. count(email),
+// count(DISTINCT email) or count() AS n: a plain count reveals no value of
+// its argument. countIf is left out, since its condition can test one.
+var countCallRe = regexp.MustCompile(`(?i)^count\s*\(\s*(?:DISTINCT\s+)?(?:[A-Za-z_][A-Za-z0-9_]*)?\s*\)(?:\s+AS\s+[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// groupByListRe finds the GROUP BY list of a statement whose clauses
+// are all at the top level
+var groupByListRe = regexp.MustCompile(`(?is)\bGROUP\s+BY\s+(.+?)(?:\s+(?:HAVING|ORDER\s+BY|LIMIT|WITH|SETTINGS|UNION)\b|\s*;?\s*$)`)
+
+// CheckSQL rejects SQL that could reveal a masked column's values. MaskRow
+// only knows result columns by name, so a masked column may be selected as
+// itself, counted with a plain count or grouped by, and nothing else: under
+// another name, e.g. SELECT MIN(customer_email) AS e, its values would
+// escape the mask, and in a condition or an ordering, e.g. WHERE
+// seller_id < 'm' or countIf(seller_id = 'x'), they could be recovered one
+// comparison at a time. Safe to call on a nil Masker.
+func (m *Masker) CheckSQL(sql string) error {
+	if m == nil {
+		return nil
+	}
+	violation := func(col string) error {
+		return nlerrors.ErrGrammarViolation{SQL: sql, Reason: "masked column " + col + " can only be selected as itself, counted or grouped by"}
+	}
+
+	// allowed spans of body a masked column may appear in: select items
+	// that are the column itself or a count, and GROUP BY items that are
+	// the column itself. A select list that can't be read, e.g. one over
+	// a subquery, allows none.
+	body := blankLiterals(sql)
+	var allowed [][2]int
+	allow := func(start, end int, countOK bool) {
+		offset := start
+		for _, item := range splitTopLevel(body[start:end]) {
+			trimmed := strings.TrimSpace(item)
+			if _, ok := m.rules[trimmed]; ok || (countOK && countCallRe.MatchString(trimmed)) {
+				allowed = append(allowed, [2]int{offset, offset + len(item)})
+			}
+			offset += len(item) + 1
+		}
+	}
+	if loc := selectFromRe.FindStringSubmatchIndex(body); loc != nil {
+		allow(loc[2], loc[3], true)
+		if group := groupByListRe.FindStringSubmatchIndex(body); group != nil {
+			allow(group[2], group[3], false)
+		}
+	}
+
+	for _, loc := range wordRe.FindAllStringIndex(body, -1) {
+		col := body[loc[0]:loc[1]]
+		if _, ok := m.rules[col]; !ok {
+			continue
+		}
+		inside := false
+		for _, span := range allowed {
+			if loc[0] >= span[0] && loc[1] <= span[1] {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return violation(col)
+		}
+	}
+	return nil
+}
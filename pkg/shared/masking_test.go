@@ -0,0 +1,42 @@
+package shared
+
+import "testing"
+
+func TestMaskerCheckSQL(t *testing.T) {
+	m := NewMasker(&Config{MaskedColumns: "seller_id,customer_email=mask"})
+
+	tests := []struct {
+		sql string
+		ok  bool
+	}{
+		{"SELECT seller_id, price FROM orders LIMIT 10", true},
+		{"SELECT DISTINCT seller_id FROM orders", true},
+		{"SELECT seller_id, count() AS orders FROM orders GROUP BY seller_id ORDER BY orders DESC", true},
+		{"SELECT count(seller_id) FROM orders", true},
+		{"SELECT count(DISTINCT customer_email) AS customers FROM orders", true},
+		{"SELECT price FROM orders WHERE status = 'seller_id'", true},
+		{"SELECT * FROM orders", true},
+
+		{"SELECT MIN(customer_email) AS e FROM orders", false},
+		{"SELECT seller_id AS s FROM orders", false},
+		{"SELECT lower(seller_id) FROM orders", false},
+		{"SELECT countIf(seller_id < 'm') FROM orders", false},
+		{"SELECT sumIf(price, seller_id = 'abc') FROM orders", false},
+		{"SELECT count() FROM orders WHERE seller_id = 'abc'", false},
+		{"SELECT seller_id, count() AS n FROM orders GROUP BY seller_id HAVING max(seller_id) > 'm'", false},
+		{"SELECT price FROM orders ORDER BY seller_id", false},
+		{"SELECT seller_id FROM (SELECT seller_id FROM orders WHERE seller_id < 'm')", false},
+		{"SELECT count() FROM orders GROUP BY substring(seller_id, 1, 1)", false},
+	}
+	for _, tt := range tests {
+		err := m.CheckSQL(tt.sql)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckSQL(%q) = %v, want ok %v", tt.sql, err, tt.ok)
+		}
+	}
+
+	var none *Masker
+	if err := none.CheckSQL("SELECT MIN(customer_email) FROM orders"); err != nil {
+		t.Errorf("nil Masker rejected SQL: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Metric is a named business metric with a fixed formula, e.g. revenue =
+// SUM(price) over order_items
+type Metric struct {
+	Name        string `json:"name"`
+	Table       string `json:"table"`
+	SQL         string `json:"sql"`
+	Description string `json:"description,omitempty"`
+}
+
+// Expression is the select item the grammar offers for the metric
+func (m Metric) Expression() string {
+	return m.SQL + " AS " + m.Name
+}
+
+// Metrics are metric definitions sorted by name
+type Metrics []Metric
+
+var metricNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// LoadMetrics reads a METRICS_FILE: a JSON object of metric name to
+// {"table", "sql", "description"}, e.g.
+//
+//	{"aov": {"table": "order_items", "sql": "SUM(price) / COUNT(DISTINCT order_id)",
+//	         "description": "Average order value"}}
+//
+// Each formula must be a read-only expression over its table's columns.
+func LoadMetrics(path string) (Metrics, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics: %w", err)
+	}
+	var defs map[string]Metric
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("invalid metrics file %s: %w", path, err)
+	}
+
+	metrics := make(Metrics, 0, len(defs))
+	for name, m := range defs {
+		m.Name = name
+		m.SQL = strings.TrimSpace(m.SQL)
+		switch {
+		case !metricNameRe.MatchString(name) || sqlKeywords[strings.ToUpper(name)]:
+			return nil, fmt.Errorf("metric %q: name must be a lower-case identifier and not a keyword", name)
+		case m.Table == "" || m.SQL == "":
+			return nil, fmt.Errorf("metric %q: table and sql are required", name)
+		}
+		if err := CheckStatement("SELECT " + m.SQL + " FROM " + m.Table); err != nil {
+			return nil, fmt.Errorf("metric %q: %w", name, err)
+		}
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics, nil
+}
+
+// For returns the metrics whose table is in schema with every column their
+// formula uses. A metric that shares a name with one of its table's
+// columns is left out, since ORDER BY name would be ambiguous.
+func (ms Metrics) For(schema *Schema) []Metric {
+	types := schemaColumns(schema)
+	var kept []Metric
+	for _, m := range ms {
+		cols, ok := types[m.Table]
+		if !ok {
+			continue
+		}
+		if _, clash := cols[m.Name]; clash {
+			continue
+		}
+		usable := true
+		for _, col := range m.Columns() {
+			if _, ok := cols[col]; !ok {
+				usable = false
+				break
+			}
+		}
+		if usable {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// Columns lists the column names the formula reads: identifiers that are
+// neither keywords nor function names
+func (m Metric) Columns() []string {
+	body := literalRe.ReplaceAllString(m.SQL, "''")
+	var cols []string
+	for _, loc := range wordRe.FindAllStringIndex(body, -1) {
+		word := body[loc[0]:loc[1]]
+		rest := strings.TrimLeft(body[loc[1]:], " ")
+		if sqlKeywords[strings.ToUpper(word)] || strings.HasPrefix(rest, "(") {
+			continue
+		}
+		cols = append(cols, word)
+	}
+	return cols
+}
@@ -0,0 +1,123 @@
+package shared
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvalMetrics accumulates eval outcomes and renders them in the
+// Prometheus text exposition format.
+type EvalMetrics struct {
+	mu sync.Mutex
+
+	runsTotal    int
+	runsFailed   int
+	caseFailures map[string]int
+
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastSummary  EvalSummary
+	lastResults  []EvalResult
+}
+
+func NewEvalMetrics() *EvalMetrics {
+	return &EvalMetrics{
+		caseFailures: make(map[string]int),
+	}
+}
+
+// Record stores the outcome of an eval run.
+func (m *EvalMetrics) Record(results []EvalResult, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	summary := ComputeSummary(results)
+
+	m.runsTotal++
+	if summary.Failed > 0 {
+		m.runsFailed++
+	}
+	for _, r := range results {
+		if !r.Passed && !r.Skipped {
+			m.caseFailures[r.Name]++
+		}
+	}
+
+	m.lastRun = time.Now()
+	m.lastDuration = duration
+	m.lastSummary = summary
+	m.lastResults = append([]EvalResult(nil), results...)
+}
+
+// WriteTo writes all metrics in Prometheus text format.
+func (m *EvalMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sb strings.Builder
+
+	writeMetric(&sb, "nl2sql_eval_runs_total", "counter", "Total number of eval runs.")
+	sb.WriteString(fmt.Sprintf("nl2sql_eval_runs_total %d\n", m.runsTotal))
+
+	writeMetric(&sb, "nl2sql_eval_runs_failed_total", "counter", "Eval runs with at least one failing case.")
+	sb.WriteString(fmt.Sprintf("nl2sql_eval_runs_failed_total %d\n", m.runsFailed))
+
+	if m.runsTotal > 0 {
+		writeMetric(&sb, "nl2sql_eval_last_run_timestamp_seconds", "gauge", "Unix time of the last eval run.")
+		sb.WriteString(fmt.Sprintf("nl2sql_eval_last_run_timestamp_seconds %d\n", m.lastRun.Unix()))
+
+		writeMetric(&sb, "nl2sql_eval_last_duration_seconds", "gauge", "Wall-clock duration of the last eval run.")
+		sb.WriteString(fmt.Sprintf("nl2sql_eval_last_duration_seconds %g\n", m.lastDuration.Seconds()))
+
+		writeMetric(&sb, "nl2sql_eval_pass_rate", "gauge", "Pass rate of the last eval run (0-100).")
+		sb.WriteString(fmt.Sprintf("nl2sql_eval_pass_rate %g\n", m.lastSummary.PassRate))
+
+		writeMetric(&sb, "nl2sql_eval_cases", "gauge", "Case counts of the last eval run by outcome.")
+		sb.WriteString(fmt.Sprintf("nl2sql_eval_cases{outcome=\"passed\"} %d\n", m.lastSummary.Passed))
+		sb.WriteString(fmt.Sprintf("nl2sql_eval_cases{outcome=\"failed\"} %d\n", m.lastSummary.Failed))
+		sb.WriteString(fmt.Sprintf("nl2sql_eval_cases{outcome=\"skipped\"} %d\n", m.lastSummary.Skipped))
+
+		results := append([]EvalResult(nil), m.lastResults...)
+		sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+		writeMetric(&sb, "nl2sql_eval_case_passed", "gauge", "Whether the case passed in the last eval run (1 or 0).")
+		for _, r := range results {
+			if r.Skipped {
+				continue
+			}
+			passed := 0
+			if r.Passed {
+				passed = 1
+			}
+			sb.WriteString(fmt.Sprintf("nl2sql_eval_case_passed{case=%q} %d\n", r.Name, passed))
+		}
+
+		writeMetric(&sb, "nl2sql_eval_case_duration_seconds", "gauge", "Duration of the case in the last eval run.")
+		for _, r := range results {
+			sb.WriteString(fmt.Sprintf("nl2sql_eval_case_duration_seconds{case=%q} %g\n", r.Name, float64(r.DurationMs)/1000))
+		}
+	}
+
+	names := make([]string, 0, len(m.caseFailures))
+	for name := range m.caseFailures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeMetric(&sb, "nl2sql_eval_case_failures_total", "counter", "Total failures per case across eval runs.")
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("nl2sql_eval_case_failures_total{case=%q} %d\n", name, m.caseFailures[name]))
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func writeMetric(sb *strings.Builder, name, kind, help string) {
+	sb.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+	sb.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, kind))
+}
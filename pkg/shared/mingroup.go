@@ -0,0 +1,124 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// Minimum group size policies
+const (
+	// GroupPolicySuppress leaves groups below the minimum out of the result
+	GroupPolicySuppress = "suppress"
+	// GroupPolicyReject fails the query if any group is below the minimum
+	GroupPolicyReject = "reject"
+)
+
+// GroupSizeColumn is the row count the reject policy selects alongside each
+// group. CheckGroupSizes removes it from the result.
+const GroupSizeColumn = "_group_size"
+
+var (
+	havingRe     = regexp.MustCompile(`(?i)\bHAVING\b`)
+	tailClauseRe = regexp.MustCompile(`(?i)\s+(ORDER\s+BY|LIMIT)\b`)
+	fromWordRe   = regexp.MustCompile(`(?i)\s+FROM\b`)
+	// condAggregateRe finds an aggregate with ClickHouse's -If combinator,
+	// e.g. countIf( or sumIf(
+	condAggregateRe = regexp.MustCompile(`(?i)\b(\w+)If\s*\(`)
+)
+
+// MinGroupSize is the minimum group size for a request: the larger of
+// MIN_GROUP_SIZE and the API key's min_group_size, so a key can only be
+// made stricter
+func MinGroupSize(cfg *Config, principal *Principal) int {
+	size := cfg.MinGroupSize
+	if principal != nil {
+		size = max(size, principal.MinGroupSize)
+	}
+	return size
+}
+
+// EnforceMinGroupSize rewrites sql so its result only describes groups of
+// at least size rows. A query that doesn't aggregate returns individual
+// rows, so it is refused with nlerrors.ErrGroupTooSmall, as is one with a
+// conditional aggregate: countIf(seller_id = 'x') describes the rows its
+// condition picks, however large their group. Under the suppress
+// policy an aggregate gets HAVING count() >= size; under reject it selects
+// GroupSizeColumn for CheckGroupSizes instead. A non-positive size leaves
+// sql unchanged.
+func EnforceMinGroupSize(sql string, size int, policy string) (string, error) {
+	if size <= 0 {
+		return sql, nil
+	}
+	if IsRowSelect(sql) {
+		return "", nlerrors.ErrGroupTooSmall{MinSize: size, RowLevel: true}
+	}
+	for _, m := range condAggregateRe.FindAllStringSubmatch(blankLiterals(sql), -1) {
+		// multiIf picks between values; it doesn't aggregate
+		if !strings.EqualFold(m[1], "multi") {
+			return "", nlerrors.ErrGroupTooSmall{MinSize: size, Conditional: true}
+		}
+	}
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	// Clauses are found with literals blanked, so a keyword inside one
+	// can't move the rewrite into it; the edits splice into sql at the
+	// same offsets
+	body := blankLiterals(sql)
+
+	if policy == GroupPolicyReject {
+		loc := fromWordRe.FindStringIndex(body)
+		if loc == nil {
+			return "", nlerrors.ErrGroupTooSmall{MinSize: size, RowLevel: true}
+		}
+		return sql[:loc[0]] + ", count() AS " + GroupSizeColumn + sql[loc[0]:] + ";", nil
+	}
+
+	cond := fmt.Sprintf("count() >= %d", size)
+	if loc := havingRe.FindStringIndex(body); loc != nil {
+		// The existing condition is parenthesized so an OR in it can't
+		// bypass the minimum
+		end := len(sql)
+		if tail := tailClauseRe.FindStringIndex(body[loc[1]:]); tail != nil {
+			end = loc[1] + tail[0]
+		}
+		existing := strings.TrimSpace(sql[loc[1]:end])
+		return sql[:loc[1]] + " " + cond + " AND (" + existing + ")" + sql[end:] + ";", nil
+	}
+	at := len(sql)
+	if loc := tailClauseRe.FindStringIndex(body); loc != nil {
+		at = loc[0]
+	}
+	return sql[:at] + " HAVING " + cond + sql[at:] + ";", nil
+}
+
+// CheckGroupSizes removes GroupSizeColumn from result and returns an
+// nlerrors.ErrGroupTooSmall if any row counted fewer than size rows. Under
+// the reject policy a result without the column fails too, since its group
+// sizes can't be checked.
+func CheckGroupSizes(result *TinybirdResponse, size int, policy string) error {
+	if policy == GroupPolicyReject && !slices.ContainsFunc(result.Meta, func(m map[string]string) bool { return m["name"] == GroupSizeColumn }) {
+		return nlerrors.ErrGroupTooSmall{MinSize: size, Unchecked: true}
+	}
+	var err error
+	for _, row := range result.Data {
+		v, ok := row[GroupSizeColumn]
+		if !ok {
+			continue
+		}
+		delete(row, GroupSizeColumn)
+		if n, ok := numericValue(v); ok && n < float64(size) {
+			err = nlerrors.ErrGroupTooSmall{MinSize: size}
+		}
+	}
+	meta := result.Meta[:0]
+	for _, m := range result.Meta {
+		if m["name"] != GroupSizeColumn {
+			meta = append(meta, m)
+		}
+	}
+	result.Meta = meta
+	return err
+}
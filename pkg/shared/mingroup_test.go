@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+func TestEnforceMinGroupSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		policy   string
+		want     string
+		wantCode nlerrors.Code
+	}{
+		{"suppress", "SELECT seller_id, count() FROM orders GROUP BY seller_id", GroupPolicySuppress, "SELECT seller_id, count() FROM orders GROUP BY seller_id HAVING count() >= 5;", ""},
+		{"existing having", "SELECT seller_id, sum(price) AS revenue FROM orders GROUP BY seller_id HAVING revenue > 10 OR 1 = 1 ORDER BY revenue", GroupPolicySuppress, "SELECT seller_id, sum(price) AS revenue FROM orders GROUP BY seller_id HAVING count() >= 5 AND (revenue > 10 OR 1 = 1) ORDER BY revenue;", ""},
+		{"reject", "SELECT seller_id, count() FROM orders GROUP BY seller_id", GroupPolicyReject, "SELECT seller_id, count(), count() AS _group_size FROM orders GROUP BY seller_id;", ""},
+		{"row select", "SELECT * FROM orders", GroupPolicySuppress, "", nlerrors.CodeGroupTooSmall},
+		{"countIf", "SELECT countIf(seller_id = 's1') AS n FROM orders", GroupPolicySuppress, "", nlerrors.CodeGroupTooSmall},
+		{"sumIf", "SELECT seller_id, sumIf(price, order_id = 'o1') FROM orders GROUP BY seller_id", GroupPolicyReject, "", nlerrors.CodeGroupTooSmall},
+		{"avgIf with space", "SELECT avgIf (price, price > 100) FROM orders", GroupPolicySuppress, "", nlerrors.CodeGroupTooSmall},
+		{"limit in literal", "SELECT seller_id, count() FROM orders WHERE product_category_name = 'no limit' GROUP BY seller_id", GroupPolicySuppress, "SELECT seller_id, count() FROM orders WHERE product_category_name = 'no limit' GROUP BY seller_id HAVING count() >= 5;", ""},
+		{"order by in literal", "SELECT seller_id, count() FROM orders WHERE seller_id != 'x order by y' GROUP BY seller_id LIMIT 10", GroupPolicySuppress, "SELECT seller_id, count() FROM orders WHERE seller_id != 'x order by y' GROUP BY seller_id HAVING count() >= 5 LIMIT 10;", ""},
+		{"having in literal", "SELECT seller_id, count() FROM orders WHERE seller_id != 'having 1 = 1' GROUP BY seller_id", GroupPolicySuppress, "SELECT seller_id, count() FROM orders WHERE seller_id != 'having 1 = 1' GROUP BY seller_id HAVING count() >= 5;", ""},
+		{"from in literal", "SELECT seller_id, 'a from b' AS t, count() FROM orders GROUP BY seller_id", GroupPolicyReject, "SELECT seller_id, 'a from b' AS t, count(), count() AS _group_size FROM orders GROUP BY seller_id;", ""},
+		{"countIf in literal", "SELECT count() FROM orders WHERE seller_id != 'countIf('", GroupPolicySuppress, "SELECT count() FROM orders WHERE seller_id != 'countIf(' HAVING count() >= 5;", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EnforceMinGroupSize(tt.sql, 5, tt.policy)
+			if code := nlerrors.CodeOf(err); code != tt.wantCode || (err != nil && tt.wantCode == "") {
+				t.Fatalf("error = %v, want code %q", err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Errorf("EnforceMinGroupSize(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckGroupSizes(t *testing.T) {
+	tests := []struct {
+		name     string
+		meta     []string
+		size     interface{}
+		policy   string
+		wantCode nlerrors.Code
+	}{
+		{"large enough", []string{"seller_id", GroupSizeColumn}, 7, GroupPolicyReject, ""},
+		{"too small", []string{"seller_id", GroupSizeColumn}, 2, GroupPolicyReject, nlerrors.CodeGroupTooSmall},
+		{"column missing", []string{"seller_id"}, nil, GroupPolicyReject, nlerrors.CodeGroupTooSmall},
+		{"suppressed", []string{"seller_id"}, nil, GroupPolicySuppress, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &TinybirdResponse{Data: []map[string]interface{}{{"seller_id": "s1"}}}
+			for _, name := range tt.meta {
+				result.Meta = append(result.Meta, map[string]string{"name": name})
+			}
+			if tt.size != nil {
+				result.Data[0][GroupSizeColumn] = tt.size
+			}
+			err := CheckGroupSizes(result, 5, tt.policy)
+			if code := nlerrors.CodeOf(err); code != tt.wantCode || (err != nil && tt.wantCode == "") {
+				t.Fatalf("error = %v, want code %q", err, tt.wantCode)
+			}
+			if _, ok := result.Data[0][GroupSizeColumn]; ok || len(result.Meta) != 1 {
+				t.Errorf("%s left in result: %v %v", GroupSizeColumn, result.Data, result.Meta)
+			}
+		})
+	}
+}
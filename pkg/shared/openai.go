@@ -4,40 +4,111 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
 )
 
+// DefaultModel is used when OPENAI_MODEL is not set
+const DefaultModel = "gpt-5"
+
 type OpenAIClient struct {
+	clientOptions
 	apiKey          string
-	grammar         string
-	toolDescription string
-	userHint        string
+	baseURL         string
+	maxPromptTokens int
+	// prompt is what SetSchema, SetProfile and SetExamples last set. It is
+	// swapped whole, so a schema reload never races a generation in flight
+	// and each generation sees one schema, profile and set of examples
+	// throughout.
+	prompt atomic.Pointer[promptState]
+	// setMu serializes the setters, which each replace one part of prompt
+	setMu          sync.Mutex
+	embeddingModel string
 }
 
-// ErrUnsupportedQuery is returned when the LLM determines the query
-// cannot be answered with the available schema.
-type ErrUnsupportedQuery struct {
-	Reason        string
-	AvailableData string
+// promptState is the part of a generation request that is set before
+// generating rather than passed in
+type promptState struct {
+	// compiled is the grammar and tool descriptions of the last SetSchema
+	compiled *compiledSchema
+	// profile is the tenant's prompt guidance and glossary, if any
+	profile *TenantProfile
+	// examples are similar earlier questions and their SQL, if any
+	examples []FewShotExample
 }
 
-func (e ErrUnsupportedQuery) Error() string {
-	return e.Reason
-}
+// ErrUnsupportedQuery is returned when the LLM determines the query
+// cannot be answered with the available schema.
+type ErrUnsupportedQuery = nlerrors.ErrUnsupportedQuery
 
-func NewOpenAIClient(cfg *Config) *OpenAIClient {
+func NewOpenAIClient(cfg *Config, opts ...ClientOption) *OpenAIClient {
+	o := newClientOptions(append([]ClientOption{WithLimiter(OpenAILimiter(cfg))}, opts...))
+	if o.model == "" {
+		o.model = cfg.OpenAIModel
+	}
+	if o.model == "" {
+		o.model = DefaultModel
+	}
+	baseURL := cfg.OpenAIBaseURL
+	if baseURL == "" {
+		baseURL = DefaultOpenAIBaseURL
+	}
 	return &OpenAIClient{
-		apiKey: cfg.OpenAIAPIKey,
+		clientOptions:   o,
+		apiKey:          cfg.OpenAIAPIKey,
+		baseURL:         baseURL,
+		maxPromptTokens: cfg.MaxPromptTokens,
+		embeddingModel:  cfg.EmbeddingModel,
 	}
 }
 
+// Model returns the model used for generation.
+func (c *OpenAIClient) Model() string {
+	return c.model
+}
+
 // SetSchema updates the grammar and tool description based on schema.
+// Safe to call while other goroutines generate: generations already
+// started finish with the schema they began with.
 func (c *OpenAIClient) SetSchema(schema *Schema) {
-	c.grammar = schema.GenerateGrammar()
-	c.toolDescription = schema.GenerateToolDescription()
-	c.userHint = schema.GenerateUserHint()
+	compiled := compile(schema)
+	c.update(func(p *promptState) { p.compiled = &compiled })
+}
+
+// SetProfile replaces the default prompt guidance with the profile's and
+// adds its glossary. The grammar side of a profile is applied to the schema
+// passed to SetSchema. A nil profile restores the default prompt.
+func (c *OpenAIClient) SetProfile(profile *TenantProfile) {
+	c.update(func(p *promptState) { p.profile = profile })
+}
+
+// SetExamples adds earlier questions and their SQL to the prompt, as
+// few-shot examples. Nil removes them.
+func (c *OpenAIClient) SetExamples(examples []FewShotExample) {
+	c.update(func(p *promptState) { p.examples = examples })
+}
+
+// update replaces the prompt state with a copy that change modified
+func (c *OpenAIClient) update(change func(p *promptState)) {
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+	next := *c.snapshot()
+	change(&next)
+	c.prompt.Store(&next)
+}
+
+// snapshot returns the prompt state as the setters last left it, with an
+// empty compiled schema before the first SetSchema
+func (c *OpenAIClient) snapshot() *promptState {
+	if p := c.prompt.Load(); p != nil {
+		return p
+	}
+	return &promptState{compiled: &compiledSchema{}}
 }
 
 // Request/Response types for OpenAI Responses API
@@ -69,17 +140,43 @@ type CannotAnswerInput struct {
 type ResponsesResponse struct {
 	ID     string       `json:"id"`
 	Output []OutputItem `json:"output"`
+	Usage  Usage        `json:"usage"`
+}
+
+// Usage reports token consumption for a single Responses API call
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// Generation is the outcome of a single GenerateSQL call
+type Generation struct {
+	SQL   string
+	Model string
+	Usage Usage
+	// PromptTokens is the estimated size of the prompt sent
+	PromptTokens int
+	// PromptTrimmed is set when descriptions were left out of the prompt
+	// to fit the token limit
+	PromptTrimmed bool
 }
 
 type OutputItem struct {
+	Type      string          `json:"type"`
+	Name      string          `json:"name,omitempty"`
+	Input     string          `json:"input,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	CallID    string          `json:"call_id,omitempty"`
+	Content   []OutputContent `json:"content,omitempty"`
+}
+
+// OutputContent is one part of a message output item: output_text, or a
+// refusal when the model declines to answer
+type OutputContent struct {
 	Type    string `json:"type"`
-	Name    string `json:"name,omitempty"`
-	Input   string `json:"input,omitempty"`
-	CallID  string `json:"call_id,omitempty"`
-	Content []struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	} `json:"content,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Refusal string `json:"refusal,omitempty"`
 }
 
 func (c *OpenAIClient) GenerateSQL(naturalLanguage string) (string, error) {
@@ -88,110 +185,276 @@ func (c *OpenAIClient) GenerateSQL(naturalLanguage string) (string, error) {
 
 // GenerateSQLWithTime generates SQL with a specific reference time.
 func (c *OpenAIClient) GenerateSQLWithTime(naturalLanguage string, currentTime time.Time) (string, error) {
-	if c.grammar == "" || c.toolDescription == "" {
-		return "", fmt.Errorf("schema not set: call SetSchema before GenerateSQL")
+	gen, err := c.Generate(naturalLanguage, currentTime)
+	if err != nil {
+		return "", err
 	}
+	return gen.SQL, nil
+}
 
-	timeStr := currentTime.Format("2006-01-02 15:04:05")
-
-	reqBody := ResponsesRequest{
-		Model: "gpt-5",
-		Input: fmt.Sprintf(`Convert this natural language query to a valid ClickHouse SQL query.
-
-There is only ONE table: order_items. Each row IS an order - do NOT use GROUP BY order_id.
-
-IMPORTANT - when to use GROUP BY:
-- "top N orders by price" → NO GROUP BY, just: SELECT * FROM order_items ORDER BY price DESC LIMIT N
-- "total revenue" → NO GROUP BY: SELECT SUM(price) FROM order_items
-- "revenue PER seller" or "BY seller" → USE GROUP BY: SELECT seller_id, SUM(price) FROM order_items GROUP BY seller_id
-
-Only use GROUP BY when the user explicitly asks for aggregation BY a dimension (per seller, by product, etc).
-
-Current UTC time: %s
+// Tools returns the tool definitions sent with every generation request:
+// the grammar-constrained SQL tool and the refusal function. SetSchema must
+// have been called.
+func (c *OpenAIClient) Tools() []Tool {
+	schema := c.snapshot().compiled
+	return c.tools(schema.grammar, schema.toolDescription)
+}
 
-Query: %s`,
-			timeStr, naturalLanguage),
-		Tools: []Tool{
-			{
-				Type:        "custom",
-				Name:        "sql_generator",
-				Description: c.toolDescription,
-				Format: &ToolFormat{
-					Type:       "grammar",
-					Syntax:     "lark",
-					Definition: c.grammar,
-				},
+// tools is Tools with the SQL tool constrained by grammar and described by
+// description
+func (c *OpenAIClient) tools(grammar, description string) []Tool {
+	return []Tool{
+		{
+			Type:        "custom",
+			Name:        "sql_generator",
+			Description: description,
+			Format: &ToolFormat{
+				Type:       "grammar",
+				Syntax:     "lark",
+				Definition: grammar,
 			},
-			{
-				Type:        "function",
-				Name:        "cannot_answer",
-				Description: "Call this when the query cannot be answered with the available database schema. Use this for questions about data that doesn't exist in the tables, or for completely unrelated questions.",
-				Parameters: map[string]interface{}{
-					"type": "object",
-					"properties": map[string]interface{}{
-						"reason": map[string]interface{}{
-							"type":        "string",
-							"description": "Brief explanation of why this query cannot be answered",
-						},
+		},
+		{
+			Type:        "function",
+			Name:        "cannot_answer",
+			Description: "Call this when the query cannot be answered with the available database schema. Use this for questions about data that doesn't exist in the tables, or for completely unrelated questions.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"reason": map[string]interface{}{
+						"type":        "string",
+						"description": "Brief explanation of why this query cannot be answered",
 					},
-					"required": []string{"reason"},
 				},
+				"required": []string{"reason"},
 			},
 		},
-		ParallelToolCalls: false,
-	}
-
-	jsonBody, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
+}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/responses", bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+// Generate is like GenerateSQLWithTime but also reports the model and
+// token usage. currentTime's location is the user's time zone for relative
+// dates. Once the API has responded the Generation is returned even
+// alongside an error, so refusals are still accounted for.
+func (c *OpenAIClient) Generate(naturalLanguage string, currentTime time.Time) (*Generation, error) {
+	prompt := c.snapshot()
+	schema := prompt.compiled
+	if schema.grammar == "" || schema.toolDescription == "" {
+		return nil, fmt.Errorf("schema not set: call SetSchema before GenerateSQL")
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to execute request: %w", err)
+	// Descriptions are the first thing to go when the schema outgrows the
+	// prompt budget; only refuse if the bare schema doesn't fit either
+	reqBody := c.generationRequest(prompt, naturalLanguage, currentTime, schema.grammar, schema.toolDescription)
+	promptTokens := EstimatePromptTokens(reqBody)
+	trimmed := false
+	if limit := PromptTokenLimit(c.model, c.maxPromptTokens); promptTokens > limit {
+		if schema.compactToolDescription != schema.toolDescription {
+			reqBody = c.generationRequest(prompt, naturalLanguage, currentTime, schema.grammar, schema.compactToolDescription)
+			promptTokens = EstimatePromptTokens(reqBody)
+			trimmed = true
+		}
+		if promptTokens > limit {
+			gen := &Generation{Model: c.model, PromptTokens: promptTokens, PromptTrimmed: trimmed}
+			return gen, nlerrors.ErrPromptTooLarge{Tokens: promptTokens, Limit: limit}
+		}
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	result, err := c.createResponse(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("openai error (%d): %s", resp.StatusCode, string(body))
+		return nil, err
 	}
 
-	var result ResponsesResponse
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
-	}
+	gen := &Generation{Model: c.model, Usage: result.Usage, PromptTokens: promptTokens, PromptTrimmed: trimmed}
+	gen.SQL, err = ParseGeneration(result, schema.userHint)
+	return gen, err
+}
 
+// ParseGeneration reads the SQL out of a generation response: the input
+// of the sql_generator call. A cannot_answer call or a model refusal is an
+// ErrUnsupportedQuery with hint as its AvailableData; a response with
+// neither SQL nor a refusal is a grammar violation.
+func ParseGeneration(result *ResponsesResponse, hint string) (string, error) {
+	refusal := ""
 	for _, item := range result.Output {
 		if item.Type == "custom_tool_call" && item.Name == "sql_generator" {
+			if strings.TrimSpace(item.Input) == "" {
+				return "", nlerrors.ErrGrammarViolation{Reason: "empty SQL generated"}
+			}
+			if err := ValidateLiterals(item.Input); err != nil {
+				return "", err
+			}
 			return item.Input, nil
 		}
 
 		if item.Type == "function_call" && item.Name == "cannot_answer" {
+			args := item.Arguments
+			if args == "" {
+				args = item.Input
+			}
 			var input CannotAnswerInput
-			if err := json.Unmarshal([]byte(item.Input), &input); err != nil {
+			if err := json.Unmarshal([]byte(args), &input); err != nil {
 				return "", ErrUnsupportedQuery{
 					Reason:        "Query cannot be answered with available data",
-					AvailableData: c.userHint,
+					AvailableData: hint,
 				}
 			}
 			return "", ErrUnsupportedQuery{
 				Reason:        input.Reason,
-				AvailableData: c.userHint,
+				AvailableData: hint,
 			}
 		}
+
+		if item.Type == "message" {
+			for _, content := range item.Content {
+				if content.Type == "refusal" && refusal == "" {
+					refusal = content.Refusal
+				}
+			}
+		}
+	}
+
+	// A refusal only counts if no tool call follows it
+	if refusal != "" {
+		return "", ErrUnsupportedQuery{Reason: refusal, AvailableData: hint}
+	}
+	return "", nlerrors.ErrGrammarViolation{Reason: "no SQL generated in response"}
+}
+
+// GenerationRequest returns the Responses API request Generate sends for
+// a question before any trimming. SetSchema must have been called.
+func (c *OpenAIClient) GenerationRequest(naturalLanguage string, currentTime time.Time) ResponsesRequest {
+	prompt := c.snapshot()
+	return c.generationRequest(prompt, naturalLanguage, currentTime, prompt.compiled.grammar, prompt.compiled.toolDescription)
+}
+
+// defaultGuidance is the prompt guidance for tenants without their own
+const defaultGuidance = `There is only ONE table: order_items. Each row IS an order - do NOT use GROUP BY order_id.
+
+IMPORTANT - when to use GROUP BY:
+- "top N orders by price" → NO GROUP BY, just: SELECT * FROM order_items ORDER BY price DESC LIMIT N
+- "total revenue" → NO GROUP BY: SELECT SUM(price) FROM order_items
+- "revenue PER seller" or "BY seller" → USE GROUP BY: SELECT seller_id, SUM(price) FROM order_items GROUP BY seller_id
+- "how many items cost over 100 and how many under 10" → ONE query with conditional aggregates: SELECT countIf(price > 100) AS over_100, countIf(price < 10) AS under_10 FROM order_items
+
+Only use GROUP BY when the user explicitly asks for aggregation BY a dimension (per seller, by product, etc).`
+
+// generationRequest builds the Responses API request for a question with
+// prompt's profile and examples, the SQL tool constrained by grammar and
+// described by description
+func (c *OpenAIClient) generationRequest(prompt *promptState, naturalLanguage string, currentTime time.Time, grammar, description string) ResponsesRequest {
+	guidance := defaultGuidance
+	var glossary string
+	if prompt.profile != nil {
+		if prompt.profile.Prompt != "" {
+			guidance = strings.TrimSpace(prompt.profile.Prompt)
+		}
+		glossary = glossaryPrompt(prompt.profile.Glossary)
+	}
+	if glossary != "" {
+		guidance += "\n\n" + strings.TrimSpace(glossary)
+	}
+	if examples := fewShotPrompt(prompt.examples); examples != "" {
+		guidance += "\n\n" + strings.TrimSpace(examples)
+	}
+	return ResponsesRequest{
+		Model: c.model,
+		Input: fmt.Sprintf(`Convert this natural language query to a valid ClickHouse SQL query.
+
+%s
+
+%s
+
+Query: %s`,
+			guidance, referenceTimePrompt(currentTime), naturalLanguage),
+		Tools:             c.tools(grammar, description),
+		ParallelToolCalls: false,
+	}
+}
+
+// CheckModel verifies the API key and that the configured model is
+// available, using the free model-retrieval endpoint.
+func (c *OpenAIClient) CheckModel() error {
+	status, body, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", c.baseURL+"/models/"+c.model, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("openai error (%d): %s", status, string(body))
+	}
+	return nil
+}
+
+// textRequest is a plain Responses API call without tools
+type textRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+// Complete sends a free-form prompt and returns the model's text output.
+func (c *OpenAIClient) Complete(prompt string) (string, Usage, error) {
+	result, err := c.createResponse(textRequest{Model: c.model, Input: prompt})
+	if err != nil {
+		return "", Usage{}, err
 	}
 
-	return "", fmt.Errorf("no SQL generated in response")
+	var sb strings.Builder
+	for _, item := range result.Output {
+		if item.Type != "message" {
+			continue
+		}
+		for _, content := range item.Content {
+			if content.Type == "output_text" {
+				sb.WriteString(content.Text)
+			}
+		}
+	}
+	if sb.Len() == 0 {
+		return "", result.Usage, fmt.Errorf("no text in response")
+	}
+	return strings.TrimSpace(sb.String()), result.Usage, nil
+}
+
+// createResponse POSTs a request body to the Responses API
+func (c *OpenAIClient) createResponse(reqBody interface{}) (*ResponsesResponse, error) {
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	status, body, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", c.baseURL+"/responses", bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+		return req, nil
+	})
+	if err != nil {
+		if isTimeout(err) {
+			return nil, nlerrors.ErrLLMTimeout{Err: err}
+		}
+		return nil, err
+	}
+
+	if status == http.StatusTooManyRequests {
+		return nil, nlerrors.ErrRateLimited{Service: "openai"}
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("openai error (%d): %s", status, string(body))
+	}
+
+	var result ResponsesResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &result, nil
 }
@@ -0,0 +1,221 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// TestParseGeneration runs Responses API outputs recorded in
+// testdata/responses through ParseGeneration
+func TestParseGeneration(t *testing.T) {
+	const hint = "order_items: seller_id, price"
+
+	tests := []struct {
+		file       string
+		wantSQL    string
+		wantCode   nlerrors.Code
+		wantReason string
+	}{
+		{file: "sql.json", wantSQL: "SELECT seller_id, sum(price) AS revenue FROM order_items GROUP BY seller_id ORDER BY revenue DESC LIMIT 5;"},
+		{file: "cannot_answer.json", wantCode: nlerrors.CodeUnsupportedQuery, wantReason: "The schema has no weather data."},
+		{file: "cannot_answer_malformed.json", wantCode: nlerrors.CodeUnsupportedQuery, wantReason: "Query cannot be answered with available data"},
+		{file: "refusal.json", wantCode: nlerrors.CodeUnsupportedQuery, wantReason: "I can't help with that request."},
+		{file: "refusal_then_sql.json", wantSQL: "SELECT count() FROM order_items;"},
+		{file: "text_only.json", wantCode: nlerrors.CodeGrammarViolation},
+		{file: "empty_sql.json", wantCode: nlerrors.CodeGrammarViolation},
+		{file: "unsafe_literal.json", wantCode: nlerrors.CodeGrammarViolation},
+		{file: "unknown_tool.json", wantCode: nlerrors.CodeGrammarViolation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "responses", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp ResponsesResponse
+			if err := json.Unmarshal(data, &resp); err != nil {
+				t.Fatalf("recorded response doesn't decode: %v", err)
+			}
+
+			sql, err := ParseGeneration(&resp, hint)
+			if sql != tt.wantSQL {
+				t.Errorf("sql = %q, want %q", sql, tt.wantSQL)
+			}
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if code := nlerrors.CodeOf(err); code != tt.wantCode {
+				t.Fatalf("error %v has code %q, want %q", err, code, tt.wantCode)
+			}
+			var unsupported ErrUnsupportedQuery
+			if errors.As(err, &unsupported) {
+				if unsupported.Reason != tt.wantReason {
+					t.Errorf("reason = %q, want %q", unsupported.Reason, tt.wantReason)
+				}
+				if unsupported.AvailableData != hint {
+					t.Errorf("available data = %q, want the hint", unsupported.AvailableData)
+				}
+			}
+		})
+	}
+}
+
+// TestGenerationRequestGolden pins the Responses API request sent for a
+// question. Run with -update after an intended prompt or grammar change.
+func TestGenerationRequestGolden(t *testing.T) {
+	client := NewOpenAIClient(&Config{OpenAIAPIKey: "test", OpenAIModel: "gpt-5"})
+	client.SetSchema(&Schema{Datasources: []Datasource{{
+		Name:        "order_items",
+		Description: "One row per item sold",
+		Columns: []Column{
+			{Name: "seller_id", Type: "String"},
+			{Name: "price", Type: "Float64", Description: "Item price in BRL"},
+			{Name: "created_at", Type: "DateTime"},
+		},
+	}}})
+	req := client.GenerationRequest("revenue by seller", time.Date(2025, 3, 14, 9, 30, 0, 0, time.UTC))
+
+	got, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	golden := filepath.Join("testdata", "generation_request.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("generation request changed; run with -update if intended\ngot:\n%s", got)
+	}
+}
+
+// TestGenerationRequestShape checks the parts of the request the
+// Responses API contract depends on, independent of the prompt wording
+func TestGenerationRequestShape(t *testing.T) {
+	client := NewOpenAIClient(&Config{OpenAIAPIKey: "test", OpenAIModel: "gpt-5"})
+	client.SetSchema(&Schema{Datasources: []Datasource{{Name: "order_items", Columns: []Column{{Name: "price", Type: "Float64"}}}}})
+	data, err := json.Marshal(client.GenerationRequest("total revenue", time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req struct {
+		Model             string `json:"model"`
+		Input             string `json:"input"`
+		ParallelToolCalls *bool  `json:"parallel_tool_calls"`
+		Tools             []struct {
+			Type   string `json:"type"`
+			Name   string `json:"name"`
+			Format *struct {
+				Type       string `json:"type"`
+				Syntax     string `json:"syntax"`
+				Definition string `json:"definition"`
+			} `json:"format"`
+			Parameters *struct {
+				Type     string   `json:"type"`
+				Required []string `json:"required"`
+			} `json:"parameters"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Model != "gpt-5" || req.Input == "" {
+		t.Errorf("model = %q, input %q", req.Model, req.Input)
+	}
+	if req.ParallelToolCalls == nil || *req.ParallelToolCalls {
+		t.Error("parallel_tool_calls must be sent as false")
+	}
+	if len(req.Tools) != 2 {
+		t.Fatalf("got %d tools, want sql_generator and cannot_answer", len(req.Tools))
+	}
+	sqlTool, refuseTool := req.Tools[0], req.Tools[1]
+	if sqlTool.Type != "custom" || sqlTool.Name != "sql_generator" || sqlTool.Format == nil ||
+		sqlTool.Format.Type != "grammar" || sqlTool.Format.Syntax != "lark" || sqlTool.Format.Definition == "" || sqlTool.Parameters != nil {
+		t.Errorf("sql_generator tool = %s", data)
+	}
+	if refuseTool.Type != "function" || refuseTool.Name != "cannot_answer" || refuseTool.Format != nil ||
+		refuseTool.Parameters == nil || refuseTool.Parameters.Type != "object" || len(refuseTool.Parameters.Required) != 1 || refuseTool.Parameters.Required[0] != "reason" {
+		t.Errorf("cannot_answer tool = %s", data)
+	}
+}
+
+// TestSetSchemaWhileGenerating changes the prompt while other goroutines
+// generate; run with -race to catch unsynchronized state
+func TestSetSchemaWhileGenerating(t *testing.T) {
+	recorded, err := os.ReadFile(filepath.Join("testdata", "responses", "sql.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(recorded)
+	}))
+	defer server.Close()
+
+	client := NewOpenAIClient(&Config{OpenAIAPIKey: "test", OpenAIBaseURL: server.URL})
+	schemas := []*Schema{
+		{Datasources: []Datasource{{Name: "order_items", Columns: []Column{{Name: "price", Type: "Float64"}}}}},
+		{Datasources: []Datasource{{Name: "order_items", Columns: []Column{{Name: "price", Type: "Float64"}, {Name: "seller_id", Type: "String"}}}}},
+	}
+	client.SetSchema(schemas[0])
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			client.SetSchema(schemas[i%2])
+			client.SetProfile(&TenantProfile{Prompt: "Prices are in BRL."})
+			client.SetExamples([]FewShotExample{{Question: "total revenue", SQL: "SELECT sum(price) FROM order_items"}})
+			client.SetProfile(nil)
+			client.SetExamples(nil)
+		}
+	}()
+
+	var generators sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		generators.Add(1)
+		go func() {
+			defer generators.Done()
+			for i := 0; i < 20; i++ {
+				if _, err := client.Generate("revenue by seller", time.Now()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	generators.Wait()
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,238 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page size bounds for paginated queries. MAX_DEFAULT_LIMIT, when lower,
+// caps the page size too.
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// ErrInvalidPageToken is returned for a next-page token this server didn't
+// issue, that was altered, or that belongs to another API key
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// ErrPageTokenExpired is returned for a next-page token older than
+// PAGE_TOKEN_TTL
+var ErrPageTokenExpired = errors.New("page token expired; ask the question again")
+
+// PageInfo describes one page of a paginated row select
+type PageInfo struct {
+	Page     int `json:"page"`
+	PageSize int `json:"page_size"`
+	// TotalRows is the number of rows across all pages. It is exact once the
+	// last page is reached; before that it is the warehouse's estimate of
+	// rows read, an upper bound, and TotalEstimated is set. Zero and unset
+	// when the warehouse can't estimate.
+	TotalRows      int64 `json:"total_rows,omitempty"`
+	TotalEstimated bool  `json:"total_estimated,omitempty"`
+	// NextPageToken fetches the following page without generating the SQL
+	// again; empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// PageQuery is a row select split into pages: the SQL without its LIMIT,
+// plus the rows the original LIMIT allowed (0 for no LIMIT)
+type PageQuery struct {
+	SQL   string `json:"sql"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// NewPageQuery splits sql into a PageQuery. It returns false for
+// aggregates and for queries whose LIMIT can't be removed, e.g. one with
+// an OFFSET or a LIMIT in a subquery, which are not paginated.
+func NewPageQuery(sql string) (PageQuery, bool) {
+	if !IsRowSelect(sql) || strings.Contains(strings.ToUpper(blankLiterals(sql)), "OFFSET") {
+		return PageQuery{}, false
+	}
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	locs := limitValueRe.FindAllStringSubmatchIndex(blankLiterals(sql), -1)
+	switch len(locs) {
+	case 0:
+		return PageQuery{SQL: sql}, true
+	case 1:
+		m := locs[0]
+		if strings.TrimSpace(sql[m[1]:]) != "" {
+			return PageQuery{}, false
+		}
+		limit, err := strconv.Atoi(sql[m[2]:m[3]])
+		if err != nil {
+			return PageQuery{}, false
+		}
+		return PageQuery{SQL: strings.TrimSpace(sql[:m[0]]), Limit: limit}, true
+	}
+	return PageQuery{}, false
+}
+
+// Offset is the number of rows before page (1-based)
+func (q PageQuery) Offset(page, size int) int {
+	return (page - 1) * size
+}
+
+// PageSQL returns the SQL for one page. A page past the original LIMIT
+// returns no rows.
+func (q PageQuery) PageSQL(page, size int) string {
+	offset := q.Offset(page, size)
+	if q.Limit > 0 && offset+size > q.Limit {
+		size = max(q.Limit-offset, 0)
+	}
+	return fmt.Sprintf("%s LIMIT %d OFFSET %d;", q.SQL, size, offset)
+}
+
+// More reports whether rows may follow a page that returned rows rows
+func (q PageQuery) More(page, size, rows int) bool {
+	return rows >= size && (q.Limit == 0 || q.Offset(page, size)+rows < q.Limit)
+}
+
+// PageSize validates a requested page size: 0 means DefaultPageSize, and
+// the result is at most MaxPageSize and maxDefaultLimit, if positive
+func PageSize(requested, maxDefaultLimit int) (int, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("page_size must not be negative")
+	}
+	size := requested
+	if size == 0 {
+		size = DefaultPageSize
+	}
+	if size > MaxPageSize {
+		size = MaxPageSize
+	}
+	if maxDefaultLimit > 0 && size > maxDefaultLimit {
+		size = maxDefaultLimit
+	}
+	return size, nil
+}
+
+// pageToken is the signed content of a next-page token
+type pageToken struct {
+	Query         PageQuery `json:"q"`
+	Page          int       `json:"p"`
+	PageSize      int       `json:"n"`
+	Key           string    `json:"k,omitempty"`
+	SchemaVersion string    `json:"v"`
+	// OrderApplied carries the order the first page reported
+	OrderApplied []string `json:"o,omitempty"`
+	// IssuedAt is when the first page was served, in Unix seconds
+	IssuedAt int64 `json:"iat"`
+}
+
+// PageCursor is the content of a next-page token: the page to fetch and
+// what the first page was served under
+type PageCursor struct {
+	Query         PageQuery
+	Page          int
+	PageSize      int
+	SchemaVersion string
+	OrderApplied  []string
+	// IssuedAt is when the first page was served; zero for the first page
+	// itself. Later pages' tokens keep it, so paging can't extend them.
+	IssuedAt time.Time
+}
+
+// pageTokenKey is PAGE_TOKEN_SECRET, or TINYBIRD_TOKEN when it is unset:
+// either way a secret only the server holds
+func pageTokenKey(cfg *Config) []byte {
+	if cfg.PageTokenSecret != "" {
+		return []byte(cfg.PageTokenSecret)
+	}
+	return []byte("nl2sql-page-token:" + cfg.TinybirdToken)
+}
+
+// EncodePageToken signs cur, the page to fetch next, as a token. It is
+// bound to keyID, so it can't be replayed by a key with other permissions,
+// and expires PAGE_TOKEN_TTL after cur.IssuedAt (now, if unset).
+func EncodePageToken(cfg *Config, keyID string, cur PageCursor) string {
+	issued := cur.IssuedAt
+	if issued.IsZero() {
+		issued = time.Now()
+	}
+	payload, _ := json.Marshal(pageToken{
+		Query:         cur.Query,
+		Page:          cur.Page,
+		PageSize:      cur.PageSize,
+		Key:           keyID,
+		SchemaVersion: cur.SchemaVersion,
+		OrderApplied:  cur.OrderApplied,
+		IssuedAt:      issued.Unix(),
+	})
+	mac := hmac.New(sha256.New, pageTokenKey(cfg))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// DecodePageToken verifies a token from EncodePageToken for keyID. The SQL
+// in it was validated when the first page was served; the signature
+// guarantees it hasn't changed since, including the issue time, so an
+// expired token gets ErrPageTokenExpired.
+func DecodePageToken(cfg *Config, keyID, token string) (PageCursor, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return PageCursor{}, ErrInvalidPageToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return PageCursor{}, ErrInvalidPageToken
+	}
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return PageCursor{}, ErrInvalidPageToken
+	}
+	mac := hmac.New(sha256.New, pageTokenKey(cfg))
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return PageCursor{}, ErrInvalidPageToken
+	}
+
+	var tok pageToken
+	if err := json.Unmarshal(payload, &tok); err != nil || tok.Key != keyID || tok.Page < 1 || tok.PageSize < 1 || tok.IssuedAt == 0 {
+		return PageCursor{}, ErrInvalidPageToken
+	}
+	issued := time.Unix(tok.IssuedAt, 0)
+	if time.Since(issued) > cfg.PageTokenTTL {
+		return PageCursor{}, ErrPageTokenExpired
+	}
+	return PageCursor{
+		Query:         tok.Query,
+		Page:          tok.Page,
+		PageSize:      tok.PageSize,
+		SchemaVersion: tok.SchemaVersion,
+		OrderApplied:  tok.OrderApplied,
+		IssuedAt:      issued,
+	}, nil
+}
+
+// PageTotal works out PageInfo.TotalRows for a page that returned rows
+// rows: exact on the last page, otherwise the warehouse's estimate of the
+// rows the unpaginated query reads, capped by its LIMIT
+func PageTotal(warehouse Warehouse, q PageQuery, page, size, rows int) (int64, bool) {
+	offset := q.Offset(page, size)
+	if !q.More(page, size, rows) {
+		return int64(offset + rows), false
+	}
+	estimator, ok := warehouse.(RowEstimator)
+	if !ok {
+		return 0, false
+	}
+	total, err := estimator.EstimateRows(q.SQL)
+	if err != nil {
+		return 0, false
+	}
+	if q.Limit > 0 && total > int64(q.Limit) {
+		total = int64(q.Limit)
+	}
+	if min := int64(offset + rows); total < min {
+		total = min
+	}
+	return total, true
+}
@@ -0,0 +1,73 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageToken(t *testing.T) {
+	cfg := &Config{PageTokenSecret: "secret", PageTokenTTL: time.Hour}
+	cur := PageCursor{Query: PageQuery{SQL: "SELECT * FROM orders"}, Page: 2, PageSize: 10, SchemaVersion: "v1"}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		keyID   string
+		wantErr error
+	}{
+		{"fresh", func() string { return EncodePageToken(cfg, "key", cur) }, "key", nil},
+		{"other key", func() string { return EncodePageToken(cfg, "key", cur) }, "other", ErrInvalidPageToken},
+		{"expired", func() string {
+			old := cur
+			old.IssuedAt = time.Now().Add(-2 * time.Hour)
+			return EncodePageToken(cfg, "key", old)
+		}, "key", ErrPageTokenExpired},
+		{"issue time altered", func() string {
+			old := cur
+			old.IssuedAt = time.Now().Add(-2 * time.Hour)
+			encoded, sig, _ := strings.Cut(EncodePageToken(cfg, "key", old), ".")
+			payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+			var tok pageToken
+			json.Unmarshal(payload, &tok)
+			tok.IssuedAt = time.Now().Unix()
+			payload, _ = json.Marshal(tok)
+			return base64.RawURLEncoding.EncodeToString(payload) + "." + sig
+		}, "key", ErrInvalidPageToken},
+		{"other secret", func() string {
+			return EncodePageToken(&Config{PageTokenSecret: "other", PageTokenTTL: time.Hour}, "key", cur)
+		}, "key", ErrInvalidPageToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodePageToken(cfg, tt.keyID, tt.token())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodePageToken error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Page != cur.Page || got.Query != cur.Query || got.IssuedAt.IsZero()) {
+				t.Errorf("DecodePageToken = %+v, want %+v with an issue time", got, cur)
+			}
+		})
+	}
+}
+
+func TestPageTokenKeepsFirstIssueTime(t *testing.T) {
+	cfg := &Config{PageTokenSecret: "secret", PageTokenTTL: time.Hour}
+	issued := time.Now().Add(-30 * time.Minute).Truncate(time.Second)
+	first, err := DecodePageToken(cfg, "", EncodePageToken(cfg, "", PageCursor{Page: 2, PageSize: 10, IssuedAt: issued}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := first
+	next.Page++
+	second, err := DecodePageToken(cfg, "", EncodePageToken(cfg, "", next))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.IssuedAt.Equal(issued) {
+		t.Errorf("next page's token issued at %v, want the first page's %v", second.IssuedAt, issued)
+	}
+}
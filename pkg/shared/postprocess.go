@@ -0,0 +1,435 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RowProcessor transforms a result row in place before it is encoded,
+// e.g. to format a value or rename a column. It sees rows one at a time,
+// so it works for streamed results as well as buffered ones.
+type RowProcessor interface {
+	ProcessRow(row map[string]interface{})
+}
+
+// PostProcessorFactory builds a RowProcessor from one step of a
+// POSTPROCESSORS_FILE: the step's JSON object, type included
+type PostProcessorFactory func(cfg *Config, step json.RawMessage) (RowProcessor, error)
+
+var (
+	postProcessorsMu sync.RWMutex
+	postProcessors   = map[string]PostProcessorFactory{
+		"mask":     newMaskStep,
+		"currency": newCurrencyStep,
+		"rename":   newRenameStep,
+		"derive":   newDeriveStep,
+	}
+)
+
+// RegisterPostProcessor makes a processor type available to
+// POSTPROCESSORS_FILE steps. Registering a type twice replaces it, so an
+// embedder can override a built-in.
+func RegisterPostProcessor(name string, factory PostProcessorFactory) {
+	postProcessorsMu.Lock()
+	defer postProcessorsMu.Unlock()
+	postProcessors[name] = factory
+}
+
+// PostProcessorTypes returns the registered processor types, sorted
+func PostProcessorTypes() []string {
+	postProcessorsMu.RLock()
+	defer postProcessorsMu.RUnlock()
+	types := make([]string, 0, len(postProcessors))
+	for name := range postProcessors {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// postProcessorFile is a POSTPROCESSORS_FILE. A tenant with its own steps
+// gets those instead of the default ones.
+type postProcessorFile struct {
+	Default []json.RawMessage            `json:"default"`
+	Tenants map[string][]json.RawMessage `json:"tenants"`
+}
+
+// Pipeline runs the MASKED_COLUMNS masker and then a tenant's
+// POSTPROCESSORS_FILE steps, in order, over each result row. Masking comes
+// first so no step sees a sensitive value. A nil Pipeline does nothing.
+type Pipeline struct {
+	steps []RowProcessor
+	// restricted are result columns dropped before any step; see Restrict
+	restricted map[string]bool
+}
+
+// NewPipeline builds the pipeline for tenant ("" for requests without an
+// API key). The file is read on every call, like ACCESS_FILE, so edits
+// apply to the next request.
+func NewPipeline(cfg *Config, tenant string) (*Pipeline, error) {
+	p := &Pipeline{}
+	if m := NewMasker(cfg); m != nil {
+		p.steps = append(p.steps, m)
+	}
+	if cfg.PostProcessorsFile == "" {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(cfg.PostProcessorsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read post-processors: %w", err)
+	}
+	var file postProcessorFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid post-processors file %s: %w", cfg.PostProcessorsFile, err)
+	}
+	steps := file.Default
+	if tenantSteps, ok := file.Tenants[tenant]; ok && tenant != "" {
+		steps = tenantSteps
+	}
+	for i, raw := range steps {
+		step, err := newPostProcessor(cfg, raw)
+		if err != nil {
+			return nil, fmt.Errorf("post-processors file %s: step %d: %w", cfg.PostProcessorsFile, i+1, err)
+		}
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+func newPostProcessor(cfg *Config, raw json.RawMessage) (RowProcessor, error) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return nil, err
+	}
+	postProcessorsMu.RLock()
+	factory, ok := postProcessors[head.Type]
+	postProcessorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q (have %s)", head.Type, strings.Join(PostProcessorTypes(), ", "))
+	}
+	return factory(cfg, raw)
+}
+
+// ProcessRow runs every step over row
+func (p *Pipeline) ProcessRow(row map[string]interface{}) {
+	if p == nil {
+		return
+	}
+	for col := range p.restricted {
+		delete(row, col)
+	}
+	for _, step := range p.steps {
+		step.ProcessRow(row)
+	}
+}
+
+// Process runs every step over each row of result
+func (p *Pipeline) Process(result *TinybirdResponse) {
+	if p == nil || result == nil {
+		return
+	}
+	for _, row := range result.Data {
+		p.ProcessRow(row)
+	}
+	if len(p.restricted) > 0 {
+		meta := result.Meta[:0]
+		for _, col := range result.Meta {
+			if !p.restricted[col["name"]] {
+				meta = append(meta, col)
+			}
+		}
+		result.Meta = meta
+	}
+}
+
+// Restrict makes the pipeline drop result columns named after a column of
+// the tables sql references that visible leaves out, before any other step
+// sees them. It backs up CheckSchemaAccess: SQL that got past it still
+// can't return a restricted column under its own name.
+func (p *Pipeline) Restrict(sql string, full, visible *Schema) {
+	if p == nil {
+		return
+	}
+	p.restricted = restrictedResultColumns(sql, full, visible)
+}
+
+// CheckSQL rejects sql if it would get a masked column's values past a
+// masking step under another name; see Masker.CheckSQL
+func (p *Pipeline) CheckSQL(sql string) error {
+	if p == nil {
+		return nil
+	}
+	for _, step := range p.steps {
+		if m, ok := step.(*Masker); ok {
+			if err := m.CheckSQL(sql); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Unordered returns the columns results must not be ordered by: those a
+// masking step masks, whose order would hint at the hidden values, and
+// those Restrict drops
+func (p *Pipeline) Unordered() map[string]bool {
+	if p == nil {
+		return nil
+	}
+	cols := make(map[string]bool, len(p.restricted))
+	for col := range p.restricted {
+		cols[col] = true
+	}
+	for _, step := range p.steps {
+		if m, ok := step.(*Masker); ok {
+			for col := range m.rules {
+				cols[col] = true
+			}
+		}
+	}
+	return cols
+}
+
+// MaskedColumns returns the names of the columns masked so far by
+// MASKED_COLUMNS or a mask step, sorted
+func (p *Pipeline) MaskedColumns() []string {
+	if p == nil {
+		return nil
+	}
+	var cols []string
+	for _, step := range p.steps {
+		if m, ok := step.(*Masker); ok {
+			for _, col := range m.Columns() {
+				cols = appendUnique(cols, col)
+			}
+		}
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// ProcessRow masks row; it makes Masker a RowProcessor
+func (m *Masker) ProcessRow(row map[string]interface{}) {
+	m.MaskRow(row)
+}
+
+// newMaskStep masks columns on top of MASKED_COLUMNS, in the same format:
+//
+//	{"type": "mask", "columns": "customer_email=mask,seller_id"}
+func newMaskStep(cfg *Config, step json.RawMessage) (RowProcessor, error) {
+	var opts struct {
+		Columns string `json:"columns"`
+	}
+	if err := json.Unmarshal(step, &opts); err != nil {
+		return nil, err
+	}
+	rules, err := parseMaskSpec(opts.Columns)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("mask: columns is required")
+	}
+	return &Masker{rules: rules, salt: cfg.MaskingSalt, masked: make(map[string]bool)}, nil
+}
+
+// currencySymbols are prefixed to formatted amounts; other currencies get
+// their code and a space
+var currencySymbols = map[string]string{
+	"USD": "$", "EUR": "€", "GBP": "£", "BRL": "R$", "JPY": "¥",
+}
+
+// currencyStep formats numeric columns as money, e.g. 1234.5 as "R$1,234.50"
+type currencyStep struct {
+	columns  []string
+	prefix   string
+	decimals int
+}
+
+// newCurrencyStep reads
+//
+//	{"type": "currency", "columns": ["price"], "currency": "BRL", "decimals": 2}
+//
+// decimals defaults to 2
+func newCurrencyStep(cfg *Config, step json.RawMessage) (RowProcessor, error) {
+	var opts struct {
+		Columns  []string `json:"columns"`
+		Currency string   `json:"currency"`
+		Decimals *int     `json:"decimals"`
+	}
+	if err := json.Unmarshal(step, &opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Columns) == 0 || opts.Currency == "" {
+		return nil, fmt.Errorf("currency: columns and currency are required")
+	}
+	s := &currencyStep{columns: opts.Columns, decimals: 2}
+	if opts.Decimals != nil {
+		if *opts.Decimals < 0 || *opts.Decimals > 6 {
+			return nil, fmt.Errorf("currency: decimals must be between 0 and 6")
+		}
+		s.decimals = *opts.Decimals
+	}
+	code := strings.ToUpper(opts.Currency)
+	if symbol, ok := currencySymbols[code]; ok {
+		s.prefix = symbol
+	} else {
+		s.prefix = code + " "
+	}
+	return s, nil
+}
+
+func (s *currencyStep) ProcessRow(row map[string]interface{}) {
+	for _, col := range s.columns {
+		n, ok := numericValue(row[col])
+		if !ok {
+			continue
+		}
+		sign := ""
+		if n < 0 {
+			sign, n = "-", -n
+		}
+		row[col] = sign + s.prefix + groupThousands(strconv.FormatFloat(n, 'f', s.decimals, 64))
+	}
+}
+
+// groupThousands adds commas to the integer part of a formatted number
+func groupThousands(num string) string {
+	whole, frac, hasFrac := strings.Cut(num, ".")
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	if hasFrac {
+		b.WriteString("." + frac)
+	}
+	return b.String()
+}
+
+// renameStep replaces column names with friendly labels
+type renameStep struct {
+	columns map[string]string
+}
+
+// newRenameStep reads
+//
+//	{"type": "rename", "columns": {"sum(price)": "Revenue"}}
+func newRenameStep(cfg *Config, step json.RawMessage) (RowProcessor, error) {
+	var opts struct {
+		Columns map[string]string `json:"columns"`
+	}
+	if err := json.Unmarshal(step, &opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Columns) == 0 {
+		return nil, fmt.Errorf("rename: columns is required")
+	}
+	return &renameStep{columns: opts.Columns}, nil
+}
+
+func (s *renameStep) ProcessRow(row map[string]interface{}) {
+	for from, to := range s.columns {
+		if v, ok := row[from]; ok {
+			delete(row, from)
+			row[to] = v
+		}
+	}
+}
+
+// deriveExprRe is an operand, an arithmetic operator and an operand, each
+// operand a column name or a number
+var deriveExprRe = regexp.MustCompile(`^\s*(\S+)\s*([-+*/])\s*(\S+)\s*$`)
+
+// deriveStep adds a column computed from two others or a constant
+type deriveStep struct {
+	column      string
+	left, right string
+	op          byte
+}
+
+// newDeriveStep reads
+//
+//	{"type": "derive", "column": "total", "expr": "price + freight_value"}
+//
+// expr is one binary operation (+, -, * or /) on columns or numbers. The
+// column is null when an operand is missing or not a number.
+func newDeriveStep(cfg *Config, step json.RawMessage) (RowProcessor, error) {
+	var opts struct {
+		Column string `json:"column"`
+		Expr   string `json:"expr"`
+	}
+	if err := json.Unmarshal(step, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Column == "" {
+		return nil, fmt.Errorf("derive: column is required")
+	}
+	m := deriveExprRe.FindStringSubmatch(opts.Expr)
+	if m == nil {
+		return nil, fmt.Errorf("derive: expr %q must be <operand> <+|-|*|/> <operand>", opts.Expr)
+	}
+	return &deriveStep{column: opts.Column, left: m[1], op: m[2][0], right: m[3]}, nil
+}
+
+func (s *deriveStep) ProcessRow(row map[string]interface{}) {
+	a, aok := s.operand(row, s.left)
+	b, bok := s.operand(row, s.right)
+	if !aok || !bok {
+		row[s.column] = nil
+		return
+	}
+	var v float64
+	switch s.op {
+	case '+':
+		v = a + b
+	case '-':
+		v = a - b
+	case '*':
+		v = a * b
+	case '/':
+		if b == 0 {
+			row[s.column] = nil
+			return
+		}
+		v = a / b
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		row[s.column] = nil
+		return
+	}
+	row[s.column] = v
+}
+
+func (s *deriveStep) operand(row map[string]interface{}, name string) (float64, bool) {
+	if v, ok := row[name]; ok {
+		return numericValue(v)
+	}
+	n, err := strconv.ParseFloat(name, 64)
+	return n, err == nil
+}
+
+// numericValue reads a number from a result value. ClickHouse quotes 64-bit
+// integers in JSON, so numeric strings count.
+func numericValue(v interface{}) (float64, bool) {
+	if n, ok := toFloat(v); ok {
+		return n, true
+	}
+	if s, ok := v.(string); ok {
+		n, err := strconv.ParseFloat(s, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
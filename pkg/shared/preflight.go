@@ -0,0 +1,82 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PreflightCheck is the outcome of one start-up check
+type PreflightCheck struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// Preflight checks that a deployment's credentials work end to end: the
+// warehouse runs SELECT 1 and lists a schema, and the model generates SQL
+// for a trivial question. It costs one small generation, so a wrong key,
+// host or model is caught without running the eval suite. The generation
+// is skipped if the schema can't be fetched.
+func Preflight(generator SchemaGenerator, warehouse Warehouse) []PreflightCheck {
+	var checks []PreflightCheck
+	run := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		checks = append(checks, PreflightCheck{Name: name, Duration: time.Since(start), Err: err})
+		return err == nil
+	}
+
+	run("tinybird: SELECT 1", func() error {
+		_, err := warehouse.ExecuteQuery("SELECT 1")
+		return err
+	})
+
+	var schema *Schema
+	if !run("tinybird: fetch schema", func() error {
+		var err error
+		if schema, err = warehouse.FetchSchema(); err != nil {
+			return err
+		}
+		if len(schema.Datasources) == 0 {
+			return fmt.Errorf("token can't see any datasources")
+		}
+		return nil
+	}) {
+		return checks
+	}
+
+	run(fmt.Sprintf("model: generate SQL for %q", PreflightQuestion(schema)), func() error {
+		return CheckGeneration(generator, schema)
+	})
+	return checks
+}
+
+// PreflightQuestion is the trivial question CheckGeneration asks: a row
+// count of the first datasource by name
+func PreflightQuestion(schema *Schema) string {
+	return SmokeEvalCases(schema)[0].Query
+}
+
+// CheckGeneration asks generator PreflightQuestion against schema, which
+// must have a datasource. A refusal passes, since the model still answered.
+func CheckGeneration(generator SchemaGenerator, schema *Schema) error {
+	generator.SetSchema(schema)
+	_, err := generator.Generate(PreflightQuestion(schema), time.Now().UTC())
+	var unsupportedErr ErrUnsupportedQuery
+	if errors.As(err, &unsupportedErr) {
+		return nil
+	}
+	return err
+}
+
+// PreflightError joins the failed checks into one error, or returns nil
+func PreflightError(checks []PreflightCheck) error {
+	var errs []error
+	for _, c := range checks {
+		if c.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, c.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"encoding/json"
+	"unicode"
+)
+
+// modelInputTokens is each model's input context window. Unknown models
+// get gpt-5's.
+var modelInputTokens = map[string]int{
+	"gpt-5":      272_000,
+	"gpt-5-mini": 272_000,
+	"gpt-5-nano": 272_000,
+}
+
+// EstimateTokens approximates how many tokens text encodes to without the
+// model's tokenizer: a word costs a token per four characters and every
+// other symbol costs one. Grammars are mostly symbols, so this errs high
+// where a chars/4 rule would err low.
+func EstimateTokens(text string) int {
+	tokens, word := 0, 0
+	flush := func() {
+		tokens += (word + 3) / 4
+		word = 0
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			word++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
+
+// EstimatePromptTokens approximates the input tokens of a generation
+// request: the prompt and the tool definitions, grammar included
+func EstimatePromptTokens(req ResponsesRequest) int {
+	tools, _ := json.Marshal(req.Tools)
+	return EstimateTokens(req.Input) + EstimateTokens(string(tools))
+}
+
+// PromptTokenLimit is the largest prompt Generate sends: MAX_PROMPT_TOKENS
+// when set, otherwise the model's input context window
+func PromptTokenLimit(model string, maxPromptTokens int) int {
+	if maxPromptTokens > 0 {
+		return maxPromptTokens
+	}
+	if limit, ok := modelInputTokens[model]; ok {
+		return limit
+	}
+	return modelInputTokens[DefaultModel]
+}
+
+// withoutDescriptions returns a copy of s without datasource, column and
+// metric descriptions, the part of the prompt that can go without losing
+// the ability to answer
+func (s *Schema) withoutDescriptions() *Schema {
+	out := &Schema{Relationships: s.Relationships, Aggregates: s.Aggregates}
+	for _, ds := range s.Datasources {
+		stripped := Datasource{Name: ds.Name, Partial: ds.Partial}
+		for _, col := range ds.Columns {
+			stripped.Columns = append(stripped.Columns, Column{Name: col.Name, Type: col.Type})
+		}
+		out.Datasources = append(out.Datasources, stripped)
+	}
+	for _, m := range s.Metrics {
+		m.Description = ""
+		out.Metrics = append(out.Metrics, m)
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		peer    string
+		xff     []string
+		want    string
+	}{
+		{"no proxies trusted", "", "203.0.113.9:4000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"untrusted peer", "10.0.0.0/8", "203.0.113.9:4000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"trusted peer", "10.0.0.0/8", "10.1.2.3:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed hop before the client", "10.0.0.0/8", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.0/8,192.0.2.1", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.7, 192.0.2.1, 10.9.9.9"}, "198.51.100.7"},
+		{"repeated headers", "10.0.0.0/8", "10.1.2.3:4000", []string{"1.2.3.4", "198.51.100.7"}, "198.51.100.7"},
+		{"only trusted hops", "10.0.0.0/8", "10.1.2.3:4000", []string{"10.0.0.5"}, "10.0.0.5"},
+		{"trusted peer without header", "10.0.0.0/8", "10.1.2.3:4000", nil, "10.1.2.3"},
+		{"single trusted IP", "::1", "[::1]:4000", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := ParseTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/api/query", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := ClientIP(r, trusted); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsGarbage(t *testing.T) {
+	for _, spec := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0.1,nope"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// QueryTagOff disables QUERY_TAG
+const QueryTagOff = "off"
+
+// QueryTag says who a warehouse query runs for. TinybirdClient sends it as
+// ClickHouse's log_comment setting, so warehouse query logs and billing
+// can be attributed to this service, a request and a tenant.
+type QueryTag struct {
+	App       string `json:"app"`
+	RequestID string `json:"request_id,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+// QueryTagger is a Warehouse that can tag the queries it sends with the
+// request they serve
+type QueryTagger interface {
+	TagQueries(requestID, tenant string)
+}
+
+// tagUnsafeRe matches what can't go in a tag. Request IDs come from
+// callers, so anything that could end the quoted setting value is dropped.
+var tagUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9_.:@/-]`)
+
+// comment renders the tag as a JSON log_comment, or "" if tagging is off
+func (t QueryTag) comment() string {
+	if t.App == "" || t.App == QueryTagOff {
+		return ""
+	}
+	t.App = tagUnsafeRe.ReplaceAllString(t.App, "")
+	t.RequestID = tagUnsafeRe.ReplaceAllString(t.RequestID, "")
+	t.Tenant = tagUnsafeRe.ReplaceAllString(t.Tenant, "")
+	b, _ := json.Marshal(t)
+	return string(b)
+}
+
+// TagQueries adds requestID and tenant to the tag sent with every query
+func (c *TinybirdClient) TagQueries(requestID, tenant string) {
+	c.tag.RequestID, c.tag.Tenant = requestID, tenant
+}
+
+// tagSettings returns settings plus the log_comment carrying the tag
+func (c *TinybirdClient) tagSettings(settings []ClickHouseSetting) []ClickHouseSetting {
+	comment := c.tag.comment()
+	if comment == "" {
+		return settings
+	}
+	tagged := make([]ClickHouseSetting, 0, len(settings)+1)
+	tagged = append(tagged, settings...)
+	return append(tagged, ClickHouseSetting{Name: "log_comment", Value: comment})
+}
+
+// QuestionTagger is a Warehouse that can prefix the queries it runs with
+// the question they answer, when QUERY_COMMENT is on
+type QuestionTagger interface {
+	TagQuestion(question string)
+}
+
+// maxQuestionComment bounds the question in a QUERY_COMMENT, in runes
+const maxQuestionComment = 200
+
+// TagQuestion sets the question executed queries are prefixed with
+func (c *TinybirdClient) TagQuestion(question string) {
+	c.question = question
+}
+
+// questionComment renders the question as a comment to put before the
+// SQL, or "" if QUERY_COMMENT is off. The question is the caller's text,
+// so it goes on one line, without anything that would end the comment or
+// open a nested one, and is cut to maxQuestionComment runes.
+func (c *TinybirdClient) questionComment() string {
+	if !c.comment {
+		return ""
+	}
+	question := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, c.question)
+	question = strings.Join(strings.Fields(question), " ")
+	for strings.Contains(question, "*/") || strings.Contains(question, "/*") {
+		question = strings.NewReplacer("*/", "* /", "/*", "/ *").Replace(question)
+	}
+	if runes := []rune(question); len(runes) > maxQuestionComment {
+		question = string(runes[:maxQuestionComment]) + "..."
+	}
+	if question == "" {
+		return ""
+	}
+	return "/* question: " + question + " */ "
+}
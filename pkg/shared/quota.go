@@ -0,0 +1,200 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// Quota caps an API key's usage per UTC day and month. Zero means no limit.
+// Tokens are input plus output tokens.
+type Quota struct {
+	DailyQueries   int `json:"daily_queries,omitempty"`
+	MonthlyQueries int `json:"monthly_queries,omitempty"`
+	DailyTokens    int `json:"daily_tokens,omitempty"`
+	MonthlyTokens  int `json:"monthly_tokens,omitempty"`
+}
+
+// QuotaCounter is usage against one limit
+type QuotaCounter struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit,omitempty"`
+	// Remaining is only set when there is a limit
+	Remaining *int `json:"remaining,omitempty"`
+}
+
+func newQuotaCounter(used, limit int) QuotaCounter {
+	c := QuotaCounter{Used: used, Limit: limit}
+	if limit > 0 {
+		remaining := max(limit-used, 0)
+		c.Remaining = &remaining
+	}
+	return c
+}
+
+// QuotaPeriod is usage in the current day or month
+type QuotaPeriod struct {
+	Queries  QuotaCounter `json:"queries"`
+	Tokens   QuotaCounter `json:"tokens"`
+	ResetsAt time.Time    `json:"resets_at"`
+}
+
+// QuotaStatus is an API key's usage against its quota
+type QuotaStatus struct {
+	Day   QuotaPeriod `json:"day"`
+	Month QuotaPeriod `json:"month"`
+}
+
+// Check returns nlerrors.ErrQuotaExceeded for the first exhausted limit
+func (s *QuotaStatus) Check() error {
+	for _, p := range []struct {
+		name   string
+		period QuotaPeriod
+	}{{"day", s.Day}, {"month", s.Month}} {
+		for _, c := range []struct {
+			measure string
+			counter QuotaCounter
+		}{{"queries", p.period.Queries}, {"tokens", p.period.Tokens}} {
+			if c.counter.Limit > 0 && c.counter.Used >= c.counter.Limit {
+				return nlerrors.ErrQuotaExceeded{Measure: c.measure, Period: p.name, Limit: c.counter.Limit, ResetsAt: p.period.ResetsAt}
+			}
+		}
+	}
+	return nil
+}
+
+// keyUsage is one API key's usage in its latest UTC day and month
+type keyUsage struct {
+	day, month  string
+	dayTotals   UsageTotals
+	monthTotals UsageTotals
+}
+
+func (k *keyUsage) add(rec UsageRecord) {
+	day := rec.Time.UTC().Format("2006-01-02")
+	month := day[:7]
+	if month > k.month {
+		k.month, k.monthTotals = month, UsageTotals{}
+	}
+	if day > k.day {
+		k.day, k.dayTotals = day, UsageTotals{}
+	}
+	if month == k.month {
+		k.monthTotals.add(rec)
+	}
+	if day == k.day {
+		k.dayTotals.add(rec)
+	}
+}
+
+// QuotaStatus returns key's usage in now's UTC day and month against
+// quota. With a USAGE_FILE it counts every instance's requests: the file is
+// read incrementally from where the last call stopped, so usage survives
+// restarts and is shared by instances appending to the same file. Without
+// one only this instance's requests count.
+func (l *UsageLedger) QuotaStatus(key string, quota Quota, now time.Time, path string) (*QuotaStatus, error) {
+	now = now.UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var usage keyUsage
+	if l != nil {
+		l.mu.Lock()
+		err := l.syncQuota(path)
+		if k := l.quotaUsage[key]; k != nil {
+			usage = *k
+		}
+		l.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var day, month UsageTotals
+	if usage.day == dayStart.Format("2006-01-02") {
+		day = usage.dayTotals
+	}
+	if usage.month == monthStart.Format("2006-01") {
+		month = usage.monthTotals
+	}
+	return &QuotaStatus{
+		Day: QuotaPeriod{
+			Queries:  newQuotaCounter(day.Requests, quota.DailyQueries),
+			Tokens:   newQuotaCounter(day.InputTokens+day.OutputTokens, quota.DailyTokens),
+			ResetsAt: dayStart.AddDate(0, 0, 1),
+		},
+		Month: QuotaPeriod{
+			Queries:  newQuotaCounter(month.Requests, quota.MonthlyQueries),
+			Tokens:   newQuotaCounter(month.InputTokens+month.OutputTokens, quota.MonthlyTokens),
+			ResetsAt: monthStart.AddDate(0, 1, 0),
+		},
+	}, nil
+}
+
+// countQuota adds rec to its key's usage. Callers hold l.mu.
+func (l *UsageLedger) countQuota(rec UsageRecord) {
+	if rec.Key == "" {
+		return
+	}
+	if l.quotaUsage == nil {
+		l.quotaUsage = make(map[string]*keyUsage)
+	}
+	k := l.quotaUsage[rec.Key]
+	if k == nil {
+		k = &keyUsage{}
+		l.quotaUsage[rec.Key] = k
+	}
+	k.add(rec)
+}
+
+// syncQuota counts records appended to path since the last call. A
+// different path, or a file that shrank, starts the count over. Callers
+// hold l.mu.
+func (l *UsageLedger) syncQuota(path string) error {
+	if path != l.quotaPath {
+		l.quotaPath, l.quotaOffset, l.quotaUsage = path, 0, nil
+	}
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open usage file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat usage file: %w", err)
+	}
+	if info.Size() < l.quotaOffset {
+		l.quotaOffset, l.quotaUsage = 0, nil
+	}
+	if _, err := f.Seek(l.quotaOffset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read usage file: %w", err)
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A partial last line is still being written; read it next time
+			break
+		}
+		l.quotaOffset += int64(len(line))
+		var rec UsageRecord
+		if json.Unmarshal(line, &rec) == nil {
+			l.countQuota(rec)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxRefusalRecords bounds the in-memory log when no REFUSALS_FILE is set
+const maxRefusalRecords = 10_000
+
+// RefusalRecord is one question the model declined to answer
+type RefusalRecord struct {
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Question string    `json:"question"`
+	Reason   string    `json:"reason"`
+}
+
+// RefusedQuestion is a question refused Count times, differing at most in
+// case, punctuation and spacing
+type RefusedQuestion struct {
+	Question string    `json:"question"`
+	Count    int       `json:"count"`
+	Reasons  []string  `json:"reasons"`
+	Tenants  []string  `json:"tenants,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// RefusalTerm is a word that appears in Count refused questions
+type RefusalTerm struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// RefusalReport summarizes refusals since a point in time, most common
+// first. Terms are the words refused questions share most, which point at
+// the datasources or metrics worth adding.
+type RefusalReport struct {
+	Since     time.Time         `json:"since"`
+	Total     int               `json:"total"`
+	Questions []RefusedQuestion `json:"questions"`
+	Terms     []RefusalTerm     `json:"terms"`
+}
+
+// RefusalLog records refused questions. Like UsageLedger it keeps recent
+// records in memory unless given a file, in which case every record is
+// appended as a JSON line and reports read the file. Safe for concurrent
+// use.
+type RefusalLog struct {
+	mu      sync.Mutex
+	records []RefusalRecord
+}
+
+func NewRefusalLog() *RefusalLog {
+	return &RefusalLog{}
+}
+
+// Record stores rec, appending it to path when path is non-empty. A nil
+// log ignores the record.
+func (l *RefusalLog) Record(rec RefusalRecord, path string) error {
+	if l == nil {
+		return nil
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if path == "" {
+		l.records = append(l.records, rec)
+		if len(l.records) > maxRefusalRecords {
+			l.records = append([]RefusalRecord(nil), l.records[len(l.records)-maxRefusalRecords:]...)
+		}
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal refusal: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open refusals file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write refusals file: %w", err)
+	}
+	return nil
+}
+
+// Report groups refusals at or after since, reading path when it is
+// non-empty, and keeps the top questions and terms
+func (l *RefusalLog) Report(since time.Time, top int, path string) (*RefusalReport, error) {
+	records, err := l.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RefusalReport{Since: since, Questions: []RefusedQuestion{}, Terms: []RefusalTerm{}}
+	questions := make(map[string]*RefusedQuestion)
+	terms := make(map[string]int)
+	for _, rec := range records {
+		if rec.Time.Before(since) {
+			continue
+		}
+		report.Total++
+
+		words := refusalWords(rec.Question)
+		key := strings.Join(words, " ")
+		q := questions[key]
+		if q == nil {
+			q = &RefusedQuestion{Question: rec.Question}
+			questions[key] = q
+		}
+		for _, w := range uniqueStrings(words) {
+			if !stopWords[w] {
+				terms[w]++
+			}
+		}
+		q.Count++
+		q.Reasons = appendUnique(q.Reasons, rec.Reason)
+		if rec.Tenant != "" {
+			q.Tenants = appendUnique(q.Tenants, rec.Tenant)
+		}
+		if rec.Time.After(q.LastSeen) {
+			q.LastSeen = rec.Time
+			q.Question = rec.Question
+		}
+	}
+
+	for _, q := range questions {
+		report.Questions = append(report.Questions, *q)
+	}
+	sort.Slice(report.Questions, func(i, j int) bool {
+		a, b := report.Questions[i], report.Questions[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	if len(report.Questions) > top {
+		report.Questions = report.Questions[:top]
+	}
+
+	for term, count := range terms {
+		report.Terms = append(report.Terms, RefusalTerm{Term: term, Count: count})
+	}
+	sort.Slice(report.Terms, func(i, j int) bool {
+		a, b := report.Terms[i], report.Terms[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Term < b.Term
+	})
+	if len(report.Terms) > top {
+		report.Terms = report.Terms[:top]
+	}
+	return report, nil
+}
+
+// load returns the in-memory records, or every record in path
+func (l *RefusalLog) load(path string) ([]RefusalRecord, error) {
+	if path == "" {
+		if l == nil {
+			return nil, nil
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return append([]RefusalRecord(nil), l.records...), nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open refusals file: %w", err)
+	}
+	defer f.Close()
+
+	var records []RefusalRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec RefusalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Skip a line torn by a crash mid-write rather than fail the report
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read refusals file: %w", err)
+	}
+	return records, nil
+}
+
+// refusalWords lower-cases question and splits it into words, dropping
+// punctuation, so rephrasings that differ only in those group together
+func refusalWords(question string) []string {
+	return strings.FieldsFunc(strings.ToLower(question), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+func uniqueStrings(values []string) []string {
+	var out []string
+	for _, v := range values {
+		out = appendUnique(out, v)
+	}
+	return out
+}
+
+func appendUnique(values []string, v string) []string {
+	for _, existing := range values {
+		if existing == v {
+			return values
+		}
+	}
+	return append(values, v)
+}
+
+// stopWords are left out of RefusalReport.Terms
+var stopWords = map[string]bool{
+	"a": true, "about": true, "all": true, "an": true, "and": true, "are": true,
+	"as": true, "at": true, "by": true, "can": true, "do": true, "does": true,
+	"each": true, "for": true, "from": true, "get": true, "give": true, "has": true,
+	"have": true, "how": true, "i": true, "in": true, "is": true, "it": true,
+	"many": true, "me": true, "much": true, "my": true, "of": true, "on": true,
+	"or": true, "our": true, "per": true, "show": true, "the": true, "there": true,
+	"to": true, "was": true, "we": true, "were": true, "what": true, "when": true,
+	"where": true, "which": true, "who": true, "why": true, "with": true, "you": true,
+}
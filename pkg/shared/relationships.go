@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Relationship is a joinable pair of columns: From.FromColumn references
+// To.ToColumn
+type Relationship struct {
+	From       string `json:"from"`
+	FromColumn string `json:"from_column"`
+	To         string `json:"to"`
+	ToColumn   string `json:"to_column"`
+	// Declared is set for relationships from SCHEMA_RELATIONSHIPS rather
+	// than inferred from column names
+	Declared bool `json:"declared,omitempty"`
+}
+
+func (r Relationship) String() string {
+	return r.From + "." + r.FromColumn + " = " + r.To + "." + r.ToColumn
+}
+
+// ParseRelationships parses SCHEMA_RELATIONSHIPS, a comma-separated list of
+// foreign keys such as "order_items.order_id=orders.order_id"
+func ParseRelationships(spec string) ([]Relationship, error) {
+	var rels []Relationship
+	for _, entry := range splitList(spec) {
+		from, to, ok := strings.Cut(entry, "=")
+		fromTable, fromCol, ok1 := strings.Cut(strings.TrimSpace(from), ".")
+		toTable, toCol, ok2 := strings.Cut(strings.TrimSpace(to), ".")
+		if !ok || !ok1 || !ok2 || fromTable == "" || fromCol == "" || toTable == "" || toCol == "" {
+			return nil, fmt.Errorf("invalid relationship %q (want table.column=table.column)", entry)
+		}
+		rels = append(rels, Relationship{From: fromTable, FromColumn: fromCol, To: toTable, ToColumn: toCol, Declared: true})
+	}
+	return rels, nil
+}
+
+// InferRelationships returns the declared relationships that exist in
+// schema plus those implied by column names. A column named x_id is taken
+// to reference the table named x (or its plural) when that table has an
+// x_id or id column of the same type; an x_id shared by tables without
+// such an owner links them to each other. Declared relationships win over
+// inferred ones between the same tables.
+func InferRelationships(schema *Schema, declared []Relationship) []Relationship {
+	types := schemaColumns(schema)
+	var rels []Relationship
+	linked := make(map[[2]string]bool)
+	link := func(r Relationship) {
+		a, b := r.From, r.To
+		if a > b {
+			a, b = b, a
+		}
+		if linked[[2]string{a, b}] {
+			return
+		}
+		linked[[2]string{a, b}] = true
+		rels = append(rels, r)
+	}
+
+	for _, r := range declared {
+		if _, ok := types[r.From][r.FromColumn]; !ok {
+			continue
+		}
+		if _, ok := types[r.To][r.ToColumn]; !ok {
+			continue
+		}
+		link(r)
+	}
+
+	// Tables holding each *_id column
+	holders := make(map[string][]string)
+	for _, ds := range schema.Datasources {
+		for _, col := range ds.Columns {
+			if strings.HasSuffix(col.Name, "_id") && len(col.Name) > len("_id") {
+				holders[col.Name] = append(holders[col.Name], ds.Name)
+			}
+		}
+	}
+	keys := make([]string, 0, len(holders))
+	for key := range holders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tables := holders[key]
+		sort.Strings(tables)
+		owner, ownerCol := keyOwner(schema, strings.TrimSuffix(key, "_id"), key, types)
+		for i, table := range tables {
+			if owner != "" {
+				if table != owner && joinableTypes(types[table][key], types[owner][ownerCol]) {
+					link(Relationship{From: table, FromColumn: key, To: owner, ToColumn: ownerCol})
+				}
+				continue
+			}
+			for _, other := range tables[i+1:] {
+				if joinableTypes(types[table][key], types[other][key]) {
+					link(Relationship{From: table, FromColumn: key, To: other, ToColumn: key})
+				}
+			}
+		}
+	}
+	return rels
+}
+
+// keyOwner finds the table an x_id column refers to and its key column
+func keyOwner(schema *Schema, entity, key string, types map[string]map[string]string) (string, string) {
+	for _, ds := range schema.Datasources {
+		name := strings.ToLower(ds.Name)
+		if name != entity && name != entity+"s" && name != entity+"es" &&
+			!(strings.HasSuffix(entity, "y") && name == strings.TrimSuffix(entity, "y")+"ies") {
+			continue
+		}
+		for _, col := range []string{key, "id"} {
+			if _, ok := types[ds.Name][col]; ok {
+				return ds.Name, col
+			}
+		}
+	}
+	return "", ""
+}
+
+// joinableTypes compares column types ignoring Nullable and LowCardinality
+func joinableTypes(a, b string) bool {
+	return baseType(a) == baseType(b)
+}
+
+// GenerateJoinGrammar returns Lark rules for a JOIN clause whose ON
+// condition can only be one of the schema's relationships. GenerateGrammar
+// doesn't include them yet: select_stmt, the validator and the column
+// rules need to accept joins and qualified names first. It returns "" when
+// there are no relationships.
+func (s *Schema) GenerateJoinGrammar() string {
+	if len(s.Relationships) == 0 {
+		return ""
+	}
+	conditions := make([]string, 0, len(s.Relationships))
+	for _, r := range s.Relationships {
+		conditions = append(conditions, fmt.Sprintf(`"%s"`, r.String()))
+	}
+	sort.Strings(conditions)
+	return fmt.Sprintf("join_clause: \"JOIN\" SP table SP \"ON\" SP join_condition\njoin_condition: %s\n", strings.Join(conditions, " | "))
+}
@@ -0,0 +1,135 @@
+package shared
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// ConfigReloader holds the live configuration of a long-running process and
+// re-resolves it on demand. Only settings marked Reloadable are applied;
+// changes to anything else are logged and ignored until restart.
+type ConfigReloader struct {
+	load    func() (*Config, error)
+	current atomic.Pointer[Config]
+
+	mu          sync.Mutex
+	subscribers []func(*Config)
+}
+
+// NewConfigReloader loads the initial configuration with load
+func NewConfigReloader(load func() (*Config, error)) (*ConfigReloader, error) {
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r := &ConfigReloader{load: load}
+	r.current.Store(cfg)
+	return r, nil
+}
+
+// Config returns the current configuration. Treat it as read-only.
+func (r *ConfigReloader) Config() *Config {
+	return r.current.Load()
+}
+
+// OnReload registers fn to be called with the new config after each
+// reload that applied at least one change.
+func (r *ConfigReloader) OnReload(fn func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers = append(r.subscribers, fn)
+}
+
+// ConfigChange is one applied or rejected setting change
+type ConfigChange struct {
+	Key     string `json:"key"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	Applied bool   `json:"applied"`
+}
+
+// Reload re-reads all sources and applies reloadable changes. Every change
+// is written to the audit log. An invalid configuration leaves the current
+// one in place.
+func (r *ConfigReloader) Reload() ([]ConfigChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		slog.Error("Config reload rejected", "audit", true, "error", err)
+		return nil, err
+	}
+
+	old := r.current.Load()
+	updated := *old
+	var changes []ConfigChange
+	for _, f := range configFields {
+		before, after := f.get(old), f.get(next)
+		if before == after {
+			continue
+		}
+		change := ConfigChange{Key: f.Key, Old: before, New: after, Applied: f.Reloadable}
+		if f.Secret {
+			change.Old, change.New = redact(before), redact(after)
+		}
+		if f.Reloadable {
+			if err := f.set(&updated, after); err != nil {
+				return nil, err
+			}
+			slog.Info("Config change applied", "audit", true, "key", f.Key, "old", change.Old, "new", change.New)
+		} else {
+			slog.Warn("Config change requires restart", "audit", true, "key", f.Key, "old", change.Old, "new", change.New)
+		}
+		changes = append(changes, change)
+	}
+
+	applied := false
+	for _, c := range changes {
+		applied = applied || c.Applied
+	}
+	if !applied {
+		slog.Info("Config reloaded", "audit", true, "changes", 0)
+		return changes, nil
+	}
+
+	r.current.Store(&updated)
+	for _, fn := range r.subscribers {
+		fn(&updated)
+	}
+	return changes, nil
+}
+
+// ReloadOnSIGHUP reloads the configuration on every SIGHUP until ctx is done
+func (r *ConfigReloader) ReloadOnSIGHUP(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				slog.Info("SIGHUP received, reloading config")
+				r.Reload()
+			}
+		}
+	}()
+}
+
+// redact masks all but the last four characters of a secret
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
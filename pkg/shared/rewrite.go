@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxRewrites bounds the alternative questions offered for a refusal
+const maxRewrites = 3
+
+const rewritePrompt = `A user asked a data analytics tool a question it cannot answer with the tables below. The refusal reason was: %s
+
+Propose up to %d alternative questions, as close as possible to what the user wanted, that CAN be answered using only these tables and columns. Return one question per line, with no numbering or extra text. If nothing close is answerable, return nothing.
+
+Tables:
+%s
+Question: %s`
+
+// SuggestRewrites asks the model for up to three answerable questions
+// close to one that was refused. Suggestions that repeat the question are
+// dropped.
+func SuggestRewrites(llm Completer, question, reason string, schema *Schema) ([]string, Usage, error) {
+	var tables strings.Builder
+	for _, ds := range schema.Datasources {
+		cols := make([]string, len(ds.Columns))
+		for i, c := range ds.Columns {
+			cols[i] = c.Name + " " + c.Type
+		}
+		fmt.Fprintf(&tables, "- %s(%s)\n", ds.Name, strings.Join(cols, ", "))
+	}
+
+	text, usage, err := llm.Complete(fmt.Sprintf(rewritePrompt, reason, maxRewrites, tables.String(), question))
+	if err != nil {
+		return nil, usage, err
+	}
+	var rewrites []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*0123456789.) "))
+		if line == "" || strings.EqualFold(line, question) {
+			continue
+		}
+		rewrites = append(rewrites, line)
+		if len(rewrites) == maxRewrites {
+			break
+		}
+	}
+	return rewrites, usage, nil
+}
@@ -3,59 +3,76 @@ package shared
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"regexp"
 	"sort"
 	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
 )
 
 // Column represents a column in a datasource
 type Column struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
+	// Description explains the column's meaning to the model, e.g. units
+	Description string `json:"description,omitempty"`
+	// Stats are set with COLUMN_STATS
+	Stats *ColumnStats `json:"stats,omitempty"`
 }
 
 // Datasource represents a Tinybird datasource
 type Datasource struct {
-	Name    string   `json:"name"`
-	Columns []Column `json:"columns"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Columns     []Column `json:"columns"`
+	// Partial marks a datasource FilterSchema dropped columns from, so the
+	// grammar doesn't offer SELECT *
+	Partial bool `json:"-"`
 }
 
 // Schema holds all datasources and their columns
 type Schema struct {
-	Datasources []Datasource
+	Datasources []Datasource `json:"datasources"`
+	// Relationships are the joinable column pairs between datasources
+	Relationships []Relationship `json:"relationships,omitempty"`
+	// Metrics are the METRICS_FILE definitions whose table is present
+	Metrics []Metric `json:"metrics,omitempty"`
+	// Aggregates limits the aggregate functions the grammar offers; empty
+	// allows all of them
+	Aggregates []string `json:"aggregates,omitempty"`
 }
 
-// FetchSchema fetches the schema from Tinybird API
+// FetchSchema fetches the schema from Tinybird API, including datasource
+// and column descriptions, then applies SCHEMA_DESCRIPTIONS_FILE on top and
+// works out relationships from column names and SCHEMA_RELATIONSHIPS.
+// METRICS_FILE definitions are attached for the tables that exist, and with
+// COLUMN_STATS each column's statistics.
 func (c *TinybirdClient) FetchSchema() (*Schema, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v0/datasources", c.host), nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch datasources: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	status, body, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/datasources", c.endpoint()), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+		return req, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to fetch datasources: %w", nlerrors.ErrWarehouse{Err: err})
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("tinybird error (%d): %s", resp.StatusCode, string(body))
+	if err := warehouseStatusError(status, body); err != nil {
+		return nil, err
 	}
 
 	var result struct {
 		Datasources []struct {
-			Name    string `json:"name"`
-			Columns []struct {
-				Name string `json:"name"`
-				Type string `json:"type"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Columns     []struct {
+				Name        string `json:"name"`
+				Type        string `json:"type"`
+				Description string `json:"description"`
 			} `json:"columns"`
 		} `json:"datasources"`
 	}
@@ -66,16 +83,39 @@ func (c *TinybirdClient) FetchSchema() (*Schema, error) {
 
 	schema := &Schema{}
 	for _, ds := range result.Datasources {
-		datasource := Datasource{Name: ds.Name}
+		datasource := Datasource{Name: ds.Name, Description: ds.Description}
 		for _, col := range ds.Columns {
 			datasource.Columns = append(datasource.Columns, Column{
-				Name: col.Name,
-				Type: col.Type,
+				Name:        col.Name,
+				Type:        col.Type,
+				Description: col.Description,
 			})
 		}
 		schema.Datasources = append(schema.Datasources, datasource)
 	}
 
+	if c.descriptionsFile != "" {
+		descriptions, err := LoadSchemaDescriptions(c.descriptionsFile)
+		if err != nil {
+			return nil, err
+		}
+		descriptions.Apply(schema)
+	}
+	declared, err := ParseRelationships(c.relationships)
+	if err != nil {
+		return nil, err
+	}
+	schema.Relationships = InferRelationships(schema, declared)
+	if c.metricsFile != "" {
+		metrics, err := LoadMetrics(c.metricsFile)
+		if err != nil {
+			return nil, err
+		}
+		schema.Metrics = metrics.For(schema)
+	}
+	if c.columnStats {
+		c.collectColumnStats(schema)
+	}
 	return schema, nil
 }
 
@@ -107,15 +147,49 @@ NEQ: "!="
 start: select_stmt SEMI
 select_stmt: "SELECT" SP select_list SP "FROM" SP table (SP where_clause)? (SP group_clause)? (SP order_clause)? (SP limit_clause)?
 select_list: select_item (COMMA SP select_item)*
-select_item: agg_expr | column | star
 star: "*"
 agg_expr: agg_func LPAREN agg_arg RPAREN (SP "AS" SP alias)?
-agg_func: "SUM" | "COUNT" | "AVG" | "MIN" | "MAX"
-agg_arg: column | star
+`)
+	quotedAggs := make([]string, 0, len(Aggregates))
+	for _, agg := range s.aggregates() {
+		quotedAggs = append(quotedAggs, fmt.Sprintf(`"%s"`, agg))
+	}
+	sb.WriteString(fmt.Sprintf("agg_func: %s\n", strings.Join(quotedAggs, " | ")))
+	sb.WriteString(`agg_arg: column | star
 alias: IDENTIFIER
-
 `)
 
+	// Conditional aggregates filter rows per select item, so several
+	// filtered counts or totals come from one scan
+	selectItems := "agg_expr | column"
+	if !s.partial() {
+		selectItems += " | star"
+	}
+	if alts := conditionalAggregateRules(s.aggregates()); len(alts) > 0 {
+		sb.WriteString(fmt.Sprintf("cond_agg_expr: (%s) (SP \"AS\" SP alias)?\n", strings.Join(alts, " | ")))
+		selectItems += " | cond_agg_expr"
+	}
+	sb.WriteString("\n")
+
+	// Metrics are whole expressions, so the model picks one by name and can
+	// sort by its alias, but can't change its formula
+	if len(s.Metrics) > 0 {
+		exprs := make([]string, 0, len(s.Metrics))
+		names := make([]string, 0, len(s.Metrics))
+		for _, m := range s.Metrics {
+			exprs = append(exprs, fmt.Sprintf(`"%s"`, m.Expression()))
+			names = append(names, fmt.Sprintf(`"%s"`, m.Name))
+		}
+		sb.WriteString("# Metrics\n")
+		sb.WriteString(fmt.Sprintf("select_item: %s | metric\n", selectItems))
+		sb.WriteString(fmt.Sprintf("metric: %s\n", strings.Join(exprs, " | ")))
+		sb.WriteString(fmt.Sprintf("metric_name: %s\n", strings.Join(names, " | ")))
+		sb.WriteString("sort_item: (column | metric_name) (SP sort_dir)?\n\n")
+	} else {
+		sb.WriteString(fmt.Sprintf("select_item: %s\n", selectItems))
+		sb.WriteString("sort_item: column (SP sort_dir)?\n\n")
+	}
+
 	// Generate table rule
 	sb.WriteString("# Tables\n")
 	if len(s.Datasources) > 0 {
@@ -168,7 +242,6 @@ compare_op: GTE | LTE | GT | LT | EQ | NEQ
 value: STRING | NUMBER | DATETIME
 group_clause: "GROUP" SP "BY" SP column (COMMA SP column)*
 order_clause: "ORDER" SP "BY" SP sort_item (COMMA SP sort_item)*
-sort_item: column (SP sort_dir)?
 sort_dir: "ASC" | "DESC"
 limit_clause: "LIMIT" SP NUMBER
 IDENTIFIER: /[A-Za-z_][A-Za-z0-9_]*/
@@ -180,6 +253,17 @@ DATETIME: /'[0-9]{4}-[0-9]{2}-[0-9]{2}( [0-9]{2}:[0-9]{2}:[0-9]{2})?'/
 	return sb.String()
 }
 
+// partial reports whether any datasource is missing columns the caller
+// may not see
+func (s *Schema) partial() bool {
+	for _, ds := range s.Datasources {
+		if ds.Partial {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateToolDescription creates a description of available tables and columns
 func (s *Schema) GenerateToolDescription() string {
 	var sb strings.Builder
@@ -198,6 +282,9 @@ func (s *Schema) GenerateToolDescription() string {
 	for _, name := range dsNames {
 		ds := dsMap[name]
 		sb.WriteString(fmt.Sprintf("\n## %s\n", ds.Name))
+		if ds.Description != "" {
+			sb.WriteString(ds.Description + "\n")
+		}
 
 		colNames := make([]string, 0, len(ds.Columns))
 		colMap := make(map[string]Column)
@@ -209,12 +296,43 @@ func (s *Schema) GenerateToolDescription() string {
 
 		for _, colName := range colNames {
 			col := colMap[colName]
-			sb.WriteString(fmt.Sprintf("- %s (%s)\n", col.Name, col.Type))
+			notes := col.Description
+			if stats := col.statsNote(); stats != "" && notes != "" {
+				notes += "; " + stats
+			} else if stats != "" {
+				notes = stats
+			}
+			if notes != "" {
+				sb.WriteString(fmt.Sprintf("- %s (%s): %s\n", col.Name, col.Type, notes))
+			} else {
+				sb.WriteString(fmt.Sprintf("- %s (%s)\n", col.Name, col.Type))
+			}
+		}
+	}
+
+	if len(s.Relationships) > 0 {
+		sb.WriteString("\nRelated tables (joins are not supported yet, so answer from the one table that has every column needed):\n")
+		for _, r := range s.Relationships {
+			sb.WriteString("- " + r.String() + "\n")
+		}
+	}
+
+	if len(s.Metrics) > 0 {
+		sb.WriteString("\nMetrics (select these by name instead of writing the formula, so they are computed consistently):\n")
+		for _, m := range s.Metrics {
+			line := fmt.Sprintf("- %s = %s, from %s", m.Name, m.SQL, m.Table)
+			if m.Description != "" {
+				line += ": " + m.Description
+			}
+			sb.WriteString(line + "\n")
 		}
 	}
 
 	sb.WriteString("\nSupported operations:\n")
-	sb.WriteString("- SELECT with columns or aggregates (SUM, COUNT, AVG, MIN, MAX)\n")
+	sb.WriteString(fmt.Sprintf("- SELECT with columns or aggregates (%s)\n", strings.Join(s.aggregates(), ", ")))
+	if forms := conditionalAggregateForms(s.aggregates()); len(forms) > 0 {
+		sb.WriteString(fmt.Sprintf("- Conditional aggregates %s, to filter each aggregate separately in one query, e.g. SELECT countIf(col > 100) AS over_100, countIf(col < 10) AS under_10\n", strings.Join(forms, ", ")))
+	}
 	sb.WriteString("- WHERE with comparisons (=, !=, >, <, >=, <=)\n")
 	sb.WriteString("- GROUP BY columns\n")
 	sb.WriteString("- ORDER BY columns (ASC/DESC)\n")
@@ -224,6 +342,55 @@ func (s *Schema) GenerateToolDescription() string {
 	return sb.String()
 }
 
+// conditionalAggregates maps an aggregate to its ClickHouse -If form, which
+// only aggregates the rows matching a condition
+var conditionalAggregates = []struct{ agg, fn string }{
+	{"COUNT", "countIf"},
+	{"SUM", "sumIf"},
+	{"AVG", "avgIf"},
+}
+
+// conditionalAggregateRules returns the grammar alternatives for the -If
+// forms of aggs: countIf takes only the condition, the others a column too
+func conditionalAggregateRules(aggs []string) []string {
+	var rules []string
+	for _, c := range conditionalAggregates {
+		if !containsString(aggs, c.agg) {
+			continue
+		}
+		if c.agg == "COUNT" {
+			rules = append(rules, fmt.Sprintf(`"%s" LPAREN condition RPAREN`, c.fn))
+		} else {
+			rules = append(rules, fmt.Sprintf(`"%s" LPAREN column COMMA SP condition RPAREN`, c.fn))
+		}
+	}
+	return rules
+}
+
+// conditionalAggregateForms describes the -If forms of aggs for the prompt
+func conditionalAggregateForms(aggs []string) []string {
+	var forms []string
+	for _, c := range conditionalAggregates {
+		if !containsString(aggs, c.agg) {
+			continue
+		}
+		if c.agg == "COUNT" {
+			forms = append(forms, c.fn+"(condition)")
+		} else {
+			forms = append(forms, c.fn+"(column, condition)")
+		}
+	}
+	return forms
+}
+
+// aggregates returns the aggregate functions the grammar offers
+func (s *Schema) aggregates() []string {
+	if len(s.Aggregates) > 0 {
+		return s.Aggregates
+	}
+	return Aggregates
+}
+
 // GenerateUserHint creates a brief, user-friendly summary of available data
 func (s *Schema) GenerateUserHint() string {
 	if len(s.Datasources) == 0 {
@@ -243,3 +410,48 @@ func (s *Schema) GenerateUserHint() string {
 
 	return "Available data: " + strings.Join(parts, "; ")
 }
+
+// Subset returns the part of the schema covering only tables, with the
+// relationships and metrics among them. Naming a table the schema doesn't
+// have is an error, so callers learn about typos instead of getting a
+// refusal.
+func (s *Schema) Subset(tables []string) (*Schema, error) {
+	want := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		want[t] = true
+	}
+	subset := &Schema{Aggregates: s.Aggregates}
+	for _, ds := range s.Datasources {
+		if want[ds.Name] {
+			subset.Datasources = append(subset.Datasources, ds)
+			delete(want, ds.Name)
+		}
+	}
+	if len(want) > 0 {
+		unknown := make([]string, 0, len(want))
+		for t := range want {
+			unknown = append(unknown, t)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown tables: %s", strings.Join(unknown, ", "))
+	}
+	included := func(table string) bool {
+		for _, ds := range subset.Datasources {
+			if ds.Name == table {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rel := range s.Relationships {
+		if included(rel.From) && included(rel.To) {
+			subset.Relationships = append(subset.Relationships, rel)
+		}
+	}
+	for _, m := range s.Metrics {
+		if included(m.Table) {
+			subset.Metrics = append(subset.Metrics, m)
+		}
+	}
+	return subset, nil
+}
@@ -0,0 +1,163 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSchemaVersions bounds the history kept per warehouse
+const maxSchemaVersions = 20
+
+// Version identifies the schema's structure: its datasources, columns and
+// column types. Descriptions and ordering don't change it.
+func (s *Schema) Version() string {
+	var lines []string
+	for _, ds := range s.Datasources {
+		for _, col := range ds.Columns {
+			lines = append(lines, ds.Name+"."+col.Name+" "+col.Type)
+		}
+		if len(ds.Columns) == 0 {
+			lines = append(lines, ds.Name)
+		}
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// SchemaVersion is one schema seen for a warehouse
+type SchemaVersion struct {
+	Version   string    `json:"version"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Tables    int       `json:"tables"`
+	Columns   int       `json:"columns"`
+	// Change is how this version differs from the one before it
+	Change *SchemaChange `json:"change,omitempty"`
+}
+
+// SchemaChange lists what differs between two schema versions. Columns are
+// named "table.column".
+type SchemaChange struct {
+	From           string   `json:"from"`
+	To             string   `json:"to"`
+	AddedTables    []string `json:"added_tables,omitempty"`
+	RemovedTables  []string `json:"removed_tables,omitempty"`
+	AddedColumns   []string `json:"added_columns,omitempty"`
+	RemovedColumns []string `json:"removed_columns,omitempty"`
+	// RetypedColumns are columns whose type changed, as "table.column (old, now new)"
+	RetypedColumns []string `json:"retyped_columns,omitempty"`
+}
+
+// DiffSchemas reports how next differs from prev. Columns of added or
+// removed tables are not listed separately.
+func DiffSchemas(prev, next *Schema) *SchemaChange {
+	change := &SchemaChange{From: prev.Version(), To: next.Version()}
+	before := schemaColumns(prev)
+	after := schemaColumns(next)
+	for table, cols := range after {
+		old, ok := before[table]
+		if !ok {
+			change.AddedTables = append(change.AddedTables, table)
+			continue
+		}
+		for col, typ := range cols {
+			oldType, ok := old[col]
+			switch {
+			case !ok:
+				change.AddedColumns = append(change.AddedColumns, table+"."+col)
+			case oldType != typ:
+				change.RetypedColumns = append(change.RetypedColumns, table+"."+col+" ("+oldType+", now "+typ+")")
+			}
+		}
+	}
+	for table, cols := range before {
+		current, ok := after[table]
+		if !ok {
+			change.RemovedTables = append(change.RemovedTables, table)
+			continue
+		}
+		for col := range cols {
+			if _, ok := current[col]; !ok {
+				change.RemovedColumns = append(change.RemovedColumns, table+"."+col)
+			}
+		}
+	}
+	for _, list := range [][]string{change.AddedTables, change.RemovedTables, change.AddedColumns, change.RemovedColumns, change.RetypedColumns} {
+		sort.Strings(list)
+	}
+	return change
+}
+
+// Breaking reports whether queries valid under the old schema may fail
+func (c *SchemaChange) Breaking() bool {
+	return len(c.RemovedTables) > 0 || len(c.RemovedColumns) > 0 || len(c.RetypedColumns) > 0
+}
+
+// schemaColumns maps table to column to type
+func schemaColumns(s *Schema) map[string]map[string]string {
+	tables := make(map[string]map[string]string, len(s.Datasources))
+	for _, ds := range s.Datasources {
+		cols := make(map[string]string, len(ds.Columns))
+		for _, col := range ds.Columns {
+			cols[col.Name] = col.Type
+		}
+		tables[ds.Name] = cols
+	}
+	return tables
+}
+
+// schemaHistory is the versions seen for one warehouse, oldest first
+type schemaHistory struct {
+	latest   *Schema
+	versions []SchemaVersion
+}
+
+// Record notes that schema was fetched under key and returns how it
+// differs from the previously recorded schema, or nil if it is the first
+// or unchanged. History is kept in memory, so each instance has its own.
+func (c *SchemaCache) Record(key string, schema *Schema) *SchemaChange {
+	version := schema.Version()
+	now := time.Now().UTC()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	history := c.history[key]
+	if history == nil {
+		history = &schemaHistory{}
+		c.history[key] = history
+	}
+	if n := len(history.versions); n > 0 && history.versions[n-1].Version == version {
+		history.versions[n-1].LastSeen = now
+		history.latest = schema
+		return nil
+	}
+
+	entry := SchemaVersion{Version: version, FirstSeen: now, LastSeen: now, Tables: len(schema.Datasources)}
+	for _, ds := range schema.Datasources {
+		entry.Columns += len(ds.Columns)
+	}
+	if history.latest != nil {
+		entry.Change = DiffSchemas(history.latest, schema)
+	}
+	history.latest = schema
+	history.versions = append(history.versions, entry)
+	if len(history.versions) > maxSchemaVersions {
+		history.versions = history.versions[len(history.versions)-maxSchemaVersions:]
+	}
+	return entry.Change
+}
+
+// Versions returns the schema versions recorded under key, oldest first
+func (c *SchemaCache) Versions(key string) []SchemaVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	history := c.history[key]
+	if history == nil {
+		return nil
+	}
+	return append([]SchemaVersion(nil), history.versions...)
+}
@@ -0,0 +1,52 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ListenAddress returns the network and address the server should bind to.
+// LISTEN_ADDR wins over HOST/PORT; a "unix:" prefix selects a Unix socket.
+func (c *Config) ListenAddress() (network, address string) {
+	if strings.HasPrefix(c.ListenAddr, "unix:") {
+		return "unix", strings.TrimPrefix(c.ListenAddr, "unix:")
+	}
+	if c.ListenAddr != "" {
+		return "tcp", c.ListenAddr
+	}
+	port := c.Port
+	if port == "" {
+		port = "8080"
+	}
+	return "tcp", net.JoinHostPort(c.Host, port)
+}
+
+// Listen opens the configured listener, removing a stale Unix socket first
+func Listen(cfg *Config) (net.Listener, error) {
+	network, address := cfg.ListenAddress()
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s %s: %w", network, address, err)
+	}
+	return ln, nil
+}
+
+// NewHTTPServer builds an http.Server with the configured timeouts
+func NewHTTPServer(cfg *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
@@ -0,0 +1,101 @@
+package shared
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// Service modes, from least to most restricted
+const (
+	ModeNormal = "normal"
+	// ModeGenerateOnly generates and returns SQL but doesn't run it, e.g.
+	// during a warehouse incident or to stop warehouse spend
+	ModeGenerateOnly = "generate_only"
+	// ModeMaintenance refuses queries before they reach OpenAI or the
+	// warehouse
+	ModeMaintenance = "maintenance"
+)
+
+// ModeState is the service mode in effect and where it comes from:
+// "config" for SERVICE_MODE or "override" for a runtime switch
+type ModeState struct {
+	Mode   string     `json:"mode"`
+	Source string     `json:"source"`
+	Reason string     `json:"reason,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+// ServiceModeSwitch resolves the service mode: a runtime override if one is
+// set, otherwise SERVICE_MODE. Safe for concurrent use.
+type ServiceModeSwitch struct {
+	mu       sync.RWMutex
+	override *ModeState
+}
+
+// ServiceMode is the process-wide switch. Like flag overrides, a runtime
+// override lives in memory, so on serverless it only affects the warm
+// instance that received it; set SERVICE_MODE to switch every instance.
+var ServiceMode = &ServiceModeSwitch{}
+
+func validServiceMode(mode string) error {
+	switch mode {
+	case ModeNormal, ModeGenerateOnly, ModeMaintenance:
+		return nil
+	}
+	return fmt.Errorf("unknown service mode %q (want %s, %s or %s)", mode, ModeNormal, ModeGenerateOnly, ModeMaintenance)
+}
+
+// Override switches to mode until ClearOverride, whatever SERVICE_MODE says.
+// reason is shown to callers that are refused.
+func (s *ServiceModeSwitch) Override(mode, reason string) error {
+	if err := validServiceMode(mode); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.override = &ModeState{Mode: mode, Source: "override", Reason: reason, Since: &now}
+	return nil
+}
+
+// ClearOverride returns to SERVICE_MODE
+func (s *ServiceModeSwitch) ClearOverride() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.override = nil
+}
+
+// State returns the mode in effect under cfg
+func (s *ServiceModeSwitch) State(cfg *Config) ModeState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.override != nil {
+		return *s.override
+	}
+	mode := cfg.ServiceMode
+	if mode == "" {
+		mode = ModeNormal
+	}
+	return ModeState{Mode: mode, Source: "config"}
+}
+
+// CheckGenerate returns an nlerrors.ErrServicePaused if queries may not be
+// answered at all
+func (s *ServiceModeSwitch) CheckGenerate(cfg *Config) error {
+	if state := s.State(cfg); state.Mode == ModeMaintenance {
+		return nlerrors.ErrServicePaused{Mode: state.Mode, Reason: state.Reason}
+	}
+	return nil
+}
+
+// CheckExecute returns an nlerrors.ErrServicePaused if SQL may not be run
+// against the warehouse
+func (s *ServiceModeSwitch) CheckExecute(cfg *Config) error {
+	if state := s.State(cfg); state.Mode != ModeNormal {
+		return nlerrors.ErrServicePaused{Mode: state.Mode, Reason: state.Reason}
+	}
+	return nil
+}
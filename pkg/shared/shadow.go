@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+// DefaultShadowInFlight bounds the shadow comparisons nl2sql serve runs at once
+const DefaultShadowInFlight = 4
+
+// SampleShadow reports whether this request should also be answered by the
+// SHADOW_FILE variant: SHADOW_PERCENT of requests are
+func SampleShadow(cfg *Config) bool {
+	return cfg.ShadowFile != "" && cfg.ShadowPercent > 0 && rand.Float64()*100 < cfg.ShadowPercent
+}
+
+// LoadShadowVariant reads the SHADOW_FILE variant, in the format of an
+// experiment variant. The file is read on every sampled request, so edits
+// apply to the next one.
+func LoadShadowVariant(cfg *Config) (*ExperimentVariant, error) {
+	data, err := os.ReadFile(cfg.ShadowFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shadow variant: %w", err)
+	}
+	var v ExperimentVariant
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid shadow file %s: %w", cfg.ShadowFile, err)
+	}
+	if v.Name == "" {
+		v.Name = "shadow"
+	}
+	return &v, nil
+}
+
+// ShadowComparison is what a shadow run found, for the log. Rows are never
+// part of it: shadow results aren't returned or logged.
+type ShadowComparison struct {
+	Variant string
+	Model   string
+	SQL     string
+	// SameSQL is set when both generators wrote the same SQL once formatted
+	SameSQL bool
+	// Agreed is set when both queries returned the same rows
+	Agreed     bool
+	Rows       int
+	CostUSD    float64
+	GenerateMs int64
+	ExecuteMs  int64
+	Err        error
+}
+
+// CompareRows reports whether the shadow rows match the primary ones, the
+// same way an eval compares generated rows with the expected ones
+func CompareRows(primary, shadow []map[string]interface{}) bool {
+	return dataEqual(primary, shadow)
+}
+
+// CopyRows returns a copy of rows that post-processing of the originals
+// won't change
+func CopyRows(rows []map[string]interface{}) []map[string]interface{} {
+	out := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		copied := make(map[string]interface{}, len(row))
+		for k, v := range row {
+			copied[k] = v
+		}
+		out[i] = copied
+	}
+	return out
+}
+
+// ShadowRunner runs shadow comparisons in the background. When
+// maxInFlight are already running a new one is dropped, not queued, so
+// shadowing never builds up behind traffic. A nil runner drops everything.
+type ShadowRunner struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+// NewShadowRunner creates a runner with at most maxInFlight comparisons at
+// once (DefaultShadowInFlight when <= 0)
+func NewShadowRunner(maxInFlight int) *ShadowRunner {
+	if maxInFlight <= 0 {
+		maxInFlight = DefaultShadowInFlight
+	}
+	return &ShadowRunner{sem: make(chan struct{}, maxInFlight)}
+}
+
+// Go runs fn in the background and reports whether it was started
+func (s *ShadowRunner) Go(fn func()) bool {
+	if s == nil {
+		return false
+	}
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		return false
+	}
+	s.wg.Add(1)
+	go func() {
+		defer func() { <-s.sem; s.wg.Done() }()
+		fn()
+	}()
+	return true
+}
+
+// Wait blocks until the running comparisons finish
+func (s *ShadowRunner) Wait() {
+	if s != nil {
+		s.wg.Wait()
+	}
+}
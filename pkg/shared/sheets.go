@@ -0,0 +1,344 @@
+package shared
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sheetsAPIBase  = "https://sheets.googleapis.com/v4/spreadsheets"
+	driveFilesBase = "https://www.googleapis.com/drive/v3/files"
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+
+	// drive.file limits the service account to files it created or was
+	// explicitly given
+	sheetsScope = "https://www.googleapis.com/auth/spreadsheets https://www.googleapis.com/auth/drive.file"
+)
+
+// ErrSheetsNotConfigured is returned when GOOGLE_SERVICE_ACCOUNT is empty
+var ErrSheetsNotConfigured = errors.New("Google Sheets export is not configured (set GOOGLE_SERVICE_ACCOUNT)")
+
+// serviceAccount is the subset of a Google service-account key file we use
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// parseServiceAccount reads a key given inline as JSON or as a file path
+func parseServiceAccount(v string) (*serviceAccount, error) {
+	data := []byte(v)
+	if !strings.HasPrefix(strings.TrimSpace(v), "{") {
+		var err error
+		if data, err = os.ReadFile(v); err != nil {
+			return nil, err
+		}
+	}
+	var sa serviceAccount
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, fmt.Errorf("invalid service-account key: %w", err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, fmt.Errorf("service-account key needs client_email and private_key")
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("service-account private_key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service-account private_key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service-account private_key is not RSA")
+	}
+	sa.key = key
+	if sa.TokenURI == "" {
+		sa.TokenURI = googleTokenURL
+	}
+	return &sa, nil
+}
+
+// SheetsExport describes where a result set was written
+type SheetsExport struct {
+	SpreadsheetID string `json:"spreadsheet_id"`
+	URL           string `json:"url"`
+	Sheet         string `json:"sheet"`
+	Rows          int    `json:"rows"`
+}
+
+// SheetsClient writes result sets to Google Sheets as a service account
+type SheetsClient struct {
+	clientOptions
+	account   *serviceAccount
+	shareWith []string
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+// NewSheetsClient creates a client from GOOGLE_SERVICE_ACCOUNT. It returns
+// ErrSheetsNotConfigured when no key is set.
+func NewSheetsClient(cfg *Config, opts ...ClientOption) (*SheetsClient, error) {
+	if cfg.GoogleServiceAccount == "" {
+		return nil, ErrSheetsNotConfigured
+	}
+	account, err := parseServiceAccount(cfg.GoogleServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+	return &SheetsClient{
+		clientOptions: newClientOptions(opts),
+		account:       account,
+		shareWith:     splitList(cfg.SheetsShareWith),
+	}, nil
+}
+
+// Export writes data, one header row then one row per result, to a sheet.
+// With an empty spreadsheetID a new spreadsheet titled title is created and
+// shared with SHEETS_SHARE_WITH; otherwise the named tab of that
+// spreadsheet is replaced, or added if missing. The service account must
+// have edit access to an existing spreadsheet. Columns are sorted by name.
+func (c *SheetsClient) Export(title, spreadsheetID, sheet string, data []map[string]interface{}) (*SheetsExport, error) {
+	if sheet == "" {
+		sheet = "Results"
+	}
+	values := sheetValues(data)
+
+	var link string
+	if spreadsheetID == "" {
+		created, err := c.create(title, sheet)
+		if err != nil {
+			return nil, err
+		}
+		spreadsheetID, link = created.SpreadsheetID, created.SpreadsheetURL
+		for _, grantee := range c.shareWith {
+			if err := c.share(spreadsheetID, grantee); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		var err error
+		if link, err = c.prepareSheet(spreadsheetID, sheet); err != nil {
+			return nil, err
+		}
+	}
+
+	body := map[string]interface{}{"values": values}
+	path := "/" + url.PathEscape(spreadsheetID) + "/values/" + url.PathEscape(sheetRange(sheet)) + "?valueInputOption=RAW"
+	if err := c.call(http.MethodPut, sheetsAPIBase+path, body, nil); err != nil {
+		return nil, err
+	}
+	return &SheetsExport{SpreadsheetID: spreadsheetID, URL: link, Sheet: sheet, Rows: len(data)}, nil
+}
+
+type spreadsheet struct {
+	SpreadsheetID  string `json:"spreadsheetId"`
+	SpreadsheetURL string `json:"spreadsheetUrl"`
+	Sheets         []struct {
+		Properties struct {
+			Title string `json:"title"`
+		} `json:"properties"`
+	} `json:"sheets"`
+}
+
+func (c *SheetsClient) create(title, sheet string) (*spreadsheet, error) {
+	body := map[string]interface{}{
+		"properties": map[string]string{"title": title},
+		"sheets":     []interface{}{map[string]interface{}{"properties": map[string]string{"title": sheet}}},
+	}
+	var created spreadsheet
+	if err := c.call(http.MethodPost, sheetsAPIBase, body, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// prepareSheet makes sure the tab exists and is empty, returning the
+// spreadsheet's URL
+func (c *SheetsClient) prepareSheet(spreadsheetID, sheet string) (string, error) {
+	base := sheetsAPIBase + "/" + url.PathEscape(spreadsheetID)
+	var existing spreadsheet
+	if err := c.call(http.MethodGet, base+"?fields=spreadsheetUrl,sheets.properties.title", nil, &existing); err != nil {
+		return "", err
+	}
+	for _, s := range existing.Sheets {
+		if s.Properties.Title == sheet {
+			err := c.call(http.MethodPost, base+"/values/"+url.PathEscape(sheetRange(sheet))+":clear", map[string]string{}, nil)
+			return existing.SpreadsheetURL, err
+		}
+	}
+	add := map[string]interface{}{"requests": []interface{}{
+		map[string]interface{}{"addSheet": map[string]interface{}{"properties": map[string]string{"title": sheet}}},
+	}}
+	return existing.SpreadsheetURL, c.call(http.MethodPost, base+":batchUpdate", add, nil)
+}
+
+// share grants edit access to an email address, or to a whole domain
+// when grantee is "@example.com"
+func (c *SheetsClient) share(spreadsheetID, grantee string) error {
+	permission := map[string]string{"role": "writer", "type": "user", "emailAddress": grantee}
+	if domain, ok := strings.CutPrefix(grantee, "@"); ok {
+		permission = map[string]string{"role": "writer", "type": "domain", "domain": domain}
+	}
+	endpoint := driveFilesBase + "/" + url.PathEscape(spreadsheetID) + "/permissions?sendNotificationEmail=false"
+	return c.call(http.MethodPost, endpoint, permission, nil)
+}
+
+// call sends a JSON request with a service-account access token and
+// decodes the response into out when it is non-nil
+func (c *SheetsClient) call(method, endpoint string, body, out interface{}) error {
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	if body != nil {
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	status, respBody, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(method, endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return fmt.Errorf("google api error (%d): %s", status, string(respBody))
+	}
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// token returns a cached access token, exchanging a signed JWT for a new
+// one shortly before the old one expires
+func (c *SheetsClient) token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accessToken != "" && time.Now().Before(c.expires.Add(-time.Minute)) {
+		return c.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := c.account.signJWT(now)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}.Encode()
+	status, body, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.account.TokenURI, strings.NewReader(form))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("google token error (%d): %s", status, string(body))
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %w", err)
+	}
+	c.accessToken = result.AccessToken
+	c.expires = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return c.accessToken, nil
+}
+
+// signJWT builds the RS256 assertion for the OAuth JWT-bearer grant
+func (sa *serviceAccount) signJWT(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   sa.ClientEmail,
+		"scope": sheetsScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, sa.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// sheetValues converts rows to a header row plus cells. Values are written
+// RAW, so strings starting with "=" stay text rather than formulas.
+func sheetValues(data []map[string]interface{}) [][]interface{} {
+	if len(data) == 0 {
+		return [][]interface{}{}
+	}
+	var columns []string
+	for col := range data[0] {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+
+	header := make([]interface{}, len(columns))
+	for i, col := range columns {
+		header[i] = col
+	}
+	values := [][]interface{}{header}
+	for _, row := range data {
+		cells := make([]interface{}, len(columns))
+		for i, col := range columns {
+			switch v := row[col].(type) {
+			case nil:
+				cells[i] = ""
+			case string, bool, float64, int, int64, json.Number:
+				cells[i] = v
+			default:
+				b, _ := json.Marshal(v)
+				cells[i] = string(b)
+			}
+		}
+		values = append(values, cells)
+	}
+	return values
+}
+
+// sheetRange is the A1 range of a whole tab, quoting its title
+func sheetRange(sheet string) string {
+	return "'" + strings.ReplaceAll(sheet, "'", "''") + "'"
+}
@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SlowQuery is one entry of the slow-query log
+type SlowQuery struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Tenant       string    `json:"tenant,omitempty"`
+	Question     string    `json:"question"`
+	SQL          string    `json:"sql"`
+	SQLHash      string    `json:"sql_hash"`
+	Model        string    `json:"model"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	PromptTokens int       `json:"prompt_tokens,omitempty"`
+	GenerateMs   int64     `json:"generate_ms"`
+	ExecuteMs    int64     `json:"execute_ms"`
+	Rows         int       `json:"rows"`
+	RowsRead     int64     `json:"rows_read"`
+	BytesRead    int64     `json:"bytes_read"`
+	// Columns are the schema columns the SQL touched, as "table.column"
+	Columns []string `json:"columns,omitempty"`
+	// Cohort is the canary cohort; Code is the error code the request
+	// failed with, "" on success
+	Cohort string `json:"cohort,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// IsSlow reports whether generation or execution crossed its threshold
+func (q *SlowQuery) IsSlow(cfg *Config) bool {
+	return (cfg.SlowGenerateThreshold > 0 && q.GenerateMs >= cfg.SlowGenerateThreshold.Milliseconds()) ||
+		(cfg.SlowExecuteThreshold > 0 && q.ExecuteMs >= cfg.SlowExecuteThreshold.Milliseconds())
+}
+
+var slowLogMu sync.Mutex
+
+// RecordSlowQuery writes q to the slow-query channel if it crossed a
+// threshold: a warning with channel=slow_query on the request's logger and,
+// when SLOW_QUERY_LOG is set, a JSON line appended to that file
+func RecordSlowQuery(ctx context.Context, cfg *Config, q *SlowQuery) error {
+	if !q.IsSlow(cfg) {
+		return nil
+	}
+	if q.Time.IsZero() {
+		q.Time = time.Now().UTC()
+	}
+	q.SQLHash = SQLHash(q.SQL)
+
+	Logger(ctx).Warn("Slow query",
+		"channel", "slow_query",
+		"sql", q.SQL,
+		LogSQLHash, q.SQLHash,
+		LogModel, q.Model,
+		"generate_ms", q.GenerateMs,
+		"execute_ms", q.ExecuteMs,
+		"rows", q.Rows,
+		"rows_read", q.RowsRead,
+		"bytes_read", q.BytesRead,
+	)
+
+	if cfg.SlowQueryLog == "" {
+		return nil
+	}
+	line, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("failed to marshal slow query: %w", err)
+	}
+
+	slowLogMu.Lock()
+	defer slowLogMu.Unlock()
+	f, err := os.OpenFile(cfg.SlowQueryLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open slow query log: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write slow query log: %w", err)
+	}
+	return nil
+}
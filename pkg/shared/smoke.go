@@ -0,0 +1,87 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SmokeEvalCases generates trivial eval cases from the schema: a row count per
+// datasource, MIN/MAX of each numeric column and the date range of each date
+// column. Coverage grows automatically as datasources are added.
+func SmokeEvalCases(schema *Schema) []EvalCase {
+	datasources := append([]Datasource(nil), schema.Datasources...)
+	sort.Slice(datasources, func(i, j int) bool { return datasources[i].Name < datasources[j].Name })
+
+	var cases []EvalCase
+	for _, ds := range datasources {
+		table := humanize(ds.Name)
+		cases = append(cases, EvalCase{
+			Name:        fmt.Sprintf("smoke_%s_count", ds.Name),
+			Query:       fmt.Sprintf("How many rows are in %s?", table),
+			ExpectedSQL: fmt.Sprintf("SELECT COUNT(*) FROM %s;", ds.Name),
+		})
+
+		columns := append([]Column(nil), ds.Columns...)
+		sort.Slice(columns, func(i, j int) bool { return columns[i].Name < columns[j].Name })
+
+		for _, col := range columns {
+			name := humanize(col.Name)
+			switch {
+			case isNumericType(col.Type):
+				cases = append(cases,
+					EvalCase{
+						Name:        fmt.Sprintf("smoke_%s_%s_min", ds.Name, col.Name),
+						Query:       fmt.Sprintf("What is the minimum %s in %s?", name, table),
+						ExpectedSQL: fmt.Sprintf("SELECT MIN(%s) FROM %s;", col.Name, ds.Name),
+					},
+					EvalCase{
+						Name:        fmt.Sprintf("smoke_%s_%s_max", ds.Name, col.Name),
+						Query:       fmt.Sprintf("What is the maximum %s in %s?", name, table),
+						ExpectedSQL: fmt.Sprintf("SELECT MAX(%s) FROM %s;", col.Name, ds.Name),
+					},
+				)
+			case isDateType(col.Type):
+				cases = append(cases, EvalCase{
+					Name:        fmt.Sprintf("smoke_%s_%s_range", ds.Name, col.Name),
+					Query:       fmt.Sprintf("What are the earliest and latest %s in %s?", name, table),
+					ExpectedSQL: fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s;", col.Name, col.Name, ds.Name),
+				})
+			}
+		}
+	}
+	return cases
+}
+
+// baseType strips Nullable(...) and LowCardinality(...) wrappers, nested in
+// either order
+func baseType(t string) string {
+	for stripped := true; stripped; {
+		stripped = false
+		for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+			if strings.HasPrefix(t, wrapper) && strings.HasSuffix(t, ")") {
+				t = t[len(wrapper) : len(t)-1]
+				stripped = true
+			}
+		}
+	}
+	return t
+}
+
+func isNumericType(t string) bool {
+	t = baseType(t)
+	for _, prefix := range []string{"Int", "UInt", "Float", "Decimal"} {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDateType(t string) bool {
+	return strings.HasPrefix(baseType(t), "Date")
+}
+
+func humanize(name string) string {
+	return strings.ReplaceAll(name, "_", " ")
+}
@@ -0,0 +1,28 @@
+package shared
+
+import "testing"
+
+func TestBaseType(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want string
+	}{
+		{"String", "String"},
+		{"Nullable(Float64)", "Float64"},
+		{"LowCardinality(String)", "String"},
+		{"LowCardinality(Nullable(String))", "String"},
+		{"Nullable(LowCardinality(String))", "String"},
+		{"LowCardinality(Nullable(DateTime))", "DateTime"},
+		{"Array(Nullable(String))", "Array(Nullable(String))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			if got := baseType(tt.typ); got != tt.want {
+				t.Errorf("baseType(%q) = %q, want %q", tt.typ, got, tt.want)
+			}
+		})
+	}
+	if !isDateType("LowCardinality(Nullable(Date))") {
+		t.Error("LowCardinality(Nullable(Date)) not classified as a date")
+	}
+}
@@ -0,0 +1,155 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshot change kinds
+const (
+	// SnapshotSQLChanged means the SQL differs from the golden file but the
+	// case still passed, i.e. different SQL with the same results.
+	SnapshotSQLChanged = "sql_changed"
+	// SnapshotRegression means the SQL differs and the case failed.
+	SnapshotRegression = "regression"
+	// SnapshotMissing means no golden file exists for the case yet.
+	SnapshotMissing = "missing"
+)
+
+// refusedSnapshot is stored for unsupported cases; the refusal reason is
+// free text, so only the fact that the model refused is snapshotted.
+const refusedSnapshot = "-- refused"
+
+// SnapshotDiff describes a case whose generated SQL doesn't match its golden file
+type SnapshotDiff struct {
+	Name      string
+	Kind      string
+	Golden    string
+	Generated string
+}
+
+// String renders the difference as a readable clause-by-clause diff
+func (d SnapshotDiff) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s (%s)\n", d.Name, d.Kind))
+	for _, line := range diffLines(splitClauses(d.Golden), splitClauses(d.Generated)) {
+		sb.WriteString("  " + line + "\n")
+	}
+	return sb.String()
+}
+
+// CompareSnapshots checks each executed result against dir/<name>.sql
+func CompareSnapshots(dir string, results []EvalResult) ([]SnapshotDiff, error) {
+	var diffs []SnapshotDiff
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+		generated := snapshotSQL(r)
+
+		data, err := os.ReadFile(snapshotPath(dir, r.Name))
+		if errors.Is(err, os.ErrNotExist) {
+			diffs = append(diffs, SnapshotDiff{Name: r.Name, Kind: SnapshotMissing, Generated: generated})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+
+		// Compared formatted, so golden files written before formatting or
+		// edited by hand only differ when the SQL does
+		golden := strings.TrimSpace(string(data))
+		if golden == generated || FormatSQL(golden) == generated {
+			continue
+		}
+
+		kind := SnapshotSQLChanged
+		if !r.Passed {
+			kind = SnapshotRegression
+		}
+		diffs = append(diffs, SnapshotDiff{Name: r.Name, Kind: kind, Golden: golden, Generated: generated})
+	}
+	return diffs, nil
+}
+
+// UpdateSnapshots writes the generated SQL of every executed result to dir
+func UpdateSnapshots(dir string, results []EvalResult) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+		if err := os.WriteFile(snapshotPath(dir, r.Name), []byte(snapshotSQL(r)+"\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+func snapshotPath(dir, name string) string {
+	return filepath.Join(dir, name+".sql")
+}
+
+func snapshotSQL(r EvalResult) string {
+	if strings.HasPrefix(r.GeneratedSQL, "(refused") {
+		return refusedSnapshot
+	}
+	return FormatSQL(r.GeneratedSQL)
+}
+
+// splitClauses breaks SQL into the lines of its canonical formatting
+func splitClauses(sql string) []string {
+	if sql == "" {
+		return nil
+	}
+	return strings.Split(FormatSQL(sql), "\n")
+}
+
+// diffLines returns a minimal line diff with "-", "+" and " " prefixes
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+package shared
+
+import (
+	"strings"
+	"unicode"
+)
+
+// sqlKeywords are upper-cased by FormatSQL. Words that are also common
+// column names (interval units, FIRST/LAST) are only upper-cased in their
+// keyword position.
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "DISTINCT": true, "FROM": true, "WHERE": true, "PREWHERE": true,
+	"AND": true, "OR": true, "NOT": true, "IN": true, "IS": true, "NULL": true,
+	"LIKE": true, "ILIKE": true, "BETWEEN": true, "AS": true, "ON": true, "USING": true,
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true, "OUTER": true,
+	"CROSS": true, "GROUP": true, "BY": true, "ORDER": true, "HAVING": true,
+	"LIMIT": true, "OFFSET": true, "ASC": true, "DESC": true, "NULLS": true,
+	"CASE": true, "WHEN": true, "THEN": true, "ELSE": true, "END": true,
+	"INTERVAL": true, "UNION": true, "ALL": true, "WITH": true, "EXISTS": true,
+}
+
+var intervalUnits = map[string]bool{
+	"SECOND": true, "MINUTE": true, "HOUR": true, "DAY": true, "WEEK": true,
+	"MONTH": true, "QUARTER": true, "YEAR": true,
+}
+
+// clauseKeywords start a new line when they appear outside parentheses
+var clauseKeywords = map[string]bool{
+	"FROM": true, "PREWHERE": true, "WHERE": true, "GROUP": true, "HAVING": true,
+	"ORDER": true, "LIMIT": true, "UNION": true, "JOIN": true, "INNER": true,
+	"LEFT": true, "RIGHT": true, "FULL": true, "CROSS": true,
+}
+
+type sqlToken struct {
+	text string
+	// spaced is whether whitespace preceded the token in the input
+	spaced bool
+}
+
+// FormatSQL pretty-prints a query canonically: keywords upper-cased, one
+// line per top-level clause, AND/OR conditions of WHERE and HAVING on
+// indented lines of their own, and single spaces elsewhere. Literals,
+// identifiers and function names are left exactly as written, so the
+// output is equivalent SQL and formatting is idempotent.
+func FormatSQL(sql string) string {
+	tokens := tokenizeSQL(strings.TrimSpace(sql))
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	depth := 0
+	inConditions := false // inside a top-level WHERE or HAVING
+	betweenPending := false
+	for i, tok := range tokens {
+		text := tok.text
+		upper := strings.ToUpper(text)
+		word := isWordToken(text)
+
+		// Decide the token's case
+		prevText := ""
+		if i > 0 {
+			prevText = tokens[i-1].text
+		}
+		isFunc := word && i+1 < len(tokens) && tokens[i+1].text == "(" && !tokens[i+1].spaced
+		keyword := false
+		switch {
+		case !word || prevText == "." || strings.EqualFold(prevText, "AS") || isFunc:
+		case sqlKeywords[upper]:
+			keyword = true
+		case intervalUnits[upper] && i >= 2 && strings.EqualFold(tokens[i-2].text, "INTERVAL"):
+			keyword = true
+		case (upper == "FIRST" || upper == "LAST") && strings.EqualFold(prevText, "NULLS"),
+			upper == "TOTALS" && strings.EqualFold(prevText, "WITH"):
+			keyword = true
+		}
+		if keyword {
+			text = upper
+		}
+
+		// Decide what separates it from the previous token
+		sep := " "
+		switch {
+		case i == 0:
+			sep = ""
+		case strings.HasPrefix(prevText, "--"):
+			// A line comment runs to the end of the line
+			sep = "\n"
+		case keyword && depth == 0 && clauseKeywords[upper] && !isJoinContinuation(upper, prevText):
+			sep = "\n"
+			inConditions = upper == "WHERE" || upper == "HAVING" || upper == "PREWHERE"
+		case keyword && depth == 0 && inConditions && (upper == "AND" || upper == "OR") && !(upper == "AND" && betweenPending):
+			sep = "\n  "
+		case text == ")" || text == "," || text == ";" || text == "." || text == "::",
+			prevText == "(" || prevText == "." || prevText == "::",
+			text == "(" && isWordToken(prevText) && !tok.spaced,
+			isUnarySign(tokens, i) && !tok.spaced:
+			sep = ""
+		}
+		if keyword && upper == "AND" && betweenPending {
+			betweenPending = false
+		}
+		if keyword && upper == "BETWEEN" {
+			betweenPending = true
+		}
+
+		switch text {
+		case "(":
+			depth++
+		case ")":
+			if depth > 0 {
+				depth--
+			}
+		}
+		sb.WriteString(sep)
+		sb.WriteString(text)
+	}
+	return sb.String()
+}
+
+// isUnarySign reports whether tokens[i] follows a leading sign, as in -1
+func isUnarySign(tokens []sqlToken, i int) bool {
+	if i == 0 || tokens[i-1].text != "-" && tokens[i-1].text != "+" {
+		return false
+	}
+	if i == 1 {
+		return true
+	}
+	before := tokens[i-2].text
+	if before == ")" || strings.EqualFold(before, "END") {
+		return false
+	}
+	return !(isWordToken(before) && !sqlKeywords[strings.ToUpper(before)]) && !(before[0] >= '0' && before[0] <= '9') && before[0] != '\'' && before[0] != '"' && before[0] != '`'
+}
+
+// isJoinContinuation reports whether word continues a join clause already
+// started on this line, e.g. the JOIN of LEFT OUTER JOIN
+func isJoinContinuation(word, prev string) bool {
+	switch strings.ToUpper(prev) {
+	case "LEFT", "RIGHT", "FULL", "INNER", "CROSS", "OUTER", "ANY", "ALL", "ASOF", "SEMI", "ANTI":
+		return word == "JOIN" || word == "OUTER"
+	case "UNION":
+		return true
+	}
+	return false
+}
+
+func isWordToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	r := rune(s[0])
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// tokenizeSQL splits sql into words, numbers, quoted literals and
+// identifiers, comments and punctuation. Quoted text is kept verbatim.
+func tokenizeSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	spaced := false
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			spaced = true
+			i++
+			continue
+		case c == '\'' || c == '"' || c == '`':
+			i++
+			for i < len(sql) {
+				if sql[i] == '\\' {
+					i += 2
+					continue
+				}
+				if sql[i] == c {
+					// A doubled quote is an escaped quote
+					if i+1 < len(sql) && sql[i+1] == c {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= 0x80:
+			for i < len(sql) && (sql[i] == '_' || sql[i] >= 'A' && sql[i] <= 'Z' || sql[i] >= 'a' && sql[i] <= 'z' || sql[i] >= '0' && sql[i] <= '9' || sql[i] >= 0x80) {
+				i++
+			}
+		case c >= '0' && c <= '9':
+			for i < len(sql) && (sql[i] == '.' || sql[i] == '_' || sql[i] >= '0' && sql[i] <= '9' || sql[i] >= 'A' && sql[i] <= 'Z' || sql[i] >= 'a' && sql[i] <= 'z') {
+				i++
+			}
+		default:
+			i++
+			for _, op := range []string{"<=", ">=", "!=", "<>", "==", "||", "->", "::"} {
+				if strings.HasPrefix(sql[start:], op) {
+					i = start + len(op)
+					break
+				}
+			}
+		}
+		tokens = append(tokens, sqlToken{text: sql[start:i], spaced: spaced})
+		spaced = false
+	}
+	return tokens
+}
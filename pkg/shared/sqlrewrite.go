@@ -0,0 +1,157 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	limitRe     = regexp.MustCompile(`(?i)\bLIMIT\s+\d+`)
+	aggregateRe = regexp.MustCompile(`(?i)\b(SUM|COUNT|AVG|MIN|MAX)(?:If)?\s*\(`)
+	groupByRe   = regexp.MustCompile(`(?i)\bGROUP\s+BY\b`)
+)
+
+// blankLiterals replaces the contents of string literals with spaces, so
+// keywords inside them don't match while offsets into sql stay valid
+func blankLiterals(sql string) string {
+	return literalRe.ReplaceAllStringFunc(sql, func(lit string) string {
+		return "'" + strings.Repeat(" ", len(lit)-2) + "'"
+	})
+}
+
+// IsSingleRowAggregate reports whether the query aggregates without GROUP BY
+// and therefore always returns exactly one row
+func IsSingleRowAggregate(sql string) bool {
+	body := blankLiterals(sql)
+	return aggregateRe.MatchString(body) && !groupByRe.MatchString(body)
+}
+
+// ApplyDefaultLimit appends LIMIT n to queries that can return many rows and
+// have no LIMIT of their own. Returns the rewritten SQL and whether the cap
+// was applied. A non-positive limit disables the cap.
+func ApplyDefaultLimit(sql string, limit int) (string, bool) {
+	if limit <= 0 || limitRe.MatchString(blankLiterals(sql)) || IsSingleRowAggregate(sql) {
+		return sql, false
+	}
+	trimmed := strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	return fmt.Sprintf("%s LIMIT %d;", trimmed, limit), true
+}
+
+var (
+	selectFromRe = regexp.MustCompile(`(?is)^\s*SELECT\s+(?:DISTINCT\s+)?(.+?)\s+FROM\s+([A-Za-z_][A-Za-z0-9_]*)`)
+	limitValueRe = regexp.MustCompile(`(?i)\bLIMIT\s+(\d+)`)
+	aliasRe      = regexp.MustCompile(`(?i)\s+AS\s+([A-Za-z_][A-Za-z0-9_]*)$`)
+)
+
+// IsRowSelect reports whether the query returns table rows as they are,
+// without aggregating them, e.g. SELECT * or SELECT a, b
+func IsRowSelect(sql string) bool {
+	body := blankLiterals(sql)
+	return !aggregateRe.MatchString(body) && !groupByRe.MatchString(body)
+}
+
+// BoundRowSelect makes row selects return the same bounded rows every run:
+// without an ORDER BY it orders by every selected column (the table's
+// columns in schema for SELECT *) but those in unordered, and it lowers a
+// LIMIT above limit. Ordering by a masked column would give away its
+// values' order, so callers pass those as unordered; with no column left
+// no ORDER BY is added. A missing LIMIT is left to ApplyDefaultLimit.
+// Returns the rewritten SQL, the columns of any ORDER BY it added, and
+// whether it lowered the LIMIT. Aggregates, and a non-positive limit,
+// leave the SQL unchanged. Clauses are found outside string literals,
+// which are kept as written.
+func BoundRowSelect(sql string, schema *Schema, limit int, unordered map[string]bool) (string, []string, bool) {
+	if limit <= 0 || !IsRowSelect(sql) {
+		return sql, nil, false
+	}
+
+	lowered := false
+	if m := limitValueRe.FindStringSubmatchIndex(blankLiterals(sql)); m != nil {
+		if n, err := strconv.Atoi(sql[m[2]:m[3]]); err != nil || n > limit {
+			sql = sql[:m[2]] + strconv.Itoa(limit) + sql[m[3]:]
+			lowered = true
+		}
+	}
+
+	body := blankLiterals(sql)
+	var orderBy []string
+	if !orderByRe.MatchString(body) {
+		for _, col := range selectedColumns(sql, schema) {
+			if !unordered[col] {
+				orderBy = append(orderBy, col)
+			}
+		}
+	}
+	if len(orderBy) == 0 {
+		return sql, nil, lowered
+	}
+
+	clause := "ORDER BY " + strings.Join(orderBy, ", ")
+	if loc := limitRe.FindStringIndex(body); loc != nil {
+		return strings.TrimRight(sql[:loc[0]], " ") + " " + clause + " " + sql[loc[0]:], orderBy, lowered
+	}
+	trimmed := strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	return trimmed + " " + clause + ";", orderBy, lowered
+}
+
+// selectedColumns returns the names a row select's results can be ordered
+// by: its aliases and plain expressions, or the table's columns for *.
+// Returns nil if the select list can't be read.
+func selectedColumns(sql string, schema *Schema) []string {
+	m := selectFromRe.FindStringSubmatchIndex(blankLiterals(sql))
+	if m == nil {
+		return nil
+	}
+	list, table := strings.TrimSpace(sql[m[2]:m[3]]), sql[m[4]:m[5]]
+	if list == "*" {
+		if schema == nil {
+			return nil
+		}
+		for _, ds := range schema.Datasources {
+			if ds.Name == table {
+				columns := make([]string, 0, len(ds.Columns))
+				for _, col := range ds.Columns {
+					columns = append(columns, col.Name)
+				}
+				return columns
+			}
+		}
+		return nil
+	}
+
+	var columns []string
+	for _, item := range splitTopLevel(list) {
+		item = strings.TrimSpace(item)
+		if alias := aliasRe.FindStringSubmatch(item); alias != nil {
+			item = alias[1]
+		}
+		if item == "" || item == "*" {
+			return nil
+		}
+		columns = append(columns, item)
+	}
+	return columns
+}
+
+// splitTopLevel splits s at commas outside parentheses and quotes
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start, quoted := 0, 0, false
+	for i, r := range s {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
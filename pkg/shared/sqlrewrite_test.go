@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyDefaultLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		want    string
+		applied bool
+	}{
+		{"no limit", "SELECT * FROM orders", "SELECT * FROM orders LIMIT 100;", true},
+		{"own limit", "SELECT * FROM orders LIMIT 5", "SELECT * FROM orders LIMIT 5", false},
+		{"single-row aggregate", "SELECT count() FROM orders", "SELECT count() FROM orders", false},
+		{"grouped aggregate", "SELECT seller_id, count() FROM orders GROUP BY seller_id", "SELECT seller_id, count() FROM orders GROUP BY seller_id LIMIT 100;", true},
+		{"limit in literal", "SELECT * FROM orders WHERE status != 'LIMIT 1'", "SELECT * FROM orders WHERE status != 'LIMIT 1' LIMIT 100;", true},
+		{"aggregate in literal", "SELECT * FROM orders WHERE status = 'count('", "SELECT * FROM orders WHERE status = 'count(' LIMIT 100;", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, applied := ApplyDefaultLimit(tt.sql, 100)
+			if got != tt.want || applied != tt.applied {
+				t.Errorf("ApplyDefaultLimit(%q) = %q, %v; want %q, %v", tt.sql, got, applied, tt.want, tt.applied)
+			}
+		})
+	}
+}
+
+func TestBoundRowSelect(t *testing.T) {
+	schema := &Schema{Datasources: []Datasource{{
+		Name:    "order_items",
+		Columns: []Column{{Name: "order_id", Type: "String"}, {Name: "price", Type: "Float64"}},
+	}}}
+
+	tests := []struct {
+		name        string
+		sql         string
+		want        string
+		wantOrderBy []string
+		unordered   map[string]bool
+		wantLowered bool
+	}{
+		{"star", "SELECT * FROM order_items", "SELECT * FROM order_items ORDER BY order_id, price;", []string{"order_id", "price"}, nil, false},
+		{"own order", "SELECT price FROM order_items ORDER BY price DESC LIMIT 10", "SELECT price FROM order_items ORDER BY price DESC LIMIT 10", nil, nil, false},
+		{"limit lowered", "SELECT price FROM order_items LIMIT 5000", "SELECT price FROM order_items ORDER BY price LIMIT 100", []string{"price"}, nil, true},
+		{"aggregate", "SELECT count() FROM order_items", "SELECT count() FROM order_items", nil, nil, false},
+		{"limit in literal", "SELECT * FROM order_items WHERE order_id != 'LIMIT 1'", "SELECT * FROM order_items WHERE order_id != 'LIMIT 1' ORDER BY order_id, price;", []string{"order_id", "price"}, nil, false},
+		{"limit in literal and own limit", "SELECT * FROM order_items WHERE order_id != 'LIMIT 1' LIMIT 500", "SELECT * FROM order_items WHERE order_id != 'LIMIT 1' ORDER BY order_id, price LIMIT 100", []string{"order_id", "price"}, nil, true},
+		{"order by in literal", "SELECT price FROM order_items WHERE order_id = 'ORDER BY x'", "SELECT price FROM order_items WHERE order_id = 'ORDER BY x' ORDER BY price;", []string{"price"}, nil, false},
+		{"masked column skipped", "SELECT * FROM order_items", "SELECT * FROM order_items ORDER BY order_id;", []string{"order_id"}, map[string]bool{"price": true}, false},
+		{"only masked columns", "SELECT price FROM order_items LIMIT 5000", "SELECT price FROM order_items LIMIT 100", nil, map[string]bool{"price": true}, true},
+		{"aggregate in literal", "SELECT price FROM order_items WHERE order_id = 'sum('", "SELECT price FROM order_items WHERE order_id = 'sum(' ORDER BY price;", []string{"price"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, orderBy, lowered := BoundRowSelect(tt.sql, schema, 100, tt.unordered)
+			if got != tt.want || strings.Join(orderBy, ",") != strings.Join(tt.wantOrderBy, ",") || lowered != tt.wantLowered {
+				t.Errorf("BoundRowSelect(%q) = %q, %v, %v; want %q, %v, %v", tt.sql, got, orderBy, lowered, tt.want, tt.wantOrderBy, tt.wantLowered)
+			}
+		})
+	}
+}
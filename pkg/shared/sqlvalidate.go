@@ -0,0 +1,90 @@
+package shared
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// ValidateLiterals re-tokenizes generated SQL the way ClickHouse will and
+// rejects anything the grammar's STRING terminal (/'[^']*'/) should have
+// made impossible: unterminated literals, backslashes (ClickHouse treats
+// \' as an escaped quote, so the literal would end somewhere else),
+// semicolons or comment markers inside literals, comments outside them, and
+// more than one statement. Errors are nlerrors.ErrGrammarViolation.
+func ValidateLiterals(sql string) error {
+	violation := func(reason string) error {
+		return nlerrors.ErrGrammarViolation{SQL: sql, Reason: reason}
+	}
+
+	body := strings.TrimSpace(sql)
+	body = strings.TrimSuffix(body, ";")
+
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\'':
+			end := strings.IndexByte(body[i+1:], '\'')
+			if end < 0 {
+				return violation("unterminated string literal")
+			}
+			literal := body[i+1 : i+1+end]
+			switch {
+			case strings.Contains(literal, `\`):
+				return violation("backslash in string literal")
+			case strings.Contains(literal, ";"):
+				return violation("semicolon in string literal")
+			case strings.Contains(literal, "--"), strings.Contains(literal, "/*"), strings.Contains(literal, "*/"):
+				return violation("comment sequence in string literal")
+			}
+			i += end + 1
+		case c == ';':
+			return violation("multiple statements")
+		case c == '-' && strings.HasPrefix(body[i:], "--"),
+			c == '/' && strings.HasPrefix(body[i:], "/*"),
+			c == '#':
+			return violation("comment outside string literal")
+		case c == '"' || c == '`' || c == '\\':
+			return violation("unexpected quote or escape character")
+		}
+	}
+	return nil
+}
+
+// deniedKeywords can never appear outside string literals in a read-only query
+var deniedKeywords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "DROP": true, "ALTER": true,
+	"CREATE": true, "TRUNCATE": true, "RENAME": true, "ATTACH": true, "DETACH": true,
+	"GRANT": true, "REVOKE": true, "SYSTEM": true, "KILL": true, "OPTIMIZE": true,
+	"SET": true, "SETTINGS": true, "OUTFILE": true, "INFILE": true, "EXCHANGE": true,
+	"USE": true, "BACKUP": true, "RESTORE": true,
+}
+
+var (
+	literalRe     = regexp.MustCompile(`'[^']*'`)
+	wordRe        = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+	selectStartRe = regexp.MustCompile(`(?i)^\s*SELECT\b`)
+)
+
+// CheckStatement is the last gate before SQL reaches the warehouse,
+// independent of the grammar: on top of ValidateLiterals it requires a
+// single SELECT statement and rejects any deny-listed keyword outside
+// string literals.
+func CheckStatement(sql string) error {
+	if err := ValidateLiterals(sql); err != nil {
+		return err
+	}
+
+	// The statement itself must start with SELECT, not merely its first
+	// word: "0SELECT" or "'x' SELECT" are something else
+	body := literalRe.ReplaceAllString(sql, "''")
+	if !selectStartRe.MatchString(body) {
+		return nlerrors.ErrGrammarViolation{SQL: sql, Reason: "only SELECT statements are allowed"}
+	}
+	for _, w := range wordRe.FindAllString(body, -1) {
+		if deniedKeywords[strings.ToUpper(w)] {
+			return nlerrors.ErrGrammarViolation{SQL: sql, Reason: "denied keyword " + strings.ToUpper(w)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package shared
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// hostileSQL seeds the fuzzers with what a prompt-injected model might emit
+var hostileSQL = []string{
+	"SELECT count() FROM orders",
+	"SELECT * FROM orders WHERE status = 'delivered' LIMIT 10;",
+	"SELECT * FROM orders WHERE status = 'x'; DROP TABLE orders",
+	"SELECT * FROM orders WHERE status = 'x\\'; DROP TABLE orders; --'",
+	"SELECT * FROM orders WHERE status = 'it''s'",
+	"SELECT * FROM orders -- ignore the rest",
+	"SELECT * FROM orders /* hidden */ WHERE 1 = 1",
+	"SELECT * FROM orders WHERE status = '-- not a comment'",
+	"SELECT * FROM orders WHERE status = 'unterminated",
+	"SELECT \"price\" FROM orders",
+	"SELECT `price` FROM orders",
+	"SELECT * FROM orders # comment",
+	"INSERT INTO orders VALUES ('x')",
+	"select price from orders settings max_threads = 64",
+	"SELECT * FROM orders INTO OUTFILE '/tmp/x'",
+	"SELECT * FROM orders WHERE status = 'DROP TABLE orders'",
+	"WITH x AS (SELECT 1) SELECT * FROM x",
+	"0SELECT ",
+	"'x' SELECT 1",
+	"",
+	";",
+	"'",
+}
+
+// splitLiterals splits body into the text outside single-quoted literals
+// and the literals' contents, the way ClickHouse reads them without
+// escapes. ok is false if a literal is unterminated.
+func splitLiterals(body string) (outside string, literals []string, ok bool) {
+	var out strings.Builder
+	for {
+		i := strings.IndexByte(body, '\'')
+		if i < 0 {
+			out.WriteString(body)
+			return out.String(), literals, true
+		}
+		out.WriteString(body[:i])
+		out.WriteString("''")
+		end := strings.IndexByte(body[i+1:], '\'')
+		if end < 0 {
+			return out.String(), literals, false
+		}
+		literals = append(literals, body[i+1:i+1+end])
+		body = body[i+1+end+1:]
+	}
+}
+
+func FuzzValidateLiterals(f *testing.F) {
+	for _, sql := range hostileSQL {
+		f.Add(sql)
+	}
+	f.Fuzz(func(t *testing.T, sql string) {
+		err := ValidateLiterals(sql)
+		if err != nil {
+			var violation nlerrors.ErrGrammarViolation
+			if !errors.As(err, &violation) {
+				t.Fatalf("error %v is not a grammar violation", err)
+			}
+			return
+		}
+
+		body := strings.TrimSuffix(strings.TrimSpace(sql), ";")
+		outside, literals, ok := splitLiterals(body)
+		if !ok {
+			t.Fatalf("accepted an unterminated literal: %q", sql)
+		}
+		for _, lit := range literals {
+			for _, bad := range []string{`\`, ";", "--", "/*", "*/"} {
+				if strings.Contains(lit, bad) {
+					t.Fatalf("accepted %q inside literal %q: %q", bad, lit, sql)
+				}
+			}
+		}
+		for _, bad := range []string{";", "--", "/*", "#", `"`, "`", `\`} {
+			if strings.Contains(outside, bad) {
+				t.Fatalf("accepted %q outside literals: %q", bad, sql)
+			}
+		}
+	})
+}
+
+func FuzzCheckStatement(f *testing.F) {
+	for _, sql := range hostileSQL {
+		f.Add(sql)
+	}
+	f.Fuzz(func(t *testing.T, sql string) {
+		if CheckStatement(sql) != nil {
+			return
+		}
+		if err := ValidateLiterals(sql); err != nil {
+			t.Fatalf("accepted SQL that fails ValidateLiterals (%v): %q", err, sql)
+		}
+
+		outside, _, _ := splitLiterals(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+		words := strings.FieldsFunc(outside, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		})
+		// The statement, not just its first word, must start with SELECT
+		if len(words) == 0 || !strings.EqualFold(words[0], "SELECT") || !strings.HasPrefix(strings.TrimSpace(outside), words[0]) {
+			t.Fatalf("accepted a statement that isn't a SELECT: %q", sql)
+		}
+		for _, w := range words {
+			if deniedKeywords[strings.ToUpper(w)] {
+				t.Fatalf("accepted denied keyword %s: %q", w, sql)
+			}
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Start-up modes: what nl2sql serve does when Tinybird can't be reached
+const (
+	// StartupFail starts without waiting for Tinybird, and exits if
+	// PREFLIGHT is on and fails
+	StartupFail = "fail"
+	// StartupRetry waits for Tinybird with backoff, up to STARTUP_TIMEOUT,
+	// before serving
+	StartupRetry = "retry"
+	// StartupDegraded serves generate_only at once, against
+	// SCHEMA_FALLBACK_FILE if set, and returns to normal when Tinybird is
+	// reachable
+	StartupDegraded = "degraded"
+)
+
+// Backoff between start-up schema fetches
+const (
+	startupInitialBackoff = time.Second
+	startupMaxBackoff     = 30 * time.Second
+)
+
+// FetchSchemaWithBackoff fetches the schema from warehouse, retrying
+// failures with exponential backoff until it succeeds, ctx is done or
+// timeout (when positive) has passed. It returns the last error on giving up.
+func FetchSchemaWithBackoff(ctx context.Context, warehouse Warehouse, timeout time.Duration, logger *slog.Logger) (*Schema, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	backoff := startupInitialBackoff
+	for attempt := 1; ; attempt++ {
+		schema, err := warehouse.FetchSchema()
+		if err == nil {
+			return schema, nil
+		}
+		logger.Warn("Tinybird unavailable, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, startupMaxBackoff)
+	}
+}
+
+// LoadSchemaFile reads a schema saved by `nl2sql schema dump`
+func LoadSchemaFile(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %w", err)
+	}
+	var schema Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema file %s: %w", path, err)
+	}
+	return &schema, nil
+}
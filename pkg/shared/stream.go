@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
+)
+
+// RowStreamer is implemented by warehouses that can hand rows to the caller
+// as they are decoded instead of buffering the whole result
+type RowStreamer interface {
+	// StreamQuery calls fn for each row in order. The returned response
+	// carries Meta, Rows and Statistics but no Data. An error from fn stops
+	// the stream and is returned.
+	StreamQuery(sql string, fn func(row map[string]interface{}) error) (*TinybirdResponse, error)
+}
+
+// StreamQuery runs a read-only query like ExecuteQuery but decodes the
+// FORMAT JSON body incrementally, so memory stays bounded by one row
+func (c *TinybirdClient) StreamQuery(sql string, fn func(row map[string]interface{}) error) (*TinybirdResponse, error) {
+	if err := CheckStatement(sql); err != nil {
+		return nil, err
+	}
+	sql = c.questionComment() + appendSettings(sql, c.tagSettings(c.settings))
+	reqURL := fmt.Sprintf("%s/sql?q=%s", c.endpoint(), url.QueryEscape(sql+" FORMAT JSON"))
+
+	var result *TinybirdResponse
+	err := c.doStream(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+		return req, nil
+	}, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return warehouseStatusError(resp.StatusCode, body)
+		}
+		var err error
+		result, err = decodeJSONStream(resp.Body, fn)
+		return err
+	})
+	if err != nil {
+		var coded nlerrors.Error
+		if !errors.As(err, &coded) {
+			err = nlerrors.ErrWarehouse{Err: err}
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodeJSONStream walks a ClickHouse FORMAT JSON document, passing each
+// element of "data" to fn and keeping the other top-level fields
+func decodeJSONStream(r io.Reader, fn func(row map[string]interface{}) error) (*TinybirdResponse, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	result := &TinybirdResponse{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+		key, _ := tok.(string)
+		switch key {
+		case "meta":
+			err = dec.Decode(&result.Meta)
+		case "rows":
+			err = dec.Decode(&result.Rows)
+		case "statistics":
+			err = dec.Decode(&result.Statistics)
+		case "data":
+			if err = expectDelim(dec, '['); err != nil {
+				return nil, err
+			}
+			for dec.More() {
+				var row map[string]interface{}
+				if err := dec.Decode(&row); err != nil {
+					return nil, fmt.Errorf("failed to parse row: %w", err)
+				}
+				if err := fn(row); err != nil {
+					return nil, err
+				}
+			}
+			err = expectDelim(dec, ']')
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return result, nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("failed to parse response: expected %q, got %v", want, tok)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxSuggestionsPerDatasource bounds the examples offered for one table
+const maxSuggestionsPerDatasource = 6
+
+// Suggestion is an example question the schema can answer
+type Suggestion struct {
+	Datasource string `json:"datasource,omitempty"`
+	Question   string `json:"question"`
+	// Columns are the columns the question relies on, so callers can drop
+	// suggestions an API key could not ask
+	Columns []string `json:"columns,omitempty"`
+}
+
+// SuggestQuestions builds example questions for each datasource from
+// templates: counts, totals and averages of numeric columns, breakdowns by
+// a text dimension, top-N by a measure and recent activity by a date column.
+// Every question stays within what the grammar can express.
+func SuggestQuestions(schema *Schema) []Suggestion {
+	datasources := append([]Datasource(nil), schema.Datasources...)
+	sort.Slice(datasources, func(i, j int) bool { return datasources[i].Name < datasources[j].Name })
+
+	var suggestions []Suggestion
+	for _, ds := range datasources {
+		table := humanize(ds.Name)
+		var measures, dimensions, dates []Column
+		for _, col := range ds.Columns {
+			switch {
+			case isNumericType(col.Type) && !isIdentifier(col.Name):
+				measures = append(measures, col)
+			case isDateType(col.Type):
+				dates = append(dates, col)
+			case strings.HasPrefix(baseType(col.Type), "String") || isIdentifier(col.Name):
+				dimensions = append(dimensions, col)
+			}
+		}
+
+		var dsSuggestions []Suggestion
+		add := func(question string, columns ...Column) {
+			names := make([]string, 0, len(columns))
+			for _, c := range columns {
+				names = append(names, c.Name)
+			}
+			dsSuggestions = append(dsSuggestions, Suggestion{Datasource: ds.Name, Question: question, Columns: names})
+		}
+
+		add(fmt.Sprintf("How many %s are there?", table))
+		if len(measures) > 0 {
+			m := measures[0]
+			add(fmt.Sprintf("What is the total %s?", humanize(m.Name)), m)
+			add(fmt.Sprintf("Show the top 10 %s by %s", table, humanize(m.Name)), m)
+			if len(dimensions) > 0 {
+				d := dimensions[0]
+				add(fmt.Sprintf("What is the total %s by %s?", humanize(m.Name), humanize(d.Name)), m, d)
+			}
+		}
+		if len(dates) > 0 {
+			add(fmt.Sprintf("How many %s were there in the last 30 days?", table), dates[0])
+		}
+		for i := 1; i < len(measures); i++ {
+			add(fmt.Sprintf("What is the average %s?", humanize(measures[i].Name)), measures[i])
+		}
+
+		if len(dsSuggestions) > maxSuggestionsPerDatasource {
+			dsSuggestions = dsSuggestions[:maxSuggestionsPerDatasource]
+		}
+		suggestions = append(suggestions, dsSuggestions...)
+	}
+	return suggestions
+}
+
+// isIdentifier reports whether a column names an entity rather than a
+// quantity, so "total order id" is never suggested
+func isIdentifier(name string) bool {
+	return name == "id" || strings.HasSuffix(name, "_id")
+}
+
+const polishPrompt = `Rewrite each of these example questions for a data analytics tool so it reads naturally to a business user. Keep the meaning, every number and every referenced field exactly. Return one question per line, in the same order, with no numbering or extra text.
+
+%s`
+
+// PolishSuggestions asks the model to reword the template questions. If the
+// call fails or the answer doesn't line up one-to-one, the templates are
+// returned unchanged.
+func PolishSuggestions(llm Completer, suggestions []Suggestion) ([]Suggestion, Usage, error) {
+	if len(suggestions) == 0 {
+		return suggestions, Usage{}, nil
+	}
+	questions := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		questions[i] = s.Question
+	}
+
+	text, usage, err := llm.Complete(fmt.Sprintf(polishPrompt, strings.Join(questions, "\n")))
+	if err != nil {
+		return suggestions, usage, err
+	}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != len(suggestions) {
+		return suggestions, usage, fmt.Errorf("polish returned %d questions for %d suggestions", len(lines), len(suggestions))
+	}
+
+	polished := make([]Suggestion, len(suggestions))
+	for i, s := range suggestions {
+		s.Question = lines[i]
+		polished[i] = s
+	}
+	return polished, usage, nil
+}
+
+var (
+	suggestionMu    sync.Mutex
+	suggestionCache = make(map[*Schema][]Suggestion)
+)
+
+// CachedSuggestions returns the suggestions for schema, generating them on
+// first use. With llm they are polished once per schema; a failed polish
+// falls back to the templates and is retried when the schema is refreshed.
+// Like the compiled grammar, entries are keyed by the cached *Schema.
+func CachedSuggestions(schema *Schema, llm Completer) ([]Suggestion, error) {
+	suggestionMu.Lock()
+	cached, ok := suggestionCache[schema]
+	suggestionMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	suggestions := SuggestQuestions(schema)
+	var err error
+	if llm != nil {
+		suggestions, _, err = PolishSuggestions(llm, suggestions)
+	}
+
+	suggestionMu.Lock()
+	defer suggestionMu.Unlock()
+	if len(suggestionCache) >= 32 {
+		suggestionCache = make(map[*Schema][]Suggestion)
+	}
+	suggestionCache[schema] = suggestions
+	return suggestions, err
+}
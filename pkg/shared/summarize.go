@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// summaryRows bounds the rows sent to the model when summarizing
+const summaryRows = 50
+
+const summaryPrompt = `Write one plain-English sentence that answers the question from these query results, as a headline for a business user. Mention the key numbers. Do not describe the SQL, speculate beyond the data, or add anything else.
+
+Question: %s
+Rows returned: %d
+Results (JSON, first %d rows): %s`
+
+// SummarizeResult asks the model for a one-sentence headline answering
+// question from a result set. Only the first rows are sent.
+func SummarizeResult(llm Completer, question string, data []map[string]interface{}, rows int) (string, Usage, error) {
+	sample := data
+	if len(sample) > summaryRows {
+		sample = sample[:summaryRows]
+	}
+	body, err := json.Marshal(sample)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	return llm.Complete(fmt.Sprintf(summaryPrompt, question, rows, len(sample), body))
+}
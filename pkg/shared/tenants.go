@@ -0,0 +1,153 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Aggregates are the aggregate functions the grammar can generate
+var Aggregates = []string{"SUM", "COUNT", "AVG", "MIN", "MAX"}
+
+// TenantProfile shapes generation for one business: what the model is told,
+// the vocabulary it should understand and what it may generate. Empty
+// fields keep the default behaviour.
+type TenantProfile struct {
+	// Prompt replaces the default guidance in the generation prompt, e.g.
+	// how this tenant's tables relate and when to group
+	Prompt string `json:"prompt,omitempty"`
+	// Glossary defines the tenant's business terms, e.g. "GMV" as the sum
+	// of price plus freight_value
+	Glossary map[string]string `json:"glossary,omitempty"`
+	// Display holds presentation hints per column, returned with results
+	Display map[string]ColumnDisplay `json:"display,omitempty"`
+	// Grammar narrows what the grammar can generate
+	Grammar *GrammarProfile `json:"grammar,omitempty"`
+	// Examples replace the generated /api/suggestions questions
+	Examples []string `json:"examples,omitempty"`
+}
+
+// GrammarProfile restricts generation to some tables and aggregate
+// functions. Empty lists allow everything.
+type GrammarProfile struct {
+	Tables     []string `json:"tables,omitempty"`
+	Aggregates []string `json:"aggregates,omitempty"`
+}
+
+// tenantsFile is a TENANTS_FILE. A tenant's profile is layered field by
+// field over the default one.
+type tenantsFile struct {
+	Default TenantProfile            `json:"default"`
+	Tenants map[string]TenantProfile `json:"tenants"`
+}
+
+// LoadTenantProfile returns the profile for tenant ("" for requests without
+// an API key), or nil without a TENANTS_FILE. The file is read on every
+// call, like POSTPROCESSORS_FILE, so edits apply to the next request.
+func LoadTenantProfile(cfg *Config, tenant string) (*TenantProfile, error) {
+	if cfg.TenantsFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.TenantsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant profiles: %w", err)
+	}
+	var file tenantsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %w", cfg.TenantsFile, err)
+	}
+
+	profile := file.Default
+	if override, ok := file.Tenants[tenant]; ok && tenant != "" {
+		if override.Prompt != "" {
+			profile.Prompt = override.Prompt
+		}
+		if override.Glossary != nil {
+			profile.Glossary = override.Glossary
+		}
+		if override.Display != nil {
+			profile.Display = override.Display
+		}
+		if override.Grammar != nil {
+			profile.Grammar = override.Grammar
+		}
+		if override.Examples != nil {
+			profile.Examples = override.Examples
+		}
+	}
+	if profile.Grammar != nil {
+		for _, agg := range profile.Grammar.Aggregates {
+			if !containsString(Aggregates, strings.ToUpper(agg)) {
+				return nil, fmt.Errorf("tenants file %s: unknown aggregate %q (have %s)", cfg.TenantsFile, agg, strings.Join(Aggregates, ", "))
+			}
+		}
+	}
+	for col, d := range profile.Display {
+		if err := d.validate(); err != nil {
+			return nil, fmt.Errorf("tenants file %s: display %s: %w", cfg.TenantsFile, col, err)
+		}
+	}
+	return &profile, nil
+}
+
+// ApplyGrammar narrows schema to the profile's tables and aggregates.
+// Tables the schema lacks are skipped rather than refused, since an API key
+// may already have hidden them. A nil profile or grammar returns schema.
+func (p *TenantProfile) ApplyGrammar(schema *Schema) *Schema {
+	if p == nil || p.Grammar == nil {
+		return schema
+	}
+	narrowed := schema
+	if len(p.Grammar.Tables) > 0 {
+		var tables []string
+		for _, ds := range schema.Datasources {
+			if containsString(p.Grammar.Tables, ds.Name) {
+				tables = append(tables, ds.Name)
+			}
+		}
+		// Only names from the schema, so Subset can't fail
+		narrowed, _ = schema.Subset(tables)
+	}
+	if len(p.Grammar.Aggregates) > 0 {
+		copied := *narrowed
+		copied.Aggregates = nil
+		for _, agg := range p.Grammar.Aggregates {
+			copied.Aggregates = append(copied.Aggregates, strings.ToUpper(agg))
+		}
+		narrowed = &copied
+	}
+	return narrowed
+}
+
+// Suggestions returns the profile's example questions as suggestions, or
+// nil if it has none
+func (p *TenantProfile) Suggestions() []Suggestion {
+	if p == nil || p.Examples == nil {
+		return nil
+	}
+	out := make([]Suggestion, 0, len(p.Examples))
+	for _, q := range p.Examples {
+		out = append(out, Suggestion{Question: q})
+	}
+	return out
+}
+
+// glossaryPrompt renders glossary as prompt lines, sorted by term
+func glossaryPrompt(glossary map[string]string) string {
+	if len(glossary) == 0 {
+		return ""
+	}
+	terms := make([]string, 0, len(glossary))
+	for term := range glossary {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	var sb strings.Builder
+	sb.WriteString("Business terms (use these meanings when they appear in the query):\n")
+	for _, term := range terms {
+		sb.WriteString(fmt.Sprintf("- %s: %s\n", term, glossary[term]))
+	}
+	return sb.String()
+}
@@ -0,0 +1,52 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+
+	// Embedded so zones resolve on hosts without a zoneinfo database,
+	// such as the Vercel Go runtime
+	_ "time/tzdata"
+)
+
+// LoadTimezone resolves an IANA time zone name such as "America/Sao_Paulo".
+// An empty name is UTC.
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// referenceTimePrompt tells the model what time it is. Outside UTC it also
+// gives the user's local time and asks for relative dates to be resolved
+// there, with boundaries written as UTC literals because the data is UTC.
+func referenceTimePrompt(now time.Time) string {
+	const layout = "2006-01-02 15:04:05"
+	prompt := "Current UTC time: " + now.UTC().Format(layout)
+	if now.Location() == time.UTC {
+		return prompt
+	}
+	return prompt + fmt.Sprintf(`
+The user's time zone is %s (UTC%s), where it is now %s. Interpret relative dates such as "today", "yesterday" or "this month" in the user's time zone, then convert their boundaries to UTC for timestamp literals.`,
+		now.Location(), now.Format("-07:00"), now.Format(layout))
+}
+
+// ParseReferenceTime parses an as-of time for relative dates: RFC 3339, or
+// "2006-01-02 15:04:05" or "2006-01-02" in loc. A bare date means the start
+// of that day.
+func ParseReferenceTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.In(loc), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid as_of %q (want RFC 3339, YYYY-MM-DD HH:MM:SS or YYYY-MM-DD)", s)
+}
@@ -3,15 +3,35 @@ package shared
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/raindrop/nl2sql/pkg/nlerrors"
 )
 
 type TinybirdClient struct {
-	host  string
-	token string
+	clientOptions
+	host    string
+	token   string
+	apiBase string
+	// descriptionsFile overrides datasource and column descriptions
+	descriptionsFile string
+	// relationships are the SCHEMA_RELATIONSHIPS foreign keys
+	relationships string
+	// metricsFile holds the METRICS_FILE definitions
+	metricsFile string
+	// settings are the CLICKHOUSE_SETTINGS added to executed queries
+	settings []ClickHouseSetting
+	// tag is sent as log_comment with every query
+	tag QueryTag
+	// question, with QUERY_COMMENT on, prefixes executed queries as a comment
+	question string
+	comment  bool
+	// columnStats makes FetchSchema collect ColumnStats, except for the
+	// masked columns
+	columnStats bool
+	masked      map[string]string
 }
 
 type TinybirdResponse struct {
@@ -21,38 +41,63 @@ type TinybirdResponse struct {
 	Statistics map[string]interface{}   `json:"statistics"`
 }
 
-func NewTinybirdClient(cfg *Config) *TinybirdClient {
+func NewTinybirdClient(cfg *Config, opts ...ClientOption) *TinybirdClient {
+	apiBase := cfg.TinybirdAPIBase
+	if apiBase == "" {
+		apiBase = DefaultTinybirdAPIBase
+	}
+	// CLICKHOUSE_SETTINGS was validated when the config was loaded
+	settings, _ := ParseClickHouseSettings(cfg.ClickHouseSettings)
+	// So was MASKED_COLUMNS
+	masked, _ := parseMaskSpec(cfg.MaskedColumns)
 	return &TinybirdClient{
-		host:  cfg.TinybirdHost,
-		token: cfg.TinybirdToken,
+		clientOptions: newClientOptions(opts),
+		host:          cfg.TinybirdHost,
+		token:         cfg.TinybirdToken,
+		apiBase:       apiBase,
+
+		descriptionsFile: cfg.SchemaDescriptionsFile,
+		relationships:    cfg.SchemaRelationships,
+		metricsFile:      cfg.MetricsFile,
+		settings:         settings,
+		tag:              QueryTag{App: cfg.QueryTag},
+		comment:          cfg.QueryComment,
+		columnStats:      cfg.ColumnStats,
+		masked:           masked,
 	}
 }
 
+// ExecuteQuery runs a read-only query with CLICKHOUSE_SETTINGS, the query
+// tag and the question comment, rejecting SQL that fails CheckStatement
+// without contacting Tinybird.
 func (c *TinybirdClient) ExecuteQuery(sql string) (*TinybirdResponse, error) {
+	if err := CheckStatement(sql); err != nil {
+		return nil, err
+	}
+	return c.query(c.questionComment() + appendSettings(sql, c.tagSettings(c.settings)))
+}
+
+// query sends sql as-is
+func (c *TinybirdClient) query(sql string) (*TinybirdResponse, error) {
 	// Strip trailing semicolon - Tinybird doesn't like it with FORMAT JSON
 	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
 	query := fmt.Sprintf("%s FORMAT JSON", sql)
-	reqURL := fmt.Sprintf("%s/v0/sql?q=%s", c.host, url.QueryEscape(query))
-
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
-	}
-	defer resp.Body.Close()
+	reqURL := fmt.Sprintf("%s/sql?q=%s", c.endpoint(), url.QueryEscape(query))
 
-	body, err := io.ReadAll(resp.Body)
+	status, body, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+		return req, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, nlerrors.ErrWarehouse{Err: err}
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("tinybird error (%d): %s", resp.StatusCode, string(body))
+	if err := warehouseStatusError(status, body); err != nil {
+		return nil, err
 	}
 
 	var result TinybirdResponse
@@ -63,3 +108,18 @@ func (c *TinybirdClient) ExecuteQuery(sql string) (*TinybirdResponse, error) {
 	return &result, nil
 }
 
+// warehouseStatusError converts a non-200 Tinybird response to a typed error
+func warehouseStatusError(status int, body []byte) error {
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusTooManyRequests:
+		return nlerrors.ErrRateLimited{Service: "tinybird"}
+	}
+	return nlerrors.ErrWarehouse{Status: status, Message: string(body)}
+}
+
+// endpoint returns the versioned API root, e.g. https://api.tinybird.co/v0
+func (c *TinybirdClient) endpoint() string {
+	return c.host + c.apiBase
+}
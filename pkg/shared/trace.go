@@ -0,0 +1,321 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Services a TraceCall is made to
+const (
+	TraceOpenAI   = "openai"
+	TraceTinybird = "tinybird"
+)
+
+// maxTraceBody bounds each body kept in a trace
+const maxTraceBody = 1 << 20
+
+// Trace collects what one API request sent to OpenAI and Tinybird, for a
+// support bundle. Clients add to it through Tracer; the handler fills in
+// the rest. Safe for concurrent use.
+type Trace struct {
+	mu    sync.Mutex
+	calls []TraceCall
+}
+
+// TraceCall is one HTTP call to OpenAI or Tinybird. Retries are separate
+// calls with increasing Attempt.
+type TraceCall struct {
+	Service    string          `json:"service"`
+	Method     string          `json:"method"`
+	URL        string          `json:"url"`
+	Attempt    int             `json:"attempt"`
+	Request    json.RawMessage `json:"request,omitempty"`
+	Status     int             `json:"status,omitempty"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+}
+
+// Tracer is a client that can record its calls to a Trace
+type Tracer interface {
+	TraceTo(trace *Trace)
+}
+
+// TraceBundle is the downloadable trace of one request. Result rows are
+// never part of it: Tinybird responses keep their metadata and statistics
+// only, and so does the API response.
+type TraceBundle struct {
+	RequestID  string          `json:"request_id"`
+	Time       time.Time       `json:"time"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Tenant     string          `json:"tenant,omitempty"`
+	Request    json.RawMessage `json:"request,omitempty"`
+	Status     int             `json:"status"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+	// ServerTiming is the response's Server-Timing header
+	ServerTiming string `json:"server_timing,omitempty"`
+	// Model, Prompt, Grammar and GeneratedSQL are from the last SQL
+	// generation call
+	Model        string `json:"model,omitempty"`
+	Prompt       string `json:"prompt,omitempty"`
+	Grammar      string `json:"grammar,omitempty"`
+	GeneratedSQL string `json:"generated_sql,omitempty"`
+	// SQL is the SQL of the response, as returned to the caller
+	SQL   string      `json:"sql,omitempty"`
+	Calls []TraceCall `json:"calls"`
+}
+
+// TraceSummary lists a stored trace
+type TraceSummary struct {
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+}
+
+// Tracing reports whether requests should be traced
+func Tracing(cfg *Config) bool {
+	return cfg.TraceBuffer > 0 || cfg.TraceDir != ""
+}
+
+// TraceTo records the client's calls to trace
+func (c *OpenAIClient) TraceTo(trace *Trace) {
+	c.trace, c.traceService = trace, TraceOpenAI
+}
+
+// TraceTo records the client's calls to trace
+func (c *TinybirdClient) TraceTo(trace *Trace) {
+	c.trace, c.traceService = trace, TraceTinybird
+}
+
+// record adds one attempt of a client call; a nil trace ignores it
+func (t *Trace) record(service string, req *http.Request, attempt, status int, body []byte, err error, d time.Duration) {
+	if t == nil || req == nil {
+		return
+	}
+	call := TraceCall{
+		Service:    service,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Attempt:    attempt,
+		Status:     status,
+		DurationMs: d.Milliseconds(),
+	}
+	if req.GetBody != nil {
+		if rc, err := req.GetBody(); err == nil {
+			reqBody, _ := io.ReadAll(io.LimitReader(rc, maxTraceBody))
+			call.Request = TraceJSON(reqBody, false)
+		}
+	}
+	call.Response = TraceJSON(body, service == TraceTinybird)
+	if err != nil {
+		call.Error = err.Error()
+	}
+	t.mu.Lock()
+	t.calls = append(t.calls, call)
+	t.mu.Unlock()
+}
+
+// Calls returns the calls recorded so far
+func (t *Trace) Calls() []TraceCall {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceCall(nil), t.calls...)
+}
+
+// traceJSON keeps body as JSON, or as a JSON string when it isn't JSON.
+// withoutData drops the "data" field of an object, so rows stay out.
+func TraceJSON(body []byte, withoutData bool) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if len(body) > maxTraceBody {
+		body = body[:maxTraceBody]
+	}
+	if !json.Valid(body) {
+		s, _ := json.Marshal(string(body))
+		return s
+	}
+	if withoutData {
+		return WithoutData(body)
+	}
+	return body
+}
+
+// WithoutData returns body without the "data" field, if it is a JSON
+// object with one
+func WithoutData(body []byte) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	if _, ok := fields["data"]; !ok {
+		return body
+	}
+	delete(fields, "data")
+	out, _ := json.Marshal(fields)
+	return out
+}
+
+// Finish fills in the bundle's generation details from the recorded calls
+func (b *TraceBundle) Finish(calls []TraceCall) {
+	b.Calls = calls
+	if b.Calls == nil {
+		b.Calls = []TraceCall{}
+	}
+	for _, call := range b.Calls {
+		if call.Service != TraceOpenAI {
+			continue
+		}
+		var req ResponsesRequest
+		if json.Unmarshal(call.Request, &req) != nil {
+			continue
+		}
+		// Other completions, such as plan explanations, have no SQL tool
+		generation := false
+		for _, tool := range req.Tools {
+			if tool.Name == "sql_generator" {
+				generation = true
+				b.Model, b.Prompt, b.GeneratedSQL = req.Model, req.Input, ""
+				if tool.Format != nil {
+					b.Grammar = tool.Format.Definition
+				}
+			}
+		}
+		if !generation {
+			continue
+		}
+		var resp ResponsesResponse
+		if json.Unmarshal(call.Response, &resp) != nil {
+			continue
+		}
+		for _, item := range resp.Output {
+			if item.Type == "custom_tool_call" && item.Name == "sql_generator" {
+				b.GeneratedSQL = item.Input
+			}
+		}
+	}
+	var resp struct {
+		SQL string `json:"sql"`
+	}
+	if json.Unmarshal(b.Response, &resp) == nil {
+		b.SQL = resp.SQL
+	}
+}
+
+// traceIDRe matches request IDs that are safe as file names
+var traceIDRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// TraceFileName is the file name of requestID's bundle, for downloads and
+// TRACE_DIR. Request IDs can come from callers, so any but plain ones get
+// a generic name.
+func TraceFileName(requestID string) string {
+	if !traceIDRe.MatchString(requestID) {
+		return "trace.json"
+	}
+	return "trace-" + requestID + ".json"
+}
+
+// TraceStore keeps the last TRACE_BUFFER bundles in memory and, with
+// TRACE_DIR, writes each to <dir>/<request_id>.json, so a bundle can be
+// fetched from another instance or after a restart. Safe for concurrent use.
+type TraceStore struct {
+	mu      sync.Mutex
+	order   []string
+	bundles map[string][]byte
+}
+
+func NewTraceStore() *TraceStore {
+	return &TraceStore{bundles: make(map[string][]byte)}
+}
+
+// Save stores bundle. A nil store ignores it.
+func (s *TraceStore) Save(cfg *Config, bundle *TraceBundle) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal trace: %w", err)
+	}
+
+	if cfg.TraceBuffer > 0 {
+		s.mu.Lock()
+		if _, ok := s.bundles[bundle.RequestID]; !ok {
+			s.order = append(s.order, bundle.RequestID)
+		}
+		s.bundles[bundle.RequestID] = data
+		for len(s.order) > cfg.TraceBuffer {
+			delete(s.bundles, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.mu.Unlock()
+	}
+
+	if cfg.TraceDir == "" || !traceIDRe.MatchString(bundle.RequestID) {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.TraceDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create trace dir: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.TraceDir, bundle.RequestID+".json"), append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write trace: %w", err)
+	}
+	return nil
+}
+
+// ErrTraceNotFound is returned by Get for unknown or expired request IDs
+var ErrTraceNotFound = errors.New("trace not found")
+
+// Get returns the bundle of requestID as JSON, from memory or TRACE_DIR
+func (s *TraceStore) Get(cfg *Config, requestID string) ([]byte, error) {
+	if s != nil {
+		s.mu.Lock()
+		data, ok := s.bundles[requestID]
+		s.mu.Unlock()
+		if ok {
+			return data, nil
+		}
+	}
+	if cfg.TraceDir == "" || !traceIDRe.MatchString(requestID) {
+		return nil, ErrTraceNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.TraceDir, requestID+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrTraceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trace: %w", err)
+	}
+	return data, nil
+}
+
+// Recent lists the bundles held in memory, newest first
+func (s *TraceStore) Recent() []TraceSummary {
+	out := []TraceSummary{}
+	if s == nil {
+		return out
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.order) - 1; i >= 0; i-- {
+		var summary TraceSummary
+		if json.Unmarshal(s.bundles[s.order[i]], &summary) == nil {
+			out = append(out, summary)
+		}
+	}
+	return out
+}
@@ -0,0 +1,248 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxUsageRecords bounds the in-memory ledger when no USAGE_FILE is set
+const maxUsageRecords = 100_000
+
+// UsageRecord is the LLM and warehouse spend of one request
+type UsageRecord struct {
+	Time   time.Time `json:"time"`
+	Tenant string    `json:"tenant,omitempty"`
+	// Key identifies the API key, as Principal.KeyID, for quotas
+	Key          string  `json:"key,omitempty"`
+	Model        string  `json:"model"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	RowsRead     int64   `json:"rows_read"`
+	BytesRead    int64   `json:"bytes_read"`
+	// Cohort is the canary cohort, Code the error code ("" on success) and
+	// GenerateMs the generation time, for comparing cohorts
+	Cohort     string `json:"cohort,omitempty"`
+	Code       string `json:"code,omitempty"`
+	GenerateMs int64  `json:"generate_ms,omitempty"`
+	// Columns are the schema columns the SQL touched, as "table.column"
+	Columns []string `json:"columns,omitempty"`
+}
+
+// UsageTotals sums a set of UsageRecords
+type UsageTotals struct {
+	Requests     int     `json:"requests"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	RowsRead     int64   `json:"rows_read"`
+	BytesRead    int64   `json:"bytes_read"`
+}
+
+func (t *UsageTotals) add(rec UsageRecord) {
+	t.Requests++
+	t.InputTokens += rec.InputTokens
+	t.OutputTokens += rec.OutputTokens
+	t.CostUSD += rec.CostUSD
+	t.RowsRead += rec.RowsRead
+	t.BytesRead += rec.BytesRead
+}
+
+// UsageBucket is the usage of one tenant and model on one UTC day
+type UsageBucket struct {
+	Day    string `json:"day"`
+	Tenant string `json:"tenant"`
+	Model  string `json:"model"`
+	UsageTotals
+}
+
+// UsageDay is the total usage on one UTC day
+type UsageDay struct {
+	Day string `json:"day"`
+	UsageTotals
+}
+
+// UsageReport aggregates usage since a point in time
+type UsageReport struct {
+	Since    time.Time              `json:"since"`
+	Totals   UsageTotals            `json:"totals"`
+	Days     []UsageDay             `json:"days"`
+	ByTenant map[string]UsageTotals `json:"by_tenant"`
+	ByModel  map[string]UsageTotals `json:"by_model"`
+	Buckets  []UsageBucket          `json:"buckets"`
+	// Columns counts the requests that touched each schema column, for
+	// seeing which columns are actually queried
+	Columns map[string]int `json:"columns"`
+}
+
+// UsageLedger records per-request usage. Without a file it keeps the most
+// recent records in memory, which on serverless deployments only covers the
+// current instance; with USAGE_FILE every record is appended as a JSON line
+// and reports read the file. Safe for concurrent use.
+type UsageLedger struct {
+	mu      sync.Mutex
+	records []UsageRecord
+
+	// Per-key counts for quotas, and how far into quotaPath they go
+	quotaUsage  map[string]*keyUsage
+	quotaPath   string
+	quotaOffset int64
+}
+
+func NewUsageLedger() *UsageLedger {
+	return &UsageLedger{}
+}
+
+// Record stores rec, pricing it if CostUSD is unset, and appends it to path
+// when path is non-empty. A nil ledger ignores the record.
+func (l *UsageLedger) Record(rec UsageRecord, path string) error {
+	if l == nil {
+		return nil
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	if rec.CostUSD == 0 && rec.Model != "" {
+		rec.CostUSD = EstimateCost(rec.Model, Usage{InputTokens: rec.InputTokens, OutputTokens: rec.OutputTokens})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if path == "" {
+		l.countQuota(rec)
+		l.records = append(l.records, rec)
+		if len(l.records) > maxUsageRecords {
+			l.records = append([]UsageRecord(nil), l.records[len(l.records)-maxUsageRecords:]...)
+		}
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open usage file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write usage file: %w", err)
+	}
+	return nil
+}
+
+// Report aggregates records at or after since by day, tenant and model,
+// reading path when it is non-empty
+func (l *UsageLedger) Report(since time.Time, path string) (*UsageReport, error) {
+	records, err := l.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{
+		Since:    since,
+		ByTenant: make(map[string]UsageTotals),
+		ByModel:  make(map[string]UsageTotals),
+		Columns:  make(map[string]int),
+	}
+	days := make(map[string]*UsageDay)
+	buckets := make(map[[3]string]*UsageBucket)
+
+	for _, rec := range records {
+		if rec.Time.Before(since) {
+			continue
+		}
+		day := rec.Time.UTC().Format("2006-01-02")
+
+		report.Totals.add(rec)
+
+		tenant := report.ByTenant[rec.Tenant]
+		tenant.add(rec)
+		report.ByTenant[rec.Tenant] = tenant
+
+		model := report.ByModel[rec.Model]
+		model.add(rec)
+		report.ByModel[rec.Model] = model
+
+		for _, col := range rec.Columns {
+			report.Columns[col]++
+		}
+
+		if days[day] == nil {
+			days[day] = &UsageDay{Day: day}
+		}
+		days[day].add(rec)
+
+		key := [3]string{day, rec.Tenant, rec.Model}
+		if buckets[key] == nil {
+			buckets[key] = &UsageBucket{Day: day, Tenant: rec.Tenant, Model: rec.Model}
+		}
+		buckets[key].add(rec)
+	}
+
+	report.Days = make([]UsageDay, 0, len(days))
+	for _, d := range days {
+		report.Days = append(report.Days, *d)
+	}
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Day < report.Days[j].Day })
+
+	report.Buckets = make([]UsageBucket, 0, len(buckets))
+	for _, b := range buckets {
+		report.Buckets = append(report.Buckets, *b)
+	}
+	sort.Slice(report.Buckets, func(i, j int) bool {
+		a, b := report.Buckets[i], report.Buckets[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.Model < b.Model
+	})
+	return report, nil
+}
+
+// load returns the in-memory records, or every record in path
+func (l *UsageLedger) load(path string) ([]UsageRecord, error) {
+	if path == "" {
+		if l == nil {
+			return nil, nil
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return append([]UsageRecord(nil), l.records...), nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage file: %w", err)
+	}
+	defer f.Close()
+
+	var records []UsageRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Skip a line torn by a crash mid-write rather than fail the report
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+	return records, nil
+}
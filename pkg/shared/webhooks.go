@@ -0,0 +1,192 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook event types
+const (
+	// EventEvalCompleted fires after every eval run
+	EventEvalCompleted = "eval.completed"
+	// EventEvalRegressed fires when a run's pass rate is below the previous run's
+	EventEvalRegressed = "eval.pass_rate_dropped"
+	// EventQueryFailed fires when /api/query fails with a warehouse error
+	EventQueryFailed = "query.warehouse_error"
+	// EventBudgetExceeded fires when an eval run stops at its spend budget
+	EventBudgetExceeded = "budget.exceeded"
+	// EventSchemaChanged fires when a fetched schema adds, removes or
+	// retypes tables or columns
+	EventSchemaChanged = "schema.changed"
+)
+
+var webhookEvents = []string{EventEvalCompleted, EventEvalRegressed, EventQueryFailed, EventBudgetExceeded, EventSchemaChanged}
+
+// WebhookEvent is the JSON body POSTed to each webhook URL
+type WebhookEvent struct {
+	ID   string      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Notifier delivers webhook events in the background with retries. URLs,
+// event filter and signing secret come from the config passed to each
+// Notify, so they follow config reloads. A nil Notifier drops events.
+type Notifier struct {
+	opts clientOptions
+	wg   sync.WaitGroup
+
+	mu           sync.Mutex
+	lastPassRate map[string]float64
+}
+
+// NewNotifier creates a notifier. Without options deliveries use
+// DefaultRetryPolicy and a 10s timeout per attempt.
+func NewNotifier(opts ...ClientOption) *Notifier {
+	opts = append([]ClientOption{WithRetryPolicy(DefaultRetryPolicy), WithTimeout(10 * time.Second)}, opts...)
+	return &Notifier{opts: newClientOptions(opts), lastPassRate: make(map[string]float64)}
+}
+
+// Notify sends an event of type eventType to every WEBHOOK_URLS entry
+// subscribed to it. Delivery happens in the background; call Wait before
+// exiting a short-lived process.
+func (n *Notifier) Notify(cfg *Config, eventType string, data interface{}) {
+	if n == nil || cfg.WebhookURLs == "" || !webhookSubscribed(cfg.WebhookEvents, eventType) {
+		return
+	}
+
+	event := WebhookEvent{ID: newEventID(), Type: eventType, Time: time.Now().UTC(), Data: data}
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.opts.logger.Error("Failed to encode webhook event", "type", eventType, "error", err)
+		return
+	}
+
+	for _, url := range splitList(cfg.WebhookURLs) {
+		n.wg.Add(1)
+		go func(url string) {
+			defer n.wg.Done()
+			n.deliver(url, cfg.WebhookSecret, event, body)
+		}(url)
+	}
+}
+
+// EvalCompleted sends EventEvalCompleted for a run of model and, if its pass
+// rate is lower than the previous run of the same model seen by this
+// notifier, EventEvalRegressed
+func (n *Notifier) EvalCompleted(cfg *Config, model string, summary EvalSummary) {
+	if n == nil {
+		return
+	}
+	n.Notify(cfg, EventEvalCompleted, map[string]interface{}{"model": model, "summary": summary})
+
+	n.mu.Lock()
+	previous, seen := n.lastPassRate[model]
+	n.lastPassRate[model] = summary.PassRate
+	n.mu.Unlock()
+
+	if seen && summary.PassRate < previous {
+		n.Notify(cfg, EventEvalRegressed, map[string]interface{}{
+			"model":              model,
+			"previous_pass_rate": previous,
+			"pass_rate":          summary.PassRate,
+			"summary":            summary,
+		})
+	}
+}
+
+// Wait blocks until every queued delivery has finished or given up
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+func (n *Notifier) deliver(url, secret string, event WebhookEvent, body []byte) {
+	timestamp := strconv.FormatInt(event.Time.Unix(), 10)
+	status, _, err := n.opts.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-NL2SQL-Event", event.Type)
+		req.Header.Set("X-NL2SQL-Event-ID", event.ID)
+		req.Header.Set("X-NL2SQL-Timestamp", timestamp)
+		if secret != "" {
+			req.Header.Set("X-NL2SQL-Signature", SignWebhook(secret, timestamp, body))
+		}
+		return req, nil
+	})
+	log := n.opts.logger.With("type", event.Type, "event_id", event.ID, "url", url)
+	if err == nil && status >= 300 {
+		err = fmt.Errorf("status %d", status)
+	}
+	if err != nil {
+		log.Error("Webhook delivery failed", "error", err)
+		return
+	}
+	log.Debug("Webhook delivered", "status", status)
+}
+
+// SignWebhook returns the X-NL2SQL-Signature value for a delivery:
+// "sha256=" + hex HMAC-SHA256 of "<timestamp>.<body>" keyed by secret.
+// Receivers recompute it and should reject stale timestamps.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookSubscribed(events, eventType string) bool {
+	if events == "" {
+		return true
+	}
+	for _, e := range splitList(events) {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func parseWebhookEvents(spec string) error {
+	for _, e := range splitList(spec) {
+		known := false
+		for _, k := range webhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q (want one of %s)", e, strings.Join(webhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func newEventID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "evt_" + hex.EncodeToString(b)
+}
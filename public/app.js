@@ -14,7 +14,7 @@ function setLoading(loading) {
     btnLoading.style.display = loading ? 'inline' : 'none';
 }
 
-function showError(message, hint) {
+function showError(message, hint, suggestions) {
     document.getElementById('results').style.display = 'none';
     const errorEl = document.getElementById('error');
     const hintEl = document.getElementById('error-hint');
@@ -27,10 +27,37 @@ function showError(message, hint) {
     } else {
         hintEl.style.display = 'none';
     }
+
+    // Answerable alternatives offered when a question is refused
+    const suggestionsEl = document.getElementById('error-suggestions');
+    suggestionsEl.querySelectorAll('.example-btn').forEach((btn) => btn.remove());
+    (suggestions || []).forEach((question) => {
+        const btn = document.createElement('button');
+        btn.className = 'example-btn';
+        btn.textContent = question;
+        btn.onclick = () => {
+            setExample(question);
+            submitQuery();
+        };
+        suggestionsEl.appendChild(btn);
+    });
+    suggestionsEl.style.display = suggestions && suggestions.length > 0 ? 'flex' : 'none';
     
     errorEl.style.display = 'block';
 }
 
+// formatTimings renders e.g. "8.2s (schema 0.1s, generation 7.6s, execution 0.5s)"
+function formatTimings(t) {
+    const secs = ms => `${(ms / 1000).toFixed(1)}s`;
+    const parts = [
+        ['schema', t.schema_ms],
+        ['generation', t.generation_ms],
+        ['explain', t.explain_ms],
+        ['execution', t.execution_ms],
+    ].filter(([, ms]) => ms !== undefined).map(([name, ms]) => `${name} ${secs(ms)}`);
+    return `${secs(t.total_ms)} (${parts.join(', ')})`;
+}
+
 function showResults(data) {
     document.getElementById('error').style.display = 'none';
     const resultsEl = document.getElementById('results');
@@ -39,7 +66,17 @@ function showResults(data) {
     document.getElementById('sql-code').textContent = data.sql;
     
     // Show row count
-    document.getElementById('row-count').textContent = `${data.rows} row${data.rows !== 1 ? 's' : ''}`;
+    let rowCount = `${data.rows} row${data.rows !== 1 ? 's' : ''}`;
+    if (data.limit_applied && data.rows >= data.limit_applied) {
+        rowCount += ` (capped at ${data.limit_applied})`;
+    }
+    if (data.order_applied) {
+        rowCount += `, ordered by ${data.order_applied.join(', ')}`;
+    }
+    if (data.timings) {
+        rowCount += ` in ${formatTimings(data.timings)}`;
+    }
+    document.getElementById('row-count').textContent = rowCount;
     
     // Build table
     const thead = document.getElementById('table-head');
@@ -105,13 +142,14 @@ async function submitQuery() {
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ query }),
+            // "today" means the user's day, not the server's
+            body: JSON.stringify({ query, timezone: Intl.DateTimeFormat().resolvedOptions().timeZone }),
         });
         
         const data = await response.json();
         
         if (data.error) {
-            showError(data.error, data.hint);
+            showError(data.error, data.hint, data.suggestions);
         } else {
             showResults(data);
         }
@@ -130,3 +168,27 @@ document.getElementById('query-input').addEventListener('keydown', (e) => {
     }
 });
 
+// Replace the built-in examples with suggestions generated from the live schema
+async function loadSuggestions() {
+    try {
+        const response = await fetch('/api/suggestions');
+        if (!response.ok) return;
+        const data = await response.json();
+        if (!data.suggestions || data.suggestions.length === 0) return;
+
+        const container = document.querySelector('.examples');
+        container.querySelectorAll('.example-btn').forEach((btn) => btn.remove());
+        data.suggestions.slice(0, 6).forEach((s) => {
+            const btn = document.createElement('button');
+            btn.className = 'example-btn';
+            btn.textContent = s.question;
+            btn.title = s.datasource;
+            btn.onclick = () => setExample(s.question);
+            container.appendChild(btn);
+        });
+    } catch (err) {
+        // Keep the built-in examples
+    }
+}
+
+loadSuggestions();